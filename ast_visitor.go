@@ -7,13 +7,16 @@ import (
 	"go/types"
 	"os"
 	"strings"
+	"sync"
 
 	"golang.org/x/tools/go/packages"
 )
 
 // PosLookup maps file:line:col to node IDs, enabling SSA→AST position mapping.
+// Safe for concurrent use by the parallel extraction phases.
 type PosLookup struct {
-	m map[string]string // "file:line:col" → nodeID
+	mu sync.RWMutex
+	m  map[string]string // "file:line:col" → nodeID
 }
 
 func NewPosLookup() *PosLookup {
@@ -24,27 +27,54 @@ func NewPosLookup() *PosLookup {
 // later calls are ignored. This preserves statement-level nodes that SSA references.
 func (pl *PosLookup) Set(file string, line, col int, id string) {
 	key := fmt.Sprintf("%s:%d:%d", file, line, col)
+	pl.mu.Lock()
 	if _, exists := pl.m[key]; !exists {
 		pl.m[key] = id
 	}
+	pl.mu.Unlock()
 }
 
 func (pl *PosLookup) Get(file string, line, col int) string {
-	return pl.m[fmt.Sprintf("%s:%d:%d", file, line, col)]
+	key := fmt.Sprintf("%s:%d:%d", file, line, col)
+	pl.mu.RLock()
+	defer pl.mu.RUnlock()
+	return pl.m[key]
 }
 
 // DefLookup maps types.Object (declaration) to node IDs for REF edges.
 type DefLookup struct {
-	m map[types.Object]string
+	mu sync.RWMutex
+	m  map[types.Object]string
+	// fallback resolves objects declared in packages that were not walked
+	// (incremental mode). Nil in a full run.
+	fallback func(types.Object) string
+	// byPos, when set by IndexPositions, also keys declarations by source
+	// position, so an object from another type-checked copy of the same
+	// package resolves too. Loading tests creates such copies: importers
+	// see p while only its test variant "p [p.test]" is walked.
+	byPos map[string]string
+	fset  *token.FileSet
 }
 
 func NewDefLookup() *DefLookup {
 	return &DefLookup{m: make(map[types.Object]string)}
 }
 
+// IndexPositions makes the lookup also resolve objects by declaration
+// position. Call it before any Set.
+func (dl *DefLookup) IndexPositions(fset *token.FileSet) {
+	dl.fset = fset
+	dl.byPos = make(map[string]string)
+}
+
 func (dl *DefLookup) Set(obj types.Object, id string) {
 	if obj != nil {
+		dl.mu.Lock()
 		dl.m[obj] = id
+		if dl.byPos != nil && obj.Pos().IsValid() {
+			dl.byPos[dl.fset.Position(obj.Pos()).String()] = id
+		}
+		dl.mu.Unlock()
 	}
 }
 
@@ -52,12 +82,23 @@ func (dl *DefLookup) Get(obj types.Object) string {
 	if obj == nil {
 		return ""
 	}
-	return dl.m[obj]
+	dl.mu.RLock()
+	id, ok := dl.m[obj]
+	if !ok && dl.byPos != nil && obj.Pos().IsValid() {
+		id, ok = dl.byPos[dl.fset.Position(obj.Pos()).String()]
+	}
+	dl.mu.RUnlock()
+	if ok || dl.fallback == nil {
+		return id
+	}
+	return dl.fallback(obj)
 }
 
 // FuncLookup maps function positions to node IDs for parent tracking.
+// Safe for concurrent use by the parallel extraction phases.
 type FuncLookup struct {
-	m map[string]string // "file:line:col" → funcNodeID
+	mu sync.RWMutex
+	m  map[string]string // "file:line:col" → funcNodeID
 }
 
 func NewFuncLookup() *FuncLookup {
@@ -65,177 +106,239 @@ func NewFuncLookup() *FuncLookup {
 }
 
 func (fl *FuncLookup) Set(file string, line, col int, id string) {
-	fl.m[fmt.Sprintf("%s:%d:%d", file, line, col)] = id
+	key := fmt.Sprintf("%s:%d:%d", file, line, col)
+	fl.mu.Lock()
+	fl.m[key] = id
+	fl.mu.Unlock()
 }
 
 func (fl *FuncLookup) Get(file string, line, col int) string {
-	return fl.m[fmt.Sprintf("%s:%d:%d", file, line, col)]
+	key := fmt.Sprintf("%s:%d:%d", file, line, col)
+	fl.mu.RLock()
+	defer fl.mu.RUnlock()
+	return fl.m[key]
 }
 
 // WalkAST walks the AST of all packages, producing CPG nodes and AST edges.
 // Returns a PosLookup for SSA→AST mapping and a FuncLookup for parent tracking.
-func WalkAST(pkgs []*packages.Package, fset *token.FileSet, cpg *CPG, prog *Progress) (*PosLookup, *FuncLookup) {
-	prog.Log("Walking AST...")
-
+func WalkAST(pkgs []*packages.Package, fset *token.FileSet, cpg Sink, prog *Progress) (*PosLookup, *FuncLookup) {
 	posLookup := NewPosLookup()
 	funcLookup := NewFuncLookup()
 	defLookup := NewDefLookup()
+	if !flagSkipTests {
+		defLookup.IndexPositions(fset)
+	}
+	WalkASTWith(pkgs, fset, cpg, posLookup, funcLookup, defLookup, prog)
+	return posLookup, funcLookup
+}
 
-	var nodeCount, edgeCount int
-	var skippedFiles int
+// WalkASTWith is WalkAST over caller-provided lookups, which may already hold
+// entries for packages that are not walked (incremental mode).
+//
+// Packages are walked concurrently (see runSharded). Edges that target a
+// declaration (ref, eval_type, branch_target) are resolved only after every
+// package has registered its declarations, so they do not depend on walk order.
+func WalkASTWith(pkgs []*packages.Package, fset *token.FileSet, cpg Sink, posLookup *PosLookup, funcLookup *FuncLookup, defLookup *DefLookup, prog *Progress) {
+	prog.Begin("ast", "Walking AST (%d packages, %d workers)...", len(pkgs), workerCount(len(pkgs)))
+
+	stats := make([]walkStats, len(pkgs))
+	pending := make([][]declEdge, len(pkgs))
+	runSharded(len(pkgs), cpg, func(i int, shard *CPG) {
+		stats[i] = walkPackage(pkgs[i], fset, shard, posLookup, funcLookup, defLookup, &pending[i])
+	})
 
-	for _, pkg := range pkgs {
-		relPkg := modSet.RelPkg(pkg.PkgPath)
-
-		// Create package node
-		pkgID := PkgID(pkg.PkgPath)
-		cpg.AddNode(Node{
-			ID:      pkgID,
-			Kind:    "package",
-			Name:    pkg.Name,
-			Package: relPkg,
-		})
-		nodeCount++
+	var nodeCount, edgeCount, skippedFiles int
+	for _, st := range stats {
+		nodeCount += st.nodes
+		edgeCount += st.edges
+		skippedFiles += st.skippedFiles
+	}
+	for _, edges := range pending {
+		edgeCount += resolveDeclEdges(edges, defLookup, cpg)
+	}
 
-		// Import edges: package → imported package (internal modules only)
-		for impPath := range pkg.Imports {
-			if modSet.IsKnownPkg(impPath) {
-				cpg.AddEdge(Edge{Source: pkgID, Target: PkgID(impPath), Kind: "imports"})
-				edgeCount++
-			}
+	// Emit has_method edges: type_decl → function for each method.
+	// Done after all packages are walked so defLookup is fully populated.
+	hmCount := emitHasMethodEdges(pkgs, fset, defLookup, cpg)
+
+	prog.End("ast", Fields{"packages": len(pkgs), "nodes": nodeCount, "ast_edges": edgeCount, "has_method_edges": hmCount, "skipped_files": skippedFiles},
+		"Created %d nodes, %d AST edges, %d has_method edges (skipped %d generated/test files)",
+		nodeCount, edgeCount, hmCount, skippedFiles)
+}
+
+// walkStats counts what walkPackage emitted for one package.
+type walkStats struct {
+	nodes, edges, skippedFiles int
+}
+
+// walkPackage walks one package into shard. Declaration-targeted edges are
+// appended to pending for resolveDeclEdges.
+func walkPackage(pkg *packages.Package, fset *token.FileSet, shard *CPG, posLookup *PosLookup, funcLookup *FuncLookup, defLookup *DefLookup, pending *[]declEdge) walkStats {
+	var st walkStats
+	relPkg := modSet.RelPkg(pkg.PkgPath)
+
+	// Create package node
+	pkgID := PkgID(pkg.PkgPath)
+	shard.AddNode(Node{
+		ID:      pkgID,
+		Kind:    "package",
+		Name:    pkg.Name,
+		Package: relPkg,
+	})
+	st.nodes++
+
+	// Import edges: package → imported package (internal modules only)
+	for _, impPath := range sortedKeys(pkg.Imports) {
+		if modSet.IsKnownPkg(impPath) {
+			shard.AddEdge(Edge{Source: pkgID, Target: PkgID(impPath), Kind: "imports"})
+			st.edges++
 		}
+	}
 
-		var initFuncIDs []string // collect init() funcs for ordering
+	var initFuncIDs []string // collect init() funcs for ordering
 
-		for i, file := range pkg.Syntax {
-			// Get the actual file path
-			if i >= len(pkg.CompiledGoFiles) {
-				continue
-			}
-			absFile := pkg.CompiledGoFiles[i]
+	for i, file := range pkg.Syntax {
+		// Get the actual file path
+		if i >= len(pkg.CompiledGoFiles) {
+			continue
+		}
+		absFile := pkg.CompiledGoFiles[i]
 
-			// Compute relative path via ModuleSet
-			relFile := modSet.RelFile(absFile)
-			if relFile == "" {
-				continue
-			}
+		// Compute relative path via ModuleSet
+		relFile := modSet.RelFile(absFile)
+		if relFile == "" {
+			continue
+		}
 
-			if shouldSkipFile(relFile) {
-				skippedFiles++
-				continue
-			}
+		if shouldSkipFile(relFile) {
+			st.skippedFiles++
+			continue
+		}
 
-			// Create file node
-			fileID := FileID(relFile)
-			fileProps := map[string]any{
-				"loc": 0, // overwritten below from file.End() position
-			}
-			if strings.HasSuffix(relFile, ".pb.go") || strings.HasSuffix(relFile, "_generated.go") {
-				fileProps["is_generated"] = true
-			}
-			// Extract build tags from file comments
-			for _, cg := range file.Comments {
-				for _, c := range cg.List {
-					if strings.HasPrefix(c.Text, "//go:build ") {
-						fileProps["build_tags"] = strings.TrimPrefix(c.Text, "//go:build ")
-					} else if strings.HasPrefix(c.Text, "// +build ") {
-						if _, exists := fileProps["build_tags"]; !exists {
-							fileProps["build_tags"] = strings.TrimPrefix(c.Text, "// +build ")
-						}
+		// Create file node
+		fileID := FileID(relFile)
+		fileProps := map[string]any{
+			"loc": 0, // overwritten below from file.End() position
+		}
+		if strings.HasSuffix(relFile, ".pb.go") || strings.HasSuffix(relFile, "_generated.go") {
+			fileProps["is_generated"] = true
+		}
+		// Extract build tags from file comments
+		for _, cg := range file.Comments {
+			for _, c := range cg.List {
+				if strings.HasPrefix(c.Text, "//go:build ") {
+					fileProps["build_tags"] = strings.TrimPrefix(c.Text, "//go:build ")
+				} else if strings.HasPrefix(c.Text, "// +build ") {
+					if _, exists := fileProps["build_tags"]; !exists {
+						fileProps["build_tags"] = strings.TrimPrefix(c.Text, "// +build ")
 					}
 				}
 			}
-			// Compute actual LOC from file end position
-			if file.End().IsValid() {
-				fileProps["loc"] = fset.Position(file.End()).Line
-			}
-			cpg.AddNode(Node{
-				ID:         fileID,
-				Kind:       "file",
-				Name:       BaseName(relFile),
-				File:       relFile,
-				Package:    relPkg,
-				EndLine:    fset.Position(file.End()).Line,
-				Properties: fileProps,
-			})
-			nodeCount++
-			cpg.AddEdge(Edge{Source: pkgID, Target: fileID, Kind: "ast"})
-			edgeCount++
-
-			// Read source content for the sources table
-			if _, ok := cpg.Sources[relFile]; !ok {
-				content, err := os.ReadFile(absFile)
-				if err == nil {
-					cpg.Sources[relFile] = string(content)
-				}
-			}
-
-			// Walk AST of this file
-			v := &astVisitor{
-				pkg:         pkg,
-				relPkg:      relPkg,
-				relFile:     relFile,
-				fileID:      fileID,
-				fset:        fset,
-				cpg:         cpg,
-				posLookup:   posLookup,
-				funcLookup:  funcLookup,
-				defLookup:   defLookup,
-				source:      cpg.Sources[relFile],
-				parentStack: []string{fileID},
-				initIDs:     &initFuncIDs,
-				scopeNodes:  make(map[string]bool),
-			}
-			ast.Walk(v, file)
-
-			// Extract comments (not visited by ast.Walk — they're separate)
-			for _, cg := range file.Comments {
-				cLine, cCol := v.pos(cg.Pos())
-				if cLine == 0 {
-					continue
-				}
-				cID := StmtID(relPkg, BaseName(relFile), cLine, cCol, "comment")
-				text := cg.Text()
-				if len(text) > 200 {
-					text = text[:200] + "..."
-				}
-				cpg.AddNode(Node{
-					ID:      cID,
-					Kind:    "comment",
-					Name:    text,
-					File:    relFile,
-					Line:    cLine,
-					Col:     cCol,
-					EndLine: v.endLine(cg.End()),
-					Package: relPkg,
-				})
-				cpg.AddEdge(Edge{Source: fileID, Target: cID, Kind: "ast"})
-				nodeCount += 1
-				edgeCount += 1
+		}
+		// Compute actual LOC from file end position
+		if file.End().IsValid() {
+			fileProps["loc"] = fset.Position(file.End()).Line
+		}
+		shard.AddNode(Node{
+			ID:         fileID,
+			Kind:       "file",
+			Name:       BaseName(relFile),
+			File:       relFile,
+			Package:    relPkg,
+			EndLine:    fset.Position(file.End()).Line,
+			Properties: fileProps,
+		})
+		st.nodes++
+		shard.AddEdge(Edge{Source: pkgID, Target: fileID, Kind: "ast"})
+		st.edges++
+
+		// Read source content for the sources table
+		if _, ok := shard.Sources[relFile]; !ok {
+			content, err := os.ReadFile(absFile)
+			if err == nil {
+				shard.Sources[relFile] = string(content)
 			}
+		}
 
-			nodeCount += v.nodeCount
-			edgeCount += v.edgeCount
+		// Walk AST of this file
+		v := &astVisitor{
+			pkg:         pkg,
+			relPkg:      relPkg,
+			relFile:     relFile,
+			fileID:      fileID,
+			fset:        fset,
+			cpg:         shard,
+			posLookup:   posLookup,
+			funcLookup:  funcLookup,
+			defLookup:   defLookup,
+			source:      shard.Sources[relFile],
+			parentStack: []string{fileID},
+			initIDs:     &initFuncIDs,
+			declEdges:   pending,
+			scopeNodes:  make(map[string]bool),
 		}
+		ast.Walk(v, file)
 
-		// Chain init() functions within this package in source order
-		for i := 1; i < len(initFuncIDs); i++ {
-			cpg.AddEdge(Edge{
-				Source: initFuncIDs[i-1], Target: initFuncIDs[i], Kind: "init_order",
-				Properties: map[string]any{"order": i},
+		// Extract comments (not visited by ast.Walk — they're separate)
+		for _, cg := range file.Comments {
+			cLine, cCol := v.pos(cg.Pos())
+			if cLine == 0 {
+				continue
+			}
+			cID := StmtID(relPkg, BaseName(relFile), cLine, cCol, "comment")
+			text := cg.Text()
+			if len(text) > 200 {
+				text = text[:200] + "..."
+			}
+			shard.AddNode(Node{
+				ID:      cID,
+				Kind:    "comment",
+				Name:    text,
+				File:    relFile,
+				Line:    cLine,
+				Col:     cCol,
+				EndLine: v.endLine(cg.End()),
+				Package: relPkg,
 			})
-			edgeCount++
+			shard.AddEdge(Edge{Source: fileID, Target: cID, Kind: "ast"})
+			st.nodes += 1
+			st.edges += 1
 		}
+
+		st.nodes += v.nodeCount
+		st.edges += v.edgeCount
 	}
 
-	// Emit has_method edges: type_decl → function for each method.
-	// Done after all packages are walked so defLookup is fully populated.
-	hmCount := emitHasMethodEdges(pkgs, fset, defLookup, cpg)
+	// Chain init() functions within this package in source order
+	for i := 1; i < len(initFuncIDs); i++ {
+		shard.AddEdge(Edge{
+			Source: initFuncIDs[i-1], Target: initFuncIDs[i], Kind: "init_order",
+			Properties: map[string]any{"order": i},
+		})
+		st.edges++
+	}
+	return st
+}
 
-	prog.Log("Created %d nodes, %d AST edges, %d has_method edges (skipped %d generated/test files)",
-		nodeCount, edgeCount, hmCount, skippedFiles)
+// declEdge is an edge whose target is a declaration looked up in DefLookup
+// once all packages have been walked.
+type declEdge struct {
+	source string
+	obj    types.Object
+	kind   string
+}
 
-	return posLookup, funcLookup
+// resolveDeclEdges adds the pending edges whose declarations are known and
+// returns how many were added. Self-edges are dropped.
+func resolveDeclEdges(edges []declEdge, defLookup *DefLookup, cpg Sink) int {
+	var count int
+	for _, e := range edges {
+		if target := defLookup.Get(e.obj); target != "" && target != e.source {
+			cpg.AddEdge(Edge{Source: e.source, Target: target, Kind: e.kind})
+			count++
+		}
+	}
+	return count
 }
 
 type astVisitor struct {
@@ -258,6 +361,8 @@ type astVisitor struct {
 	deferIDs []string
 	// initIDs collects init() function node IDs for ordering.
 	initIDs *[]string
+	// declEdges collects edges to declarations, resolved after all packages are walked.
+	declEdges *[]declEdge
 	// scopeNodes tracks node IDs that introduce a new lexical scope (functions and blocks).
 	scopeNodes map[string]bool
 	nodeCount  int
@@ -300,6 +405,13 @@ func (v *astVisitor) addNodeAndEdge(n Node) {
 	}
 }
 
+// deferDeclEdge queues an edge from source to the node declaring obj.
+func (v *astVisitor) deferDeclEdge(source string, obj types.Object, kind string) {
+	if obj != nil {
+		*v.declEdges = append(*v.declEdges, declEdge{source: source, obj: obj, kind: kind})
+	}
+}
+
 // emitDocEdge emits a doc edge from a declaration node to its doc comment node.
 func (v *astVisitor) emitDocEdge(declID string, doc *ast.CommentGroup) {
 	if doc == nil {
@@ -386,12 +498,9 @@ func (v *astVisitor) Visit(node ast.Node) ast.Visitor {
 		// branch_target edge: break/continue/goto with label → labeled statement
 		if n.Label != nil {
 			if obj := v.pkg.TypesInfo.Uses[n.Label]; obj != nil {
-				if targetID := v.defLookup.Get(obj); targetID != "" {
-					bLine, bCol := v.pos(n.TokPos)
-					branchID := StmtID(v.relPkg, BaseName(v.relFile), bLine, bCol, "branch")
-					v.cpg.AddEdge(Edge{Source: branchID, Target: targetID, Kind: "branch_target"})
-					v.edgeCount++
-				}
+				bLine, bCol := v.pos(n.TokPos)
+				branchID := StmtID(v.relPkg, BaseName(v.relFile), bLine, bCol, "branch")
+				v.deferDeclEdge(branchID, obj, "branch_target")
 			}
 		}
 	case *ast.LabeledStmt:
@@ -498,6 +607,11 @@ func (v *astVisitor) visitFuncDecl(n *ast.FuncDecl) ast.Visitor {
 	if n.Type.TypeParams != nil && n.Type.TypeParams.NumFields() > 0 {
 		node.Properties["generic"] = true
 	}
+	if recv == "" && strings.HasSuffix(v.relFile, "_test.go") {
+		if kind := testKind(name); kind != "" {
+			node.Properties["test_kind"] = kind
+		}
+	}
 	// Signature analysis: return types and context parameter
 	if obj := v.pkg.TypesInfo.Defs[n.Name]; obj != nil {
 		if sig, ok := obj.Type().(*types.Signature); ok {
@@ -1347,10 +1461,7 @@ func (v *astVisitor) visitIdent(n *ast.Ident) {
 	v.emitEvalType(id, n)
 
 	// REF edge: identifier → declaration
-	if declID := v.defLookup.Get(obj); declID != "" {
-		v.cpg.AddEdge(Edge{Source: id, Target: declID, Kind: "ref"})
-		v.edgeCount++
-	}
+	v.deferDeclEdge(id, obj, "ref")
 }
 
 // visitSelectorExpr creates a node for field/method access (x.Field).
@@ -1411,15 +1522,9 @@ func (v *astVisitor) visitSelectorExpr(n *ast.SelectorExpr) string {
 
 	// REF edge: selector → field/method declaration
 	if obj := v.pkg.TypesInfo.Uses[n.Sel]; obj != nil {
-		if declID := v.defLookup.Get(obj); declID != "" {
-			v.cpg.AddEdge(Edge{Source: id, Target: declID, Kind: "ref"})
-			v.edgeCount++
-		}
+		v.deferDeclEdge(id, obj, "ref")
 	} else if sel, ok := v.pkg.TypesInfo.Selections[n]; ok {
-		if declID := v.defLookup.Get(sel.Obj()); declID != "" {
-			v.cpg.AddEdge(Edge{Source: id, Target: declID, Kind: "ref"})
-			v.edgeCount++
-		}
+		v.deferDeclEdge(id, sel.Obj(), "ref")
 	}
 
 	return id
@@ -1534,11 +1639,7 @@ func (v *astVisitor) emitEvalType(nodeID string, expr ast.Expr) {
 	if !ok {
 		return
 	}
-	tObj := named.Obj()
-	if typeID := v.defLookup.Get(tObj); typeID != "" && typeID != nodeID {
-		v.cpg.AddEdge(Edge{Source: nodeID, Target: typeID, Kind: "eval_type"})
-		v.edgeCount++
-	}
+	v.deferDeclEdge(nodeID, named.Obj(), "eval_type")
 }
 
 // exprNodeID predicts the CPG node ID that will be created for an expression.
@@ -1624,7 +1725,7 @@ func resolveCalleeName(call *ast.CallExpr) string {
 // emitHasMethodEdges iterates all named types in analyzed packages and emits
 // has_method edges from each type_decl to its method function nodes.
 // Uses the type checker's method sets so we catch both value and pointer receivers.
-func emitHasMethodEdges(pkgs []*packages.Package, _ *token.FileSet, defLookup *DefLookup, cpg *CPG) int {
+func emitHasMethodEdges(pkgs []*packages.Package, _ *token.FileSet, defLookup *DefLookup, cpg Sink) int {
 	count := 0
 	// Track emitted (typeDeclID, methodID) pairs to avoid double-counting
 	// value-receiver methods that appear in both T and *T method sets.
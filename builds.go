@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// BuildConfig is one GOOS/GOARCH/tags combination to load the modules under.
+// With several configured, the Go-side phases run once per configuration
+// into the same graph, and node_configs/edge_configs record which
+// configurations each node and edge was extracted in.
+type BuildConfig struct {
+	Name   string // the spec, e.g. "windows/amd64,tag=stringlabels"
+	GOOS   string
+	GOARCH string
+	Tags   []string
+}
+
+// ParseBuildSpec parses "goos/goarch" followed by optional ",tag=<tag>"
+// entries, e.g. "linux/amd64" or "windows/amd64,tag=stringlabels".
+func ParseBuildSpec(spec string) (BuildConfig, error) {
+	parts := strings.Split(strings.TrimSpace(spec), ",")
+	goos, goarch, ok := strings.Cut(parts[0], "/")
+	if !ok || goos == "" || goarch == "" || strings.Contains(goarch, "/") {
+		return BuildConfig{}, fmt.Errorf("build %q: want goos/goarch[,tag=<tag>...]", spec)
+	}
+	b := BuildConfig{GOOS: goos, GOARCH: goarch}
+	for _, p := range parts[1:] {
+		tag, ok := strings.CutPrefix(strings.TrimSpace(p), "tag=")
+		if !ok || tag == "" || strings.ContainsAny(tag, " \t") {
+			return BuildConfig{}, fmt.Errorf("build %q: invalid entry %q (want tag=<tag>)", spec, p)
+		}
+		if !slices.Contains(b.Tags, tag) {
+			b.Tags = append(b.Tags, tag)
+		}
+	}
+	b.Name = goos + "/" + goarch
+	for _, tag := range b.Tags {
+		b.Name += ",tag=" + tag
+	}
+	return b, nil
+}
+
+// Env returns environ with GOOS and GOARCH set for this configuration.
+func (b BuildConfig) Env(environ []string) []string {
+	return replaceEnv(replaceEnv(environ, "GOOS", b.GOOS), "GOARCH", b.GOARCH)
+}
+
+// BuildFlags returns the go list flags selecting the configuration's tags.
+func (b BuildConfig) BuildFlags() []string {
+	if len(b.Tags) == 0 {
+		return nil
+	}
+	return []string{"-tags=" + strings.Join(b.Tags, ",")}
+}
+
+// createBuildTables creates the build configuration base tables. They stay
+// empty unless -build is given: a graph of the host configuration alone has
+// nothing to tell apart.
+func createBuildTables(conn *sqlite.Conn) error {
+	ddl := `
+CREATE TABLE IF NOT EXISTS build_configs (
+    name TEXT PRIMARY KEY,
+    seq INTEGER NOT NULL,  -- order in which the configuration was loaded
+    goos TEXT NOT NULL,
+    goarch TEXT NOT NULL,
+    tags TEXT NOT NULL     -- JSON array
+);
+
+CREATE TABLE IF NOT EXISTS node_configs (
+    node_id TEXT NOT NULL,
+    config TEXT NOT NULL,
+    PRIMARY KEY (node_id, config)
+);
+
+CREATE TABLE IF NOT EXISTS edge_configs (
+    source TEXT NOT NULL,
+    target TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    config TEXT NOT NULL,
+    PRIMARY KEY (source, target, kind, config)
+);
+`
+	if err := sqlitex.ExecuteScript(conn, ddl, nil); err != nil {
+		return fmt.Errorf("build tables: %w", err)
+	}
+	return nil
+}
+
+// insertBuildConfig records a configuration in build_configs.
+func insertBuildConfig(conn *sqlite.Conn, b BuildConfig, seq int) error {
+	tags, _ := json.Marshal(append([]string{}, b.Tags...))
+	if err := sqlitex.Execute(conn, `INSERT OR REPLACE INTO build_configs (name, seq, goos, goarch, tags) VALUES (?, ?, ?, ?, ?)`,
+		&sqlitex.ExecOptions{Args: []any{b.Name, seq, b.GOOS, b.GOARCH, string(tags)}}); err != nil {
+		return fmt.Errorf("build config %s: %w", b.Name, err)
+	}
+	return nil
+}
+
+// createBuildViews creates v_config_specific_calls and the config_call_graph
+// query over the per-configuration call edges. Both are empty for a
+// host-only build.
+func createBuildViews(conn *sqlite.Conn) error {
+	ddl := `
+-- Call edges missing from at least one configuration: platform- or tag-specific calls
+CREATE VIEW v_config_specific_calls AS
+  SELECT ec.source AS caller_id,
+         n1.name AS caller_name,
+         n1.package AS caller_package,
+         ec.target AS callee_id,
+         n2.name AS callee_name,
+         n2.package AS callee_package,
+         group_concat(ec.config, ' ' ORDER BY b.seq) AS configs,
+         COUNT(*) AS config_count
+  FROM edge_configs ec
+  JOIN build_configs b ON b.name = ec.config
+  JOIN nodes n1 ON n1.id = ec.source
+  JOIN nodes n2 ON n2.id = ec.target
+  WHERE ec.kind = 'call'
+  GROUP BY ec.source, ec.target
+  HAVING COUNT(*) < (SELECT COUNT(*) FROM build_configs);
+
+INSERT INTO queries (name, description, sql) VALUES
+('config_call_graph',
+ 'Functions reachable from :start through call edges present in build configuration :config (see build_configs)',
+ 'WITH RECURSIVE reach(id, depth) AS (
+  SELECT :start, 0
+  UNION
+  SELECT ec.target, r.depth + 1
+  FROM reach r JOIN edge_configs ec ON ec.source = r.id
+  WHERE ec.kind = ''call'' AND ec.config = :config AND r.depth < 10
+)
+SELECT r.depth, n.id, n.name, n.package, n.file, n.line
+FROM reach r JOIN nodes n ON n.id = r.id
+ORDER BY r.depth, n.id');
+`
+	return sqlitex.ExecuteScript(conn, ddl, nil)
+}
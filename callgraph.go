@@ -2,9 +2,11 @@ package main
 
 import (
 	"go/token"
+	"sort"
 
 	"golang.org/x/tools/go/callgraph"
 	"golang.org/x/tools/go/callgraph/vta"
+	"golang.org/x/tools/go/ssa"
 )
 
 // BuildCallGraph constructs a VTA call graph and emits call/call_site edges.
@@ -13,10 +15,10 @@ func BuildCallGraph(
 	fset *token.FileSet,
 	posLookup *PosLookup,
 	funcLookup *FuncLookup,
-	cpg *CPG,
+	cpg Sink,
 	prog *Progress,
 ) {
-	prog.Log("Building VTA call graph...")
+	prog.Begin("call", "Building VTA call graph...")
 
 	cg := vta.CallGraph(ssaResult.AllFuncs, nil)
 	cg.DeleteSyntheticNodes()
@@ -25,7 +27,7 @@ func BuildCallGraph(
 	var vtaTotal, vtaProm, vtaMatched, stubCount int
 	stubs := make(map[string]bool) // track created stub nodes
 
-	_ = callgraph.GraphVisitEdges(cg, func(edge *callgraph.Edge) error {
+	for _, edge := range sortedEdges(cg, fset) {
 		caller := edge.Caller.Func
 		callee := edge.Callee.Func
 
@@ -35,7 +37,7 @@ func BuildCallGraph(
 		callerKnown := caller.Pkg != nil && modSet.IsKnownPkg(caller.Pkg.Pkg.Path())
 		calleeKnown := callee.Pkg != nil && modSet.IsKnownPkg(callee.Pkg.Pkg.Path())
 		if !callerKnown && !calleeKnown {
-			return nil
+			continue
 		}
 		vtaProm++
 
@@ -43,7 +45,7 @@ func BuildCallGraph(
 		calleeID := ssaFuncNodeID(callee, fset, funcLookup)
 
 		if callerID == "" {
-			return nil
+			continue
 		}
 
 		// Create stub node for external callee if it doesn't have a known module node.
@@ -54,7 +56,7 @@ func BuildCallGraph(
 			if calleeKnown {
 				// Known-module function without an AST node (skipped file).
 				// Skip rather than create a phantom external stub.
-				return nil
+				continue
 			}
 			pkgPath := callee.Pkg.Pkg.Path()
 			stubID := "ext::" + callee.String()
@@ -76,7 +78,7 @@ func BuildCallGraph(
 			calleeID = stubID
 		}
 		if calleeID == "" {
-			return nil
+			continue
 		}
 		vtaMatched++
 
@@ -97,11 +99,11 @@ func BuildCallGraph(
 
 		// Emit call_site→function edge (AST call node → callee)
 		if edge.Site == nil {
-			return nil
+			continue
 		}
 		sitePos := edge.Site.Pos()
 		if !sitePos.IsValid() {
-			return nil
+			continue
 		}
 		p := fset.Position(sitePos)
 		relFile := modSet.RelFile(p.Filename)
@@ -141,8 +143,10 @@ func BuildCallGraph(
 			}
 			argID := posLookup.Get(aFile, aPos.Line, aPos.Column)
 			if argID == "" {
+				unresolvedParamIn(cpg, caller, diagUnresolvedArg, aFile, aPos, args[i].Name(), edge.Site.String())
 				continue
 			}
+			cpg.AddCoverage(Coverage{Package: ssaFuncPkg(caller), Check: covParamInLookup, Total: 1})
 			paramPos := params[i-offset].Pos()
 			if !paramPos.IsValid() {
 				continue
@@ -154,8 +158,10 @@ func BuildCallGraph(
 			}
 			paramID := posLookup.Get(pFile, pPos.Line, pPos.Column)
 			if paramID == "" {
+				unresolvedParamIn(cpg, callee, diagUnresolvedParam, pFile, pPos, params[i-offset].Name(), callee.String())
 				continue
 			}
+			cpg.AddCoverage(Coverage{Package: ssaFuncPkg(callee), Check: covParamInLookup, Total: 1})
 			cpg.AddEdge(Edge{
 				Source: argID, Target: paramID, Kind: "param_in",
 				Properties: map[string]any{"index": i - offset},
@@ -184,71 +190,61 @@ func BuildCallGraph(
 			callToReturnEdges++
 		}
 
-		return nil
-	})
+	}
 
 	prog.Log("VTA: %d total edges, %d known-module pairs, %d matched to AST, %d external stubs", vtaTotal, vtaProm, vtaMatched, stubCount)
-	prog.Log("Created %d call, %d call_site, %d param_in, %d param_out, %d call_to_return edges", callEdges, callSiteEdges, paramInEdges, paramOutEdges, callToReturnEdges)
+	prog.End("call", Fields{
+		"vta_total": vtaTotal, "vta_known": vtaProm, "vta_matched": vtaMatched, "stubs": stubCount,
+		"call_edges": callEdges, "call_site_edges": callSiteEdges, "param_in_edges": paramInEdges,
+		"param_out_edges": paramOutEdges, "call_to_return_edges": callToReturnEdges,
+	}, "Created %d call, %d call_site, %d param_in, %d param_out, %d call_to_return edges", callEdges, callSiteEdges, paramInEdges, paramOutEdges, callToReturnEdges)
 }
 
-// ComputeFanInOut calculates fan-in, fan-out, and recursion from the call graph edges.
-// Must be called after BuildCallGraph has populated call edges.
-// For call targets that have no AST-derived Metrics entry (e.g., external stubs),
-// a minimal Metrics record is created so fan-in data is not silently lost.
-// Also detects direct and mutual recursion by finding self-referencing call edges
-// and marking involved function nodes with a "recursive" property.
-func ComputeFanInOut(cpg *CPG) {
-	fanIn := make(map[string]int)      // target → count
-	fanOut := make(map[string]int)     // source → count
-	recursive := make(map[string]bool) // functions with self-referencing call edges
-
-	for _, e := range cpg.Edges {
-		if e.Kind != "call" {
-			continue
-		}
-		fanOut[e.Source]++
-		fanIn[e.Target]++
-		// Direct recursion: function calls itself
-		if e.Source == e.Target {
-			recursive[e.Source] = true
-		}
+// sortedEdges returns the edges of cg ordered by caller, call site and
+// callee. GraphVisitEdges walks the node map, so emitting in its order would
+// change the stub nodes and edge rows from one run to the next.
+func sortedEdges(cg *callgraph.Graph, fset *token.FileSet) []*callgraph.Edge {
+	type keyed struct {
+		edge           *callgraph.Edge
+		caller, callee string
+		site           token.Position
 	}
-
-	// Mark recursive functions in node properties
-	for i := range cpg.Nodes {
-		if cpg.Nodes[i].Kind == "function" && recursive[cpg.Nodes[i].ID] {
-			if cpg.Nodes[i].Properties == nil {
-				cpg.Nodes[i].Properties = map[string]any{}
-			}
-			cpg.Nodes[i].Properties["recursive"] = true
+	var keys []keyed
+	_ = callgraph.GraphVisitEdges(cg, func(edge *callgraph.Edge) error {
+		k := keyed{edge: edge, caller: edge.Caller.Func.String(), callee: edge.Callee.Func.String()}
+		if edge.Site != nil {
+			k.site = fset.Position(edge.Site.Pos())
 		}
+		keys = append(keys, k)
+		return nil
+	})
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		switch {
+		case a.caller != b.caller:
+			return a.caller < b.caller
+		case a.site.Filename != b.site.Filename:
+			return a.site.Filename < b.site.Filename
+		case a.site.Line != b.site.Line:
+			return a.site.Line < b.site.Line
+		case a.site.Column != b.site.Column:
+			return a.site.Column < b.site.Column
+		}
+		return a.callee < b.callee
+	})
+	edges := make([]*callgraph.Edge, len(keys))
+	for i, k := range keys {
+		edges[i] = k.edge
 	}
+	return edges
+}
 
-	// Update existing metrics entries
-	for funcID, m := range cpg.Metrics {
-		m.FanIn = fanIn[funcID]
-		m.FanOut = fanOut[funcID]
-	}
-
-	// Create minimal metrics entries for call targets without AST-derived metrics
-	// (external stubs, known-module functions in skipped files) so fan-in is preserved
-	for targetID, fi := range fanIn {
-		if _, exists := cpg.Metrics[targetID]; !exists {
-			cpg.Metrics[targetID] = &Metrics{
-				FunctionID: targetID,
-				FanIn:      fi,
-				FanOut:     fanOut[targetID],
-			}
-		}
-	}
-	// Same for sources that only appear as callers but have no metrics
-	for sourceID, fo := range fanOut {
-		if _, exists := cpg.Metrics[sourceID]; !exists {
-			cpg.Metrics[sourceID] = &Metrics{
-				FunctionID: sourceID,
-				FanOut:     fo,
-				FanIn:      fanIn[sourceID],
-			}
-		}
-	}
+// unresolvedParamIn records a param_in endpoint posLookup could not resolve,
+// charged to the package of fn (the caller for arguments, the callee for
+// parameters).
+func unresolvedParamIn(cpg Sink, fn *ssa.Function, kind, file string, pos token.Position, symbol, message string) {
+	pkg := ssaFuncPkg(fn)
+	cpg.AddDiagnostic(Diagnostic{Package: pkg, Phase: "call", Kind: kind,
+		File: file, Line: pos.Line, Col: pos.Column, Symbol: symbol, Message: message})
+	cpg.AddCoverage(Coverage{Package: pkg, Check: covParamInLookup, Total: 1, Failed: 1})
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"go/token"
+	"sync/atomic"
 
 	"golang.org/x/tools/go/ssa"
 )
@@ -18,27 +19,23 @@ func ExtractCDG(
 	ssaResult *SSAResult,
 	fset *token.FileSet,
 	funcLookup *FuncLookup,
-	cpg *CPG,
+	cpg Sink,
 	prog *Progress,
 ) {
-	prog.Log("Extracting CDG (control dependence)...")
+	prog.Begin("cdg", "Extracting CDG (control dependence)...")
 
-	var cdgEdges, domEdges, pdomEdges, cdgFuncs int
+	var cdgEdges, domEdges, pdomEdges, cdgFuncs atomic.Int64
 
-	for fn := range ssaResult.AllFuncs {
-		if fn.Pkg == nil || fn.Synthetic != "" {
-			continue
-		}
-		if !modSet.IsKnownPkg(fn.Pkg.Pkg.Path()) {
-			continue
-		}
+	funcs := ssaResult.Funcs()
+	runSharded(len(funcs), cpg, func(k int, cpg *CPG) {
+		fn := funcs[k]
 		if len(fn.Blocks) < 2 {
-			continue
+			return
 		}
 
 		funcNodeID := ssaFuncNodeID(fn, fset, funcLookup)
 		if funcNodeID == "" {
-			continue
+			return
 		}
 
 		n := len(fn.Blocks)
@@ -69,7 +66,7 @@ func ExtractCDG(
 						Target: blockIDs[w],
 						Kind:   "cdg",
 					})
-					cdgEdges++
+					cdgEdges.Add(1)
 					w = ipdom[w]
 				}
 			}
@@ -82,7 +79,7 @@ func ExtractCDG(
 					Target: blockIDs[child.Index],
 					Kind:   "dom",
 				})
-				domEdges++
+				domEdges.Add(1)
 			}
 		}
 
@@ -94,14 +91,16 @@ func ExtractCDG(
 					Target: blockIDs[i],
 					Kind:   "pdom",
 				})
-				pdomEdges++
+				pdomEdges.Add(1)
 			}
 		}
 
-		cdgFuncs++
-	}
+		cdgFuncs.Add(1)
+	})
 
-	prog.Log("Created %d CDG, %d dom, %d pdom edges across %d functions", cdgEdges, domEdges, pdomEdges, cdgFuncs)
+	prog.End("cdg", Fields{"cdg_edges": cdgEdges.Load(), "dom_edges": domEdges.Load(), "pdom_edges": pdomEdges.Load(), "functions": cdgFuncs.Load()},
+		"Created %d CDG, %d dom, %d pdom edges across %d functions",
+		cdgEdges.Load(), domEdges.Load(), pdomEdges.Load(), cdgFuncs.Load())
 }
 
 // postDominators computes the immediate post-dominator tree using the
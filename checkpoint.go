@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Checkpoints let -resume finish a run that stopped in the SQL stages. The
+// graph itself is already in the base tables once the sink is flushed, so the
+// extraction checkpoint only has to carry what is still in memory at that
+// point: the escape and git results and the phases that ran. Every SQL stage
+// runs in its own transaction that also records its checkpoint row, so a
+// stage is either complete and checkpointed or not visible at all.
+
+// extractCheckpoint is the pipeline_checkpoints row written with the base tables.
+const extractCheckpoint = "extract"
+
+// stageCheckpointPrefix prefixes the pipeline_checkpoints rows of SQL stages.
+const stageCheckpointPrefix = "stage:"
+
+// extractState is the in-memory state the SQL stages need besides the base tables.
+type extractState struct {
+	Phases  []string         `json:"phases"`
+	Escape  []EscapeResult   `json:"escape,omitempty"`
+	Git     []GitFileHistory `json:"git,omitempty"`
+	Commits []GitCommit      `json:"commits,omitempty"`
+	Blame   []GitBlameEntry  `json:"blame,omitempty"`
+	Owners  []CodeOwners     `json:"owners,omitempty"`
+}
+
+// stageState is the checkpoint of a completed SQL stage, kept so a resumed
+// run still reports the original timings in pipeline_runs.
+type stageState struct {
+	StartMS int64 `json:"start_ms"`
+	WallMS  int64 `json:"wall_ms"`
+	Rows    int64 `json:"rows"`
+}
+
+// writeExtractCheckpoint (re)creates pipeline_checkpoints holding only the
+// extraction checkpoint, so every SQL stage runs again. Call it in the
+// transaction that completes the base tables.
+func writeExtractCheckpoint(conn *sqlite.Conn, escapeResults []EscapeResult, git GitResults, phases PhaseSet) error {
+	data, err := json.Marshal(extractState{Phases: phases.List(), Escape: escapeResults,
+		Git: git.History, Commits: git.Commits, Blame: git.Blame, Owners: git.Owners})
+	if err != nil {
+		return fmt.Errorf("extract checkpoint: %w", err)
+	}
+	script := `
+DROP TABLE IF EXISTS pipeline_checkpoints;
+CREATE TABLE pipeline_checkpoints (
+    name TEXT PRIMARY KEY,  -- 'extract' or 'stage:<stage>'
+    data TEXT NOT NULL      -- JSON
+);`
+	if err := sqlitex.ExecuteScript(conn, script, nil); err != nil {
+		return fmt.Errorf("extract checkpoint: %w", err)
+	}
+	if err := sqlitex.Execute(conn, `INSERT INTO pipeline_checkpoints (name, data) VALUES (?, ?)`,
+		&sqlitex.ExecOptions{Args: []any{extractCheckpoint, string(data)}}); err != nil {
+		return fmt.Errorf("extract checkpoint: %w", err)
+	}
+	return nil
+}
+
+// markStageDone records a completed stage. Call it inside the stage's transaction.
+func markStageDone(conn *sqlite.Conn, run stageRun) error {
+	data, _ := json.Marshal(stageState{StartMS: run.Start.Milliseconds(), WallMS: run.Wall.Milliseconds(), Rows: run.Rows})
+	if err := sqlitex.Execute(conn, `INSERT OR REPLACE INTO pipeline_checkpoints (name, data) VALUES (?, ?)`,
+		&sqlitex.ExecOptions{Args: []any{stageCheckpointPrefix + run.Stage, string(data)}}); err != nil {
+		return fmt.Errorf("stage checkpoint: %w", err)
+	}
+	return nil
+}
+
+// loadCheckpoints reads the extraction checkpoint (nil when absent) and the
+// completed stages by name.
+func loadCheckpoints(conn *sqlite.Conn) (*extractState, map[string]stageState, error) {
+	var state *extractState
+	done := make(map[string]stageState)
+	var exists bool
+	if err := sqlitex.ExecuteTransient(conn, `SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'pipeline_checkpoints'`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error { exists = true; return nil }}); err != nil {
+		return nil, nil, fmt.Errorf("read checkpoints: %w", err)
+	}
+	if !exists {
+		return nil, done, nil
+	}
+	err := sqlitex.ExecuteTransient(conn, `SELECT name, data FROM pipeline_checkpoints`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			name, data := stmt.ColumnText(0), stmt.ColumnText(1)
+			switch {
+			case name == extractCheckpoint:
+				state = new(extractState)
+				return json.Unmarshal([]byte(data), state)
+			case strings.HasPrefix(name, stageCheckpointPrefix):
+				var st stageState
+				if err := json.Unmarshal([]byte(data), &st); err != nil {
+					return err
+				}
+				done[strings.TrimPrefix(name, stageCheckpointPrefix)] = st
+			}
+			return nil
+		}})
+	if err != nil {
+		return nil, nil, fmt.Errorf("read checkpoints: %w", err)
+	}
+	return state, done, nil
+}
+
+// ResumeDB finishes the database at path from its checkpoints: the SQL
+// stages without a checkpoint run, using the phases, escape and git results
+// of the interrupted run. Stages added since that run also run, so a new
+// analysis can be tried without redoing the Go-side work.
+func ResumeDB(path string, validate bool, prog *Progress) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("resume: %w", err)
+	}
+	conn, err := openDB(path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	state, done, err := loadCheckpoints(conn)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("resume: %s has no extraction checkpoint (the run stopped before its graph was complete); run without -resume", path)
+	}
+	phases := make(PhaseSet)
+	for _, name := range state.Phases {
+		phases[name] = true
+	}
+	prog.Log("Resuming %s: %d SQL stages already complete", path, len(done))
+	if err := migrateDB(conn, prog); err != nil {
+		return err
+	}
+	compact, err := expandCompact(conn, prog)
+	if err != nil {
+		return err
+	}
+	flagCompact = flagCompact || compact
+
+	if err := finishDB(conn, path, state.Escape, GitResults{state.Git, state.Commits, state.Blame, state.Owners}, phases, validate, prog); err != nil {
+		return err
+	}
+	var nodes, edges int64
+	_ = sqlitex.ExecuteTransient(conn, `SELECT (SELECT COUNT(*) FROM nodes), (SELECT COUNT(*) FROM edges)`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			nodes, edges = stmt.ColumnInt64(0), stmt.ColumnInt64(1)
+			return nil
+		}})
+	prog.End("run", Fields{"nodes": nodes, "edges": edges}, "Done. %d nodes, %d edges.", nodes, edges)
+	return nil
+}
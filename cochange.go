@@ -0,0 +1,452 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Files and functions that keep changing in the same commits are coupled
+// whether or not the code says so (logical coupling). The git phase keeps
+// the files every commit of the history window changed, and the lines,
+// carried forward through the later commits to their numbering in the work
+// tree the graph was built from, so that the co_change stage can tell which
+// functions of the graph a commit touched. Pairs that change together often
+// but have no call, imports or ref edge between them become hidden_coupling
+// findings.
+
+const (
+	coChangeMinCommits          = 2   // pairs changing together less often are not kept
+	coChangeMaxFiles            = 50  // larger commits (moves, reformatting) couple nothing
+	coChangeMaxFunctions        = 100 // the same for the functions of a commit
+	hiddenCouplingMinCommits    = 3
+	hiddenCouplingMinConfidence = 0.5
+)
+
+// lineSeg maps the lines [start, end] of a version of a file to the work
+// tree: by adding delta, or when fixed all to line delta.
+type lineSeg struct {
+	start, end, delta int
+	fixed             bool
+}
+
+// at returns the work tree line of line y of the segment.
+func (s lineSeg) at(y int) int {
+	if s.fixed {
+		return s.delta
+	}
+	return y + s.delta
+}
+
+// lineMap maps the lines of a version of a file to the work tree, in line
+// order. Lines a later commit replaced map onto the lines that replaced
+// them, as far as there are as many, and the rest onto the last of those, so
+// what a commit changed is still found where the code is now.
+type lineMap []lineSeg
+
+// treeMap is the lineMap of a file in the work tree.
+var treeMap = lineMap{{start: 1, end: math.MaxInt32}}
+
+// lineHunk is the header of a zero-context diff hunk: oldCount lines from
+// oldStart became newCount lines from newStart.
+type lineHunk struct{ oldStart, oldCount, newStart, newCount int }
+
+// toTree appends the work tree ranges of the lines [lo, hi] to ranges.
+func (m lineMap) toTree(file string, lo, hi int, ranges []GitLineRange) []GitLineRange {
+	for _, s := range m {
+		if a, b := max(lo, s.start), min(hi, s.end); a <= b {
+			ranges = append(ranges, GitLineRange{file, s.at(a), s.at(b)})
+		}
+	}
+	return ranges
+}
+
+// before returns the map of the version before a commit, given the map of
+// the version after it and the hunks of the commit in line order.
+func (m lineMap) before(hunks []lineHunk) lineMap {
+	var out lineMap
+	// shifted maps the old lines [lo, hi], the new lines [lo+shift, hi+shift]
+	shifted := func(lo, hi, shift int) {
+		for _, s := range m {
+			if a, b := max(lo, s.start-shift), min(hi, s.end-shift); a <= b {
+				if s.fixed {
+					out = append(out, s)
+					out[len(out)-1].start, out[len(out)-1].end = a, b
+				} else {
+					out = append(out, lineSeg{start: a, end: b, delta: s.delta + shift})
+				}
+			}
+		}
+	}
+	// onto maps the old lines [lo, hi], all replaced by new line y
+	onto := func(lo, hi, y int) {
+		for _, s := range m {
+			if s.start <= y && y <= s.end {
+				out = append(out, lineSeg{start: lo, end: hi, delta: s.at(y), fixed: true})
+				return
+			}
+		}
+	}
+	shift, lo := 0, 1
+	for _, h := range hunks {
+		start := h.oldStart
+		if h.oldCount == 0 {
+			start++ // an insertion follows line oldStart
+		}
+		shifted(lo, start-1, shift)
+		if h.oldCount > 0 {
+			n := min(h.oldCount, h.newCount)
+			shifted(start, start+n-1, h.newStart-start)
+			if n < h.oldCount {
+				// the last replacing line, or the one a deletion follows
+				y := h.newStart + n - 1
+				if n == 0 {
+					y = h.newStart
+				}
+				onto(start+n, start+h.oldCount-1, max(y, 1))
+			}
+		}
+		lo = start + h.oldCount
+		shift += h.newCount - h.oldCount
+	}
+	shifted(lo, math.MaxInt32, shift)
+	return out
+}
+
+// mapCommitLines fills in the Lines of commits, the history of the module
+// in dir as runGitHistoryForDir read it, from the zero-context patches of
+// the same commits. git log lists them newest first, so each file's lineMap
+// starts at the work tree, steps back to HEAD over the uncommitted changes
+// and then back one commit at a time.
+func mapCommitLines(dir, prefix string, commits []GitCommit) error {
+	local, err := gitOutput(dir, "diff", "-U0", "--no-renames", "--relative", "--no-color", "--no-ext-diff", "HEAD", "--", ".")
+	if err != nil {
+		return err
+	}
+	history, err := gitOutput(dir, "log", "--format=%x00%H", "--no-merges", "--no-renames", "--relative", "-n", gitHistoryDepth,
+		"-p", "-U0", "--no-color", "--no-ext-diff", "--", ".")
+	if err != nil {
+		return err
+	}
+
+	index := make(map[string]int, len(commits))
+	for i, c := range commits {
+		index[c.Commit] = i
+	}
+	maps := make(map[string]lineMap)
+	current := -1
+	var oldName, newName string
+	var hunks []lineHunk
+	inHeader := false
+	flush := func() {
+		file := newName
+		if file == "" {
+			file = oldName
+		}
+		if len(hunks) > 0 && strings.HasSuffix(file, ".go") {
+			m, ok := maps[file]
+			if !ok {
+				m = treeMap
+			}
+			if current >= 0 {
+				c := &commits[current]
+				for _, h := range hunks {
+					lo, hi := h.newStart, h.newStart+h.newCount-1
+					if h.newCount == 0 {
+						lo = max(h.newStart, 1) // a deletion after line newStart
+						hi = lo
+					}
+					c.Lines = m.toTree(file, lo, hi, c.Lines)
+				}
+			}
+			maps[file] = m.before(hunks)
+		}
+		oldName, newName, hunks = "", "", nil
+	}
+	for _, line := range strings.Split(local+history, "\n") {
+		switch {
+		case strings.HasPrefix(line, "\x00"):
+			flush()
+			current = -1
+			if sha := line[1:]; len(sha) >= 12 {
+				if i, ok := index[sha[:12]]; ok {
+					current = i
+				}
+			}
+		case strings.HasPrefix(line, "diff --git "):
+			flush()
+			inHeader = true
+		case inHeader && strings.HasPrefix(line, "--- "):
+			oldName = diffPath(line[4:], "a/", prefix)
+		case inHeader && strings.HasPrefix(line, "+++ "):
+			newName = diffPath(line[4:], "b/", prefix)
+		case strings.HasPrefix(line, "@@ "):
+			inHeader = false
+			if m := hunkRe.FindStringSubmatch(line); m != nil {
+				hunks = append(hunks, lineHunk{hunkNumber(m[1]), hunkNumber(m[2]), hunkNumber(m[3]), hunkNumber(m[4])})
+			}
+		}
+	}
+	flush()
+
+	for i := range commits {
+		commits[i].Lines = mergeLineRanges(commits[i].Lines)
+	}
+	return nil
+}
+
+// hunkNumber parses a number of a hunk header; a count left out is 1.
+func hunkNumber(s string) int {
+	n, _ := strconv.Atoi(cmp.Or(s, "1"))
+	return n
+}
+
+// mergeLineRanges sorts ranges and merges the ones that overlap or touch.
+func mergeLineRanges(ranges []GitLineRange) []GitLineRange {
+	slices.SortFunc(ranges, func(a, b GitLineRange) int {
+		return cmp.Or(strings.Compare(a.RelFile, b.RelFile), cmp.Compare(a.Start, b.Start))
+	})
+	var out []GitLineRange
+	for _, r := range ranges {
+		if n := len(out); n > 0 && out[n-1].RelFile == r.RelFile && r.Start <= out[n-1].End+1 {
+			out[n-1].End = max(out[n-1].End, r.End)
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// applyCoChange creates co_change from the commits of the git history: the
+// pairs of files, and of functions, changed together in at least
+// coChangeMinCommits commits, with the support and the confidence of the
+// pair in either direction. Frequent pairs nothing in the graph connects
+// become hidden_coupling findings.
+func applyCoChange(conn *sqlite.Conn, commits []GitCommit, prog *Progress) error {
+	ddl := `
+CREATE TEMP TABLE commits (commit_id TEXT PRIMARY KEY);
+CREATE TEMP TABLE commit_files (
+    commit_id TEXT NOT NULL,
+    file TEXT NOT NULL,
+    PRIMARY KEY (commit_id, file)
+);
+CREATE TEMP TABLE commit_lines (
+    commit_id TEXT NOT NULL,
+    file TEXT NOT NULL,
+    start_line INTEGER NOT NULL,
+    end_line INTEGER NOT NULL
+);
+
+CREATE TABLE co_change (
+    level TEXT NOT NULL,          -- 'file' or 'function'
+    a TEXT NOT NULL,              -- file path or function node id, a < b
+    b TEXT NOT NULL,
+    commits INTEGER NOT NULL,     -- commits changing both
+    support REAL NOT NULL,        -- commits / commits in the history window
+    confidence_ab REAL NOT NULL,  -- commits / commits changing a
+    confidence_ba REAL NOT NULL,  -- commits / commits changing b
+    linked INTEGER NOT NULL,      -- 1 when a call, imports or ref edge connects them
+    PRIMARY KEY (level, a, b)
+);`
+	if err := sqlitex.ExecuteScript(conn, ddl, nil); err != nil {
+		return fmt.Errorf("co-change DDL: %w", err)
+	}
+
+	// Modules in one repository share commits; their files add up.
+	for _, q := range []struct {
+		sql  string
+		bind func(stmt *sqlite.Stmt, c *GitCommit) error
+	}{
+		{`INSERT OR IGNORE INTO commits (commit_id) VALUES (?)`, func(stmt *sqlite.Stmt, c *GitCommit) error {
+			stmt.BindText(1, c.Commit)
+			_, err := stmt.Step()
+			_ = stmt.Reset()
+			return err
+		}},
+		{`INSERT OR IGNORE INTO commit_files (commit_id, file) VALUES (?, ?)`, func(stmt *sqlite.Stmt, c *GitCommit) error {
+			for _, f := range c.Files {
+				stmt.BindText(1, c.Commit)
+				stmt.BindText(2, f)
+				if _, err := stmt.Step(); err != nil {
+					return err
+				}
+				_ = stmt.Reset()
+			}
+			return nil
+		}},
+		{`INSERT INTO commit_lines (commit_id, file, start_line, end_line) VALUES (?, ?, ?, ?)`, func(stmt *sqlite.Stmt, c *GitCommit) error {
+			for _, r := range c.Lines {
+				stmt.BindText(1, c.Commit)
+				stmt.BindText(2, r.RelFile)
+				stmt.BindInt64(3, int64(r.Start))
+				stmt.BindInt64(4, int64(r.End))
+				if _, err := stmt.Step(); err != nil {
+					return err
+				}
+				_ = stmt.Reset()
+			}
+			return nil
+		}},
+	} {
+		stmt, err := conn.Prepare(q.sql)
+		if err != nil {
+			return fmt.Errorf("co-change: %w", err)
+		}
+		for i := range commits {
+			if err := q.bind(stmt, &commits[i]); err != nil {
+				_ = stmt.Finalize()
+				return fmt.Errorf("co-change commit %s: %w", commits[i].Commit, err)
+			}
+		}
+		_ = stmt.Finalize()
+	}
+
+	script := fmt.Sprintf(`
+CREATE INDEX temp.idx_commit_lines ON commit_lines(file, start_line);
+
+-- What the commits small enough to mean something changed in the graph
+CREATE TEMP TABLE small_commits AS
+SELECT commit_id FROM commit_files GROUP BY commit_id HAVING COUNT(*) <= %[1]d;
+
+CREATE TEMP TABLE file_changes AS
+SELECT cf.commit_id, cf.file
+FROM commit_files cf
+JOIN small_commits sc ON sc.commit_id = cf.commit_id
+WHERE EXISTS (SELECT 1 FROM nodes n WHERE n.kind = 'file' AND n.file = cf.file);
+
+CREATE TEMP TABLE function_changes AS
+SELECT DISTINCT cl.commit_id, n.id AS function_id
+FROM commit_lines cl
+JOIN small_commits sc ON sc.commit_id = cl.commit_id
+JOIN nodes n ON n.file = cl.file AND n.kind = 'function' AND n.end_line IS NOT NULL
+  AND n.line <= cl.end_line AND n.end_line >= cl.start_line;
+
+DELETE FROM function_changes WHERE commit_id IN
+  (SELECT commit_id FROM function_changes GROUP BY commit_id HAVING COUNT(*) > %[2]d);
+
+INSERT INTO co_change (level, a, b, commits, support, confidence_ab, confidence_ba, linked)
+SELECT 'file', x.file, y.file, COUNT(*),
+  ROUND(CAST(COUNT(*) AS REAL) / (SELECT COUNT(*) FROM commits), 4),
+  ROUND(CAST(COUNT(*) AS REAL) / ca.n, 4),
+  ROUND(CAST(COUNT(*) AS REAL) / cb.n, 4),
+  0
+FROM file_changes x
+JOIN file_changes y ON y.commit_id = x.commit_id AND y.file > x.file
+JOIN (SELECT file, COUNT(*) AS n FROM file_changes GROUP BY file) ca ON ca.file = x.file
+JOIN (SELECT file, COUNT(*) AS n FROM file_changes GROUP BY file) cb ON cb.file = y.file
+GROUP BY x.file, y.file
+HAVING COUNT(*) >= %[3]d;
+
+INSERT INTO co_change (level, a, b, commits, support, confidence_ab, confidence_ba, linked)
+SELECT 'function', x.function_id, y.function_id, COUNT(*),
+  ROUND(CAST(COUNT(*) AS REAL) / (SELECT COUNT(*) FROM commits), 4),
+  ROUND(CAST(COUNT(*) AS REAL) / ca.n, 4),
+  ROUND(CAST(COUNT(*) AS REAL) / cb.n, 4),
+  0
+FROM function_changes x
+JOIN function_changes y ON y.commit_id = x.commit_id AND y.function_id > x.function_id
+JOIN (SELECT function_id, COUNT(*) AS n FROM function_changes GROUP BY function_id) ca ON ca.function_id = x.function_id
+JOIN (SELECT function_id, COUNT(*) AS n FROM function_changes GROUP BY function_id) cb ON cb.function_id = y.function_id
+GROUP BY x.function_id, y.function_id
+HAVING COUNT(*) >= %[3]d;
+
+-- Files are linked by a call or ref between their code or an import
+-- between their packages, functions by a call or a ref to one in the other,
+-- or by one enclosing the other (a closure and its function)
+UPDATE co_change SET linked = 1
+WHERE level = 'file' AND (
+  EXISTS (SELECT 1 FROM nodes s
+          JOIN edges e ON e.source = s.id AND e.kind IN ('call', 'ref')
+          JOIN nodes t ON t.id = e.target
+          WHERE s.file = co_change.a AND t.file = co_change.b)
+  OR EXISTS (SELECT 1 FROM nodes s
+          JOIN edges e ON e.source = s.id AND e.kind IN ('call', 'ref')
+          JOIN nodes t ON t.id = e.target
+          WHERE s.file = co_change.b AND t.file = co_change.a)
+  OR EXISTS (SELECT 1 FROM nodes fa
+          JOIN nodes fb ON fb.kind = 'file' AND fb.file = co_change.b
+          JOIN edges e ON e.kind = 'imports'
+            AND ((e.source = 'pkg::' || fa.package AND e.target = 'pkg::' || fb.package)
+              OR (e.source = 'pkg::' || fb.package AND e.target = 'pkg::' || fa.package))
+          WHERE fa.kind = 'file' AND fa.file = co_change.a));
+
+UPDATE co_change SET linked = 1
+WHERE level = 'function' AND (
+  EXISTS (SELECT 1 FROM edges e WHERE e.source = co_change.a AND e.target = co_change.b AND e.kind = 'call')
+  OR EXISTS (SELECT 1 FROM edges e WHERE e.source = co_change.b AND e.target = co_change.a AND e.kind = 'call')
+  OR EXISTS (SELECT 1 FROM edges e JOIN nodes s ON s.id = e.source
+             WHERE e.target = co_change.b AND e.kind = 'ref' AND s.parent_function = co_change.a)
+  OR EXISTS (SELECT 1 FROM edges e JOIN nodes s ON s.id = e.source
+             WHERE e.target = co_change.a AND e.kind = 'ref' AND s.parent_function = co_change.b)
+  OR EXISTS (SELECT 1 FROM nodes na JOIN nodes nb ON nb.id = co_change.b
+             WHERE na.id = co_change.a AND na.file = nb.file
+               AND ((na.line <= nb.line AND na.end_line >= nb.end_line) OR (nb.line <= na.line AND nb.end_line >= na.end_line))));
+
+CREATE INDEX idx_co_change_a ON co_change(a);
+CREATE INDEX idx_co_change_b ON co_change(b);
+
+-- Findings: frequent co-change with nothing in the code explaining it
+INSERT INTO findings (category, severity, node_id, file, line, message, details)
+SELECT 'hidden_coupling', 'warning',
+  (SELECT n.id FROM nodes n WHERE n.kind = 'file' AND n.file = c.a LIMIT 1),
+  c.a, 1,
+  c.a || ' and ' || c.b || ' changed together in ' || c.commits || ' commits with no call, imports or ref edge between them',
+  json_object('level', c.level, 'a', c.a, 'b', c.b, 'commits', c.commits, 'support', c.support,
+              'confidence_ab', c.confidence_ab, 'confidence_ba', c.confidence_ba)
+FROM co_change c
+WHERE c.level = 'file' AND c.linked = 0 AND c.commits >= %[4]d
+  AND MAX(c.confidence_ab, c.confidence_ba) >= %[5]g;
+
+INSERT INTO findings (category, severity, node_id, file, line, message, details)
+SELECT 'hidden_coupling', 'warning', c.a, na.file, na.line,
+  na.name || ' and ' || nb.name || ' (' || nb.file || ') changed together in ' || c.commits || ' commits with no call or ref edge between them',
+  json_object('level', c.level, 'a', c.a, 'b', c.b, 'commits', c.commits, 'support', c.support,
+              'confidence_ab', c.confidence_ab, 'confidence_ba', c.confidence_ba)
+FROM co_change c
+JOIN nodes na ON na.id = c.a
+JOIN nodes nb ON nb.id = c.b
+WHERE c.level = 'function' AND c.linked = 0 AND c.commits >= %[4]d
+  AND MAX(c.confidence_ab, c.confidence_ba) >= %[5]g;
+
+INSERT INTO queries (name, description, sql) VALUES
+  ('co_change_partners', 'Files most often changed in the same commits as a given file',
+   'SELECT CASE WHEN a = :file THEN b ELSE a END AS partner, commits, support, CASE WHEN a = :file THEN confidence_ab ELSE confidence_ba END AS confidence, linked FROM co_change WHERE level = ''file'' AND (a = :file OR b = :file) ORDER BY commits DESC'),
+  ('hidden_coupling', 'Function pairs that change together without a call or ref between them',
+   'SELECT a, b, commits, support, confidence_ab, confidence_ba FROM co_change WHERE level = ''function'' AND linked = 0 ORDER BY commits DESC, MAX(confidence_ab, confidence_ba) DESC LIMIT 30');
+
+INSERT INTO schema_docs (category, name, description, example) VALUES
+('table', 'co_change', 'Pairs of files and of functions changed in the same commits of the git history, with support, confidence and whether an edge links them', 'SELECT * FROM co_change WHERE linked = 0 ORDER BY commits DESC LIMIT 20');
+
+DROP TABLE commits;
+DROP TABLE commit_files;
+DROP TABLE commit_lines;
+DROP TABLE small_commits;
+DROP TABLE file_changes;
+DROP TABLE function_changes;
+`, coChangeMaxFiles, coChangeMaxFunctions, coChangeMinCommits, hiddenCouplingMinCommits, hiddenCouplingMinConfidence)
+	if err := sqlitex.ExecuteScript(conn, script, nil); err != nil {
+		return fmt.Errorf("co-change: %w", err)
+	}
+
+	var filePairs, functionPairs, hidden int
+	sqlitex.ExecuteTransient(conn, "SELECT COUNT(*) FILTER (WHERE level = 'file'), COUNT(*) FILTER (WHERE level = 'function') FROM co_change",
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			filePairs = stmt.ColumnInt(0)
+			functionPairs = stmt.ColumnInt(1)
+			return nil
+		}})
+	sqlitex.ExecuteTransient(conn, "SELECT COUNT(*) FROM findings WHERE category = 'hidden_coupling'",
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			hidden = stmt.ColumnInt(0)
+			return nil
+		}})
+
+	prog.Log("Co-change: %d file pairs, %d function pairs, %d hidden coupling findings", filePairs, functionPairs, hidden)
+	return nil
+}
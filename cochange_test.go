@@ -0,0 +1,113 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// treeLine returns the work tree line m maps line y to, or 0.
+func treeLine(m lineMap, y int) int {
+	for _, s := range m {
+		if s.start <= y && y <= s.end {
+			return s.at(y)
+		}
+	}
+	return 0
+}
+
+func TestLineMapBefore(t *testing.T) {
+	tests := []struct {
+		name string
+		// commits holds the hunks of each commit, newest first as git log
+		// lists them
+		commits [][]lineHunk
+		lines   []int // lines of the version before the oldest commit
+		want    []int // their work tree lines
+	}{
+		{
+			name:    "no change",
+			commits: [][]lineHunk{nil},
+			lines:   []int{1, 7, 1000},
+			want:    []int{1, 7, 1000},
+		},
+		{
+			name:    "insertion",
+			commits: [][]lineHunk{{{oldStart: 5, oldCount: 0, newStart: 6, newCount: 3}}},
+			lines:   []int{5, 6, 10},
+			want:    []int{5, 9, 13},
+		},
+		{
+			name:    "insertion at the top",
+			commits: [][]lineHunk{{{oldStart: 0, oldCount: 0, newStart: 1, newCount: 2}}},
+			lines:   []int{1, 4},
+			want:    []int{3, 6},
+		},
+		{
+			name:    "deletion maps onto the line it follows",
+			commits: [][]lineHunk{{{oldStart: 3, oldCount: 2, newStart: 2, newCount: 0}}},
+			lines:   []int{2, 3, 4, 5},
+			want:    []int{2, 2, 2, 3},
+		},
+		{
+			name:    "deletion at the top",
+			commits: [][]lineHunk{{{oldStart: 1, oldCount: 2, newStart: 0, newCount: 0}}},
+			lines:   []int{1, 2, 3},
+			want:    []int{1, 1, 1},
+		},
+		{
+			name:    "replacement by fewer lines",
+			commits: [][]lineHunk{{{oldStart: 3, oldCount: 3, newStart: 3, newCount: 1}}},
+			lines:   []int{3, 4, 5, 6},
+			want:    []int{3, 3, 3, 4},
+		},
+		{
+			name:    "replacement by more lines",
+			commits: [][]lineHunk{{{oldStart: 3, oldCount: 2, newStart: 3, newCount: 4}}},
+			lines:   []int{3, 4, 5},
+			want:    []int{3, 4, 7},
+		},
+		{
+			name: "several hunks",
+			commits: [][]lineHunk{{
+				{oldStart: 2, oldCount: 0, newStart: 3, newCount: 1},
+				{oldStart: 10, oldCount: 1, newStart: 10, newCount: 0},
+				{oldStart: 20, oldCount: 1, newStart: 20, newCount: 2},
+			}},
+			lines: []int{1, 3, 10, 11, 20, 21},
+			want:  []int{1, 4, 10, 11, 20, 22},
+		},
+		{
+			name: "two commits",
+			commits: [][]lineHunk{
+				{{oldStart: 0, oldCount: 0, newStart: 1, newCount: 2}},
+				{{oldStart: 3, oldCount: 2, newStart: 2, newCount: 0}},
+			},
+			lines: []int{1, 3, 5},
+			want:  []int{3, 4, 5},
+		},
+		{
+			name: "replaced lines stay on their replacement",
+			commits: [][]lineHunk{
+				{{oldStart: 1, oldCount: 0, newStart: 2, newCount: 5}},
+				{{oldStart: 4, oldCount: 2, newStart: 4, newCount: 1}},
+			},
+			lines: []int{3, 4, 5, 6},
+			want:  []int{8, 9, 9, 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := treeMap
+			for _, hunks := range tt.commits {
+				m = m.before(hunks)
+			}
+			var got []int
+			for _, y := range tt.lines {
+				got = append(got, treeLine(m, y))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("lines %v map to %v, want %v (map %+v)", tt.lines, got, tt.want, m)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// The compact schema stores the graph once, keyed by integers: every edge
+// endpoint, parent function and build-config row refers to a node by its
+// compact_nodes rowid, node and edge kinds are ids into the kinds lookup
+// table, and the position-based string ID is kept only on compact_nodes.
+// Properties live only in the JSON columns; compact_node_properties keeps
+// the properties SQL stages add without writing them into the JSON (taint
+// roles, escape annotations). Views named nodes, edges, node_properties,
+// edge_properties, node_configs and edge_configs keep the table shapes of the
+// regular schema, so every query written against it still works. Lookups of
+// a property by key and value scan the JSON instead of an index.
+//
+// The SQL stages write to the regular tables, so finishDB compacts after the
+// last stage, and -incremental and -resume expand a compact database back
+// first (expandCompact) and compact it again when done.
+
+// flagCompact makes finishDB convert the database to the compact schema (-compact).
+var flagCompact bool
+
+// compactViews are the views replacing the regular graph tables, with the
+// SELECT each is defined as; expandCompact fills the tables from the same
+// SELECTs, in the order of the rows they came from. The columns are in table
+// order.
+var compactViews = []struct{ name, sql, order string }{
+	{"nodes", `SELECT n.id AS id, k.name AS kind, n.name AS name, n.file AS file, n.line AS line, n.col AS col,
+         n.end_line AS end_line, n.package AS package, p.id AS parent_function,
+         n.type_info AS type_info, n.properties AS properties
+  FROM compact_nodes n
+  JOIN kinds k ON k.id = n.kind
+  LEFT JOIN compact_nodes p ON p.key = n.parent_function`, "n.key"},
+	{"edges", `SELECT s.id AS source, t.id AS target, k.name AS kind, e.properties AS properties
+  FROM compact_edges e
+  JOIN compact_nodes s ON s.key = e.source
+  JOIN compact_nodes t ON t.key = e.target
+  JOIN kinds k ON k.id = e.kind`, "e.rowid"},
+	{"node_properties", `SELECT n.id AS node_id, j.key AS key, CAST(j.value AS TEXT) AS value
+  FROM compact_nodes n, json_each(n.properties) j
+  WHERE n.properties IS NOT NULL AND n.properties != ''
+  UNION ALL
+  SELECT n.id, p.key, p.value
+  FROM compact_node_properties p JOIN compact_nodes n ON n.key = p.node`, ""},
+	{"edge_properties", `SELECT s.id AS source, t.id AS target, k.name AS edge_kind, j.key AS key, CAST(j.value AS TEXT) AS value
+  FROM compact_edges e
+  JOIN compact_nodes s ON s.key = e.source
+  JOIN compact_nodes t ON t.key = e.target
+  JOIN kinds k ON k.id = e.kind,
+  json_each(e.properties) j
+  WHERE e.properties IS NOT NULL AND e.properties != ''`, ""},
+	{"node_configs", `SELECT n.id AS node_id, c.config AS config
+  FROM compact_node_configs c JOIN compact_nodes n ON n.key = c.node`, ""},
+	{"edge_configs", `SELECT s.id AS source, t.id AS target, k.name AS kind, c.config AS config
+  FROM compact_edge_configs c
+  JOIN compact_nodes s ON s.key = c.source
+  JOIN compact_nodes t ON t.key = c.target
+  JOIN kinds k ON k.id = c.kind`, ""},
+}
+
+// compactSchema are the tables of the compact schema.
+var compactSchema = []string{"kinds", "compact_nodes", "compact_edges", "compact_node_properties", "compact_node_configs", "compact_edge_configs"}
+
+// compactDDL moves the graph tables into the compact schema and drops them;
+// compactDocs documents the result.
+const compactDDL = `
+CREATE TABLE kinds (
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE
+);
+INSERT INTO kinds (name) SELECT kind FROM nodes UNION SELECT kind FROM edges;
+
+CREATE TABLE compact_nodes (
+    key INTEGER PRIMARY KEY,
+    id TEXT NOT NULL UNIQUE,
+    kind INTEGER NOT NULL,     -- kinds.id
+    name TEXT NOT NULL,
+    file TEXT,
+    line INTEGER,
+    col INTEGER,
+    end_line INTEGER,
+    package TEXT,
+    parent_function INTEGER,   -- compact_nodes.key
+    type_info TEXT,
+    properties TEXT
+);
+INSERT INTO compact_nodes (id, kind, name, file, line, col, end_line, package, type_info, properties)
+  SELECT n.id, k.id, n.name, n.file, n.line, n.col, n.end_line, n.package, n.type_info, n.properties
+  FROM nodes n JOIN kinds k ON k.name = n.kind
+  ORDER BY n.rowid;
+UPDATE compact_nodes SET parent_function = (
+    SELECT p.key FROM nodes n JOIN compact_nodes p ON p.id = n.parent_function
+    WHERE n.id = compact_nodes.id);
+
+CREATE TABLE compact_edges (
+    source INTEGER NOT NULL,   -- compact_nodes.key
+    target INTEGER NOT NULL,   -- compact_nodes.key
+    kind INTEGER NOT NULL,     -- kinds.id
+    properties TEXT
+);
+INSERT INTO compact_edges (source, target, kind, properties)
+  SELECT s.key, t.key, k.id, e.properties
+  FROM edges e
+  JOIN compact_nodes s ON s.id = e.source
+  JOIN compact_nodes t ON t.id = e.target
+  JOIN kinds k ON k.name = e.kind
+  ORDER BY e.rowid;
+
+-- Properties SQL stages added to node_properties only
+CREATE TABLE compact_node_properties (
+    node INTEGER NOT NULL,     -- compact_nodes.key
+    key TEXT NOT NULL,
+    value TEXT NOT NULL
+);
+INSERT INTO compact_node_properties (node, key, value)
+  SELECT n.key, p.key, p.value
+  FROM node_properties p JOIN compact_nodes n ON n.id = p.node_id
+  WHERE NOT EXISTS (
+    SELECT 1 FROM json_each(n.properties) j
+    WHERE j.key = p.key AND CAST(j.value AS TEXT) = p.value)
+  ORDER BY p.rowid;
+
+CREATE TABLE compact_node_configs (
+    node INTEGER NOT NULL,     -- compact_nodes.key
+    config TEXT NOT NULL,
+    PRIMARY KEY (node, config)
+) WITHOUT ROWID;
+INSERT INTO compact_node_configs (node, config)
+  SELECT n.key, c.config FROM node_configs c JOIN compact_nodes n ON n.id = c.node_id;
+
+-- Configurations of edges that are in the graph; those of orphan edges go
+CREATE TABLE compact_edge_configs (
+    source INTEGER NOT NULL,   -- compact_nodes.key
+    target INTEGER NOT NULL,   -- compact_nodes.key
+    kind INTEGER NOT NULL,     -- kinds.id
+    config TEXT NOT NULL,
+    PRIMARY KEY (source, target, kind, config)
+) WITHOUT ROWID;
+INSERT INTO compact_edge_configs (source, target, kind, config)
+  SELECT s.key, t.key, k.id, c.config
+  FROM edge_configs c
+  JOIN compact_nodes s ON s.id = c.source
+  JOIN compact_nodes t ON t.id = c.target
+  JOIN kinds k ON k.name = c.kind;
+
+DROP TABLE node_properties;
+DROP TABLE edge_properties;
+DROP TABLE node_configs;
+DROP TABLE edge_configs;
+DROP TABLE edges;
+DROP TABLE nodes;
+
+CREATE INDEX idx_compact_nodes_kind ON compact_nodes(kind);
+CREATE INDEX idx_compact_nodes_package ON compact_nodes(package);
+CREATE INDEX idx_compact_nodes_file ON compact_nodes(file);
+CREATE INDEX idx_compact_nodes_parent ON compact_nodes(parent_function);
+CREATE INDEX idx_compact_edges_source ON compact_edges(source, kind);
+CREATE INDEX idx_compact_edges_target ON compact_edges(target, kind);
+CREATE INDEX idx_compact_edges_kind ON compact_edges(kind);
+CREATE INDEX idx_compact_node_props_node ON compact_node_properties(node);
+`
+
+const compactDocs = `
+UPDATE schema_docs SET category = 'view'
+  WHERE category = 'table' AND name IN ('nodes', 'edges', 'node_properties', 'edge_properties', 'node_configs', 'edge_configs');
+INSERT INTO schema_docs (category, name, description, example) VALUES
+('table', 'kinds', 'Node and edge kind names of the compact schema', 'SELECT name FROM kinds'),
+('table', 'compact_nodes', 'Nodes of the compact schema, keyed by integer rowid (key); the nodes view joins in the kind name and parent ID', 'SELECT key, id FROM compact_nodes WHERE id = :node_id'),
+('table', 'compact_edges', 'Edges of the compact schema, with endpoints as compact_nodes keys and kind as a kinds id', 'SELECT COUNT(*) FROM compact_edges GROUP BY kind'),
+('table', 'compact_node_properties', 'Node properties SQL stages added outside the JSON properties column (taint roles, escape annotations)', 'SELECT key, COUNT(*) FROM compact_node_properties GROUP BY key'),
+('table', 'compact_node_configs', 'node_configs of the compact schema, by compact_nodes key', NULL),
+('table', 'compact_edge_configs', 'edge_configs of the compact schema, by compact_nodes keys and kinds id', NULL);
+`
+
+const expandDocs = `
+UPDATE schema_docs SET category = 'table'
+  WHERE category = 'view' AND name IN ('nodes', 'edges', 'node_properties', 'edge_properties', 'node_configs', 'edge_configs');
+DELETE FROM schema_docs
+  WHERE category = 'table' AND name IN ('kinds', 'compact_nodes', 'compact_edges', 'compact_node_properties', 'compact_node_configs', 'compact_edge_configs');
+`
+
+// isCompact reports whether the database uses the compact schema.
+func isCompact(conn *sqlite.Conn) (bool, error) {
+	var compact bool
+	if err := sqlitex.ExecuteTransient(conn, `SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'compact_nodes'`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error { compact = true; return nil }}); err != nil {
+		return false, fmt.Errorf("schema: %w", err)
+	}
+	return compact, nil
+}
+
+// compactDB converts a finished database to the compact schema, vacuums it
+// and reports the size before and after. A database already compact is left
+// alone.
+func compactDB(conn *sqlite.Conn, prog *Progress) error {
+	compact, err := isCompact(conn)
+	if err != nil || compact {
+		return err
+	}
+	prog.Begin("compact", "Converting to compact schema ...")
+	before, err := usedBytes(conn)
+	if err != nil {
+		return err
+	}
+
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return fmt.Errorf("compact: begin tx: %w", err)
+	}
+	err = compactTables(conn)
+	endFn(&err)
+	if err != nil {
+		return fmt.Errorf("compact: %w", err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, "VACUUM", nil); err != nil {
+		return fmt.Errorf("compact: vacuum: %w", err)
+	}
+
+	after, err := usedBytes(conn)
+	if err != nil {
+		return err
+	}
+	saved := 0.0
+	if before > 0 {
+		saved = 100 * float64(before-after) / float64(before)
+	}
+	prog.End("compact", Fields{"bytes_before": before, "bytes_after": after},
+		"Compact schema: %d MB -> %d MB (%.0f%% smaller)", before/(1024*1024), after/(1024*1024), saved)
+	return nil
+}
+
+// compactTables moves the graph into the compact schema behind views.
+func compactTables(conn *sqlite.Conn) error {
+	if err := sqlitex.ExecuteScript(conn, compactDDL, nil); err != nil {
+		return err
+	}
+	for _, v := range compactViews {
+		if err := sqlitex.ExecuteTransient(conn, `CREATE VIEW `+v.name+` AS `+v.sql, nil); err != nil {
+			return fmt.Errorf("view %s: %w", v.name, err)
+		}
+	}
+	if err := sqlitex.ExecuteScript(conn, compactDocs, nil); err != nil {
+		return fmt.Errorf("schema docs: %w", err)
+	}
+	return sqlitex.ExecuteTransient(conn, "ANALYZE", nil)
+}
+
+// usedBytes returns the size of the database's pages in use, which is what
+// the file shrinks to when vacuumed.
+func usedBytes(conn *sqlite.Conn) (int64, error) {
+	var n int64
+	if err := sqlitex.ExecuteTransient(conn,
+		`SELECT (page_count - freelist_count) * page_size FROM pragma_page_count, pragma_freelist_count, pragma_page_size`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			n = stmt.ColumnInt64(0)
+			return nil
+		}}); err != nil {
+		return 0, fmt.Errorf("database size: %w", err)
+	}
+	return n, nil
+}
+
+// expandCompact converts a compact database back to the regular schema, with
+// the tables and indexes the SQL stages expect, and reports whether it was
+// compact. The kinds, compact_* tables and their schema_docs rows go.
+func expandCompact(conn *sqlite.Conn, prog *Progress) (bool, error) {
+	compact, err := isCompact(conn)
+	if err != nil || !compact {
+		return false, err
+	}
+	prog.Log("Expanding compact schema ...")
+
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return true, fmt.Errorf("expand: begin tx: %w", err)
+	}
+	err = expandTables(conn)
+	endFn(&err)
+	if err != nil {
+		return true, fmt.Errorf("expand: %w", err)
+	}
+	return true, nil
+}
+
+// expandTables replaces the views by tables filled from them and drops the
+// compact schema.
+func expandTables(conn *sqlite.Conn) error {
+	// The views read the compact tables the new tables are filled from, so
+	// they go before and the compact tables after
+	for _, v := range compactViews {
+		if err := sqlitex.ExecuteTransient(conn, `DROP VIEW `+v.name, nil); err != nil {
+			return fmt.Errorf("drop view %s: %w", v.name, err)
+		}
+	}
+	if err := sqlitex.ExecuteScript(conn, graphTablesDDL+propertyTablesDDL, nil); err != nil {
+		return err
+	}
+	if err := createBuildTables(conn); err != nil {
+		return err
+	}
+	for _, v := range compactViews {
+		q := `INSERT INTO ` + v.name + ` ` + v.sql
+		if v.order != "" {
+			q += ` ORDER BY ` + v.order
+		}
+		if err := sqlitex.ExecuteTransient(conn, q, nil); err != nil {
+			return fmt.Errorf("%s: %w", v.name, err)
+		}
+	}
+	for _, t := range compactSchema {
+		if err := sqlitex.ExecuteTransient(conn, `DROP TABLE `+t, nil); err != nil {
+			return fmt.Errorf("drop %s: %w", t, err)
+		}
+	}
+	if err := createIndexes(conn); err != nil {
+		return err
+	}
+	if err := sqlitex.ExecuteScript(conn, propertyIndexesDDL, nil); err != nil {
+		return err
+	}
+	if err := sqlitex.ExecuteScript(conn, expandDocs, nil); err != nil {
+		return fmt.Errorf("schema docs: %w", err)
+	}
+	// A resumed run may skip the analyze stage
+	return sqlitex.ExecuteTransient(conn, "ANALYZE", nil)
+}
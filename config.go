@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the declarative project description accepted by -config.
+// The same structure is built from command-line flags when no file is given,
+// so both entry points go through one validation path (Resolve).
+type Config struct {
+	Root        string         `json:"root" yaml:"root"`                 // primary module dir
+	Modules     []ModuleConfig `json:"modules,omitempty" yaml:"modules"` // additional modules
+	Deps        []string       `json:"deps,omitempty" yaml:"deps"`       // dependency module paths analyzed in full
+	Skip        SkipConfig     `json:"skip" yaml:"skip"`
+	MemoryLimit string         `json:"memory_limit,omitempty" yaml:"memory_limit"` // e.g. "8GiB", "off"
+	Phases      []string       `json:"phases,omitempty" yaml:"phases"`             // empty = all
+	SkipPhases  []string       `json:"skip_phases,omitempty" yaml:"skip_phases"`   // removed after dependency expansion
+	Jobs        int            `json:"jobs,omitempty" yaml:"jobs"`                 // extraction workers, 0 = one per CPU
+	StageJobs   int            `json:"stage_jobs,omitempty" yaml:"stage_jobs"`     // SQL stage connections, 0 or 1 = sequential
+	Builds      []string       `json:"builds,omitempty" yaml:"builds"`             // "goos/goarch[,tag=t]..."; empty = host only
+	Blame       BlameConfig    `json:"blame,omitzero" yaml:"blame"`
+	Output      OutputConfig   `json:"output,omitzero" yaml:"output"`
+
+	phases PhaseSet      // resolved from Phases and SkipPhases by Resolve
+	builds []BuildConfig // parsed from Builds by Resolve
+	deps   []ModuleInfo  // resolved from Deps by Resolve
+}
+
+// ModuleConfig declares one additional module. Path is read from go.mod when empty.
+type ModuleConfig struct {
+	Dir    string `json:"dir" yaml:"dir"`
+	Path   string `json:"path,omitempty" yaml:"path"`
+	Prefix string `json:"prefix" yaml:"prefix"`
+}
+
+// SkipConfig controls which source files shouldSkipFile excludes.
+// Patterns ending in "/" exclude a directory subtree; other patterns are
+// path.Match globs tried against both the module-relative path and the base name.
+type SkipConfig struct {
+	Tests     bool     `json:"tests" yaml:"tests"` // false also loads test packages (see testVariants)
+	Generated bool     `json:"generated" yaml:"generated"`
+	Patterns  []string `json:"patterns,omitempty" yaml:"patterns"`
+}
+
+// BlameConfig controls git blame in the git phase (see RunGitBlame).
+type BlameConfig struct {
+	Enabled bool   `json:"enabled,omitempty" yaml:"enabled"`
+	Timeout string `json:"timeout,omitempty" yaml:"timeout"` // time budget, e.g. "5m"; empty = defaultBlameTimeout
+}
+
+// OutputConfig controls where and how the database is written.
+type OutputConfig struct {
+	Path        string `json:"path" yaml:"path"`
+	Validate    bool   `json:"validate,omitempty" yaml:"validate"`
+	Incremental bool   `json:"incremental,omitempty" yaml:"incremental"` // patch an existing DB in place
+	Resume      bool   `json:"resume,omitempty" yaml:"resume"`           // finish an interrupted run from its checkpoints
+	Compact     bool   `json:"compact,omitempty" yaml:"compact"`         // integer keys, kinds table, views over them
+}
+
+// defaultMemoryLimit matches the historical hardcoded debug.SetMemoryLimit value.
+const defaultMemoryLimit = "8GiB"
+
+// DefaultConfig returns the configuration used when neither a file nor flags override it.
+func DefaultConfig() *Config {
+	return &Config{
+		Skip:        SkipConfig{Tests: true, Generated: true},
+		MemoryLimit: defaultMemoryLimit,
+	}
+}
+
+// LoadConfig reads a YAML or JSON config file. Unknown keys are errors.
+// Relative directories in the file are resolved against the file's directory.
+func LoadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	cfg := DefaultConfig()
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	default:
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", file, err)
+	}
+
+	base := filepath.Dir(file)
+	if cfg.Root != "" && !filepath.IsAbs(cfg.Root) {
+		cfg.Root = filepath.Join(base, cfg.Root)
+	}
+	for i := range cfg.Modules {
+		if d := cfg.Modules[i].Dir; d != "" && !filepath.IsAbs(d) {
+			cfg.Modules[i].Dir = filepath.Join(base, d)
+		}
+	}
+	if p := cfg.Output.Path; p != "" && !filepath.IsAbs(p) {
+		cfg.Output.Path = filepath.Join(base, p)
+	}
+	return cfg, nil
+}
+
+// ParseModuleSpecs converts the legacy -modules "dir:modpath:name" list into
+// module entries. The modpath may be omitted ("dir::name" or "dir:name").
+func ParseModuleSpecs(specs string) ([]ModuleConfig, error) {
+	var mods []ModuleConfig
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		parts := strings.SplitN(spec, ":", 3)
+		switch len(parts) {
+		case 2:
+			mods = append(mods, ModuleConfig{Dir: parts[0], Prefix: parts[1]})
+		case 3:
+			mods = append(mods, ModuleConfig{Dir: parts[0], Path: parts[1], Prefix: parts[2]})
+		default:
+			return nil, fmt.Errorf("invalid -modules spec %q (want dir:modpath:name)", spec)
+		}
+	}
+	return mods, nil
+}
+
+// Resolve validates the config and fills in derived values: absolute dirs,
+// module paths from go.mod, dependency locations, and the normalized memory limit. Every problem is
+// a hard error naming the offending entry.
+func (c *Config) Resolve() error {
+	if c.Root == "" {
+		return fmt.Errorf("config: root (primary module dir) is required")
+	}
+	if c.Output.Path == "" {
+		return fmt.Errorf("config: output.path is required")
+	}
+	if c.Output.Resume && c.Output.Incremental {
+		return fmt.Errorf("config: output.resume and output.incremental are mutually exclusive")
+	}
+
+	root, err := filepath.Abs(c.Root)
+	if err != nil {
+		return fmt.Errorf("config: root: %w", err)
+	}
+	if err := checkDir(root); err != nil {
+		return fmt.Errorf("config: root: %w", err)
+	}
+	c.Root = root
+
+	seenPrefix := make(map[string]bool)
+	seenDir := map[string]bool{root: true}
+	for i := range c.Modules {
+		m := &c.Modules[i]
+		where := fmt.Sprintf("config: modules[%d]", i)
+		if m.Dir == "" {
+			return fmt.Errorf("%s: dir is required", where)
+		}
+		dir, err := filepath.Abs(m.Dir)
+		if err != nil {
+			return fmt.Errorf("%s: dir: %w", where, err)
+		}
+		if err := checkDir(dir); err != nil {
+			return fmt.Errorf("%s: dir: %w", where, err)
+		}
+		if seenDir[dir] {
+			return fmt.Errorf("%s: dir %s is listed twice", where, dir)
+		}
+		seenDir[dir] = true
+		m.Dir = dir
+
+		if m.Prefix == "" {
+			return fmt.Errorf("%s (%s): prefix is required for non-primary modules", where, m.Dir)
+		}
+		if strings.ContainsAny(m.Prefix, ":@") || strings.HasPrefix(m.Prefix, "/") || strings.HasSuffix(m.Prefix, "/") {
+			return fmt.Errorf("%s: prefix %q must be a relative path without ':' or '@'", where, m.Prefix)
+		}
+		if seenPrefix[m.Prefix] {
+			return fmt.Errorf("%s: duplicate prefix %q", where, m.Prefix)
+		}
+		seenPrefix[m.Prefix] = true
+
+		if m.Path == "" {
+			if m.Path, err = ReadModulePath(m.Dir); err != nil {
+				return fmt.Errorf("%s: %w", where, err)
+			}
+		}
+	}
+
+	// Dependencies resolve against the go.mod files of the workspace modules
+	c.deps = nil
+	dirs := []string{c.Root}
+	seenPath := make(map[string]bool)
+	if primaryPath, err := ReadModulePath(c.Root); err == nil {
+		seenPath[primaryPath] = true
+	}
+	for _, m := range c.Modules {
+		dirs = append(dirs, m.Dir)
+		seenPath[m.Path] = true
+	}
+	for i, modPath := range c.Deps {
+		where := fmt.Sprintf("config: deps[%d]", i)
+		if seenPath[modPath] {
+			return fmt.Errorf("%s: %s is already a module under analysis", where, modPath)
+		}
+		if err := module.CheckPath(modPath); err != nil {
+			return fmt.Errorf("%s: %w", where, err)
+		}
+		seenPath[modPath] = true
+		dep, err := resolveDep(modPath, dirs)
+		if err != nil {
+			return fmt.Errorf("%s: %w", where, err)
+		}
+		if dep.Prefix, err = depPrefix(modPath, seenPrefix); err != nil {
+			return fmt.Errorf("%s: %w", where, err)
+		}
+		seenPrefix[dep.Prefix] = true
+		c.deps = append(c.deps, dep)
+	}
+
+	for i, p := range c.Skip.Patterns {
+		if _, err := path.Match(strings.TrimSuffix(p, "/"), ""); err != nil {
+			return fmt.Errorf("config: skip.patterns[%d] %q: %w", i, p, err)
+		}
+	}
+
+	if _, err := ParseMemoryLimit(c.MemoryLimit); err != nil {
+		return fmt.Errorf("config: memory_limit: %w", err)
+	}
+
+	if c.Blame.Timeout != "" {
+		if d, err := time.ParseDuration(c.Blame.Timeout); err != nil {
+			return fmt.Errorf("config: blame.timeout: %w", err)
+		} else if d <= 0 {
+			return fmt.Errorf("config: blame.timeout must be positive, got %s", c.Blame.Timeout)
+		}
+	}
+
+	if c.Jobs < 0 {
+		return fmt.Errorf("config: jobs must be >= 0, got %d", c.Jobs)
+	}
+	if c.StageJobs < 0 {
+		return fmt.Errorf("config: stage_jobs must be >= 0, got %d", c.StageJobs)
+	}
+
+	if c.phases, err = ResolvePhases(c.Phases, c.SkipPhases); err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	c.builds = nil
+	seenBuild := make(map[string]bool)
+	for i, spec := range c.Builds {
+		b, err := ParseBuildSpec(spec)
+		if err != nil {
+			return fmt.Errorf("config: builds[%d]: %w", i, err)
+		}
+		if seenBuild[b.Name] {
+			return fmt.Errorf("config: builds[%d]: %s is listed twice", i, b.Name)
+		}
+		seenBuild[b.Name] = true
+		c.builds = append(c.builds, b)
+	}
+	if len(c.builds) > 0 && c.Output.Incremental {
+		return fmt.Errorf("config: builds and output.incremental are mutually exclusive")
+	}
+	return nil
+}
+
+// ModuleSet builds the ModuleSet described by a resolved config.
+func (c *Config) ModuleSet() (*ModuleSet, error) {
+	primaryPath, err := ReadModulePath(c.Root)
+	if err != nil {
+		return nil, fmt.Errorf("primary module: %w", err)
+	}
+	primary := ModuleInfo{
+		ModPath: primaryPath,
+		Dir:     c.Root,
+		Prefix:  "", // primary module keeps paths unprefixed for backward compat
+	}
+	extras := make([]ModuleInfo, len(c.Modules), len(c.Modules)+len(c.deps))
+	for i, m := range c.Modules {
+		extras[i] = ModuleInfo{Dir: m.Dir, ModPath: m.Path, Prefix: m.Prefix}
+	}
+	extras = append(extras, c.deps...)
+	return NewModuleSet(primary, extras), nil
+}
+
+// PhaseEnabled reports whether a phase runs, after dependency expansion and
+// skips (see ResolvePhases). Only valid after Resolve.
+func (c *Config) PhaseEnabled(name string) bool {
+	return c.phases.Enabled(name)
+}
+
+// PhaseSet returns the resolved phases. Only valid after Resolve.
+func (c *Config) PhaseSet() PhaseSet {
+	return c.phases
+}
+
+// BuildConfigs returns the parsed build configurations, nil for a host-only
+// build. Only valid after Resolve.
+func (c *Config) BuildConfigs() []BuildConfig {
+	return c.builds
+}
+
+// BlameTimeout returns the time budget of git blame. Only valid after Resolve.
+func (c *Config) BlameTimeout() time.Duration {
+	if d, err := time.ParseDuration(c.Blame.Timeout); err == nil {
+		return d
+	}
+	return defaultBlameTimeout
+}
+
+// GraphConfig returns the settings that decide what the graph contains:
+// the config without its directories, output settings and execution knobs
+// (workers, memory limit, time budgets), so analyzing the same code from
+// another checkout or with other resources describes it alike.
+func (c *Config) GraphConfig() Config {
+	g := *c
+	g.Root = ""
+	g.Modules = nil
+	for _, m := range c.Modules {
+		g.Modules = append(g.Modules, ModuleConfig{Path: m.Path, Prefix: m.Prefix})
+	}
+	g.MemoryLimit = ""
+	g.Jobs, g.StageJobs = 0, 0
+	g.Blame.Timeout = ""
+	g.Output = OutputConfig{}
+	return g
+}
+
+// FingerprintSalt captures the settings that change what is emitted for a
+// package, so an incremental run after a config change regenerates everything.
+func (c *Config) FingerprintSalt() string {
+	b, _ := json.Marshal(struct {
+		Root    string
+		Modules []ModuleConfig
+		Deps    []ModuleInfo `json:",omitempty"`
+		Skip    SkipConfig
+		Phases  []string
+		Builds  []string `json:",omitempty"`
+	}{c.Root, c.Modules, c.deps, c.Skip, c.phases.List(), c.Builds})
+	return string(b)
+}
+
+// ParseMemoryLimit converts a human-readable size ("8GiB", "512MiB", "1073741824")
+// to bytes. "off", "none" and "0" disable the limit and return 0.
+func ParseMemoryLimit(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	switch strings.ToLower(s) {
+	case "", "0", "off", "none":
+		return 0, nil
+	}
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"B", 1},
+	}
+	mult := int64(1)
+	num := s
+	for _, u := range units {
+		if rest, ok := strings.CutSuffix(s, u.suffix); ok {
+			num, mult = strings.TrimSpace(rest), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	// NaN fails every comparison, so only a finite size in range passes
+	if err != nil || !(n >= 0 && n*float64(mult) < math.MaxInt64) {
+		return 0, fmt.Errorf("invalid size %q (want e.g. 8GiB, 512MiB or off)", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// checkDir returns an error unless dir exists and is a directory.
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
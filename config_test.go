@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestParseMemoryLimit(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "", want: 0},
+		{in: "0", want: 0},
+		{in: "off", want: 0},
+		{in: "None", want: 0},
+		{in: "1073741824", want: 1 << 30},
+		{in: "8GiB", want: 8 << 30},
+		{in: "512MiB", want: 512 << 20},
+		{in: "64KiB", want: 64 << 10},
+		{in: "1TiB", want: 1 << 40},
+		{in: "2GB", want: 2e9},
+		{in: "1.5GiB", want: 3 << 29},
+		{in: " 4 GiB ", want: 4 << 30},
+		{in: "100B", want: 100},
+		{in: "lots", wantErr: true},
+		{in: "-1GiB", wantErr: true},
+		{in: "GiB", wantErr: true},
+		{in: "8gib", wantErr: true},
+		{in: "NaN", wantErr: true},
+		{in: "NaNGiB", wantErr: true},
+		{in: "Inf", wantErr: true},
+		{in: "+InfMiB", wantErr: true},
+		{in: "1e30GiB", wantErr: true},
+		{in: "9223372036854775807", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseMemoryLimit(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMemoryLimit(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseMemoryLimit(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,14 +1,21 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 
+	"cpg-gen/graph/mem"
+	"cpg-gen/graph/schema"
+
 	_ "modernc.org/sqlite"
 )
 
 type DB struct {
-	conn *sql.DB
+	conn  *sql.DB
+	calls *mem.Graph
+	meta  *schema.Meta
 }
 
 type Node struct {
@@ -63,6 +70,12 @@ type FunctionMetrics struct {
 	FanOut     int    `json:"fanOut"`
 }
 
+type Meta struct {
+	SchemaVersion int                 `json:"schemaVersion"`
+	Values        map[string]string   `json:"values"`
+	Modules       []schema.ModuleMeta `json:"modules,omitempty"`
+}
+
 type Hotspot struct {
 	ID         string `json:"id"`
 	Name       string `json:"name"`
@@ -92,7 +105,30 @@ func Open(path string) (*DB, error) {
 	}
 	conn.SetMaxOpenConns(10)
 	conn.SetMaxIdleConns(5)
-	return &DB{conn: conn}, nil
+
+	// Refuse a database whose schema this build does not know rather than
+	// serve wrong answers from it
+	meta, err := schema.ReadSQL(context.Background(), conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if err := schema.Check(meta.Version); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The call graph is held in memory: traversals touch many nodes and
+	// each would otherwise be a query
+	calls, err := mem.LoadSQL(context.Background(), conn, mem.LoadOptions{
+		NodeKinds: []string{"function"},
+		EdgeKinds: []string{"call"},
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to load call graph: %w", err)
+	}
+	return &DB{conn: conn, calls: calls, meta: meta}, nil
 }
 
 func (db *DB) Close() error {
@@ -356,53 +392,49 @@ func (db *DB) getNode(id string) (*Node, error) {
 }
 
 func (db *DB) getCallees(funcID string) ([]string, error) {
-	query := `
-		SELECT DISTINCT e.target
-		FROM edges e
-		JOIN nodes n ON e.target = n.id
-		WHERE e.source = ? AND e.kind = 'call' AND n.kind = 'function'
-		LIMIT 20
-	`
-	rows, err := db.conn.Query(query, funcID)
+	return db.callNeighbors(funcID, mem.Forward)
+}
+
+func (db *DB) getCallers(funcID string) ([]string, error) {
+	return db.callNeighbors(funcID, mem.Backward)
+}
+
+func (db *DB) callNeighbors(funcID string, dir mem.Direction) ([]string, error) {
+	ids, err := db.calls.Neighbors(funcID, dir, mem.AllKinds)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var callees []string
-	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
-			return nil, err
-		}
-		callees = append(callees, id)
+	if len(ids) > 20 {
+		ids = ids[:20]
 	}
-	return callees, nil
+	return ids, nil
 }
 
-func (db *DB) getCallers(funcID string) ([]string, error) {
-	query := `
-		SELECT DISTINCT e.source
-		FROM edges e
-		JOIN nodes n ON e.source = n.id
-		WHERE e.target = ? AND e.kind = 'call' AND n.kind = 'function'
-		LIMIT 20
-	`
-	rows, err := db.conn.Query(query, funcID)
+func (db *DB) GetCallPath(fromID, toID string) (*Graph, error) {
+	path, err := db.calls.ShortestPath(fromID, toID, mem.Forward, mem.AllKinds, 10)
+	if errors.Is(err, mem.ErrNoPath) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	var callers []string
-	for rows.Next() {
-		var id string
-		if err := rows.Scan(&id); err != nil {
+	graph := &Graph{Nodes: []Node{}, Edges: []Edge{}}
+	ids := []string{fromID}
+	for _, e := range path {
+		graph.Edges = append(graph.Edges, Edge{Source: e.Source, Target: e.Target, Kind: e.Kind})
+		ids = append(ids, e.Target)
+	}
+	for _, id := range ids {
+		node, err := db.getNode(id)
+		if err != nil {
 			return nil, err
 		}
-		callers = append(callers, id)
+		if node != nil {
+			graph.Nodes = append(graph.Nodes, *node)
+		}
 	}
-	return callers, nil
+	return graph, nil
 }
 
 func (db *DB) GetSource(funcID string) (string, error) {
@@ -504,6 +536,14 @@ func (db *DB) GetFunctionMetrics(funcID string) (*FunctionMetrics, error) {
 	return &fm, nil
 }
 
+// GetMeta returns the schema version and provenance of the database, read
+// when it was opened.
+func (db *DB) GetMeta() *Meta {
+	m := &Meta{SchemaVersion: db.meta.Version, Values: db.meta.Values}
+	m.Modules, _ = db.meta.Modules()
+	return m
+}
+
 func (db *DB) GetStats() (map[string]int, error) {
 	stats := make(map[string]int)
 
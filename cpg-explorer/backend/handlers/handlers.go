@@ -90,6 +90,26 @@ func (h *Handler) GetCallGraph(w http.ResponseWriter, r *http.Request) {
 	h.respondJSON(w, graph)
 }
 
+func (h *Handler) GetCallPath(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if from == "" || to == "" {
+		h.respondError(w, http.StatusBadRequest, "from and to parameters required")
+		return
+	}
+
+	graph, err := h.db.GetCallPath(from, to)
+	if err != nil {
+		h.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if graph == nil {
+		h.respondError(w, http.StatusNotFound, "no call path")
+		return
+	}
+	h.respondJSON(w, graph)
+}
+
 func (h *Handler) GetSource(w http.ResponseWriter, r *http.Request) {
 	funcID := r.URL.Query().Get("id")
 	if funcID == "" {
@@ -151,6 +171,10 @@ func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
 	h.respondJSON(w, stats)
 }
 
+func (h *Handler) GetMeta(w http.ResponseWriter, r *http.Request) {
+	h.respondJSON(w, h.db.GetMeta())
+}
+
 func (h *Handler) GetFunctionMetrics(w http.ResponseWriter, r *http.Request) {
 	funcID := r.URL.Query().Get("id")
 	if funcID == "" {
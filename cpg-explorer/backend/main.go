@@ -37,10 +37,12 @@ func main() {
 	api := r.PathPrefix("/api").Subrouter()
 	api.HandleFunc("/health", h.HealthCheck).Methods("GET")
 	api.HandleFunc("/stats", h.GetStats).Methods("GET")
+	api.HandleFunc("/meta", h.GetMeta).Methods("GET")
 	api.HandleFunc("/packages", h.GetPackages).Methods("GET")
 	api.HandleFunc("/packages/graph", h.GetPackageGraph).Methods("GET")
 	api.HandleFunc("/packages/{name}/functions", h.GetPackageFunctions).Methods("GET")
 	api.HandleFunc("/callgraph", h.GetCallGraph).Methods("GET")
+	api.HandleFunc("/callgraph/path", h.GetCallPath).Methods("GET")
 	api.HandleFunc("/function/source", h.GetSource).Methods("GET")
 	api.HandleFunc("/function/metrics", h.GetFunctionMetrics).Methods("GET")
 	api.HandleFunc("/function/findings", h.GetFunctionFindings).Methods("GET")
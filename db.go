@@ -3,85 +3,178 @@ package main
 import (
 	"fmt"
 	"os"
+	"path"
 	"strings"
 
 	"zombiezen.com/go/sqlite"
 	"zombiezen.com/go/sqlite/sqlitex"
+
+	"cpg-gen/graph/schema"
 )
 
 const batchSize = 50000
 
-// WriteDB writes the CPG to a SQLite database file.
-func WriteDB(path string, cpg *CPG, escapeResults []EscapeResult, gitHistory []GitFileHistory, validate bool, prog *Progress) error {
+// CreateDB creates a fresh database at path with empty base tables and
+// returns a sink that streams the extraction phases into it. WriteDB
+// completes the database once every phase has run.
+func CreateDB(path string, prog *Progress) (*DBSink, error) {
 	prog.Log("Writing SQLite to %s ...", path)
 
 	_ = os.Remove(path) // ignore if doesn't exist
 
-	conn, err := sqlite.OpenConn(path, sqlite.OpenCreate, sqlite.OpenReadWrite, sqlite.OpenWAL)
+	conn, err := openDB(path)
 	if err != nil {
-		return fmt.Errorf("open sqlite: %w", err)
-	}
-	defer func() { _ = conn.Close() }()
-
-	// Performance pragmas
-	if err := sqlitex.ExecuteTransient(conn, "PRAGMA synchronous = NORMAL", nil); err != nil {
-		return err
-	}
-	if err := sqlitex.ExecuteTransient(conn, "PRAGMA temp_store = MEMORY", nil); err != nil {
-		return err
-	}
-	if err := sqlitex.ExecuteTransient(conn, "PRAGMA mmap_size = 268435456", nil); err != nil {
-		return err
-	}
-	if err := sqlitex.ExecuteTransient(conn, "PRAGMA cache_size = -64000", nil); err != nil {
-		return err
-	}
-	if err := sqlitex.ExecuteTransient(conn, "PRAGMA journal_mode = WAL", nil); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Create tables without indexes (deferred creation for speed)
 	if err := createTables(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return newDBSink(conn, path, prog), nil
+}
+
+// WriteDB flushes the sink, derives fan-in/fan-out and recursion from the
+// stored call edges, records the package fingerprints and the extraction
+// checkpoint, and builds every derived table.
+func WriteDB(sink *DBSink, escapeResults []EscapeResult, git GitResults, fingerprints []PackageFingerprint, phases PhaseSet, validate bool, prog *Progress) error {
+	if err := sink.Finish(); err != nil {
 		return err
 	}
+	conn := sink.conn
 
-	// Bulk insert in a transaction
 	endFn, err := sqlitex.ImmediateTransaction(conn)
 	if err != nil {
 		return fmt.Errorf("begin tx: %w", err)
 	}
-
-	if err := insertNodes(conn, cpg.Nodes, prog); err != nil {
-		endFn(&err)
-		return err
-	}
-	if err := insertEdges(conn, cpg.Edges, prog); err != nil {
+	if err := computeFanInOut(conn); err != nil {
 		endFn(&err)
 		return err
 	}
-	if err := insertSources(conn, cpg.Sources, prog); err != nil {
+	if err := writeFingerprints(conn, fingerprints); err != nil {
 		endFn(&err)
 		return err
 	}
-	if err := insertMetrics(conn, cpg.Metrics, prog); err != nil {
+	if err := writeExtractCheckpoint(conn, escapeResults, git, phases); err != nil {
 		endFn(&err)
 		return err
 	}
-
 	endFn(&err)
 	if err != nil {
 		return fmt.Errorf("commit: %w", err)
 	}
 
-	// Create flow semantics table for stdlib data-flow modeling
-	prog.Log("Building flow semantics model...")
-	if err := createFlowSemantics(conn); err != nil {
+	return finishDB(conn, sink.path, escapeResults, git, phases, validate, prog)
+}
+
+// computeFanInOut fills metrics.fan_in/fan_out from the call edges, adds
+// minimal metrics rows for call endpoints without AST-derived metrics
+// (external stubs, functions in skipped files) so fan-in is not lost, and
+// marks directly recursive functions with a "recursive" node property.
+func computeFanInOut(conn *sqlite.Conn) error {
+	steps := []struct{ name, sql string }{
+		{"fan counts", `CREATE TEMP TABLE fan AS
+		  SELECT id, SUM(fan_in) AS fan_in, SUM(fan_out) AS fan_out FROM (
+		    SELECT target AS id, COUNT(*) AS fan_in, 0 AS fan_out FROM edges WHERE kind = 'call' GROUP BY target
+		    UNION ALL
+		    SELECT source, 0, COUNT(*) FROM edges WHERE kind = 'call' GROUP BY source
+		  ) GROUP BY id`},
+		{"fan index", `CREATE UNIQUE INDEX temp.idx_fan ON fan(id)`},
+		{"missing metrics", `INSERT OR IGNORE INTO metrics (function_id, cyclomatic_complexity, fan_in, fan_out, loc, num_params)
+		  SELECT id, 0, 0, 0, 0, 0 FROM fan`},
+		{"stub metrics", `DELETE FROM metrics WHERE function_id LIKE 'ext::%'
+		  AND function_id NOT IN (SELECT id FROM nodes)`},
+		{"fan update", `UPDATE metrics SET
+		  fan_in = COALESCE((SELECT f.fan_in FROM fan f WHERE f.id = metrics.function_id), 0),
+		  fan_out = COALESCE((SELECT f.fan_out FROM fan f WHERE f.id = metrics.function_id), 0)`},
+		{"recursive", `UPDATE nodes SET properties = json_set(COALESCE(properties, '{}'), '$.recursive', json('true'))
+		  WHERE kind = 'function'
+		    AND id IN (SELECT source FROM edges WHERE kind = 'call' AND source = target)`},
+		{"cleanup", `DROP TABLE temp.fan`},
+	}
+	for _, st := range steps {
+		if err := sqlitex.ExecuteTransient(conn, st.sql, nil); err != nil {
+			return fmt.Errorf("fan-in/fan-out %s: %w", st.name, err)
+		}
+	}
+	return nil
+}
+
+// openDB opens (or creates) a SQLite database with the bulk-load pragmas.
+func openDB(path string) (*sqlite.Conn, error) {
+	conn, err := sqlite.OpenConn(path, sqlite.OpenCreate, sqlite.OpenReadWrite, sqlite.OpenWAL)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite: %w", err)
+	}
+
+	// Performance pragmas
+	for _, pragma := range []string{
+		"PRAGMA synchronous = NORMAL",
+		"PRAGMA temp_store = MEMORY",
+		"PRAGMA mmap_size = 268435456",
+		"PRAGMA cache_size = -64000",
+		"PRAGMA journal_mode = WAL",
+	} {
+		if err := sqlitex.ExecuteTransient(conn, pragma, nil); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// finishDB runs every derived stage on top of the base tables (nodes, edges,
+// sources, metrics): heuristic DFG, indexes, views, findings, dashboards and
+// the other analysis tables. Both full and incremental writes end here, and
+// with -compact convert the result to the compact schema.
+// Stages belonging to a phase that is not in phases are skipped; the
+// pipeline_phases and pipeline_runs tables record what ran.
+func finishDB(conn *sqlite.Conn, path string, escapeResults []EscapeResult, git GitResults, phases PhaseSet, validate bool, prog *Progress) error {
+	stages := pipelineStages(escapeResults, git, phases, validate, prog)
+	runs, err := runStages(conn, path, stages, phases, prog)
+	// Record the runs even when a stage failed, so the failure is in the DB
+	if werr := writeStageRuns(conn, stages, runs); werr != nil && err == nil {
+		err = werr
+	}
+	if err != nil {
+		return err
+	}
+	// Hash before compacting, so both layouts of the same graph agree.
+	if err := writeContentHash(conn, prog); err != nil {
 		return err
 	}
 
-	// Heuristic DFG for external calls using flow semantics
-	prog.Log("Inferring DFG for external calls...")
+	if flagCompact {
+		if err := compactDB(conn, prog); err != nil {
+			return err
+		}
+	}
+	reportSize(path, prog)
+	return nil
+}
+
+// deleteOrphanEdges removes edges whose endpoints were never emitted as nodes
+// (e.g. positions in skipped files), before indexing.
+func deleteOrphanEdges(conn *sqlite.Conn, prog *Progress) error {
+	if err := sqlitex.ExecuteTransient(conn,
+		`DELETE FROM edges WHERE source NOT IN (SELECT id FROM nodes) OR target NOT IN (SELECT id FROM nodes)`,
+		&sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error { return nil },
+		}); err != nil {
+		return fmt.Errorf("orphan cleanup: %w", err)
+	}
+	changes := conn.Changes()
+	if changes > 0 {
+		prog.Log("Removed %d orphan edges", changes)
+	}
+	return nil
+}
 
+// inferHeuristicDFG adds dfg edges through calls to external functions, which
+// have no SSA bodies: precise arg→return and arg→arg flows from
+// flow_semantics, and an all-args→return fallback for the rest.
+func inferHeuristicDFG(conn *sqlite.Conn, prog *Progress) error {
 	// Step 1: Precise DFG for functions WITH custom semantics (arg→return)
 	var preciseDFG, fallbackDFG, sideEffectDFG int
 	if err := sqlitex.ExecuteTransient(conn,
@@ -150,181 +243,12 @@ func WriteDB(path string, cpg *CPG, escapeResults []EscapeResult, gitHistory []G
 		prog.Log("Created %d heuristic DFG edges (%d precise, %d side-effect, %d fallback)",
 			totalDFG, preciseDFG, sideEffectDFG, fallbackDFG)
 	}
-
-	// Clean up orphan edges before indexing
-	if err := sqlitex.ExecuteTransient(conn,
-		`DELETE FROM edges WHERE source NOT IN (SELECT id FROM nodes) OR target NOT IN (SELECT id FROM nodes)`,
-		&sqlitex.ExecOptions{
-			ResultFunc: func(stmt *sqlite.Stmt) error { return nil },
-		}); err != nil {
-		return fmt.Errorf("orphan cleanup: %w", err)
-	}
-	changes := conn.Changes()
-	if changes > 0 {
-		prog.Log("Removed %d orphan edges", changes)
-	}
-
-	// Create indexes after all inserts
-	prog.Log("Creating indexes...")
-	if err := createIndexes(conn); err != nil {
-		return err
-	}
-
-	// EOG: expression evaluation order for call arguments
-	prog.Log("Computing evaluation order edges...")
-	if err := computeEOG(conn, prog); err != nil {
-		return err
-	}
-
-	// FTS5 full-text search on source code
-	prog.Log("Building FTS5 index...")
-	if err := createFTS(conn); err != nil {
-		return err
-	}
-
-	// Pre-computed summary statistics for viewer dashboards
-	prog.Log("Computing summary statistics...")
-	if err := createSummaryStats(conn); err != nil {
-		return err
-	}
-
-	// Pre-built analysis views and example queries
-	prog.Log("Creating analysis views...")
-	if err := createAnalysisViews(conn); err != nil {
-		return err
-	}
-
-	// Security taint model: classify known sources/sinks/barriers
-	prog.Log("Building taint model...")
-	if err := createTaintModel(conn); err != nil {
-		return err
-	}
-
-	// Additional analysis: API surface, method sets, risk scores, etc.
-	prog.Log("Computing additional analysis...")
-	if err := createAdditionalAnalysis(conn, prog); err != nil {
-		return err
-	}
-
-	// Apply escape analysis annotations from the Go compiler
-	if len(escapeResults) > 0 {
-		prog.Log("Applying escape analysis annotations...")
-		if err := applyEscapeAnalysis(conn, escapeResults, prog); err != nil {
-			prog.Log("Warning: escape analysis failed: %v", err)
-		}
-	}
-
-	// Advanced analysis: stability metrics, risk scores, dead code, etc.
-	prog.Log("Computing advanced analysis...")
-	if err := createAdvancedAnalysis(conn, prog); err != nil {
-		return err
-	}
-
-	// Cohesion, concurrency, and pattern analysis
-	prog.Log("Computing cohesion and patterns...")
-	if err := createCohesionAndPatterns(conn, prog); err != nil {
-		return err
-	}
-
-	// Run ANALYZE before dashboard queries — without statistics, the query planner
-	// has no row counts and picks catastrophically bad plans on 445k+ row tables
-	prog.Log("Running ANALYZE for query planner...")
-	if err := sqlitex.ExecuteTransient(conn, "ANALYZE", nil); err != nil {
-		return err
-	}
-
-	// Pre-computed dashboard data for easy chart rendering
-	prog.Log("Building dashboard data...")
-	if err := createDashboardData(conn, prog); err != nil {
-		return err
-	}
-
-	// Graph intelligence: top-N tables, cross-package coupling, error chains
-	prog.Log("Building graph intelligence...")
-	if err := createGraphIntelligence(conn, prog); err != nil {
-		return err
-	}
-
-	// File-level analysis and dependency graph data for visualization
-	prog.Log("Building file and dependency analysis...")
-	if err := createFileAndDepAnalysis(conn, prog); err != nil {
-		return err
-	}
-
-	// Type system analysis: hierarchy, implementation map, method resolution
-	prog.Log("Building type system analysis...")
-	if err := createTypeSystemAnalysis(conn, prog); err != nil {
-		return err
-	}
-
-	// Code navigation aids and pattern summaries
-	prog.Log("Building navigation and patterns...")
-	if err := createNavigationAndPatterns(conn, prog); err != nil {
-		return err
-	}
-
-	// Schema documentation: self-describing DB for interview candidates
-	prog.Log("Building schema documentation...")
-	if err := createSchemaDocs(conn); err != nil {
-		return err
-	}
-
-	// Git history for diff-aware analysis
-	if len(gitHistory) > 0 {
-		prog.Log("Running git history analysis...")
-		if err := applyGitHistory(conn, gitHistory, prog); err != nil {
-			return err
-		}
-	}
-
-	// Taint flow state materialization for precise taint analysis
-	prog.Log("Computing taint flow states...")
-	if err := createTaintFlowStates(conn, prog); err != nil {
-		return err
-	}
-
-	// Index sensitivity for map/array taint tracking
-	prog.Log("Computing index sensitivity...")
-	if err := createIndexSensitivity(conn, prog); err != nil {
-		return err
-	}
-
-	// SCIP-style cross-repository symbol identifiers
-	prog.Log("Building SCIP symbol index...")
-	if err := createSCIPSymbols(conn, prog); err != nil {
-		return err
-	}
-
-	// Communication patterns: Honda session types, protocol detection, duality
-	prog.Log("Building communication patterns...")
-	if err := createCommunicationPatterns(conn, prog); err != nil {
-		return err
-	}
-
-	// Honda 2008 corrections: subtyping, acyclic deps, association relation
-	prog.Log("Applying Honda 2008 corrections (Scalas & Yoshida 2019, Yoshida & Hou 2024)...")
-	if err := createSessionTypeCorrections(conn, prog); err != nil {
-		return err
-	}
-
-	if validate {
-		if err := runValidation(conn, prog); err != nil {
-			return err
-		}
-	}
-
-	// Report file size
-	info, _ := os.Stat(path)
-	if info != nil {
-		mb := info.Size() / (1024 * 1024)
-		prog.Log("Wrote %s (%d MB)", path, mb)
-	}
-
 	return nil
 }
 
-func createTables(conn *sqlite.Conn) error {
-	ddl := `
+// graphTablesDDL creates the nodes and edges tables; expandCompact recreates
+// them from a compact database.
+const graphTablesDDL = `
 CREATE TABLE nodes (
     id TEXT PRIMARY KEY,
     kind TEXT NOT NULL,
@@ -345,7 +269,10 @@ CREATE TABLE edges (
     kind TEXT NOT NULL,
     properties TEXT
 );
+`
 
+func createTables(conn *sqlite.Conn) error {
+	ddl := graphTablesDDL + `
 CREATE TABLE sources (
     file TEXT PRIMARY KEY,
     content TEXT NOT NULL,
@@ -361,7 +288,22 @@ CREATE TABLE metrics (
     num_params INTEGER
 );
 `
-	return sqlitex.ExecuteScript(conn, ddl, nil)
+	if err := sqlitex.ExecuteScript(conn, ddl, nil); err != nil {
+		return err
+	}
+	if err := createDiagnosticTables(conn); err != nil {
+		return err
+	}
+	if err := createModuleTables(conn); err != nil {
+		return err
+	}
+	if err := createMetaTable(conn); err != nil {
+		return err
+	}
+	if err := setSchemaVersion(conn, schema.Version); err != nil {
+		return err
+	}
+	return createBuildTables(conn)
 }
 
 func createIndexes(conn *sqlite.Conn) error {
@@ -377,116 +319,6 @@ CREATE INDEX idx_edges_kind ON edges(kind);
 	return sqlitex.ExecuteScript(conn, indexes, nil)
 }
 
-func insertNodes(conn *sqlite.Conn, nodes []Node, prog *Progress) error {
-	stmt, err := conn.Prepare(`INSERT OR IGNORE INTO nodes (id, kind, name, file, line, col, end_line, package, parent_function, type_info, properties) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
-	if err != nil {
-		return fmt.Errorf("prepare node insert: %w", err)
-	}
-	defer func() { _ = stmt.Finalize() }()
-
-	for i, n := range nodes {
-		stmt.BindText(1, n.ID)
-		stmt.BindText(2, n.Kind)
-		stmt.BindText(3, n.Name)
-		bindTextOrNull(stmt, 4, n.File)
-		bindIntOrNull(stmt, 5, n.Line)
-		bindIntOrNull(stmt, 6, n.Col)
-		bindIntOrNull(stmt, 7, n.EndLine)
-		bindTextOrNull(stmt, 8, n.Package)
-		bindTextOrNull(stmt, 9, n.ParentFunction)
-		bindTextOrNull(stmt, 10, n.TypeInfo)
-		bindTextOrNull(stmt, 11, PropsJSON(n.Properties))
-
-		if _, err := stmt.Step(); err != nil {
-			return fmt.Errorf("insert node %s: %w", n.ID, err)
-		}
-		_ = stmt.Reset()
-
-		if (i+1)%batchSize == 0 {
-			prog.Verbose("  inserted %d/%d nodes", i+1, len(nodes))
-		}
-	}
-
-	prog.Log("Inserted %d nodes", len(nodes))
-	return nil
-}
-
-func insertEdges(conn *sqlite.Conn, edges []Edge, prog *Progress) error {
-	stmt, err := conn.Prepare(`INSERT INTO edges (source, target, kind, properties) VALUES (?, ?, ?, ?)`)
-	if err != nil {
-		return fmt.Errorf("prepare edge insert: %w", err)
-	}
-	defer func() { _ = stmt.Finalize() }()
-
-	for i, e := range edges {
-		stmt.BindText(1, e.Source)
-		stmt.BindText(2, e.Target)
-		stmt.BindText(3, e.Kind)
-		bindTextOrNull(stmt, 4, PropsJSON(e.Properties))
-
-		if _, err := stmt.Step(); err != nil {
-			return fmt.Errorf("insert edge %s→%s: %w", e.Source, e.Target, err)
-		}
-		_ = stmt.Reset()
-
-		if (i+1)%batchSize == 0 {
-			prog.Verbose("  inserted %d/%d edges", i+1, len(edges))
-		}
-	}
-
-	prog.Log("Inserted %d edges", len(edges))
-	return nil
-}
-
-func insertSources(conn *sqlite.Conn, sources map[string]string, prog *Progress) error {
-	stmt, err := conn.Prepare(`INSERT OR IGNORE INTO sources (file, content, package) VALUES (?, ?, ?)`)
-	if err != nil {
-		return fmt.Errorf("prepare source insert: %w", err)
-	}
-	defer func() { _ = stmt.Finalize() }()
-
-	for file, content := range sources {
-		stmt.BindText(1, file)
-		stmt.BindText(2, content)
-		// Extract package from file path: first directory component
-		pkg := extractPkgFromPath(file)
-		bindTextOrNull(stmt, 3, pkg)
-
-		if _, err := stmt.Step(); err != nil {
-			return fmt.Errorf("insert source %s: %w", file, err)
-		}
-		_ = stmt.Reset()
-	}
-
-	prog.Log("Inserted %d source files", len(sources))
-	return nil
-}
-
-func insertMetrics(conn *sqlite.Conn, metrics map[string]*Metrics, prog *Progress) error {
-	stmt, err := conn.Prepare(`INSERT OR IGNORE INTO metrics (function_id, cyclomatic_complexity, fan_in, fan_out, loc, num_params) VALUES (?, ?, ?, ?, ?, ?)`)
-	if err != nil {
-		return fmt.Errorf("prepare metrics insert: %w", err)
-	}
-	defer func() { _ = stmt.Finalize() }()
-
-	for _, m := range metrics {
-		stmt.BindText(1, m.FunctionID)
-		stmt.BindInt64(2, int64(m.CyclomaticComplexity))
-		stmt.BindInt64(3, int64(m.FanIn))
-		stmt.BindInt64(4, int64(m.FanOut))
-		stmt.BindInt64(5, int64(m.LOC))
-		stmt.BindInt64(6, int64(m.NumParams))
-
-		if _, err := stmt.Step(); err != nil {
-			return fmt.Errorf("insert metric %s: %w", m.FunctionID, err)
-		}
-		_ = stmt.Reset()
-	}
-
-	prog.Log("Inserted %d function metrics", len(metrics))
-	return nil
-}
-
 func runValidation(conn *sqlite.Conn, prog *Progress) error {
 	prog.Log("Running validation queries...")
 
@@ -564,6 +396,9 @@ INSERT INTO sources_fts(sources_fts) VALUES('rebuild');
 
 // createSummaryStats builds pre-computed summary tables for viewer dashboards.
 func createSummaryStats(conn *sqlite.Conn) error {
+	if err := createPackageCompleteness(conn); err != nil {
+		return fmt.Errorf("package_completeness: %w", err)
+	}
 	ddl := `
 CREATE TABLE stats_node_kinds AS
   SELECT kind, COUNT(*) as count FROM nodes GROUP BY kind ORDER BY count DESC;
@@ -590,22 +425,35 @@ CREATE TABLE stats_overview AS
     (SELECT COUNT(DISTINCT package) FROM nodes WHERE package IS NOT NULL) as total_packages,
     (SELECT COUNT(*) FROM nodes WHERE kind='function') as total_functions,
     (SELECT COUNT(*) FROM nodes WHERE kind='type_decl') as total_types,
-    (SELECT COUNT(*) FROM metrics) as total_metrics;
+    (SELECT COUNT(*) FROM metrics) as total_metrics,
+    (SELECT COUNT(*) FROM diagnostics) as total_diagnostics,
+    (SELECT ROUND(AVG(completeness), 4) FROM package_completeness) as avg_completeness,
+    (SELECT MIN(completeness) FROM package_completeness) as min_completeness,
+    (SELECT COUNT(*) FROM package_completeness WHERE completeness < 1) as incomplete_packages;
+` + propertyTablesDDL + `
+INSERT INTO node_properties (node_id, key, value)
+  SELECT n.id, j.key, j.value
+  FROM nodes n, json_each(n.properties) j
+  WHERE n.properties IS NOT NULL AND n.properties != '';
 
--- Vertical node properties: extracted from JSON for fast indexed queries
+INSERT INTO edge_properties (source, target, edge_kind, key, value)
+  SELECT e.source, e.target, e.kind, j.key, j.value
+  FROM edges e, json_each(e.properties) j
+  WHERE e.properties IS NOT NULL AND e.properties != '';
+` + propertyIndexesDDL
+	return sqlitex.ExecuteScript(conn, ddl, nil)
+}
+
+// propertyTablesDDL creates the vertical property tables: node and edge
+// properties extracted from the JSON columns for fast indexed queries, plus
+// the node properties later stages add (taint roles, escape annotations).
+const propertyTablesDDL = `
 CREATE TABLE node_properties (
     node_id TEXT NOT NULL,
     key TEXT NOT NULL,
     value TEXT NOT NULL
 );
-INSERT INTO node_properties (node_id, key, value)
-  SELECT n.id, j.key, j.value
-  FROM nodes n, json_each(n.properties) j
-  WHERE n.properties IS NOT NULL AND n.properties != '';
-CREATE INDEX idx_node_props_key_value ON node_properties(key, value);
-CREATE INDEX idx_node_props_node ON node_properties(node_id);
 
--- Vertical edge properties
 CREATE TABLE edge_properties (
     source TEXT NOT NULL,
     target TEXT NOT NULL,
@@ -613,14 +461,14 @@ CREATE TABLE edge_properties (
     key TEXT NOT NULL,
     value TEXT NOT NULL
 );
-INSERT INTO edge_properties (source, target, edge_kind, key, value)
-  SELECT e.source, e.target, e.kind, j.key, j.value
-  FROM edges e, json_each(e.properties) j
-  WHERE e.properties IS NOT NULL AND e.properties != '';
+`
+
+// propertyIndexesDDL indexes the vertical property tables once filled.
+const propertyIndexesDDL = `
+CREATE INDEX idx_node_props_key_value ON node_properties(key, value);
+CREATE INDEX idx_node_props_node ON node_properties(node_id);
 CREATE INDEX idx_edge_props_key_value ON edge_properties(key, value);
 `
-	return sqlitex.ExecuteScript(conn, ddl, nil)
-}
 
 // createAnalysisViews creates SQL views and a queries table for program analysis.
 func createAnalysisViews(conn *sqlite.Conn) error {
@@ -1572,24 +1420,37 @@ JOIN nodes callee ON callee.id = cse.target
 JOIN taint_specs ts ON callee.package = ts.package AND callee.name = ts.func_name
 WHERE c.kind = 'call';
 
--- Findings: functions containing both sources and sinks
+-- Findings: functions containing both sources and sinks, with the
+-- categories listed in order
 INSERT INTO findings (category, severity, node_id, file, line, message, details)
 SELECT 'taint_hotspot', 'warning', fn.id, fn.file, fn.line,
-  fn.name || ' has taint source (' || GROUP_CONCAT(DISTINCT src_cat.value) || ') and sink (' || GROUP_CONCAT(DISTINCT sink_cat.value) || ')',
+  fn.name || ' has taint source (' || h.sources || ') and sink (' || h.sinks || ')',
   json_object('function', fn.name, 'package', fn.package,
-              'source_categories', GROUP_CONCAT(DISTINCT src_cat.value),
-              'sink_categories', GROUP_CONCAT(DISTINCT sink_cat.value))
-FROM node_properties src_role
-JOIN nodes src ON src.id = src_role.node_id
-JOIN node_properties src_cat ON src_cat.node_id = src.id AND src_cat.key = 'taint_category'
-JOIN nodes fn ON fn.id = src.parent_function
-JOIN nodes sink ON sink.parent_function = fn.id
-JOIN node_properties sink_role ON sink_role.node_id = sink.id
-  AND sink_role.key = 'taint_role' AND sink_role.value = 'sink'
-JOIN node_properties sink_cat ON sink_cat.node_id = sink.id AND sink_cat.key = 'taint_category'
-WHERE src_role.key = 'taint_role' AND src_role.value = 'source'
-  AND src.parent_function IS NOT NULL
-GROUP BY fn.id;
+              'source_categories', h.sources,
+              'sink_categories', h.sinks)
+FROM (
+  SELECT fn_id,
+    (SELECT GROUP_CONCAT(category) FROM (SELECT DISTINCT src_cat.value AS category
+       FROM nodes src
+       JOIN node_properties src_role ON src_role.node_id = src.id
+         AND src_role.key = 'taint_role' AND src_role.value = 'source'
+       JOIN node_properties src_cat ON src_cat.node_id = src.id AND src_cat.key = 'taint_category'
+       WHERE src.parent_function = fn_id ORDER BY 1)) AS sources,
+    (SELECT GROUP_CONCAT(category) FROM (SELECT DISTINCT sink_cat.value AS category
+       FROM nodes sink
+       JOIN node_properties sink_role ON sink_role.node_id = sink.id
+         AND sink_role.key = 'taint_role' AND sink_role.value = 'sink'
+       JOIN node_properties sink_cat ON sink_cat.node_id = sink.id AND sink_cat.key = 'taint_category'
+       WHERE sink.parent_function = fn_id ORDER BY 1)) AS sinks
+  FROM (SELECT DISTINCT src.parent_function AS fn_id
+        FROM node_properties src_role
+        JOIN nodes src ON src.id = src_role.node_id
+        JOIN node_properties src_cat ON src_cat.node_id = src.id AND src_cat.key = 'taint_category'
+        WHERE src_role.key = 'taint_role' AND src_role.value = 'source'
+          AND src.parent_function IS NOT NULL)
+) h
+JOIN nodes fn ON fn.id = h.fn_id
+WHERE h.sinks IS NOT NULL;
 `
 	return sqlitex.ExecuteScript(conn, ddl, nil)
 }
@@ -1667,7 +1528,8 @@ INSERT INTO schema_docs (category, name, description, example) VALUES
 ('edge_kind', 'branch_target', 'Branch statement→target label', NULL),
 ('edge_kind', 'error_wrap', 'Error wrapping: fmt.Errorf %%w or errors.Join → wrapped error', NULL),
 ('edge_kind', 'capture', 'Closure→captured variable from outer scope', NULL),
-('edge_kind', 'eog', 'Evaluation order: arg[i]→arg[i+1] within call', NULL);
+('edge_kind', 'eog', 'Evaluation order: arg[i]→arg[i+1] within call', NULL),
+('edge_kind', 'tests', 'Test function→production function it reaches through call edges (properties.depth = shortest call depth); needs -skip-tests=false', NULL);
 
 -- Node properties (on JSON properties column)
 INSERT INTO schema_docs (category, name, description, example) VALUES
@@ -1689,7 +1551,8 @@ INSERT INTO schema_docs (category, name, description, example) VALUES
 ('node_property', 'inlineable', 'Function can be inlined by compiler', 'true'),
 ('node_property', 'heap_escapes', 'Variable escapes to heap (GC pressure)', 'true/false'),
 ('node_property', 'taint_role', 'Security taint classification', 'source/sink/barrier/propagator'),
-('node_property', 'taint_category', 'Taint category detail', 'http_input, sql_injection');
+('node_property', 'taint_category', 'Taint category detail', 'http_input, sql_injection'),
+('node_property', 'test_kind', 'Function in a _test.go file that go test runs', 'test/benchmark/fuzz/example');
 
 -- Tables
 INSERT INTO schema_docs (category, name, description, example) VALUES
@@ -1705,7 +1568,16 @@ INSERT INTO schema_docs (category, name, description, example) VALUES
 ('table', 'edge_properties', 'Vertical edge property table', 'SELECT * FROM edge_properties WHERE key=''dynamic'''),
 ('table', 'stats_overview', 'Summary statistics for the entire CPG', 'SELECT * FROM stats_overview'),
 ('table', 'stats_packages', 'Per-package statistics', 'SELECT * FROM stats_packages ORDER BY functions DESC'),
-('table', 'sources_fts', 'FTS5 full-text search on source code', 'SELECT file FROM sources_fts WHERE content MATCH ''mutex''');
+('table', 'sources_fts', 'FTS5 full-text search on source code', 'SELECT file FROM sources_fts WHERE content MATCH ''mutex'''),
+('table', 'diagnostics', 'Where extraction lost information: load errors, SSA failures, SSA functions without AST nodes, unresolved DFG/param_in positions', 'SELECT kind, COUNT(*) FROM diagnostics GROUP BY kind'),
+('table', 'package_coverage', 'Per-package attempted/failed counts of the SSA match, DFG lookup and param_in lookup checks', 'SELECT * FROM package_coverage WHERE failed > 0'),
+('table', 'modules', 'Build list modules providing the loaded packages, with the selected version, replace directive and the package prefix of analyzed modules', 'SELECT * FROM modules WHERE prefix IS NOT NULL'),
+('table', 'module_requires', 'Require directives of each module''s go.mod: the module graph behind the build list', 'SELECT requires, version FROM module_requires WHERE module = :module AND indirect = 0'),
+('table', 'cpg_meta', 'Provenance of the database: schema_version, generator_version, go_version, generated_at, flags, config, modules (JSON with each module''s commit and dirty state) and content_hash (SHA-256 of all rows except cpg_meta and pipeline timings, independent of row order); PRAGMA user_version also holds the schema version', 'SELECT key, value FROM cpg_meta'),
+('table', 'build_configs', 'Build configurations (-build goos/goarch[,tag=...]) the graph was extracted under; empty for a host-only build', 'SELECT * FROM build_configs ORDER BY seq'),
+('table', 'node_configs', 'Build configurations each extracted node appears in', 'SELECT config FROM node_configs WHERE node_id = :node_id'),
+('table', 'edge_configs', 'Build configurations each extracted edge appears in (derived edges such as eog are not listed)', 'SELECT config FROM edge_configs WHERE source = :source AND target = :target AND kind = ''call'''),
+('table', 'package_completeness', 'Per-package completeness score (0-1) derived from diagnostics and package_coverage', 'SELECT package, completeness FROM package_completeness WHERE completeness < 1');
 
 -- Views
 INSERT INTO schema_docs (category, name, description, example) VALUES
@@ -1721,6 +1593,8 @@ INSERT INTO schema_docs (category, name, description, example) VALUES
 ('view', 'v_error_handling', 'Error-returning functions with metrics', NULL),
 ('view', 'v_package_stability', 'Package stability metrics: afferent/efferent coupling, instability index, abstractness', NULL),
 ('view', 'v_control_flow_profile', 'Control flow breakdown per function: if/for/switch/select/return/defer/go counts', NULL),
+('view', 'v_config_specific_calls', 'Call edges missing from at least one build configuration (platform- or tag-specific calls)', 'SELECT * FROM v_config_specific_calls WHERE configs LIKE ''%windows%'''),
+('view', 'v_untested_functions', 'Production functions no test reaches (no incoming tests edge), ranked by hotspot score', 'SELECT * FROM v_untested_functions LIMIT 20'),
 ('finding', 'risk_score', 'Composite bug-risk score combining complexity, LOC, fan-in, fan-out', NULL),
 ('finding', 'dead_code', 'Internal functions with zero callers (unreachable code)', NULL),
 ('finding', 'interface_bloat', 'Interfaces with 5+ methods (Go idiom prefers small interfaces)', NULL),
@@ -1786,7 +1660,9 @@ INSERT INTO schema_docs (category, name, description, example) VALUES
 ('query', 'symbol_search', 'Search symbols by name (supports LIKE patterns)', NULL),
 ('query', 'file_outline_query', 'Get hierarchical outline of a file', NULL),
 ('query', 'xref_lookup', 'Find all usages of a symbol', NULL),
-('query', 'go_patterns', 'Go-specific construct usage per package', NULL);
+('query', 'go_patterns', 'Go-specific construct usage per package', NULL),
+('table', 'pipeline_runs', 'Per-stage outcome of the SQL pipeline: status, wall time, rows produced and error', 'SELECT stage, wall_ms, rows FROM pipeline_runs ORDER BY wall_ms DESC LIMIT 10'),
+('table', 'pipeline_checkpoints', 'Extraction state and completed SQL stages used by -resume', 'SELECT name FROM pipeline_checkpoints');
 
 CREATE INDEX idx_schema_docs_cat ON schema_docs(category);
 `
@@ -1896,7 +1772,7 @@ INSERT INTO findings (category, severity, node_id, file, line, message, details)
     2.0 * CAST(m.loc AS REAL) / MAX(maxes.max_loc, 1) +
     1.0 * CAST(m.fan_in AS REAL) / MAX(maxes.max_fi, 1) +
     1.0 * CAST(m.fan_out AS REAL) / MAX(maxes.max_fo, 1)
-  ) DESC
+  ) DESC, m.function_id
   LIMIT 200;
 
 -- Dead code: internal functions with zero callers that aren't entry points
@@ -2464,11 +2340,11 @@ CREATE TABLE error_chains (
 	// Top functions by complexity
 	if err := sqlitex.ExecuteTransient(conn, `
 INSERT INTO dashboard_top_functions
-  SELECT 'complexity', ROW_NUMBER() OVER (ORDER BY m.cyclomatic_complexity DESC), m.function_id,
+  SELECT 'complexity', ROW_NUMBER() OVER (ORDER BY m.cyclomatic_complexity DESC, m.function_id), m.function_id,
     n.name, n.package, n.file, m.cyclomatic_complexity
   FROM metrics m JOIN nodes n ON n.id = m.function_id
   WHERE m.cyclomatic_complexity > 0
-  ORDER BY m.cyclomatic_complexity DESC LIMIT 50`,
+  ORDER BY m.cyclomatic_complexity DESC, m.function_id LIMIT 50`,
 		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error { return nil }}); err != nil {
 		return fmt.Errorf("top complexity: %w", err)
 	}
@@ -2476,11 +2352,11 @@ INSERT INTO dashboard_top_functions
 	// Top by LOC
 	if err := sqlitex.ExecuteTransient(conn, `
 INSERT INTO dashboard_top_functions
-  SELECT 'loc', ROW_NUMBER() OVER (ORDER BY m.loc DESC), m.function_id,
+  SELECT 'loc', ROW_NUMBER() OVER (ORDER BY m.loc DESC, m.function_id), m.function_id,
     n.name, n.package, n.file, m.loc
   FROM metrics m JOIN nodes n ON n.id = m.function_id
   WHERE m.loc > 0
-  ORDER BY m.loc DESC LIMIT 50`,
+  ORDER BY m.loc DESC, m.function_id LIMIT 50`,
 		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error { return nil }}); err != nil {
 		return fmt.Errorf("top loc: %w", err)
 	}
@@ -2488,11 +2364,11 @@ INSERT INTO dashboard_top_functions
 	// Top by fan-in (most called)
 	if err := sqlitex.ExecuteTransient(conn, `
 INSERT INTO dashboard_top_functions
-  SELECT 'fan_in', ROW_NUMBER() OVER (ORDER BY m.fan_in DESC), m.function_id,
+  SELECT 'fan_in', ROW_NUMBER() OVER (ORDER BY m.fan_in DESC, m.function_id), m.function_id,
     n.name, n.package, n.file, m.fan_in
   FROM metrics m JOIN nodes n ON n.id = m.function_id
   WHERE m.fan_in > 0
-  ORDER BY m.fan_in DESC LIMIT 50`,
+  ORDER BY m.fan_in DESC, m.function_id LIMIT 50`,
 		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error { return nil }}); err != nil {
 		return fmt.Errorf("top fan_in: %w", err)
 	}
@@ -2500,11 +2376,11 @@ INSERT INTO dashboard_top_functions
 	// Top by fan-out (calls the most)
 	if err := sqlitex.ExecuteTransient(conn, `
 INSERT INTO dashboard_top_functions
-  SELECT 'fan_out', ROW_NUMBER() OVER (ORDER BY m.fan_out DESC), m.function_id,
+  SELECT 'fan_out', ROW_NUMBER() OVER (ORDER BY m.fan_out DESC, m.function_id), m.function_id,
     n.name, n.package, n.file, m.fan_out
   FROM metrics m JOIN nodes n ON n.id = m.function_id
   WHERE m.fan_out > 0
-  ORDER BY m.fan_out DESC LIMIT 50`,
+  ORDER BY m.fan_out DESC, m.function_id LIMIT 50`,
 		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error { return nil }}); err != nil {
 		return fmt.Errorf("top fan_out: %w", err)
 	}
@@ -2526,7 +2402,7 @@ INSERT INTO dashboard_hotspots
   JOIN nodes n ON n.id = m.function_id
   LEFT JOIN (SELECT node_id, COUNT(*) AS cnt FROM findings GROUP BY node_id) fc ON fc.node_id = m.function_id
   WHERE m.cyclomatic_complexity > 0
-  ORDER BY 10 DESC LIMIT 200`,
+  ORDER BY 10 DESC, 1 LIMIT 200`,
 		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error { return nil }}); err != nil {
 		return fmt.Errorf("hotspots: %w", err)
 	}
@@ -2736,15 +2612,14 @@ INSERT INTO dashboard_file_heatmap
 		return fmt.Errorf("file heatmap: %w", err)
 	}
 
-	// Package dependency graph (filtered to Prometheus-internal packages only)
+	// Package dependency graph (filtered to packages of analyzed modules only;
+	// external stubs keep their full import path and have no package node)
 	if err := sqlitex.ExecuteTransient(conn, `
 INSERT INTO dashboard_package_graph
   SELECT source_package, target_package, call_count
   FROM package_coupling
-  WHERE source_package NOT LIKE 'github.com/%'
-    AND target_package NOT LIKE 'github.com/%'
-    AND source_package NOT LIKE 'golang.org/%'
-    AND target_package NOT LIKE 'golang.org/%'
+  WHERE source_package IN (SELECT package FROM nodes WHERE kind = 'package')
+    AND target_package IN (SELECT package FROM nodes WHERE kind = 'package')
     AND call_count >= 2`,
 		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error { return nil }}); err != nil {
 		return fmt.Errorf("package graph: %w", err)
@@ -2765,12 +2640,14 @@ INSERT INTO dashboard_function_detail
     (SELECT COUNT(*) FROM nodes b WHERE b.kind IN ('if','for','switch','select') AND b.parent_function = n.id),
     (SELECT COUNT(*) FROM nodes r WHERE r.kind = 'return' AND r.parent_function = n.id),
     COALESCE((SELECT COUNT(*) FROM findings fi WHERE fi.node_id = n.id), 0),
-    (SELECT GROUP_CONCAT(DISTINCT caller.name)
+    (SELECT GROUP_CONCAT(name) FROM (SELECT DISTINCT caller.name
      FROM edges ce JOIN nodes caller ON caller.id = ce.source
-     WHERE ce.target = n.id AND ce.kind = 'call' AND caller.kind = 'function'),
-    (SELECT GROUP_CONCAT(DISTINCT callee.name)
+     WHERE ce.target = n.id AND ce.kind = 'call' AND caller.kind = 'function'
+     ORDER BY caller.name)),
+    (SELECT GROUP_CONCAT(name) FROM (SELECT DISTINCT callee.name
      FROM edges ce JOIN nodes callee ON callee.id = ce.target
-     WHERE ce.source = n.id AND ce.kind = 'call' AND callee.kind = 'function')
+     WHERE ce.source = n.id AND ce.kind = 'call' AND callee.kind = 'function'
+     ORDER BY callee.name))
   FROM nodes n
   LEFT JOIN metrics m ON m.function_id = n.id
   WHERE n.kind = 'function'`,
@@ -3439,8 +3316,37 @@ INSERT INTO queries (name, description, sql) VALUES
 }
 
 // createSCIPSymbols generates SCIP (Source Code Intelligence Protocol) compatible
-// symbol identifiers for cross-repository code navigation.
-func createSCIPSymbols(conn *sqlite.Conn, prog *Progress) error {
+// symbol identifiers for cross-repository code navigation. Each node is scoped
+// to the module that owns its package, so the gomod segment names the real
+// module path rather than assuming a single repository; dependency modules
+// carry their pinned version instead of v0.
+func createSCIPSymbols(conn *sqlite.Conn, modules []ModuleInfo, prog *Progress) error {
+	// Module prefix → module path, for resolving which module owns a package
+	if err := sqlitex.ExecuteTransient(conn,
+		`CREATE TEMP TABLE scip_modules (prefix TEXT PRIMARY KEY, mod_path TEXT NOT NULL, version TEXT NOT NULL)`,
+		nil); err != nil {
+		return fmt.Errorf("scip modules: %w", err)
+	}
+	stmt, err := conn.Prepare(`INSERT OR IGNORE INTO scip_modules (prefix, mod_path, version) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	for _, m := range modules {
+		version := "v0"
+		if m.Dep && m.Version != "" {
+			version = m.Version
+		}
+		stmt.BindText(1, m.Prefix)
+		stmt.BindText(2, m.ModPath)
+		stmt.BindText(3, version)
+		if _, err := stmt.Step(); err != nil {
+			_ = stmt.Finalize()
+			return fmt.Errorf("scip modules: %w", err)
+		}
+		_ = stmt.Reset()
+	}
+	_ = stmt.Finalize()
+
 	ddl := `
 CREATE TABLE scip_symbols (
     node_id TEXT PRIMARY KEY,
@@ -3450,50 +3356,72 @@ CREATE TABLE scip_symbols (
     display_name TEXT
 );
 
--- Functions: scip-go gomod github.com/prometheus/prometheus v0 package/name().
+-- Owning module per node: longest matching non-empty prefix, else the primary module.
+-- scope = "<mod_path> <version> <pkg-within-module>/" with '/' in the package path mapped to '.'
+CREATE TEMP TABLE scip_scope AS
+SELECT n.id AS node_id,
+  COALESCE(m.mod_path, (SELECT mod_path FROM scip_modules WHERE prefix = '')) || ' ' ||
+  COALESCE(m.version, 'v0') || ' ' ||
+  CASE
+    WHEN m.prefix IS NULL THEN REPLACE(n.package, '/', '.') || '/'
+    WHEN n.package = m.prefix THEN ''
+    ELSE REPLACE(SUBSTR(n.package, LENGTH(m.prefix) + 2), '/', '.') || '/'
+  END AS scope
+FROM nodes n
+LEFT JOIN scip_modules m ON m.prefix = (
+  SELECT sm.prefix FROM scip_modules sm
+  WHERE sm.prefix != '' AND (n.package = sm.prefix OR n.package LIKE sm.prefix || '/%')
+  ORDER BY LENGTH(sm.prefix) DESC LIMIT 1
+)
+WHERE n.kind IN ('function', 'type_decl', 'package') AND n.package IS NOT NULL;
+
+-- Functions: scip-go gomod <module> v0 package/name().
 INSERT INTO scip_symbols (node_id, scip_id, kind, package, display_name)
 SELECT n.id,
-  'scip-go gomod github.com/prometheus/prometheus v0 ' ||
-  REPLACE(n.package, '/', '.') || '/' || n.name || '().',
+  'scip-go gomod ' || sc.scope || n.name || '().',
   'function', n.package, n.name
 FROM nodes n
+JOIN scip_scope sc ON sc.node_id = n.id
 WHERE n.kind = 'function'
   AND n.name NOT LIKE '%.%'
   AND n.package IS NOT NULL AND n.name != '';
 
--- Methods: scip-go gomod github.com/prometheus/prometheus v0 package/Type#Method().
+-- Methods: scip-go gomod <module> v0 package/Type#Method().
 INSERT INTO scip_symbols (node_id, scip_id, kind, package, display_name)
 SELECT n.id,
-  'scip-go gomod github.com/prometheus/prometheus v0 ' ||
-  REPLACE(n.package, '/', '.') || '/' ||
+  'scip-go gomod ' || sc.scope ||
   REPLACE(REPLACE(SUBSTR(n.name, 1, INSTR(n.name, '.') - 1), '(*', ''), ')', '') ||
   '#' || SUBSTR(n.name, INSTR(n.name, '.') + 1) || '().',
   'method', n.package, n.name
 FROM nodes n
+JOIN scip_scope sc ON sc.node_id = n.id
 WHERE n.kind = 'function'
   AND n.name LIKE '%.%'
   AND n.package IS NOT NULL;
 
--- Types: scip-go gomod github.com/prometheus/prometheus v0 package/TypeName#
+-- Types: scip-go gomod <module> v0 package/TypeName#
 INSERT OR IGNORE INTO scip_symbols (node_id, scip_id, kind, package, display_name)
 SELECT n.id,
-  'scip-go gomod github.com/prometheus/prometheus v0 ' ||
-  REPLACE(n.package, '/', '.') || '/' || n.name || '#',
+  'scip-go gomod ' || sc.scope || n.name || '#',
   'type', n.package, n.name
 FROM nodes n
+JOIN scip_scope sc ON sc.node_id = n.id
 WHERE n.kind = 'type_decl'
   AND n.package IS NOT NULL AND n.name != '';
 
--- Packages: scip-go gomod github.com/prometheus/prometheus v0 package/
+-- Packages: scip-go gomod <module> v0 package/
 INSERT OR IGNORE INTO scip_symbols (node_id, scip_id, kind, package, display_name)
 SELECT n.id,
-  'scip-go gomod github.com/prometheus/prometheus v0 ' ||
-  REPLACE(n.package, '/', '.') || '/',
+  'scip-go gomod ' || sc.scope,
   'package', n.package, n.name
 FROM nodes n
+JOIN scip_scope sc ON sc.node_id = n.id
 WHERE n.kind = 'package'
   AND n.package IS NOT NULL;
 
+DROP TABLE scip_scope;
+DROP TABLE scip_modules;
+
 CREATE INDEX idx_scip_kind ON scip_symbols(kind);
 CREATE INDEX idx_scip_pkg ON scip_symbols(package);
 
@@ -3526,10 +3454,16 @@ INSERT INTO queries (name, description, sql) VALUES
 	return nil
 }
 
+// prometheusModPath is the module the communication protocols are written
+// for.
+const prometheusModPath = "github.com/prometheus/prometheus"
+
 // createCommunicationPatterns builds Honda session type-inspired protocol
 // analysis connecting Prometheus with its ecosystem services (adapter, alertmanager, etc.).
 // Inspired by Honda 1998 (binary session types) and Honda 2008 (multiparty asynchronous session types).
-func createCommunicationPatterns(conn *sqlite.Conn, prog *Progress) error {
+// The protocol model is only seeded when the primary module modPath is
+// Prometheus; other modules get their signal channels alone.
+func createCommunicationPatterns(conn *sqlite.Conn, modPath string, prog *Progress) error {
 	ddl := `
 -- ═══════════════════════════════════════════════════════════════════
 -- Communication Patterns — Honda Session Type Analysis
@@ -3634,7 +3568,13 @@ CREATE TABLE comm_graph (
     label TEXT,
     PRIMARY KEY (source_component, target_component, protocol_id)
 );
+`
 
+	// The protocols, their participants and endpoints, the channel patterns
+	// and the causality edges below describe Prometheus and the services
+	// around it, so they are only seeded when Prometheus is the primary
+	// module.
+	seed := `
 -- ═══════════════════════════════════════════════════════════════════
 -- Protocol Definitions
 -- ═══════════════════════════════════════════════════════════════════
@@ -4082,14 +4022,6 @@ FROM nodes p
 WHERE p.kind = 'select' AND p.package IN ('scrape', 'notifier', 'rules')
 GROUP BY p.package;
 
--- Detect signal channels (chan struct{} used for cancellation/shutdown)
-INSERT INTO comm_channel_patterns (component, pattern, channel_type, sender_package, description)
-SELECT 'prometheus', 'signal', 'chan struct{}',
-       n.package, 'Shutdown/cancellation signal in ' || n.package
-FROM nodes n
-WHERE n.kind = 'send' AND n.package NOT LIKE 'github.com%'
-GROUP BY n.package;
-
 -- Pipeline pattern: scrape → storage → remote_write
 INSERT INTO comm_channel_patterns (component, pattern, session_type, description) VALUES
 ('prometheus', 'pipeline',
@@ -4114,6 +4046,7 @@ SELECT e1.id, e2.id, 'IO', 'adapter_series',
 FROM comm_endpoints e1, comm_endpoints e2
 WHERE e1.protocol_id = 'adapter_series' AND e1.component = 'adapter'
   AND e2.protocol_id IN ('adapter_query', 'adapter_query_range') AND e2.component = 'adapter'
+ORDER BY e1.id, e2.id
 LIMIT 3;
 
 -- OO causality: Prometheus sends alerts in order (same channel, same sender)
@@ -4123,6 +4056,7 @@ SELECT e1.id, e2.id, 'OO', 'alertmanager_notify',
 FROM comm_endpoints e1, comm_endpoints e2
 WHERE e1.protocol_id = 'alertmanager_notify' AND e1.function_name LIKE '%sendAll%'
   AND e2.protocol_id = 'alertmanager_notify' AND e2.function_name LIKE '%sendOne%'
+ORDER BY e1.id, e2.id
 LIMIT 1;
 
 -- II causality: Prometheus receives discovery updates, must process in order per provider
@@ -4132,8 +4066,22 @@ SELECT e1.id, e2.id, 'II', 'discovery',
 FROM comm_endpoints e1, comm_endpoints e2
 WHERE e1.protocol_id = 'discovery' AND e2.protocol_id = 'scrape'
   AND e1.role = 'client' AND e2.role = 'client'
+ORDER BY e1.id, e2.id
 LIMIT 3;
+`
 
+	// Signal channels (chan struct{} used for cancellation/shutdown) of the
+	// analyzed packages, external stubs aside, whatever the module.
+	signals := `
+INSERT INTO comm_channel_patterns (component, pattern, channel_type, sender_package, description)
+SELECT ?, 'signal', 'chan struct{}',
+       n.package, 'Shutdown/cancellation signal in ' || n.package
+FROM nodes n
+WHERE n.kind = 'send' AND n.id NOT LIKE 'ext::%'
+GROUP BY n.package
+ORDER BY n.package;`
+
+	analysis := `
 -- ═══════════════════════════════════════════════════════════════════
 -- Protocol Conformance Checks
 -- ═══════════════════════════════════════════════════════════════════
@@ -4314,12 +4262,23 @@ INSERT INTO queries (name, description, sql) VALUES
 ('comm_deadlock_check', 'Check for cycles in causality graph (potential deadlocks per Honda 2008)',
  'SELECT c1.kind || '' → '' || c2.kind AS causality_chain, c1.description, c2.description FROM comm_causality c1 JOIN comm_causality c2 ON c1.target_endpoint = c2.source_endpoint WHERE c1.source_endpoint != c2.target_endpoint'),
 
-('comm_channel_patterns', 'Internal channel communication patterns within Prometheus',
+('comm_channel_patterns', 'Internal channel communication patterns of the analyzed modules',
  'SELECT pattern, channel_type, sender_package, receiver_package, goroutine_count, description FROM comm_channel_patterns ORDER BY pattern');
 `
 	if err := sqlitex.ExecuteScript(conn, ddl, nil); err != nil {
 		return fmt.Errorf("communication patterns: %w", err)
 	}
+	if modPath == prometheusModPath {
+		if err := sqlitex.ExecuteScript(conn, seed, nil); err != nil {
+			return fmt.Errorf("communication patterns: %w", err)
+		}
+	}
+	if err := sqlitex.Execute(conn, signals, &sqlitex.ExecOptions{Args: []any{path.Base(modPath)}}); err != nil {
+		return fmt.Errorf("communication patterns: %w", err)
+	}
+	if err := sqlitex.ExecuteScript(conn, analysis, nil); err != nil {
+		return fmt.Errorf("communication patterns: %w", err)
+	}
 
 	// Count results
 	var protocols, endpoints, causality, channelPatterns int
@@ -4490,8 +4449,9 @@ FROM comm_participants p
 JOIN comm_protocols proto ON proto.id = p.protocol_id
 LEFT JOIN (
     SELECT protocol_id, component, COUNT(*) as cnt,
-           GROUP_CONCAT(DISTINCT package) as packages
-    FROM comm_endpoints
+           (SELECT GROUP_CONCAT(package) FROM (SELECT DISTINCT e2.package FROM comm_endpoints e2
+             WHERE e2.protocol_id = e.protocol_id AND e2.component = e.component ORDER BY 1)) as packages
+    FROM comm_endpoints e
     GROUP BY protocol_id, component
 ) ep ON ep.protocol_id = p.protocol_id AND ep.component = p.component;
 
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// resolveDep locates dependency modPath at the version pinned by the first
+// of dirs (the workspace module roots, primary first) whose go.mod requires
+// it, honoring that go.mod's replace directives. The copy vendored in that
+// module's vendor directory is preferred, then the module cache. Nothing is
+// downloaded: a dependency found in neither is an error.
+func resolveDep(modPath string, dirs []string) (ModuleInfo, error) {
+	for _, dir := range dirs {
+		gomod := filepath.Join(dir, "go.mod")
+		data, err := os.ReadFile(gomod)
+		if err != nil {
+			return ModuleInfo{}, fmt.Errorf("read %s: %w", gomod, err)
+		}
+		f, err := modfile.Parse(gomod, data, nil)
+		if err != nil {
+			return ModuleInfo{}, err
+		}
+		var pinned module.Version
+		for _, r := range f.Require {
+			if r.Mod.Path == modPath {
+				pinned = r.Mod
+				break
+			}
+		}
+		if pinned.Path == "" {
+			continue
+		}
+
+		target := pinned
+		for _, r := range f.Replace {
+			if r.Old.Path == modPath && (r.Old.Version == "" || r.Old.Version == pinned.Version) {
+				target = r.New
+				break
+			}
+		}
+		m := ModuleInfo{ModPath: modPath, Version: pinned.Version, Dep: true}
+		if target.Version == "" {
+			// Replaced by a local directory
+			m.Dir = target.Path
+			if !filepath.IsAbs(m.Dir) {
+				m.Dir = filepath.Join(dir, m.Dir)
+			}
+			if err := checkDir(m.Dir); err != nil {
+				return ModuleInfo{}, fmt.Errorf("%s: replacement: %w", modPath, err)
+			}
+			return m, nil
+		}
+		if vendored(dir, modPath) {
+			m.Dir = filepath.Join(dir, "vendor", filepath.FromSlash(modPath))
+			return m, nil
+		}
+
+		cache, err := goModCache()
+		if err != nil {
+			return ModuleInfo{}, fmt.Errorf("%s: %w", modPath, err)
+		}
+		escPath, err := module.EscapePath(target.Path)
+		if err != nil {
+			return ModuleInfo{}, err
+		}
+		escVersion, err := module.EscapeVersion(target.Version)
+		if err != nil {
+			return ModuleInfo{}, err
+		}
+		m.Dir = filepath.Join(cache, filepath.FromSlash(escPath+"@"+escVersion))
+		if err := checkDir(m.Dir); err != nil {
+			return ModuleInfo{}, fmt.Errorf("%s@%s is not in the module cache (run go mod download %s@%s): %w",
+				target.Path, target.Version, target.Path, target.Version, err)
+		}
+		return m, nil
+	}
+	return ModuleInfo{}, fmt.Errorf("%s is not required by any module's go.mod", modPath)
+}
+
+// vendored reports whether dir/vendor/modules.txt lists modPath.
+func vendored(dir, modPath string) bool {
+	f, err := os.Open(filepath.Join(dir, "vendor", "modules.txt"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// "# <module> <version>" heads each module's package list
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 3 && fields[0] == "#" && fields[1] == modPath {
+			return true
+		}
+	}
+	return false
+}
+
+// goModCache returns the module cache directory.
+func goModCache() (string, error) {
+	dir, err := goEnv("GOMODCACHE")
+	if err != nil {
+		return "", err
+	}
+	if dir == "" {
+		return "", fmt.Errorf("go env GOMODCACHE: empty")
+	}
+	return dir, nil
+}
+
+// goEnv returns the go environment variable key, asking the go command
+// (which also reads go env -w settings) when it is not set in the
+// environment.
+func goEnv(key string) (string, error) {
+	if v := os.Getenv(key); v != "" {
+		return v, nil
+	}
+	out, err := exec.Command("go", "env", key).Output()
+	if err != nil {
+		return "", fmt.Errorf("go env %s: %w", key, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// depPrefix picks the node ID prefix for a dependency: the last element of
+// its path without the major version suffix ("common" for
+// github.com/prometheus/common, "yaml" for gopkg.in/yaml.v3), widened to the
+// last two elements joined by "_" if that is already taken.
+func depPrefix(modPath string, taken map[string]bool) (string, error) {
+	base, _, ok := module.SplitPathVersion(modPath)
+	if !ok {
+		base = modPath
+	}
+	prefix := path.Base(base)
+	if taken[prefix] {
+		prefix = path.Base(path.Dir(base)) + "_" + prefix
+	}
+	if taken[prefix] || strings.ContainsAny(prefix, ":@") {
+		return "", fmt.Errorf("%s: no free prefix (tried %q)", modPath, prefix)
+	}
+	return prefix, nil
+}
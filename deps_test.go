@@ -0,0 +1,145 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDepPrefix(t *testing.T) {
+	tests := []struct {
+		modPath string
+		taken   []string
+		want    string
+		wantErr bool
+	}{
+		{modPath: "github.com/prometheus/common", want: "common"},
+		{modPath: "gopkg.in/yaml.v3", want: "yaml"},
+		{modPath: "github.com/prometheus/client_golang/v2", want: "client_golang"},
+		{modPath: "github.com/prometheus/common", taken: []string{"common"}, want: "prometheus_common"},
+		{modPath: "gopkg.in/yaml.v3", taken: []string{"yaml"}, want: "gopkg.in_yaml"},
+		{modPath: "github.com/prometheus/common", taken: []string{"common", "prometheus_common"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.modPath, func(t *testing.T) {
+			taken := make(map[string]bool)
+			for _, p := range tt.taken {
+				taken[p] = true
+			}
+			got, err := depPrefix(tt.modPath, taken)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("depPrefix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("depPrefix() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// writeFiles writes the files, relative to dir, creating their directories.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResolveDep(t *testing.T) {
+	root := t.TempDir()
+	cache := filepath.Join(root, "modcache")
+	t.Setenv("GOMODCACHE", cache)
+	writeFiles(t, root, map[string]string{
+		// module cache copies; upper case letters are escaped as !x
+		"modcache/example.com/cached@v1.2.0/go.mod":   "module example.com/cached\n",
+		"modcache/example.com/!fork@v1.3.0/go.mod":    "module example.com/Fork\n",
+		"modcache/example.com/pinned@v1.0.0/go.mod":   "module example.com/pinned\n",
+		"modcache/example.com/vendored@v0.5.0/go.mod": "module example.com/vendored\n",
+		"modcache/example.com/toolonly@v0.1.0/go.mod": "module example.com/toolonly\n",
+
+		"local/go.mod":                         "module example.com/local\n",
+		"app/vendor/modules.txt":               "# example.com/vendored v0.5.0\n## explicit\nexample.com/vendored\n",
+		"app/vendor/example.com/vendored/v.go": "package vendored\n",
+		"tool/go.mod":                          "module example.com/tool\n\nrequire example.com/toolonly v0.1.0\n",
+		"app/go.mod": `module example.com/app
+
+require (
+	example.com/cached v1.2.0
+	example.com/forked v1.1.0
+	example.com/local v0.0.0
+	example.com/missing v0.0.0
+	example.com/pinned v1.0.0
+	example.com/uncached v1.9.9
+	example.com/vendored v0.5.0
+)
+
+replace example.com/local => ../local
+
+replace example.com/missing => ../missing
+
+replace example.com/forked => example.com/Fork v1.3.0
+
+replace example.com/pinned v0.9.0 => ../local
+`,
+	})
+	app, tool := filepath.Join(root, "app"), filepath.Join(root, "tool")
+
+	tests := []struct {
+		modPath string
+		want    ModuleInfo
+		wantErr string
+	}{
+		{
+			modPath: "example.com/cached",
+			want:    ModuleInfo{ModPath: "example.com/cached", Dir: filepath.Join(cache, "example.com", "cached@v1.2.0"), Version: "v1.2.0", Dep: true},
+		},
+		{
+			modPath: "example.com/local",
+			want:    ModuleInfo{ModPath: "example.com/local", Dir: filepath.Join(root, "local"), Version: "v0.0.0", Dep: true},
+		},
+		{
+			modPath: "example.com/forked",
+			want:    ModuleInfo{ModPath: "example.com/forked", Dir: filepath.Join(cache, "example.com", "!fork@v1.3.0"), Version: "v1.1.0", Dep: true},
+		},
+		{
+			// the replace only applies to v0.9.0
+			modPath: "example.com/pinned",
+			want:    ModuleInfo{ModPath: "example.com/pinned", Dir: filepath.Join(cache, "example.com", "pinned@v1.0.0"), Version: "v1.0.0", Dep: true},
+		},
+		{
+			modPath: "example.com/vendored",
+			want:    ModuleInfo{ModPath: "example.com/vendored", Dir: filepath.Join(app, "vendor", "example.com", "vendored"), Version: "v0.5.0", Dep: true},
+		},
+		{
+			modPath: "example.com/toolonly",
+			want:    ModuleInfo{ModPath: "example.com/toolonly", Dir: filepath.Join(cache, "example.com", "toolonly@v0.1.0"), Version: "v0.1.0", Dep: true},
+		},
+		{modPath: "example.com/missing", wantErr: "replacement"},
+		{modPath: "example.com/uncached", wantErr: "not in the module cache"},
+		{modPath: "example.com/unknown", wantErr: "not required by any module"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.modPath, func(t *testing.T) {
+			got, err := resolveDep(tt.modPath, []string{app, tool})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveDep() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveDep() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("resolveDep() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
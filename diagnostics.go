@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+	"golang.org/x/tools/go/ssa"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Diagnostic records a place where extraction lost information: a package
+// that failed to load or to build as SSA, an SSA function with no AST node,
+// or an SSA position posLookup could not resolve to a node. Without them a
+// missing edge cannot be told apart from code that has none.
+type Diagnostic struct {
+	Package   string // relative import path
+	Phase     string // load, ssa, cfg, dfg or call
+	Kind      string // one of the diag* constants
+	File      string // relative to repo root, "" when unknown
+	Line, Col int
+	Symbol    string // SSA function or value involved, if any
+	Message   string
+}
+
+// Diagnostic kinds.
+const (
+	diagLoadError       = "load_error"       // packages.Load or type-check error
+	diagSSAFailure      = "ssa_failure"      // package skipped by SSA construction
+	diagSSAUnmatched    = "ssa_unmatched"    // SSA function with no AST function node
+	diagUnresolvedDef   = "unresolved_def"   // DFG definition position with no node
+	diagUnresolvedUse   = "unresolved_use"   // DFG use position with no node
+	diagUnresolvedArg   = "unresolved_arg"   // param_in argument position with no node
+	diagUnresolvedParam = "unresolved_param" // param_in parameter position with no node
+)
+
+// Coverage counts, for one package, how many items a check attempted and how
+// many of them failed. Counts from several calls with the same package and
+// check add up; package_completeness derives its score from the totals.
+type Coverage struct {
+	Package string
+	Check   string // one of the cov* constants
+	Total   int
+	Failed  int
+}
+
+// Coverage checks.
+const (
+	covSSAMatch      = "ssa_match"       // SSA functions matched to an AST function node
+	covDFGLookup     = "dfg_lookup"      // DFG def/use positions resolved to a node
+	covParamInLookup = "param_in_lookup" // param_in argument/parameter positions resolved to a node
+)
+
+type coverageKey struct{ pkg, check string }
+
+// sortedCoverage returns the counters of m ordered by package and check.
+func sortedCoverage(m map[coverageKey]*Coverage) []*Coverage {
+	keys := make([]coverageKey, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pkg != keys[j].pkg {
+			return keys[i].pkg < keys[j].pkg
+		}
+		return keys[i].check < keys[j].check
+	})
+	out := make([]*Coverage, len(keys))
+	for i, k := range keys {
+		out[i] = m[k]
+	}
+	return out
+}
+
+// ssaFuncPkg returns the relative import path of fn's package, or "" for
+// functions without one.
+func ssaFuncPkg(fn *ssa.Function) string {
+	if fn.Pkg == nil {
+		return ""
+	}
+	return modSet.RelPkg(fn.Pkg.Pkg.Path())
+}
+
+// loadDiagnostics converts the errors of a loaded package.
+func loadDiagnostics(pkg *packages.Package) []Diagnostic {
+	var diags []Diagnostic
+	for _, e := range pkg.Errors {
+		d := Diagnostic{
+			Package: modSet.RelPkg(pkg.PkgPath),
+			Phase:   "load",
+			Kind:    diagLoadError,
+			Message: e.Msg,
+		}
+		d.File, d.Line, d.Col = parseErrorPos(e.Pos)
+		diags = append(diags, d)
+	}
+	return diags
+}
+
+// parseErrorPos splits a packages.Error position ("file:line:col",
+// "file:line", "file" or "-") into a repo-relative file, line and column.
+func parseErrorPos(pos string) (file string, line, col int) {
+	if pos == "" || pos == "-" {
+		return "", 0, 0
+	}
+	file = pos
+	var nums []int
+	for range 2 {
+		i := strings.LastIndexByte(file, ':')
+		if i < 0 {
+			break
+		}
+		n, err := strconv.Atoi(file[i+1:])
+		if err != nil {
+			break
+		}
+		nums = append([]int{n}, nums...)
+		file = file[:i]
+	}
+	if len(nums) > 0 {
+		line = nums[0]
+	}
+	if len(nums) > 1 {
+		col = nums[1]
+	}
+	return modSet.RelFile(file), line, col
+}
+
+// createDiagnosticTables creates the diagnostics and package_coverage base
+// tables. IF NOT EXISTS lets an incremental update add them to a database
+// written before they existed.
+func createDiagnosticTables(conn *sqlite.Conn) error {
+	ddl := `
+CREATE TABLE IF NOT EXISTS diagnostics (
+    package TEXT,
+    phase TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    file TEXT,
+    line INTEGER,
+    col INTEGER,
+    symbol TEXT,
+    message TEXT
+);
+
+CREATE TABLE IF NOT EXISTS package_coverage (
+    package TEXT NOT NULL,
+    check_name TEXT NOT NULL,
+    total INTEGER NOT NULL,
+    failed INTEGER NOT NULL,
+    PRIMARY KEY (package, check_name)
+);
+`
+	if err := sqlitex.ExecuteScript(conn, ddl, nil); err != nil {
+		return fmt.Errorf("diagnostic tables: %w", err)
+	}
+	return nil
+}
+
+// createPackageCompleteness scores every package by how much of what the
+// extraction attempted made it into the graph: the product of the fraction of
+// SSA functions matched to AST nodes and the fraction of DFG and param_in
+// positions resolved to nodes. A package that failed to load or to build as
+// SSA scores 0; checks that never ran (phase disabled) count as complete.
+func createPackageCompleteness(conn *sqlite.Conn) error {
+	ddl := `
+CREATE TABLE package_completeness AS
+  WITH pkgs AS (
+    SELECT DISTINCT package FROM nodes WHERE kind = 'package' AND package IS NOT NULL
+    UNION SELECT package FROM diagnostics WHERE package IS NOT NULL
+    UNION SELECT package FROM package_coverage
+  ),
+  diag AS (
+    SELECT package,
+           SUM(kind = 'load_error') AS load_errors,
+           MAX(kind = 'ssa_failure') AS ssa_failed,
+           COUNT(*) AS diagnostics
+    FROM diagnostics GROUP BY package
+  ),
+  cov AS (
+    SELECT package,
+           SUM(CASE WHEN check_name = 'ssa_match' THEN total ELSE 0 END) AS ssa_functions,
+           SUM(CASE WHEN check_name = 'ssa_match' THEN failed ELSE 0 END) AS ssa_unmatched,
+           SUM(CASE WHEN check_name != 'ssa_match' THEN total ELSE 0 END) AS lookups,
+           SUM(CASE WHEN check_name != 'ssa_match' THEN failed ELSE 0 END) AS unresolved_lookups
+    FROM package_coverage GROUP BY package
+  )
+  SELECT p.package,
+         COALESCE(d.load_errors, 0) AS load_errors,
+         COALESCE(d.ssa_failed, 0) AS ssa_failed,
+         COALESCE(c.ssa_functions, 0) AS ssa_functions,
+         COALESCE(c.ssa_unmatched, 0) AS ssa_unmatched,
+         COALESCE(c.lookups, 0) AS lookups,
+         COALESCE(c.unresolved_lookups, 0) AS unresolved_lookups,
+         COALESCE(d.diagnostics, 0) AS diagnostics,
+         CASE WHEN COALESCE(d.load_errors, 0) > 0 OR COALESCE(d.ssa_failed, 0) > 0 THEN 0.0
+              ELSE ROUND((1.0 - COALESCE(CAST(c.ssa_unmatched AS REAL) / NULLIF(c.ssa_functions, 0), 0))
+                       * (1.0 - COALESCE(CAST(c.unresolved_lookups AS REAL) / NULLIF(c.lookups, 0), 0)), 4)
+         END AS completeness
+  FROM pkgs p
+  LEFT JOIN diag d ON d.package = p.package
+  LEFT JOIN cov c ON c.package = p.package
+  ORDER BY completeness, p.package;
+`
+	return sqlitex.ExecuteScript(conn, ddl, nil)
+}
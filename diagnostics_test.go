@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// TestPackageCompletenessSynthetic builds the graph of a module whose code
+// makes SSA add values of its own, the varargs array of a variadic call and
+// the comma-ok receive of a range over a channel, and expects every package
+// to score as complete.
+func TestPackageCompletenessSynthetic(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"go.mod": "module example.com/sample\n\ngo 1.22\n",
+		"a/a.go": `package a
+
+import "fmt"
+
+func Sum(ch <-chan int) int {
+	total := 0
+	for x := range ch {
+		total += x
+	}
+	fmt.Printf("total %d\n", total)
+	return total
+}
+
+func Local(n int) (count int) {
+	ch := make(chan string, n)
+	close(ch)
+	for range ch {
+		count++
+	}
+	return count
+}
+`,
+		"cmd/app/main.go": `package main
+
+import (
+	"fmt"
+
+	"example.com/sample/a"
+)
+
+func join(parts ...string) string {
+	s := ""
+	for _, p := range parts {
+		s += p
+	}
+	return s
+}
+
+func main() {
+	ch := make(chan int, 1)
+	ch <- 1
+	close(ch)
+	fmt.Println(a.Sum(ch), a.Local(2), join("x", "y"))
+}
+`,
+	})
+	out := filepath.Join(t.TempDir(), "cpg.db")
+
+	args, cmdLine := os.Args, flag.CommandLine
+	t.Cleanup(func() { os.Args, flag.CommandLine = args, cmdLine })
+	flag.CommandLine = flag.NewFlagSet(args[0], flag.ContinueOnError)
+	os.Args = []string{args[0], "-phases", "cfg,dfg,call", dir, out}
+	if err := run(); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	conn, err := sqlite.OpenConn(out, sqlite.OpenReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	packages := 0
+	err = sqlitex.ExecuteTransient(conn,
+		`SELECT package, lookups, unresolved_lookups, diagnostics, completeness FROM package_completeness ORDER BY package`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			packages++
+			if stmt.ColumnInt(1) == 0 {
+				t.Errorf("package %s: no lookups recorded", stmt.ColumnText(0))
+			}
+			if c := stmt.ColumnFloat(4); c != 1.0 {
+				t.Errorf("package %s: completeness %v with %d of %d lookups unresolved and %d diagnostics, want 1.0",
+					stmt.ColumnText(0), c, stmt.ColumnInt(2), stmt.ColumnInt(1), stmt.ColumnInt(3))
+			}
+			return nil
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packages != 2 {
+		t.Errorf("package_completeness has %d packages, want 2", packages)
+	}
+	err = sqlitex.ExecuteTransient(conn, `SELECT kind, file, line, message FROM diagnostics`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			t.Errorf("diagnostic %s at %s:%d: %s", stmt.ColumnText(0), stmt.ColumnText(1), stmt.ColumnInt(2), stmt.ColumnText(3))
+			return nil
+		}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
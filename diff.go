@@ -0,0 +1,678 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"cpg-gen/graph"
+	"cpg-gen/graph/schema"
+)
+
+// "cpg-gen diff" compares two databases of the same code, typically two
+// releases. Function node IDs carry positions (FuncID), so they change
+// whenever code above a function moves; the diff matches functions by a key
+// built from what identifies them regardless of position: package, receiver
+// and name, and signature. Calls, metrics and findings are compared through
+// those keys.
+
+// diffMetrics are the metrics columns compared for matched functions.
+var diffMetrics = []string{"cyclomatic_complexity", "loc", "num_params", "fan_in", "fan_out"}
+
+// runDiff implements "cpg-gen diff": it reports what changed structurally
+// between two CPG databases and writes the result as the diff_* tables.
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	format := fs.String("format", "text", "Report format: text or json")
+	limit := fs.Int("limit", 20, "Maximum rows per section of the text report (0 = unlimited)")
+	out := fs.String("out", "", "Database to write the diff_* tables to (default the new database)")
+	tables := fs.Bool("tables", true, "Write the diff_* tables")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: cpg-gen diff [flags] <old.db> <new.db>\n\n")
+		fmt.Fprintf(os.Stderr, "Compares two CPG databases: added, removed and modified functions, added and\n")
+		fmt.Fprintf(os.Stderr, "removed calls, metric deltas and new or resolved findings. Functions are matched\n")
+		fmt.Fprintf(os.Stderr, "by package, receiver, name and signature, so moved code is not reported.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	pos, err := parseInterspersed(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if len(pos) != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected 2 arguments, got %d", len(pos))
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("-format %s: want text or json", *format)
+	}
+
+	oldSnap, err := loadSnapshot(pos[0])
+	if err != nil {
+		return err
+	}
+	newSnap, err := loadSnapshot(pos[1])
+	if err != nil {
+		return err
+	}
+	d := diffSnapshots(oldSnap, newSnap)
+
+	if *tables {
+		path := *out
+		if path == "" {
+			path = pos[1]
+		}
+		if err := writeDiffTables(path, d); err != nil {
+			return err
+		}
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	}
+	return writeDiffReport(os.Stdout, d, *limit)
+}
+
+// diffFunc is a function of one side of a diff.
+type diffFunc struct {
+	Key, ID, Name, Package, File string
+	Line                         int
+	Body                         string // hash of the source lines; "" without a sources row
+	Metrics                      map[string]int64
+}
+
+// diffFinding is a finding of one side of a diff. Key identifies it across
+// versions: category, the key of the node it is on, and the message without
+// positions and numbers.
+type diffFinding struct {
+	Key, Anchor                      string
+	Category, Severity, NodeID, File string
+	Line                             int
+	Message                          string
+}
+
+// snapshot is what a diff compares of one database.
+type snapshot struct {
+	Path        string
+	ContentHash string
+	Funcs       map[string]*diffFunc     // by key
+	Keys        map[string]string        // function node ID → key
+	Calls       map[[2]string][2]string  // caller, callee key → node IDs
+	Findings    map[string][]diffFinding // by key
+}
+
+// funcKeyQuery selects the functions with the position-independent part of
+// their key; external stubs are keyed by their ID, which has no position.
+// Rows with the same base key come in position order and are numbered.
+const funcKeyQuery = `SELECT id, name, COALESCE(package, ''), COALESCE(file, ''), COALESCE(line, 0), COALESCE(end_line, 0),
+  CASE WHEN id LIKE 'ext::%' THEN id
+       ELSE COALESCE(package, '') || '::' || name || ' ' || COALESCE(type_info, '') END AS base
+  FROM nodes WHERE kind = 'function'
+  ORDER BY base, file, line, id`
+
+// loadSnapshot reads the functions, calls, metrics and findings of the
+// database at path.
+func loadSnapshot(path string) (*snapshot, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadOnly)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	defer conn.Close()
+	version, err := readSchemaVersion(conn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := schema.Check(version); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	s := &snapshot{
+		Path:     path,
+		Funcs:    make(map[string]*diffFunc),
+		Keys:     make(map[string]string),
+		Calls:    make(map[[2]string][2]string),
+		Findings: make(map[string][]diffFinding),
+	}
+	if err := s.loadFuncs(conn); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := s.loadCalls(conn); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := s.loadMetrics(conn); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := s.loadFindings(conn); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if version >= 2 {
+		_ = sqlitex.ExecuteTransient(conn, `SELECT value FROM cpg_meta WHERE key = ?`, &sqlitex.ExecOptions{
+			Args:       []any{schema.KeyContentHash},
+			ResultFunc: func(stmt *sqlite.Stmt) error { s.ContentHash = stmt.ColumnText(0); return nil },
+		})
+	}
+	return s, nil
+}
+
+// loadFuncs reads the function nodes, keys them and hashes their bodies from
+// the sources table, so a function that only moved is not modified.
+func (s *snapshot) loadFuncs(conn *sqlite.Conn) error {
+	type span struct {
+		fn        *diffFunc
+		line, end int
+	}
+	byFile := make(map[string][]span)
+	var prev string
+	var n int
+	if err := sqlitex.ExecuteTransient(conn, funcKeyQuery, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			base := stmt.ColumnText(6)
+			if base == prev {
+				n++
+			} else {
+				prev, n = base, 1
+			}
+			key := base
+			if n > 1 {
+				key = fmt.Sprintf("%s#%d", base, n)
+			}
+			fn := &diffFunc{Key: key, ID: stmt.ColumnText(0), Name: stmt.ColumnText(1), Package: stmt.ColumnText(2),
+				File: stmt.ColumnText(3), Line: stmt.ColumnInt(4)}
+			s.Funcs[key] = fn
+			s.Keys[fn.ID] = key
+			if fn.File != "" && fn.Line > 0 {
+				byFile[fn.File] = append(byFile[fn.File], span{fn, fn.Line, stmt.ColumnInt(5)})
+			}
+			return nil
+		}}); err != nil {
+		return fmt.Errorf("functions: %w", err)
+	}
+
+	ok, err := hasTable(conn, "sources")
+	if err != nil || !ok {
+		return err
+	}
+	stmt, err := conn.Prepare(`SELECT content FROM sources WHERE file = ?`)
+	if err != nil {
+		return fmt.Errorf("sources: %w", err)
+	}
+	for _, file := range sortedKeys(byFile) {
+		stmt.BindText(1, file)
+		found, err := stmt.Step()
+		if err != nil {
+			return fmt.Errorf("sources %s: %w", file, err)
+		}
+		if found {
+			lines := strings.Split(stmt.ColumnText(0), "\n")
+			for _, sp := range byFile[file] {
+				end := max(sp.end, sp.line)
+				if sp.line > len(lines) {
+					continue
+				}
+				end = min(end, len(lines))
+				sum := sha256.Sum256([]byte(strings.Join(lines[sp.line-1:end], "\n")))
+				sp.fn.Body = hex.EncodeToString(sum[:])
+			}
+		}
+		_ = stmt.Reset()
+	}
+	return nil
+}
+
+// loadCalls reads the call edges between function nodes.
+func (s *snapshot) loadCalls(conn *sqlite.Conn) error {
+	if err := sqlitex.ExecuteTransient(conn, `SELECT DISTINCT source, target FROM edges WHERE kind = 'call'`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			caller, callee := stmt.ColumnText(0), stmt.ColumnText(1)
+			ck, ok1 := s.Keys[caller]
+			ek, ok2 := s.Keys[callee]
+			if ok1 && ok2 {
+				s.Calls[[2]string{ck, ek}] = [2]string{caller, callee}
+			}
+			return nil
+		}}); err != nil {
+		return fmt.Errorf("calls: %w", err)
+	}
+	return nil
+}
+
+// loadMetrics reads the diffMetrics of every function.
+func (s *snapshot) loadMetrics(conn *sqlite.Conn) error {
+	ok, err := hasTable(conn, "metrics")
+	if err != nil || !ok {
+		return err
+	}
+	if err := sqlitex.ExecuteTransient(conn,
+		`SELECT function_id, `+strings.Join(diffMetrics, ", ")+` FROM metrics`, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				fn := s.Funcs[s.Keys[stmt.ColumnText(0)]]
+				if fn == nil {
+					return nil
+				}
+				fn.Metrics = make(map[string]int64, len(diffMetrics))
+				for i, m := range diffMetrics {
+					if stmt.ColumnType(i+1) != sqlite.TypeNull {
+						fn.Metrics[m] = stmt.ColumnInt64(i + 1)
+					}
+				}
+				return nil
+			}}); err != nil {
+		return fmt.Errorf("metrics: %w", err)
+	}
+	return nil
+}
+
+var (
+	// findingPosRe matches the position suffix of a node ID in a message.
+	findingPosRe = regexp.MustCompile(`@[^\s@:]+:\d+:\d+(:\w+)?`)
+	findingNumRe = regexp.MustCompile(`\d+(\.\d+)?`)
+)
+
+// loadFindings reads the findings and keys them. A finding is anchored to
+// the key of its function; on another node, to the key of the enclosing
+// function and the node's kind and name, or to the node's package, kind and
+// name outside functions.
+func (s *snapshot) loadFindings(conn *sqlite.Conn) error {
+	ok, err := hasTable(conn, "findings")
+	if err != nil || !ok {
+		return err
+	}
+	if err := sqlitex.ExecuteTransient(conn, `SELECT f.category, f.severity, COALESCE(f.node_id, ''), COALESCE(f.file, ''),
+  COALESCE(f.line, 0), f.message, COALESCE(n.kind, ''), COALESCE(n.name, ''), COALESCE(n.package, ''), COALESCE(n.parent_function, '')
+  FROM findings f LEFT JOIN nodes n ON n.id = f.node_id`, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			f := diffFinding{Category: stmt.ColumnText(0), Severity: stmt.ColumnText(1), NodeID: stmt.ColumnText(2),
+				File: stmt.ColumnText(3), Line: stmt.ColumnInt(4), Message: stmt.ColumnText(5)}
+			kind, name, pkg, parent := stmt.ColumnText(6), stmt.ColumnText(7), stmt.ColumnText(8), stmt.ColumnText(9)
+			switch key, fn := s.Keys[f.NodeID]; {
+			case f.NodeID == "":
+			case fn:
+				f.Anchor = key
+			case s.Keys[parent] != "":
+				f.Anchor = s.Keys[parent] + " " + kind + " " + name
+			case kind != "":
+				f.Anchor = pkg + "::" + kind + " " + name
+			default:
+				f.Anchor = findingPosRe.ReplaceAllString(f.NodeID, "")
+			}
+			msg := findingNumRe.ReplaceAllString(findingPosRe.ReplaceAllString(f.Message, ""), "N")
+			f.Key = f.Category + "\x00" + f.Anchor + "\x00" + msg
+			s.Findings[f.Key] = append(s.Findings[f.Key], f)
+			return nil
+		}}); err != nil {
+		return fmt.Errorf("findings: %w", err)
+	}
+	return nil
+}
+
+// hasTable reports whether the database has a table or view called name.
+func hasTable(conn *sqlite.Conn, name string) (bool, error) {
+	var ok bool
+	if err := sqlitex.ExecuteTransient(conn, `SELECT 1 FROM sqlite_master WHERE type IN ('table', 'view') AND name = ?`,
+		&sqlitex.ExecOptions{
+			Args:       []any{name},
+			ResultFunc: func(stmt *sqlite.Stmt) error { ok = true; return nil },
+		}); err != nil {
+		return false, fmt.Errorf("schema: %w", err)
+	}
+	return ok, nil
+}
+
+// graphDiff is the result of a diff, every list sorted by key.
+type graphDiff struct {
+	Old       string          `json:"old"`
+	New       string          `json:"new"`
+	OldHash   string          `json:"old_content_hash,omitempty"`
+	NewHash   string          `json:"new_content_hash,omitempty"`
+	Functions []funcChange    `json:"functions"`
+	Calls     []callChange    `json:"calls"`
+	Metrics   []metricChange  `json:"metrics"`
+	Findings  []findingChange `json:"findings"`
+}
+
+// funcChange is an added, removed or modified function. File and Line are
+// its position in the new database, or the old one for a removed function.
+type funcChange struct {
+	Status  string   `json:"status"` // added, removed, modified
+	Key     string   `json:"key"`
+	Package string   `json:"package"`
+	Name    string   `json:"name"`
+	OldID   string   `json:"old_id,omitempty"`
+	NewID   string   `json:"new_id,omitempty"`
+	File    string   `json:"file,omitempty"`
+	Line    int      `json:"line,omitempty"`
+	Changes []string `json:"changes,omitempty"` // of a modified function: body, calls
+}
+
+// callChange is an added or removed call edge, with the node IDs of the
+// database that has it.
+type callChange struct {
+	Status   string `json:"status"` // added, removed
+	Caller   string `json:"caller"`
+	Callee   string `json:"callee"`
+	CallerID string `json:"caller_id"`
+	CalleeID string `json:"callee_id"`
+}
+
+// metricChange is a metric that differs for a function in both databases.
+type metricChange struct {
+	Key        string `json:"key"`
+	FunctionID string `json:"function_id"`
+	Metric     string `json:"metric"`
+	Old        int64  `json:"old"`
+	New        int64  `json:"new"`
+}
+
+// findingChange is a finding only the new database has, or only the old.
+type findingChange struct {
+	Status   string `json:"status"` // new, resolved
+	Category string `json:"category"`
+	Severity string `json:"severity"`
+	Anchor   string `json:"anchor"`
+	NodeID   string `json:"node_id,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message"`
+}
+
+// count returns how many entries of d have each status, for the report.
+func (d *graphDiff) count() map[string]int {
+	c := make(map[string]int)
+	for _, f := range d.Functions {
+		c["functions_"+f.Status]++
+	}
+	for _, e := range d.Calls {
+		c["calls_"+e.Status]++
+	}
+	for _, f := range d.Findings {
+		c["findings_"+f.Status]++
+	}
+	c["metric_changes"] = len(d.Metrics)
+	return c
+}
+
+// diffSnapshots compares two snapshots.
+func diffSnapshots(old, cur *snapshot) *graphDiff {
+	d := &graphDiff{Old: old.Path, New: cur.Path, OldHash: old.ContentHash, NewHash: cur.ContentHash,
+		Functions: []funcChange{}, Calls: []callChange{}, Metrics: []metricChange{}, Findings: []findingChange{}}
+
+	calleesChanged := make(map[string]bool) // caller keys
+	for _, k := range sortedCalls(cur.Calls) {
+		if _, ok := old.Calls[k]; !ok {
+			ids := cur.Calls[k]
+			d.Calls = append(d.Calls, callChange{"added", k[0], k[1], ids[0], ids[1]})
+			calleesChanged[k[0]] = true
+		}
+	}
+	for _, k := range sortedCalls(old.Calls) {
+		if _, ok := cur.Calls[k]; !ok {
+			ids := old.Calls[k]
+			d.Calls = append(d.Calls, callChange{"removed", k[0], k[1], ids[0], ids[1]})
+			calleesChanged[k[0]] = true
+		}
+	}
+	sort.SliceStable(d.Calls, func(i, j int) bool {
+		a, b := d.Calls[i], d.Calls[j]
+		if a.Caller != b.Caller {
+			return a.Caller < b.Caller
+		}
+		return a.Callee < b.Callee
+	})
+
+	keys := make(map[string]bool)
+	for k := range old.Funcs {
+		keys[k] = true
+	}
+	for k := range cur.Funcs {
+		keys[k] = true
+	}
+	for _, k := range sortedKeys(keys) {
+		o, n := old.Funcs[k], cur.Funcs[k]
+		switch {
+		case o == nil:
+			d.Functions = append(d.Functions, funcChange{Status: "added", Key: k, Package: n.Package, Name: n.Name,
+				NewID: n.ID, File: n.File, Line: n.Line})
+		case n == nil:
+			d.Functions = append(d.Functions, funcChange{Status: "removed", Key: k, Package: o.Package, Name: o.Name,
+				OldID: o.ID, File: o.File, Line: o.Line})
+		default:
+			var changes []string
+			if o.Body != "" && n.Body != "" && o.Body != n.Body {
+				changes = append(changes, "body")
+			}
+			if calleesChanged[k] {
+				changes = append(changes, "calls")
+			}
+			if len(changes) > 0 {
+				d.Functions = append(d.Functions, funcChange{Status: "modified", Key: k, Package: n.Package, Name: n.Name,
+					OldID: o.ID, NewID: n.ID, File: n.File, Line: n.Line, Changes: changes})
+			}
+			for _, m := range diffMetrics {
+				ov, ook := o.Metrics[m]
+				nv, nok := n.Metrics[m]
+				if ook && nok && ov != nv {
+					d.Metrics = append(d.Metrics, metricChange{Key: k, FunctionID: n.ID, Metric: m, Old: ov, New: nv})
+				}
+			}
+		}
+	}
+
+	// Findings are multisets per key: only the surplus on either side is
+	// new or resolved.
+	fkeys := make(map[string]bool)
+	for k := range old.Findings {
+		fkeys[k] = true
+	}
+	for k := range cur.Findings {
+		fkeys[k] = true
+	}
+	for _, k := range sortedKeys(fkeys) {
+		o, n := old.Findings[k], cur.Findings[k]
+		for _, f := range n[min(len(o), len(n)):] {
+			d.Findings = append(d.Findings, findingChange{"new", f.Category, f.Severity, f.Anchor, f.NodeID, f.File, f.Line, f.Message})
+		}
+		for _, f := range o[min(len(o), len(n)):] {
+			d.Findings = append(d.Findings, findingChange{"resolved", f.Category, f.Severity, f.Anchor, f.NodeID, f.File, f.Line, f.Message})
+		}
+	}
+	return d
+}
+
+func sortedCalls(m map[[2]string][2]string) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+// writeDiffReport writes the text report: the counts, then each section as
+// a table of at most limit rows.
+func writeDiffReport(w io.Writer, d *graphDiff, limit int) error {
+	c := d.count()
+	fmt.Fprintf(w, "%s -> %s\n", d.Old, d.New)
+	if d.OldHash != "" && d.OldHash == d.NewHash {
+		fmt.Fprintf(w, "identical content (hash %s)\n", d.NewHash)
+	}
+	fmt.Fprintf(w, "functions: %d added, %d removed, %d modified\n", c["functions_added"], c["functions_removed"], c["functions_modified"])
+	fmt.Fprintf(w, "calls:     %d added, %d removed\n", c["calls_added"], c["calls_removed"])
+	fmt.Fprintf(w, "metrics:   %d changed\n", c["metric_changes"])
+	fmt.Fprintf(w, "findings:  %d new, %d resolved\n", c["findings_new"], c["findings_resolved"])
+
+	sections := []reportSection{
+		{"Functions", &graph.Table{Columns: []string{"status", "key", "file", "line", "changes"}}},
+		{"Calls", &graph.Table{Columns: []string{"status", "caller", "callee"}}},
+		{"Metrics", &graph.Table{Columns: []string{"key", "metric", "old", "new", "delta"}}},
+		{"Findings", &graph.Table{Columns: []string{"status", "category", "severity", "file", "line", "message"}}},
+	}
+	line := func(n int) any {
+		if n == 0 {
+			return nil
+		}
+		return int64(n)
+	}
+	for _, f := range d.Functions {
+		sections[0].t.Rows = append(sections[0].t.Rows, []any{f.Status, f.Key, f.File, line(f.Line), strings.Join(f.Changes, ",")})
+	}
+	for _, e := range d.Calls {
+		sections[1].t.Rows = append(sections[1].t.Rows, []any{e.Status, e.Caller, e.Callee})
+	}
+	for _, m := range d.Metrics {
+		sections[2].t.Rows = append(sections[2].t.Rows, []any{m.Key, m.Metric, m.Old, m.New, m.New - m.Old})
+	}
+	for _, f := range d.Findings {
+		sections[3].t.Rows = append(sections[3].t.Rows, []any{f.Status, f.Category, f.Severity, f.File, line(f.Line), f.Message})
+	}
+	return writeSections(w, sections, limit)
+}
+
+const diffTablesDDL = `
+DROP TABLE IF EXISTS diff_summary;
+DROP TABLE IF EXISTS diff_functions;
+DROP TABLE IF EXISTS diff_calls;
+DROP TABLE IF EXISTS diff_metrics;
+DROP TABLE IF EXISTS diff_findings;
+CREATE TABLE diff_summary (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+);
+CREATE TABLE diff_functions (
+    key TEXT PRIMARY KEY,
+    status TEXT NOT NULL,
+    package TEXT,
+    name TEXT NOT NULL,
+    old_id TEXT,
+    new_id TEXT,
+    file TEXT,
+    line INTEGER,
+    changes TEXT
+);
+CREATE TABLE diff_calls (
+    status TEXT NOT NULL,
+    caller_key TEXT NOT NULL,
+    callee_key TEXT NOT NULL,
+    caller_id TEXT NOT NULL,
+    callee_id TEXT NOT NULL,
+    PRIMARY KEY (caller_key, callee_key)
+);
+CREATE TABLE diff_metrics (
+    function_key TEXT NOT NULL,
+    function_id TEXT NOT NULL,
+    metric TEXT NOT NULL,
+    old_value INTEGER,
+    new_value INTEGER,
+    delta INTEGER,
+    PRIMARY KEY (function_key, metric)
+);
+CREATE TABLE diff_findings (
+    status TEXT NOT NULL,
+    category TEXT NOT NULL,
+    severity TEXT,
+    anchor TEXT,
+    node_id TEXT,
+    file TEXT,
+    line INTEGER,
+    message TEXT NOT NULL
+);
+CREATE INDEX idx_diff_findings_category ON diff_findings(category);
+`
+
+const diffDocs = `
+DELETE FROM schema_docs WHERE category = 'table' AND name LIKE 'diff\_%' ESCAPE '\';
+INSERT INTO schema_docs (category, name, description, example) VALUES
+('table', 'diff_summary', 'cpg-gen diff: the compared databases, their content hashes and the change counts', 'SELECT * FROM diff_summary'),
+('table', 'diff_functions', 'cpg-gen diff: functions added, removed or modified (body, calls) since the old database, matched by package, receiver, name and signature', 'SELECT * FROM diff_functions WHERE status = ''modified'''),
+('table', 'diff_calls', 'cpg-gen diff: call edges added or removed, by function key, with the node IDs of the database that has them', 'SELECT * FROM diff_calls WHERE status = ''added'''),
+('table', 'diff_metrics', 'cpg-gen diff: metrics that changed for functions in both databases', 'SELECT * FROM diff_metrics ORDER BY ABS(delta) DESC'),
+('table', 'diff_findings', 'cpg-gen diff: findings only the new database has (new) or only the old (resolved)', 'SELECT category, status, COUNT(*) FROM diff_findings GROUP BY 1, 2');
+`
+
+// writeDiffTables replaces the diff_* tables of the database at path.
+func writeDiffTables(path string, d *graphDiff) (err error) {
+	conn, err := openDB(path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return fmt.Errorf("diff tables: begin tx: %w", err)
+	}
+	defer endFn(&err)
+
+	if err := sqlitex.ExecuteScript(conn, diffTablesDDL, nil); err != nil {
+		return fmt.Errorf("diff tables: %w", err)
+	}
+	if docs, err := hasTable(conn, "schema_docs"); err != nil {
+		return err
+	} else if docs {
+		if err := sqlitex.ExecuteScript(conn, diffDocs, nil); err != nil {
+			return fmt.Errorf("diff docs: %w", err)
+		}
+	}
+
+	summary := map[string]string{"old": d.Old, "new": d.New, "old_content_hash": d.OldHash, "new_content_hash": d.NewHash}
+	for k, v := range d.count() {
+		summary[k] = fmt.Sprint(v)
+	}
+	insert := func(query string, args ...any) error {
+		return sqlitex.Execute(conn, query, &sqlitex.ExecOptions{Args: args})
+	}
+	for _, k := range sortedKeys(summary) {
+		if err := insert(`INSERT INTO diff_summary (key, value) VALUES (?, ?)`, k, summary[k]); err != nil {
+			return fmt.Errorf("diff_summary: %w", err)
+		}
+	}
+	for _, f := range d.Functions {
+		if err := insert(`INSERT INTO diff_functions (key, status, package, name, old_id, new_id, file, line, changes)
+  VALUES (?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, 0), NULLIF(?, ''))`,
+			f.Key, f.Status, f.Package, f.Name, f.OldID, f.NewID, f.File, f.Line, strings.Join(f.Changes, ",")); err != nil {
+			return fmt.Errorf("diff_functions: %w", err)
+		}
+	}
+	for _, e := range d.Calls {
+		if err := insert(`INSERT INTO diff_calls (status, caller_key, callee_key, caller_id, callee_id) VALUES (?, ?, ?, ?, ?)`,
+			e.Status, e.Caller, e.Callee, e.CallerID, e.CalleeID); err != nil {
+			return fmt.Errorf("diff_calls: %w", err)
+		}
+	}
+	for _, m := range d.Metrics {
+		if err := insert(`INSERT INTO diff_metrics (function_key, function_id, metric, old_value, new_value, delta) VALUES (?, ?, ?, ?, ?, ?)`,
+			m.Key, m.FunctionID, m.Metric, m.Old, m.New, m.New-m.Old); err != nil {
+			return fmt.Errorf("diff_metrics: %w", err)
+		}
+	}
+	for _, f := range d.Findings {
+		if err := insert(`INSERT INTO diff_findings (status, category, severity, anchor, node_id, file, line, message)
+  VALUES (?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, 0), ?)`,
+			f.Status, f.Category, f.Severity, f.Anchor, f.NodeID, f.File, f.Line, f.Message); err != nil {
+			return fmt.Errorf("diff_findings: %w", err)
+		}
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -18,19 +19,34 @@ type EscapeResult struct {
 	Detail  string // variable or function name
 }
 
-// RunEscapeAnalysis runs `go build -gcflags=-m` on each module directory
-// and parses the compiler's escape analysis decisions.
+// RunEscapeAnalysis runs `go build -gcflags=-m` on each workspace module
+// directory and parses the compiler's escape analysis decisions.
 func RunEscapeAnalysis(prog *Progress) []EscapeResult {
-	prog.Log("Running Go escape analysis (-gcflags=-m) across %d modules...", len(modSet.Dirs()))
+	prog.Begin("escape", "Running Go escape analysis (-gcflags=-m) across %d modules...", len(modSet.Workspace()))
 
 	var allResults []EscapeResult
 
-	for _, mod := range modSet.Dirs() {
+	for _, mod := range modSet.Workspace() {
 		results := runEscapeForDir(mod.Dir, mod.Prefix, prog)
 		allResults = append(allResults, results...)
 	}
+	// The compiler reports packages as their builds finish.
+	sort.SliceStable(allResults, func(i, j int) bool {
+		a, b := allResults[i], allResults[j]
+		switch {
+		case a.RelFile != b.RelFile:
+			return a.RelFile < b.RelFile
+		case a.Line != b.Line:
+			return a.Line < b.Line
+		case a.Col != b.Col:
+			return a.Col < b.Col
+		case a.Kind != b.Kind:
+			return a.Kind < b.Kind
+		}
+		return a.Detail < b.Detail
+	})
 
-	prog.Log("Escape analysis: %d annotations total", len(allResults))
+	prog.End("escape", Fields{"annotations": len(allResults)}, "Escape analysis: %d annotations total", len(allResults))
 	return allResults
 }
 
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"os/exec"
 	"strconv"
 	"strings"
@@ -19,39 +18,65 @@ type GitFileHistory struct {
 	DaysSinceEdit int
 }
 
-// GitBlameEntry holds per-line-range blame data from git blame --porcelain.
-type GitBlameEntry struct {
-	RelFile string
-	Line    int
-	Author  string
-	Date    string // ISO 8601
-	Commit  string // short SHA
+// GitCommit is a commit in the git history: the .go files it changed and
+// the lines it changed, mapped to where that code is in the work tree.
+type GitCommit struct {
+	Commit string
+	Files  []string
+	Lines  []GitLineRange
+}
+
+// GitLineRange is a range of lines of a file, numbered as in the work tree.
+type GitLineRange struct {
+	RelFile    string
+	Start, End int
+}
+
+// GitResults are what the git phase hands to the SQL stages: the file
+// history and commits, and with -blame the blame runs and CODEOWNERS rules.
+type GitResults struct {
+	History []GitFileHistory
+	Commits []GitCommit
+	Blame   []GitBlameEntry
+	Owners  []CodeOwners
 }
 
 // RunGitHistory extracts per-file change frequency from `git log --numstat`
-// across all modules in the ModuleSet.
-func RunGitHistory(prog *Progress) []GitFileHistory {
-	prog.Log("Running git log for file history across %d modules...", len(modSet.Dirs()))
+// across the workspace modules in the ModuleSet, along with the files and
+// lines every commit changed (see mapCommitLines).
+func RunGitHistory(prog *Progress) ([]GitFileHistory, []GitCommit) {
+	prog.Begin("git", "Running git log for file history across %d modules...", len(modSet.Workspace()))
 
 	var allResults []GitFileHistory
+	var allCommits []GitCommit
 
-	for _, mod := range modSet.Dirs() {
-		results := runGitHistoryForDir(mod.Dir, mod.Prefix, prog)
+	for _, mod := range modSet.Workspace() {
+		results, commits := runGitHistoryForDir(mod.Dir, mod.Prefix, prog)
+		if err := mapCommitLines(mod.Dir, mod.Prefix, commits); err != nil {
+			prog.Verbose("Git line history for %s: failed: %v", mod.Dir, err)
+		}
 		allResults = append(allResults, results...)
+		allCommits = append(allCommits, commits...)
 	}
 
-	prog.Log("Git history: %d files with change data", len(allResults))
-	return allResults
+	prog.End("git", Fields{"files": len(allResults), "commits": len(allCommits)},
+		"Git history: %d files with change data, %d commits", len(allResults), len(allCommits))
+	return allResults, allCommits
 }
 
-func runGitHistoryForDir(dir, prefix string, prog *Progress) []GitFileHistory {
-	cmd := exec.Command("git", "log", "--format=%H %aI %aN", "--numstat", "--no-merges", "-n", "500")
+// gitHistoryDepth is how many commits back the git history looks, counting
+// only commits that touch the module (both git log calls limit themselves to
+// its directory, so they see the same window).
+const gitHistoryDepth = "500"
+
+func runGitHistoryForDir(dir, prefix string, prog *Progress) ([]GitFileHistory, []GitCommit) {
+	cmd := exec.Command("git", "log", "--format=%H %aI %aN", "--numstat", "--no-merges", "--no-renames", "--relative", "-n", gitHistoryDepth, "--", ".")
 	cmd.Dir = dir
 
 	out, err := cmd.Output()
 	if err != nil {
 		prog.Verbose("Git history for %s: failed: %v", dir, err)
-		return nil
+		return nil, nil
 	}
 
 	type fileStats struct {
@@ -65,6 +90,7 @@ func runGitHistoryForDir(dir, prefix string, prog *Progress) []GitFileHistory {
 
 	var currentAuthor, currentDate string
 	var currentCommit string
+	var commits []GitCommit
 
 	for _, line := range strings.Split(string(out), "\n") {
 		line = strings.TrimSpace(line)
@@ -79,6 +105,7 @@ func runGitHistoryForDir(dir, prefix string, prog *Progress) []GitFileHistory {
 				currentCommit = parts[0][:12]
 				currentDate = parts[1]
 				currentAuthor = parts[2]
+				commits = append(commits, GitCommit{Commit: currentCommit})
 			}
 			continue
 		}
@@ -111,6 +138,9 @@ func runGitHistoryForDir(dir, prefix string, prog *Progress) []GitFileHistory {
 			}
 			files[relFile] = fs
 		}
+		if n := len(commits); n > 0 {
+			commits[n-1].Files = append(commits[n-1].Files, relFile)
+		}
 		fs.commits[currentCommit] = true
 		fs.authors[currentAuthor] = true
 		fs.ins += ins
@@ -123,7 +153,8 @@ func runGitHistoryForDir(dir, prefix string, prog *Progress) []GitFileHistory {
 	}
 
 	var results []GitFileHistory
-	for file, fs := range files {
+	for _, file := range sortedKeys(files) {
+		fs := files[file]
 		results = append(results, GitFileHistory{
 			RelFile:     file,
 			CommitCount: len(fs.commits),
@@ -135,65 +166,5 @@ func runGitHistoryForDir(dir, prefix string, prog *Progress) []GitFileHistory {
 		})
 	}
 
-	return results
-}
-
-// RunGitBlame extracts per-function blame data using `git blame --porcelain`.
-// Only samples function declaration lines to keep the data manageable.
-func RunGitBlame(dir string, files []string, prog *Progress) []GitBlameEntry {
-	prog.Log("Running git blame for %d files...", len(files))
-
-	var results []GitBlameEntry
-	for _, relFile := range files {
-		cmd := exec.Command("git", "blame", "--porcelain", "--", relFile)
-		cmd.Dir = dir
-
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			continue
-		}
-		if err := cmd.Start(); err != nil {
-			continue
-		}
-
-		scanner := bufio.NewScanner(stdout)
-		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
-
-		var currentLine int
-		var currentAuthor, currentDate, currentCommit string
-
-		for scanner.Scan() {
-			text := scanner.Text()
-
-			// Header line: "commit_sha orig_line final_line [num_lines]"
-			if len(text) >= 40 && text[0] != '\t' && !strings.HasPrefix(text, "author") &&
-				!strings.HasPrefix(text, "committer") && !strings.HasPrefix(text, "summary") &&
-				!strings.HasPrefix(text, "previous") && !strings.HasPrefix(text, "filename") &&
-				!strings.HasPrefix(text, "boundary") {
-				parts := strings.Fields(text)
-				if len(parts) >= 3 {
-					currentCommit = parts[0][:12]
-					currentLine, _ = strconv.Atoi(parts[2])
-				}
-			} else if strings.HasPrefix(text, "author ") {
-				currentAuthor = strings.TrimPrefix(text, "author ")
-			} else if strings.HasPrefix(text, "author-time ") {
-				currentDate = strings.TrimPrefix(text, "author-time ")
-			} else if len(text) > 0 && text[0] == '\t' {
-				// Content line — emit entry
-				results = append(results, GitBlameEntry{
-					RelFile: relFile,
-					Line:    currentLine,
-					Author:  currentAuthor,
-					Date:    currentDate,
-					Commit:  currentCommit,
-				})
-			}
-		}
-
-		_ = cmd.Wait()
-	}
-
-	prog.Log("Git blame: %d line entries across %d files", len(results), len(files))
-	return results
+	return results, commits
 }
@@ -0,0 +1,271 @@
+// Package graph reads and traverses a code property graph database written
+// by cpg-gen. It gives typed access to the nodes and edges tables, the
+// common traversals (callers, callees, program slices, control flow graphs,
+// shortest paths) and the named queries stored in the queries table, so tools
+// built on a CPG do not have to copy the schema's SQL.
+//
+// A DB is safe for concurrent use; every method takes a context that
+// interrupts the underlying SQLite statement when it is done.
+package graph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"cpg-gen/graph/schema"
+)
+
+// ErrNotFound is returned when a requested node or named query does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Node is a row of the nodes table. Properties holds the decoded JSON
+// properties column, nil when the node has none.
+type Node struct {
+	ID             string
+	Kind           string
+	Name           string
+	File           string
+	Line           int
+	Col            int
+	EndLine        int
+	Package        string
+	ParentFunction string
+	TypeInfo       string
+	Properties     map[string]any
+}
+
+// Edge is a row of the edges table.
+type Edge struct {
+	Source     string
+	Target     string
+	Kind       string
+	Properties map[string]any
+}
+
+// DB is a read-only handle on a CPG database.
+type DB struct {
+	pool    *sqlitex.Pool
+	version int
+}
+
+// Open opens the CPG database at path read-only. It fails with an error
+// wrapping schema.ErrVersion when the database's schema version is one this
+// package cannot read.
+func Open(path string) (*DB, error) {
+	pool, err := sqlitex.NewPool(path, sqlitex.PoolOptions{Flags: sqlite.OpenReadOnly})
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	db := &DB{pool: pool}
+	err = db.with(context.Background(), func(conn *sqlite.Conn) error {
+		var tables int
+		if err := sqlitex.ExecuteTransient(conn,
+			`SELECT COUNT(*) FROM sqlite_master WHERE type IN ('table', 'view') AND name IN ('nodes', 'edges')`,
+			&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+				tables = stmt.ColumnInt(0)
+				return nil
+			}}); err != nil {
+			return err
+		}
+		if tables != 2 {
+			return fmt.Errorf("no nodes and edges tables")
+		}
+		var userVersion int
+		if err := sqlitex.ExecuteTransient(conn, `PRAGMA user_version`,
+			&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+				userVersion = stmt.ColumnInt(0)
+				return nil
+			}}); err != nil {
+			return err
+		}
+		db.version = schema.VersionOf(userVersion)
+		return schema.Check(db.version)
+	})
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Close closes the database.
+func (db *DB) Close() error {
+	return db.pool.Close()
+}
+
+// with runs fn on a pooled connection that is interrupted when ctx is done.
+func (db *DB) with(ctx context.Context, fn func(conn *sqlite.Conn) error) error {
+	conn, err := db.pool.Take(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.pool.Put(conn)
+	conn.SetInterrupt(ctx.Done())
+	defer conn.SetInterrupt(nil)
+	return fn(conn)
+}
+
+const nodeColumns = `id, kind, name, COALESCE(file, ''), COALESCE(line, 0), COALESCE(col, 0), COALESCE(end_line, 0),
+  COALESCE(package, ''), COALESCE(parent_function, ''), COALESCE(type_info, ''), properties`
+
+func scanNode(stmt *sqlite.Stmt) (Node, error) {
+	n := Node{
+		ID:             stmt.ColumnText(0),
+		Kind:           stmt.ColumnText(1),
+		Name:           stmt.ColumnText(2),
+		File:           stmt.ColumnText(3),
+		Line:           stmt.ColumnInt(4),
+		Col:            stmt.ColumnInt(5),
+		EndLine:        stmt.ColumnInt(6),
+		Package:        stmt.ColumnText(7),
+		ParentFunction: stmt.ColumnText(8),
+		TypeInfo:       stmt.ColumnText(9),
+	}
+	var err error
+	n.Properties, err = decodeProperties(stmt.ColumnText(10))
+	if err != nil {
+		return Node{}, fmt.Errorf("node %s: %w", n.ID, err)
+	}
+	return n, nil
+}
+
+const edgeColumns = `source, target, kind, properties`
+
+func scanEdge(stmt *sqlite.Stmt) (Edge, error) {
+	e := Edge{
+		Source: stmt.ColumnText(0),
+		Target: stmt.ColumnText(1),
+		Kind:   stmt.ColumnText(2),
+	}
+	var err error
+	e.Properties, err = decodeProperties(stmt.ColumnText(3))
+	if err != nil {
+		return Edge{}, fmt.Errorf("edge %s→%s: %w", e.Source, e.Target, err)
+	}
+	return e, nil
+}
+
+func decodeProperties(s string) (map[string]any, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var props map[string]any
+	if err := json.Unmarshal([]byte(s), &props); err != nil {
+		return nil, fmt.Errorf("properties: %w", err)
+	}
+	return props, nil
+}
+
+// jsonList encodes ids for binding to json_each.
+func jsonList(ids []string) string {
+	b, _ := json.Marshal(ids)
+	return string(b)
+}
+
+// Node returns the node with the given ID, or ErrNotFound.
+func (db *DB) Node(ctx context.Context, id string) (*Node, error) {
+	nodes, err := db.Nodes(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("node %s: %w", id, ErrNotFound)
+	}
+	return &nodes[0], nil
+}
+
+// Nodes returns the nodes with the given IDs, in ID order. IDs without a
+// node are skipped.
+func (db *DB) Nodes(ctx context.Context, ids ...string) ([]Node, error) {
+	var nodes []Node
+	err := db.with(ctx, func(conn *sqlite.Conn) error {
+		var err error
+		nodes, err = queryNodes(conn, ids)
+		return err
+	})
+	return nodes, err
+}
+
+func queryNodes(conn *sqlite.Conn, ids []string) ([]Node, error) {
+	return queryNodesWhere(conn, `id IN (SELECT value FROM json_each(?))`, jsonList(ids))
+}
+
+// queryNodesWhere returns the nodes matching a WHERE clause, in ID order.
+func queryNodesWhere(conn *sqlite.Conn, where string, args ...any) ([]Node, error) {
+	var nodes []Node
+	err := sqlitex.Execute(conn, `SELECT `+nodeColumns+` FROM nodes WHERE `+where+` ORDER BY id`,
+		&sqlitex.ExecOptions{
+			Args: args,
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				n, err := scanNode(stmt)
+				if err != nil {
+					return err
+				}
+				nodes = append(nodes, n)
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, fmt.Errorf("nodes: %w", err)
+	}
+	return nodes, nil
+}
+
+// Direction selects which way edges are followed.
+type Direction int
+
+const (
+	Forward  Direction = iota // from source to target
+	Backward                  // from target to source
+)
+
+// Edges returns the edges leaving (Forward) or entering (Backward) the node,
+// restricted to the given kinds when any are given.
+func (db *DB) Edges(ctx context.Context, id string, dir Direction, kinds ...string) ([]Edge, error) {
+	var edges []Edge
+	err := db.with(ctx, func(conn *sqlite.Conn) error {
+		var err error
+		edges, err = queryEdges(conn, []string{id}, dir, kinds)
+		return err
+	})
+	return edges, err
+}
+
+// queryEdges returns the edges of the given kinds (all when empty) leaving
+// or entering any of ids.
+func queryEdges(conn *sqlite.Conn, ids []string, dir Direction, kinds []string) ([]Edge, error) {
+	end := "source"
+	if dir == Backward {
+		end = "target"
+	}
+	var kindList any
+	if len(kinds) > 0 {
+		kindList = jsonList(kinds)
+	}
+	var edges []Edge
+	err := sqlitex.Execute(conn,
+		`SELECT `+edgeColumns+` FROM edges
+		 WHERE `+end+` IN (SELECT value FROM json_each(?1))
+		   AND (?2 IS NULL OR kind IN (SELECT value FROM json_each(?2)))
+		 ORDER BY source, target, kind`,
+		&sqlitex.ExecOptions{
+			Args: []any{jsonList(ids), kindList},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				e, err := scanEdge(stmt)
+				if err != nil {
+					return err
+				}
+				edges = append(edges, e)
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, fmt.Errorf("edges: %w", err)
+	}
+	return edges, nil
+}
@@ -0,0 +1,75 @@
+package mem
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// LoadOptions select what of the database a Graph holds.
+type LoadOptions struct {
+	NodeKinds []string // load only nodes of these kinds; empty loads every node
+	EdgeKinds []string // load only edges of these kinds; empty loads every edge
+}
+
+// NodeQuery returns the SELECT of the nodes to load (id, kind) and its
+// arguments, for loaders that feed a Builder from their own connection.
+func (o LoadOptions) NodeQuery() (string, []any) {
+	return kindQuery(`SELECT id, kind FROM nodes`, o.NodeKinds, ` ORDER BY id`)
+}
+
+// EdgeQuery returns the SELECT of the edges to load (source, target, kind)
+// and its arguments.
+func (o LoadOptions) EdgeQuery() (string, []any) {
+	return kindQuery(`SELECT source, target, kind FROM edges`, o.EdgeKinds, ``)
+}
+
+func kindQuery(sel string, kinds []string, tail string) (string, []any) {
+	if len(kinds) == 0 {
+		return sel + tail, nil
+	}
+	args := make([]any, len(kinds))
+	for i, k := range kinds {
+		args[i] = k
+	}
+	return sel + ` WHERE kind IN (?` + strings.Repeat(`, ?`, len(kinds)-1) + `)` + tail, args
+}
+
+// LoadSQL loads a Graph from a CPG database opened with database/sql.
+func LoadSQL(ctx context.Context, db *sql.DB, opts LoadOptions) (*Graph, error) {
+	b := NewBuilder()
+	query, args := opts.NodeQuery()
+	if err := scanRows(ctx, db, query, args, func(v []string) { b.AddNode(v[0], v[1]) }); err != nil {
+		return nil, fmt.Errorf("load nodes: %w", err)
+	}
+	query, args = opts.EdgeQuery()
+	if err := scanRows(ctx, db, query, args, func(v []string) { b.AddEdge(v[0], v[1], v[2]) }); err != nil {
+		return nil, fmt.Errorf("load edges: %w", err)
+	}
+	return b.Build()
+}
+
+func scanRows(ctx context.Context, db *sql.DB, query string, args []any, fn func([]string)) error {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	v := make([]string, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range v {
+		ptrs[i] = &v[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		fn(v)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,254 @@
+// Package mem holds a CPG's nodes and edges in memory as compressed sparse
+// row (CSR) adjacency arrays over integer node indexes, for traversals at
+// interactive speed: breadth-first search, k-hop neighborhoods,
+// reachability and bidirectional shortest paths, each restricted to a set of
+// edge kinds. It depends only on the standard library, so any program that
+// reads the database through database/sql can use it (see LoadSQL);
+// cpg-gen's own graph package loads one with (*graph.DB).Memory.
+//
+// A Graph is immutable once built and safe for concurrent use.
+package mem
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Direction selects which way edges are followed.
+type Direction int
+
+const (
+	Forward  Direction = iota // from source to target
+	Backward                  // from target to source
+	Both                      // either way
+)
+
+// Mask is a set of edge kinds, one bit per kind the graph holds (see
+// Graph.Mask).
+type Mask uint64
+
+// AllKinds follows every edge.
+const AllKinds Mask = ^Mask(0)
+
+// maxEdgeKinds is the number of edge kinds a Mask can tell apart.
+const maxEdgeKinds = 64
+
+// Edge is an edge of the graph.
+type Edge struct {
+	Source, Target, Kind string
+}
+
+// Graph is a directed multigraph in CSR form: node i's outgoing edges are
+// out.nodes[out.offsets[i]:out.offsets[i+1]], its incoming edges likewise in
+// in, each list sorted by the far node and then the kind.
+type Graph struct {
+	ids       []string         // node index → ID
+	index     map[string]int32 // ID → node index
+	nodeKind  []uint16         // node index → index in nodeKinds
+	nodeKinds []string
+	edgeKinds []string // kind bit → name
+	out, in   adjacency
+}
+
+type adjacency struct {
+	offsets []int32 // len(ids)+1
+	nodes   []int32 // the far end of each edge
+	kinds   []uint8 // the kind bit of each edge
+}
+
+// Len returns the number of nodes.
+func (g *Graph) Len() int { return len(g.ids) }
+
+// EdgeCount returns the number of edges.
+func (g *Graph) EdgeCount() int { return len(g.out.nodes) }
+
+// Has reports whether the graph holds the node.
+func (g *Graph) Has(id string) bool {
+	_, ok := g.index[id]
+	return ok
+}
+
+// Kind returns the kind of a node, or "" if the graph does not hold it.
+func (g *Graph) Kind(id string) string {
+	i, ok := g.index[id]
+	if !ok {
+		return ""
+	}
+	return g.nodeKinds[g.nodeKind[i]]
+}
+
+// EdgeKinds returns the edge kinds the graph holds, in Mask bit order.
+func (g *Graph) EdgeKinds() []string {
+	return append([]string(nil), g.edgeKinds...)
+}
+
+// Mask returns the mask of the given edge kinds, or AllKinds when none are
+// given. Kinds the graph does not hold match nothing.
+func (g *Graph) Mask(kinds ...string) Mask {
+	if len(kinds) == 0 {
+		return AllKinds
+	}
+	var m Mask
+	for _, k := range kinds {
+		for bit, name := range g.edgeKinds {
+			if name == k {
+				m |= 1 << bit
+			}
+		}
+	}
+	return m
+}
+
+// node returns the index of id.
+func (g *Graph) node(id string) (int32, error) {
+	i, ok := g.index[id]
+	if !ok {
+		return 0, fmt.Errorf("node %s is not in the graph", id)
+	}
+	return i, nil
+}
+
+// each calls fn for every edge of node i that mask admits, in dir, with the
+// node at the far end; forward reports whether the edge was followed from
+// source to target.
+func (g *Graph) each(i int32, dir Direction, mask Mask, fn func(next int32, kind uint8, forward bool)) {
+	if dir != Backward {
+		for e := g.out.offsets[i]; e < g.out.offsets[i+1]; e++ {
+			if mask&(1<<g.out.kinds[e]) != 0 {
+				fn(g.out.nodes[e], g.out.kinds[e], true)
+			}
+		}
+	}
+	if dir != Forward {
+		for e := g.in.offsets[i]; e < g.in.offsets[i+1]; e++ {
+			if mask&(1<<g.in.kinds[e]) != 0 {
+				fn(g.in.nodes[e], g.in.kinds[e], false)
+			}
+		}
+	}
+}
+
+// edge returns the graph edge followed from node i to next.
+func (g *Graph) edge(i, next int32, kind uint8, forward bool) Edge {
+	if forward {
+		return Edge{Source: g.ids[i], Target: g.ids[next], Kind: g.edgeKinds[kind]}
+	}
+	return Edge{Source: g.ids[next], Target: g.ids[i], Kind: g.edgeKinds[kind]}
+}
+
+// Builder accumulates nodes and edges for a Graph.
+type Builder struct {
+	g         *Graph
+	nodeKinds map[string]uint16
+	edgeKinds map[string]uint8
+	src, dst  []int32
+	kinds     []uint8
+	err       error
+}
+
+// NewBuilder returns an empty Builder.
+func NewBuilder() *Builder {
+	return &Builder{
+		g:         &Graph{index: make(map[string]int32)},
+		nodeKinds: make(map[string]uint16),
+		edgeKinds: make(map[string]uint8),
+	}
+}
+
+// AddNode adds a node; adding an ID again keeps the first kind.
+func (b *Builder) AddNode(id, kind string) {
+	if _, ok := b.g.index[id]; ok {
+		return
+	}
+	k, ok := b.nodeKinds[kind]
+	if !ok {
+		k = uint16(len(b.g.nodeKinds))
+		b.nodeKinds[kind] = k
+		b.g.nodeKinds = append(b.g.nodeKinds, kind)
+	}
+	b.g.index[id] = int32(len(b.g.ids))
+	b.g.ids = append(b.g.ids, id)
+	b.g.nodeKind = append(b.g.nodeKind, k)
+}
+
+// AddEdge adds an edge between two added nodes and reports whether it did:
+// edges with an end that is not in the graph (a node kind left out of the
+// load) are dropped.
+func (b *Builder) AddEdge(source, target, kind string) bool {
+	s, ok := b.g.index[source]
+	if !ok {
+		return false
+	}
+	t, ok := b.g.index[target]
+	if !ok {
+		return false
+	}
+	k, ok := b.edgeKinds[kind]
+	if !ok {
+		if len(b.g.edgeKinds) == maxEdgeKinds {
+			if b.err == nil {
+				b.err = fmt.Errorf("edge kind %s: more than %d edge kinds", kind, maxEdgeKinds)
+			}
+			return false
+		}
+		k = uint8(len(b.g.edgeKinds))
+		b.edgeKinds[kind] = k
+		b.g.edgeKinds = append(b.g.edgeKinds, kind)
+	}
+	b.src = append(b.src, s)
+	b.dst = append(b.dst, t)
+	b.kinds = append(b.kinds, k)
+	return true
+}
+
+// Build returns the graph. The Builder must not be used afterwards.
+func (b *Builder) Build() (*Graph, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	order := make([]int32, len(b.src))
+	for i := range order {
+		order[i] = int32(i)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		x, y := order[i], order[j]
+		if b.src[x] != b.src[y] {
+			return b.src[x] < b.src[y]
+		}
+		if b.dst[x] != b.dst[y] {
+			return b.dst[x] < b.dst[y]
+		}
+		return b.kinds[x] < b.kinds[y]
+	})
+	n := len(b.g.ids)
+	// The in lists are filled in (source, target) order, so each comes out
+	// sorted by source
+	b.g.out = fill(n, order, b.src, b.dst, b.kinds)
+	b.g.in = fill(n, order, b.dst, b.src, b.kinds)
+	g := b.g
+	*b = Builder{}
+	return g, nil
+}
+
+// fill lays the edges out by from node, in the given order within each.
+func fill(n int, order, from, to []int32, kinds []uint8) adjacency {
+	a := adjacency{
+		offsets: make([]int32, n+1),
+		nodes:   make([]int32, len(order)),
+		kinds:   make([]uint8, len(order)),
+	}
+	for _, f := range from {
+		a.offsets[f+1]++
+	}
+	for i := 1; i <= n; i++ {
+		a.offsets[i] += a.offsets[i-1]
+	}
+	next := append([]int32(nil), a.offsets[:n]...)
+	for _, e := range order {
+		f := from[e]
+		a.nodes[next[f]] = to[e]
+		a.kinds[next[f]] = kinds[e]
+		next[f]++
+	}
+	return a
+}
@@ -0,0 +1,182 @@
+package mem
+
+import "errors"
+
+// ErrNoPath is returned by ShortestPath when the target is not reachable.
+var ErrNoPath = errors.New("no path")
+
+// Reached is a node a traversal reached, with its distance in edges from
+// the start.
+type Reached struct {
+	ID    string
+	Depth int
+}
+
+// BFS walks breadth-first from start along the edges mask admits, calling
+// visit once per node reached within maxDepth edges (0 = unlimited), the
+// start first at depth 0. Neighbors are visited in node index order. It
+// stops early when visit returns false.
+func (g *Graph) BFS(start string, dir Direction, mask Mask, maxDepth int, visit func(id string, depth int) bool) error {
+	s, err := g.node(start)
+	if err != nil {
+		return err
+	}
+	if !visit(g.ids[s], 0) {
+		return nil
+	}
+	seen := map[int32]bool{s: true}
+	frontier := []int32{s}
+	for depth := 1; len(frontier) > 0 && (maxDepth <= 0 || depth <= maxDepth); depth++ {
+		var next []int32
+		stopped := false
+		for _, i := range frontier {
+			g.each(i, dir, mask, func(n int32, _ uint8, _ bool) {
+				if stopped || seen[n] {
+					return
+				}
+				seen[n] = true
+				next = append(next, n)
+				stopped = !visit(g.ids[n], depth)
+			})
+			if stopped {
+				return nil
+			}
+		}
+		frontier = next
+	}
+	return nil
+}
+
+// Neighborhood returns the nodes within k edges of start (k = 0 is the
+// start alone), in BFS order.
+func (g *Graph) Neighborhood(start string, dir Direction, mask Mask, k int) ([]Reached, error) {
+	var reached []Reached
+	err := g.BFS(start, dir, mask, max(k, 0), func(id string, depth int) bool {
+		if k <= 0 && depth > 0 {
+			return false
+		}
+		reached = append(reached, Reached{ID: id, Depth: depth})
+		return true
+	})
+	return reached, err
+}
+
+// Neighbors returns the distinct nodes one edge away from id, in node index
+// order for a single direction.
+func (g *Graph) Neighbors(id string, dir Direction, mask Mask) ([]string, error) {
+	i, err := g.node(id)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	seen := make(map[int32]bool)
+	g.each(i, dir, mask, func(n int32, _ uint8, _ bool) {
+		if !seen[n] {
+			seen[n] = true
+			ids = append(ids, g.ids[n])
+		}
+	})
+	return ids, nil
+}
+
+// Reachable reports whether to can be reached from from within maxDepth
+// edges (0 = unlimited).
+func (g *Graph) Reachable(from, to string, dir Direction, mask Mask, maxDepth int) (bool, error) {
+	_, err := g.ShortestPath(from, to, dir, mask, maxDepth)
+	if errors.Is(err, ErrNoPath) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// step is how a search reached a node: the node before it and the edge
+// between them.
+type step struct {
+	prev    int32
+	kind    uint8
+	forward bool // the edge was followed from source to target
+	depth   int
+}
+
+// ShortestPath returns the edges of a shortest path of at most maxDepth
+// edges (0 = unlimited) from one node to another, in walking order, or
+// ErrNoPath; the path from a node to itself is empty. The edges keep their
+// own direction, so a Backward path lists each edge target first. It
+// searches from both ends at once, each round growing the smaller frontier
+// by a full level.
+func (g *Graph) ShortestPath(from, to string, dir Direction, mask Mask, maxDepth int) ([]Edge, error) {
+	s, err := g.node(from)
+	if err != nil {
+		return nil, err
+	}
+	t, err := g.node(to)
+	if err != nil {
+		return nil, err
+	}
+	if s == t {
+		return nil, nil
+	}
+	// The search from the target walks the other way
+	rdir := dir
+	switch dir {
+	case Forward:
+		rdir = Backward
+	case Backward:
+		rdir = Forward
+	}
+
+	fwd := map[int32]step{s: {prev: -1}}
+	bwd := map[int32]step{t: {prev: -1}}
+	ff, bf := []int32{s}, []int32{t}
+	for len(ff) > 0 && len(bf) > 0 {
+		fd, bd := fwd[ff[0]].depth, bwd[bf[0]].depth
+		if maxDepth > 0 && fd+bd >= maxDepth {
+			break
+		}
+		// Grow one side by a full level; the best meeting node of that
+		// level closes a shortest path
+		grow, other, frontier, d := fwd, bwd, &ff, dir
+		if len(bf) < len(ff) {
+			grow, other, frontier, d = bwd, fwd, &bf, rdir
+		}
+		var next []int32
+		meet, best := int32(-1), 0
+		for _, i := range *frontier {
+			g.each(i, d, mask, func(n int32, kind uint8, forward bool) {
+				if _, seen := grow[n]; seen {
+					return
+				}
+				grow[n] = step{prev: i, kind: kind, forward: forward, depth: grow[i].depth + 1}
+				next = append(next, n)
+				if o, ok := other[n]; ok && (meet < 0 || o.depth < best) {
+					meet, best = n, o.depth
+				}
+			})
+		}
+		if meet >= 0 {
+			return g.joinPath(fwd, bwd, meet), nil
+		}
+		*frontier = next
+	}
+	return nil, ErrNoPath
+}
+
+// joinPath returns the path from the start of the fwd search through meet
+// to the start of the bwd search.
+func (g *Graph) joinPath(fwd, bwd map[int32]step, meet int32) []Edge {
+	var path []Edge
+	for i := meet; fwd[i].prev >= 0; i = fwd[i].prev {
+		st := fwd[i]
+		path = append(path, g.edge(st.prev, i, st.kind, st.forward))
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	for i := meet; bwd[i].prev >= 0; i = bwd[i].prev {
+		st := bwd[i]
+		// The bwd search walked from the far end towards meet; the edge
+		// it followed from st.prev to i is walked from i to st.prev here
+		path = append(path, g.edge(i, st.prev, st.kind, !st.forward))
+	}
+	return path
+}
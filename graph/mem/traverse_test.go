@@ -0,0 +1,148 @@
+package mem
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testGraph builds
+//
+//	a -call-> b -call-> c -call-> d
+//	a -ref--> d
+//	b -call-> e
+//
+// and a node x without edges.
+func testGraph(t *testing.T) *Graph {
+	t.Helper()
+	b := NewBuilder()
+	for _, id := range []string{"a", "b", "c", "d", "e", "x"} {
+		b.AddNode(id, "function")
+	}
+	for _, e := range []Edge{
+		{"a", "b", "call"}, {"b", "c", "call"}, {"c", "d", "call"},
+		{"a", "d", "ref"}, {"b", "e", "call"},
+	} {
+		if !b.AddEdge(e.Source, e.Target, e.Kind) {
+			t.Fatalf("AddEdge(%v) dropped the edge", e)
+		}
+	}
+	if b.AddEdge("a", "missing", "call") {
+		t.Fatal("AddEdge to a missing node added the edge")
+	}
+	g, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestShortestPath(t *testing.T) {
+	g := testGraph(t)
+	tests := []struct {
+		name     string
+		from, to string
+		dir      Direction
+		kinds    []string
+		maxDepth int
+		want     []Edge
+		wantErr  error
+	}{
+		{
+			name: "any kind", from: "a", to: "d", dir: Forward,
+			want: []Edge{{"a", "d", "ref"}},
+		},
+		{
+			name: "calls only", from: "a", to: "d", dir: Forward, kinds: []string{"call"},
+			want: []Edge{{"a", "b", "call"}, {"b", "c", "call"}, {"c", "d", "call"}},
+		},
+		{
+			name: "within the depth", from: "a", to: "d", dir: Forward, kinds: []string{"call"}, maxDepth: 3,
+			want: []Edge{{"a", "b", "call"}, {"b", "c", "call"}, {"c", "d", "call"}},
+		},
+		{
+			name: "beyond the depth", from: "a", to: "d", dir: Forward, kinds: []string{"call"}, maxDepth: 2,
+			wantErr: ErrNoPath,
+		},
+		{
+			name: "against the edges", from: "d", to: "a", dir: Forward,
+			wantErr: ErrNoPath,
+		},
+		{
+			name: "backward keeps the edge direction", from: "d", to: "a", dir: Backward, kinds: []string{"call"},
+			want: []Edge{{"c", "d", "call"}, {"b", "c", "call"}, {"a", "b", "call"}},
+		},
+		{
+			name: "both ways", from: "e", to: "c", dir: Both,
+			want: []Edge{{"b", "e", "call"}, {"b", "c", "call"}},
+		},
+		{
+			name: "same node", from: "a", to: "a", dir: Forward,
+		},
+		{
+			name: "unreachable node", from: "a", to: "x", dir: Both,
+			wantErr: ErrNoPath,
+		},
+		{
+			name: "kind the graph lacks", from: "a", to: "b", dir: Forward, kinds: []string{"imports"},
+			wantErr: ErrNoPath,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := g.ShortestPath(tt.from, tt.to, tt.dir, g.Mask(tt.kinds...), tt.maxDepth)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ShortestPath() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ShortestPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := g.ShortestPath("a", "missing", Forward, AllKinds, 0); err == nil || errors.Is(err, ErrNoPath) {
+		t.Errorf("ShortestPath() to a missing node: error = %v, want one naming the node", err)
+	}
+}
+
+func TestMask(t *testing.T) {
+	g := testGraph(t)
+	call, ref := g.Mask("call"), g.Mask("ref")
+	if call == 0 || ref == 0 || call&ref != 0 {
+		t.Fatalf("Mask(call) = %b, Mask(ref) = %b: want distinct non-empty masks", call, ref)
+	}
+	if got := g.Mask("call", "ref"); got != call|ref {
+		t.Errorf("Mask(call, ref) = %b, want %b", got, call|ref)
+	}
+	if got := g.Mask(); got != AllKinds {
+		t.Errorf("Mask() = %b, want AllKinds", got)
+	}
+	if got := g.Mask("imports"); got != 0 {
+		t.Errorf("Mask(imports) = %b, want 0", got)
+	}
+
+	tests := []struct {
+		id   string
+		dir  Direction
+		mask Mask
+		want []string
+	}{
+		{"a", Forward, AllKinds, []string{"b", "d"}},
+		{"a", Forward, call, []string{"b"}},
+		{"a", Forward, ref, []string{"d"}},
+		{"d", Backward, AllKinds, []string{"a", "c"}},
+		{"d", Backward, call, []string{"c"}},
+		{"b", Both, call, []string{"c", "e", "a"}},
+		{"b", Both, ref, nil},
+		{"a", Forward, 0, nil},
+	}
+	for _, tt := range tests {
+		got, err := g.Neighbors(tt.id, tt.dir, tt.mask)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Neighbors(%s, %d, %b) = %v, want %v", tt.id, tt.dir, tt.mask, got, tt.want)
+		}
+	}
+}
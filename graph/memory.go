@@ -0,0 +1,44 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"cpg-gen/graph/mem"
+)
+
+// Memory loads the graph, or the node and edge kinds opts select, into an
+// in-memory mem.Graph for traversals that would take many queries here.
+func (db *DB) Memory(ctx context.Context, opts mem.LoadOptions) (*mem.Graph, error) {
+	b := mem.NewBuilder()
+	err := db.with(ctx, func(conn *sqlite.Conn) error {
+		query, args := opts.NodeQuery()
+		if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+			Args: args,
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				b.AddNode(stmt.ColumnText(0), stmt.ColumnText(1))
+				return nil
+			},
+		}); err != nil {
+			return fmt.Errorf("load nodes: %w", err)
+		}
+		query, args = opts.EdgeQuery()
+		if err := sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+			Args: args,
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				b.AddEdge(stmt.ColumnText(0), stmt.ColumnText(1), stmt.ColumnText(2))
+				return nil
+			},
+		}); err != nil {
+			return fmt.Errorf("load edges: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.Build()
+}
@@ -0,0 +1,40 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"cpg-gen/graph/schema"
+)
+
+// SchemaVersion returns the schema version of the database.
+func (db *DB) SchemaVersion() int { return db.version }
+
+// Meta returns the schema version and the cpg_meta entries: the provenance
+// of the run that wrote the database. For a database written before
+// cpg_meta existed they are derived from its META_DATA node.
+func (db *DB) Meta(ctx context.Context) (*schema.Meta, error) {
+	m := &schema.Meta{Version: db.version, Values: make(map[string]string)}
+	err := db.with(ctx, func(conn *sqlite.Conn) error {
+		if db.version == schema.Legacy {
+			m.Values = schema.LegacyValues("")
+			return sqlitex.ExecuteTransient(conn, schema.LegacyQuery, &sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error {
+					m.Values = schema.LegacyValues(stmt.ColumnText(0))
+					return nil
+				}})
+		}
+		return sqlitex.ExecuteTransient(conn, schema.MetaQuery, &sqlitex.ExecOptions{
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				m.Values[stmt.ColumnText(0)] = stmt.ColumnText(1)
+				return nil
+			}})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("meta: %w", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,529 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// A Pattern is a path pattern over the graph in a small Cypher-like syntax:
+// nodes in parentheses joined by relationships in brackets, e.g.
+//
+//	(f:function {package:"scrape"})-[:call*1..4]->(g)<-[:call_site]-(c:call)
+//
+// A node is (var:kind|kind {key:value, ...}), every part optional. Keys
+// name a column of the nodes table (id, kind, name, file, line, col,
+// end_line, package, parent_function, type_info) or else a field of its
+// properties JSON; values are strings, numbers, true, false or null, and
+// compare for equality.
+//
+// A relationship is -[var:kind|kind*min..max]-> or <-[...]- against the edge
+// direction, every part optional; --> and <-- match any single edge. Without
+// '*' it matches one edge. '*' alone means 1 or more edges, '*n' exactly n,
+// and either bound of '*min..max' may be left out (min defaults to 1, max
+// to MatchOptions.MaxHops). A variable-length relationship is a
+// reachability test: it matches once when the far node is reachable within
+// the bounds, however many routes lead there.
+//
+// Named variables are returned: a node as two columns, its ID under the
+// variable name and its name under var_name; a single-edge relationship as
+// its kind, a variable-length one as its shortest length in edges. When no
+// variable is named every node is returned, as n1, n2, ....
+type Pattern struct {
+	Nodes []NodePattern
+	Rels  []RelPattern // Rels[i] joins Nodes[i] to Nodes[i+1]
+}
+
+// NodePattern matches one node.
+type NodePattern struct {
+	Var   string
+	Kinds []string // any of; empty matches every kind
+	Props []Property
+}
+
+// Property is a key:value constraint; Value is a string, int64, float64,
+// bool or nil.
+type Property struct {
+	Key   string
+	Value any
+}
+
+// RelPattern matches the edges between two nodes.
+type RelPattern struct {
+	Var       string
+	Kinds     []string // any of; empty matches every kind
+	Backward  bool     // <-[...]-: the edge runs from the right node to the left
+	VarLength bool
+	Min, Max  int // hop bounds of a variable-length relationship; Max < 0 is unbounded
+}
+
+// DefaultMaxHops bounds a variable-length relationship without an upper
+// bound when MatchOptions.MaxHops is 0.
+const DefaultMaxHops = 10
+
+// MatchOptions control Match.
+type MatchOptions struct {
+	Limit   int           // maximum rows returned; 0 = unlimited
+	MaxHops int           // upper bound for '*' and '*n..'; 0 = DefaultMaxHops
+	Timeout time.Duration // abandon the query after this long; 0 = only ctx
+}
+
+// Match runs a path pattern (see Pattern) and returns one row per distinct
+// binding of its variables, ordered by the returned columns. A result cut
+// off by opts.Limit has Truncated set; a query cut off by opts.Timeout or
+// ctx fails with the context's error.
+func (db *DB) Match(ctx context.Context, pattern string, opts MatchOptions) (*Table, error) {
+	p, err := ParsePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sql, params, err := p.SQL(opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	var t *Table
+	err = db.with(ctx, func(conn *sqlite.Conn) error {
+		var err error
+		t, err = run(conn, sql, params)
+		return err
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("match: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("match: %w", err)
+	}
+	if opts.Limit > 0 && len(t.Rows) > opts.Limit {
+		t.Rows = t.Rows[:opts.Limit]
+		t.Truncated = true
+	}
+	return t, nil
+}
+
+// nodeColumnKeys are the property keys that name a column of nodes.
+var nodeColumnKeys = map[string]bool{
+	"id": true, "kind": true, "name": true, "file": true, "line": true, "col": true,
+	"end_line": true, "package": true, "parent_function": true, "type_info": true,
+}
+
+// SQL compiles the pattern into a single SELECT over nodes and edges with
+// named parameters. Variable-length relationships become recursive CTEs
+// that walk from whichever end node is constrained (the left one when both
+// or neither are) and keep one row per reached node and depth, so cycles
+// end at the hop bound instead of needing path bookkeeping.
+func (p *Pattern) SQL(opts MatchOptions) (string, map[string]any, error) {
+	if len(p.Nodes) == 0 || len(p.Rels) != len(p.Nodes)-1 {
+		return "", nil, fmt.Errorf("pattern: %d nodes and %d relationships", len(p.Nodes), len(p.Rels))
+	}
+	maxHops := opts.MaxHops
+	if maxHops <= 0 {
+		maxHops = DefaultMaxHops
+	}
+	params := make(map[string]any)
+	param := func(v any) string {
+		name := "p" + strconv.Itoa(len(params)+1)
+		params[name] = v
+		return ":" + name
+	}
+	kindIn := func(col string, kinds []string) string {
+		ps := make([]string, len(kinds))
+		for i, k := range kinds {
+			ps[i] = param(k)
+		}
+		return col + " IN (" + strings.Join(ps, ", ") + ")"
+	}
+	nodeConds := func(alias string, n NodePattern) []string {
+		var conds []string
+		if len(n.Kinds) > 0 {
+			conds = append(conds, kindIn(alias+".kind", n.Kinds))
+		}
+		for _, prop := range n.Props {
+			col := alias + "." + prop.Key
+			if !nodeColumnKeys[prop.Key] {
+				col = "json_extract(" + alias + ".properties, " + param("$."+prop.Key) + ")"
+			}
+			v := prop.Value
+			if b, ok := v.(bool); ok {
+				// json_extract yields JSON booleans as 1 and 0
+				v = int64(0)
+				if b {
+					v = int64(1)
+				}
+			}
+			if v == nil {
+				conds = append(conds, col+" IS NULL")
+			} else {
+				conds = append(conds, col+" = "+param(v))
+			}
+		}
+		return conds
+	}
+
+	var (
+		ctes, cols, joins, where []string
+		named                    = make(map[string]string) // variable → "node" or "rel"
+		firstNode                = make(map[string]int)
+	)
+	returnAll := true
+	for _, n := range p.Nodes {
+		returnAll = returnAll && n.Var == ""
+	}
+	for _, r := range p.Rels {
+		returnAll = returnAll && r.Var == ""
+	}
+
+	for i, n := range p.Nodes {
+		alias := "n" + strconv.Itoa(i)
+		if i == 0 {
+			joins = append(joins, "FROM nodes n0")
+		} else {
+			r := p.Rels[i-1]
+			prev := "n" + strconv.Itoa(i-1)
+			from, to := "source", "target"
+			if r.Backward {
+				from, to = to, from
+			}
+			if !r.VarLength {
+				e := "e" + strconv.Itoa(i)
+				joins = append(joins,
+					fmt.Sprintf("JOIN edges %s ON %s.%s = %s.id", e, e, from, prev),
+					fmt.Sprintf("JOIN nodes %s ON %s.id = %s.%s", alias, alias, e, to))
+				if len(r.Kinds) > 0 {
+					where = append(where, kindIn(e+".kind", r.Kinds))
+				}
+				if r.Var != "" {
+					cols = append(cols, e+".kind AS "+quoteIdent(r.Var))
+				}
+			} else {
+				// Walk from the constrained end; walking from the right
+				// follows the edges the other way
+				seed, prevCol, nextCol := p.Nodes[i-1], "start", "node"
+				if len(seed.Kinds) == 0 && len(seed.Props) == 0 && (len(n.Kinds) > 0 || len(n.Props) > 0) {
+					seed, prevCol, nextCol = n, "node", "start"
+					from, to = to, from
+				}
+				w, m := "w"+strconv.Itoa(i), "m"+strconv.Itoa(i)
+				hi := r.Max
+				if hi < 0 {
+					hi = maxHops
+				}
+				seedWhere := ""
+				if conds := nodeConds("n", seed); len(conds) > 0 {
+					seedWhere = " WHERE " + strings.Join(conds, " AND ")
+				}
+				step := fmt.Sprintf("SELECT w.start, e.%s, w.depth + 1 FROM %s w JOIN edges e ON e.%s = w.node WHERE w.depth < %d", to, w, from, hi)
+				if len(r.Kinds) > 0 {
+					step += " AND " + kindIn("e.kind", r.Kinds)
+				}
+				ctes = append(ctes,
+					fmt.Sprintf("%s(start, node, depth) AS (\n  SELECT n.id, n.id, 0 FROM nodes n%s\n  UNION\n  %s\n)", w, seedWhere, step),
+					fmt.Sprintf("%s(start, node, depth) AS (\n  SELECT start, node, MIN(depth) FROM %s WHERE depth >= %d GROUP BY start, node\n)", m, w, r.Min))
+				joins = append(joins,
+					fmt.Sprintf("JOIN %s ON %s.%s = %s.id", m, m, prevCol, prev),
+					fmt.Sprintf("JOIN nodes %s ON %s.id = %s.%s", alias, alias, m, nextCol))
+				if r.Var != "" {
+					cols = append(cols, m+".depth AS "+quoteIdent(r.Var))
+				}
+			}
+			if r.Var != "" {
+				if named[r.Var] != "" {
+					return "", nil, fmt.Errorf("pattern: variable %s used twice", r.Var)
+				}
+				named[r.Var] = "rel"
+			}
+		}
+
+		where = append(where, nodeConds(alias, n)...)
+		switch {
+		case n.Var == "" && returnAll:
+			name := "n" + strconv.Itoa(i+1)
+			cols = append(cols, alias+".id AS "+name, alias+".name AS "+name+"_name")
+		case n.Var == "":
+		case named[n.Var] == "rel":
+			return "", nil, fmt.Errorf("pattern: variable %s names both a node and a relationship", n.Var)
+		case named[n.Var] == "node":
+			// The same node again, e.g. (f)-[:call]->(f)
+			where = append(where, fmt.Sprintf("%s.id = n%d.id", alias, firstNode[n.Var]))
+		default:
+			named[n.Var] = "node"
+			firstNode[n.Var] = i
+			cols = append(cols, alias+".id AS "+quoteIdent(n.Var), alias+".name AS "+quoteIdent(n.Var+"_name"))
+		}
+	}
+
+	var b strings.Builder
+	if len(ctes) > 0 {
+		b.WriteString("WITH RECURSIVE\n" + strings.Join(ctes, ",\n") + "\n")
+	}
+	b.WriteString("SELECT DISTINCT " + strings.Join(cols, ", ") + "\n" + strings.Join(joins, "\n"))
+	if len(where) > 0 {
+		b.WriteString("\nWHERE " + strings.Join(where, "\n  AND "))
+	}
+	order := make([]string, len(cols))
+	for i := range order {
+		order[i] = strconv.Itoa(i + 1)
+	}
+	b.WriteString("\nORDER BY " + strings.Join(order, ", "))
+	if opts.Limit > 0 {
+		// One more than asked tells Match the result was cut off
+		fmt.Fprintf(&b, "\nLIMIT %d", opts.Limit+1)
+	}
+	return b.String(), params, nil
+}
+
+func quoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// ParsePattern parses a path pattern (see Pattern).
+func ParsePattern(s string) (*Pattern, error) {
+	ps := &patternParser{s: s}
+	p := new(Pattern)
+	n, err := ps.node()
+	if err != nil {
+		return nil, err
+	}
+	p.Nodes = append(p.Nodes, n)
+	for {
+		ps.space()
+		if ps.pos == len(ps.s) {
+			return p, nil
+		}
+		r, err := ps.rel()
+		if err != nil {
+			return nil, err
+		}
+		n, err := ps.node()
+		if err != nil {
+			return nil, err
+		}
+		p.Rels = append(p.Rels, r)
+		p.Nodes = append(p.Nodes, n)
+	}
+}
+
+type patternParser struct {
+	s   string
+	pos int
+}
+
+func (ps *patternParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("pattern: at offset %d: %s", ps.pos, fmt.Sprintf(format, args...))
+}
+
+func (ps *patternParser) space() {
+	for ps.pos < len(ps.s) && strings.IndexByte(" \t\r\n", ps.s[ps.pos]) >= 0 {
+		ps.pos++
+	}
+}
+
+// accept consumes tok if it comes next.
+func (ps *patternParser) accept(tok string) bool {
+	ps.space()
+	if strings.HasPrefix(ps.s[ps.pos:], tok) {
+		ps.pos += len(tok)
+		return true
+	}
+	return false
+}
+
+func (ps *patternParser) expect(tok string) error {
+	if !ps.accept(tok) {
+		return ps.errorf("expected %q", tok)
+	}
+	return nil
+}
+
+// ident consumes an identifier, returning "" if none comes next.
+func (ps *patternParser) ident() string {
+	ps.space()
+	start := ps.pos
+	for ps.pos < len(ps.s) {
+		c := ps.s[ps.pos]
+		if c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || ps.pos > start && '0' <= c && c <= '9' {
+			ps.pos++
+			continue
+		}
+		break
+	}
+	return ps.s[start:ps.pos]
+}
+
+// kinds parses ":kind|kind..." if it comes next.
+func (ps *patternParser) kinds() ([]string, error) {
+	if !ps.accept(":") {
+		return nil, nil
+	}
+	var kinds []string
+	for {
+		k := ps.ident()
+		if k == "" {
+			return nil, ps.errorf("expected a kind")
+		}
+		kinds = append(kinds, k)
+		if !ps.accept("|") {
+			return kinds, nil
+		}
+	}
+}
+
+func (ps *patternParser) node() (NodePattern, error) {
+	var n NodePattern
+	if err := ps.expect("("); err != nil {
+		return n, err
+	}
+	n.Var = ps.ident()
+	var err error
+	if n.Kinds, err = ps.kinds(); err != nil {
+		return n, err
+	}
+	if ps.accept("{") {
+		for !ps.accept("}") {
+			if len(n.Props) > 0 {
+				if err := ps.expect(","); err != nil {
+					return n, err
+				}
+			}
+			key := ps.ident()
+			if key == "" {
+				return n, ps.errorf("expected a property key")
+			}
+			if err := ps.expect(":"); err != nil {
+				return n, err
+			}
+			v, err := ps.value()
+			if err != nil {
+				return n, err
+			}
+			n.Props = append(n.Props, Property{Key: key, Value: v})
+		}
+	}
+	return n, ps.expect(")")
+}
+
+func (ps *patternParser) value() (any, error) {
+	ps.space()
+	if ps.pos == len(ps.s) {
+		return nil, ps.errorf("expected a value")
+	}
+	switch c := ps.s[ps.pos]; {
+	case c == '"' || c == '\'':
+		start := ps.pos
+		var b strings.Builder
+		for ps.pos++; ps.pos < len(ps.s); ps.pos++ {
+			switch ps.s[ps.pos] {
+			case c:
+				ps.pos++
+				return b.String(), nil
+			case '\\':
+				ps.pos++
+				if ps.pos == len(ps.s) {
+					break
+				}
+				switch e := ps.s[ps.pos]; e {
+				case 'n':
+					b.WriteByte('\n')
+				case 't':
+					b.WriteByte('\t')
+				default:
+					b.WriteByte(e)
+				}
+			default:
+				b.WriteByte(ps.s[ps.pos])
+			}
+		}
+		ps.pos = start
+		return nil, ps.errorf("unterminated string")
+	case c == '-' || '0' <= c && c <= '9':
+		start := ps.pos
+		for ps.pos++; ps.pos < len(ps.s) && strings.IndexByte("0123456789.eE+-", ps.s[ps.pos]) >= 0; ps.pos++ {
+		}
+		lit := ps.s[start:ps.pos]
+		if i, err := strconv.ParseInt(lit, 10, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(lit, 64); err == nil {
+			return f, nil
+		}
+		ps.pos = start
+		return nil, ps.errorf("invalid number %q", lit)
+	}
+	start := ps.pos
+	switch word := ps.ident(); word {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	default:
+		ps.pos = start
+		return nil, ps.errorf("expected a string, number, true, false or null")
+	}
+}
+
+func (ps *patternParser) rel() (RelPattern, error) {
+	r := RelPattern{Min: 1, Max: 1}
+	if ps.accept("<-") {
+		r.Backward = true
+	} else if err := ps.expect("-"); err != nil {
+		return r, ps.errorf("expected a relationship or the end of the pattern")
+	}
+	if ps.accept("[") {
+		r.Var = ps.ident()
+		var err error
+		if r.Kinds, err = ps.kinds(); err != nil {
+			return r, err
+		}
+		if ps.accept("*") {
+			r.VarLength = true
+			r.Min, r.Max = 1, -1
+			lo, hasLo := ps.int()
+			switch {
+			case ps.accept(".."):
+				if hasLo {
+					r.Min = lo
+				}
+				if hi, ok := ps.int(); ok {
+					r.Max = hi
+				}
+			case hasLo:
+				r.Min, r.Max = lo, lo
+			}
+			if r.Max >= 0 && r.Max < r.Min {
+				return r, ps.errorf("empty hop range %d..%d", r.Min, r.Max)
+			}
+		}
+		if err := ps.expect("]"); err != nil {
+			return r, err
+		}
+	}
+	if r.Backward {
+		return r, ps.expect("-")
+	}
+	return r, ps.expect("->")
+}
+
+// int consumes a non-negative integer if one comes next.
+func (ps *patternParser) int() (int, bool) {
+	ps.space()
+	start := ps.pos
+	for ps.pos < len(ps.s) && '0' <= ps.s[ps.pos] && ps.s[ps.pos] <= '9' {
+		ps.pos++
+	}
+	n, err := strconv.Atoi(ps.s[start:ps.pos])
+	if err != nil {
+		ps.pos = start
+		return 0, false
+	}
+	return n, true
+}
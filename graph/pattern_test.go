@@ -0,0 +1,264 @@
+package graph
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    *Pattern
+		wantErr string
+	}{
+		{
+			pattern: "()",
+			want:    &Pattern{Nodes: []NodePattern{{}}},
+		},
+		{
+			pattern: `(f:function|method {package:"scrape", line: 12, exported:true, doc:null})`,
+			want: &Pattern{Nodes: []NodePattern{{
+				Var:   "f",
+				Kinds: []string{"function", "method"},
+				Props: []Property{
+					{Key: "package", Value: "scrape"},
+					{Key: "line", Value: int64(12)},
+					{Key: "exported", Value: true},
+					{Key: "doc", Value: nil},
+				},
+			}}},
+		},
+		{
+			pattern: `({name:'a\'b\n', score:-1.5})`,
+			want: &Pattern{Nodes: []NodePattern{{Props: []Property{
+				{Key: "name", Value: "a'b\n"},
+				{Key: "score", Value: -1.5},
+			}}}},
+		},
+		{
+			pattern: "(a)-->(b)<--(c)",
+			want: &Pattern{
+				Nodes: []NodePattern{{Var: "a"}, {Var: "b"}, {Var: "c"}},
+				Rels:  []RelPattern{{Min: 1, Max: 1}, {Backward: true, Min: 1, Max: 1}},
+			},
+		},
+		{
+			pattern: "(f:function)-[r:call|ref]->(g) <-[:call_site]- (c:call)",
+			want: &Pattern{
+				Nodes: []NodePattern{{Var: "f", Kinds: []string{"function"}}, {Var: "g"}, {Var: "c", Kinds: []string{"call"}}},
+				Rels: []RelPattern{
+					{Var: "r", Kinds: []string{"call", "ref"}, Min: 1, Max: 1},
+					{Kinds: []string{"call_site"}, Backward: true, Min: 1, Max: 1},
+				},
+			},
+		},
+		{
+			pattern: "(a)-[:call*]->(b)",
+			want: &Pattern{
+				Nodes: []NodePattern{{Var: "a"}, {Var: "b"}},
+				Rels:  []RelPattern{{Kinds: []string{"call"}, VarLength: true, Min: 1, Max: -1}},
+			},
+		},
+		{
+			pattern: "(a)-[*3]->(b)",
+			want: &Pattern{
+				Nodes: []NodePattern{{Var: "a"}, {Var: "b"}},
+				Rels:  []RelPattern{{VarLength: true, Min: 3, Max: 3}},
+			},
+		},
+		{
+			pattern: "(a)-[d*2..]->(b)-[*..4]->(c)-[*0..2]->(e)",
+			want: &Pattern{
+				Nodes: []NodePattern{{Var: "a"}, {Var: "b"}, {Var: "c"}, {Var: "e"}},
+				Rels: []RelPattern{
+					{Var: "d", VarLength: true, Min: 2, Max: -1},
+					{VarLength: true, Min: 1, Max: 4},
+					{VarLength: true, Min: 0, Max: 2},
+				},
+			},
+		},
+		{pattern: "", wantErr: `expected "("`},
+		{pattern: "(a", wantErr: `expected ")"`},
+		{pattern: "(a:)", wantErr: "expected a kind"},
+		{pattern: "({:1})", wantErr: "expected a property key"},
+		{pattern: "({a:1 b:2})", wantErr: `expected ","`},
+		{pattern: `({a:"x})`, wantErr: "unterminated string"},
+		{pattern: "({a:1.2.3})", wantErr: "invalid number"},
+		{pattern: "({a:yes})", wantErr: "expected a string, number"},
+		{pattern: "(a) (b)", wantErr: "expected a relationship"},
+		{pattern: "(a)-[:call]-(b)", wantErr: `expected "->"`},
+		{pattern: "(a)-[*3..2]->(b)", wantErr: "empty hop range 3..2"},
+		{pattern: "(a)-[:call->(b)", wantErr: `expected "]"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			got, err := ParsePattern(tt.pattern)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParsePattern() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePattern() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParsePattern() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// testDB writes a graph of three functions and their call sites to a
+// database and opens it:
+//
+//	main -call-> run -call-> stop, run -call-> run
+//	main -ref--> stop
+//	cs1 (in main) -call_site-> run
+func testDB(t *testing.T) *DB {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cpg.db")
+	conn, err := sqlite.OpenConn(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sqlitex.ExecuteScript(conn, `
+CREATE TABLE nodes (
+    id TEXT PRIMARY KEY, kind TEXT NOT NULL, name TEXT NOT NULL, file TEXT, line INTEGER,
+    col INTEGER, end_line INTEGER, package TEXT, parent_function TEXT, type_info TEXT, properties TEXT
+);
+CREATE TABLE edges (source TEXT NOT NULL, target TEXT NOT NULL, kind TEXT NOT NULL, properties TEXT);
+INSERT INTO nodes (id, kind, name, package, parent_function, properties) VALUES
+('main', 'function', 'main', 'cmd', NULL, '{"exported":false}'),
+('run', 'function', 'Run', 'scrape', NULL, '{"exported":true}'),
+('stop', 'function', 'Stop', 'scrape', NULL, '{"exported":true}'),
+('cs1', 'call', 'Run', 'cmd', 'main', NULL);
+INSERT INTO edges (source, target, kind) VALUES
+('main', 'run', 'call'), ('run', 'stop', 'call'), ('run', 'run', 'call'),
+('main', 'stop', 'ref'), ('cs1', 'run', 'call_site');
+`, nil)
+	if cerr := conn.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMatch(t *testing.T) {
+	db := testDB(t)
+	tests := []struct {
+		pattern string
+		opts    MatchOptions
+		columns []string
+		rows    [][]any
+	}{
+		{
+			pattern: `(f:function {package:"scrape"})`,
+			columns: []string{"f", "f_name"},
+			rows:    [][]any{{"run", "Run"}, {"stop", "Stop"}},
+		},
+		{
+			pattern: `(f {exported:false})`,
+			columns: []string{"f", "f_name"},
+			rows:    [][]any{{"main", "main"}},
+		},
+		{
+			pattern: `(f {parent_function:null, kind:"call"})`,
+			columns: []string{"f", "f_name"},
+		},
+		{
+			pattern: "(a)-[r]->(b {id:'stop'})",
+			columns: []string{"a", "a_name", "r", "b", "b_name"},
+			rows:    [][]any{{"main", "main", "ref", "stop", "Stop"}, {"run", "Run", "call", "stop", "Stop"}},
+		},
+		{
+			pattern: "(:function {name:'main'})-[:call]->()",
+			columns: []string{"n1", "n1_name", "n2", "n2_name"},
+			rows:    [][]any{{"main", "main", "run", "Run"}},
+		},
+		{
+			pattern: "(s:call)-[:call_site]->(f)<-[:call]-(f)",
+			columns: []string{"s", "s_name", "f", "f_name"},
+			rows:    [][]any{{"cs1", "Run", "run", "Run"}},
+		},
+		{
+			pattern: "(a {name:'main'})-[d:call*]->(b)",
+			columns: []string{"a", "a_name", "d", "b", "b_name"},
+			rows:    [][]any{{"main", "main", int64(1), "run", "Run"}, {"main", "main", int64(2), "stop", "Stop"}},
+		},
+		{
+			pattern: "(a)-[:call*2]->(b {name:'Stop'})",
+			columns: []string{"a", "a_name", "b", "b_name"},
+			rows:    [][]any{{"main", "main", "stop", "Stop"}, {"run", "Run", "stop", "Stop"}},
+		},
+		{
+			pattern: "(a {name:'main'})-[:call*..1]->(b)",
+			columns: []string{"a", "a_name", "b", "b_name"},
+			rows:    [][]any{{"main", "main", "run", "Run"}},
+		},
+		{
+			pattern: "(a {name:'main'})-[:call*0..0]->(b)",
+			columns: []string{"a", "a_name", "b", "b_name"},
+			rows:    [][]any{{"main", "main", "main", "main"}},
+		},
+		{
+			pattern: "(a {name:'main'})-[:call*]->(b)",
+			opts:    MatchOptions{MaxHops: 1},
+			columns: []string{"a", "a_name", "b", "b_name"},
+			rows:    [][]any{{"main", "main", "run", "Run"}},
+		},
+		{
+			pattern: "(f:function)",
+			opts:    MatchOptions{Limit: 2},
+			columns: []string{"f", "f_name"},
+			rows:    [][]any{{"main", "main"}, {"run", "Run"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			got, err := db.Match(context.Background(), tt.pattern, tt.opts)
+			if err != nil {
+				t.Fatalf("Match() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.Columns, tt.columns) {
+				t.Errorf("Match() columns = %v, want %v", got.Columns, tt.columns)
+			}
+			if len(got.Rows) != 0 || len(tt.rows) != 0 {
+				if !reflect.DeepEqual(got.Rows, tt.rows) {
+					t.Errorf("Match() rows = %v, want %v", got.Rows, tt.rows)
+				}
+			}
+			if want := tt.opts.Limit > 0; got.Truncated != want {
+				t.Errorf("Match() truncated = %v, want %v", got.Truncated, want)
+			}
+		})
+	}
+}
+
+func TestPatternSQLErrors(t *testing.T) {
+	for _, pattern := range []string{
+		"(a)-[a]->(b)",
+		"(a)-[r]->(b)-[r]->(c)",
+	} {
+		p, err := ParsePattern(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := p.SQL(MatchOptions{}); err == nil {
+			t.Errorf("SQL(%q) succeeded, want a variable error", pattern)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Query is a named entry of the queries table. Params lists its named
+// parameters without the leading ':' (for example "node_id").
+type Query struct {
+	Name        string
+	Description string
+	SQL         string
+	Params      []string
+}
+
+// Table is the result of a query: column names and one value per column
+// per row (int64, float64, string, []byte or nil).
+type Table struct {
+	Columns   []string
+	Rows      [][]any
+	Truncated bool // rows beyond a result limit were dropped (see Match)
+}
+
+// Queries returns the named queries, in name order.
+func (db *DB) Queries(ctx context.Context) ([]Query, error) {
+	var queries []Query
+	err := db.with(ctx, func(conn *sqlite.Conn) error {
+		err := sqlitex.ExecuteTransient(conn, `SELECT name, COALESCE(description, ''), sql FROM queries ORDER BY name`,
+			&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+				queries = append(queries, Query{
+					Name:        stmt.ColumnText(0),
+					Description: stmt.ColumnText(1),
+					SQL:         stmt.ColumnText(2),
+				})
+				return nil
+			}})
+		if err != nil {
+			return fmt.Errorf("queries: %w", err)
+		}
+		for i := range queries {
+			// A query that no longer prepares (schema drift) is listed without params
+			queries[i].Params, _ = queryParams(conn, queries[i].SQL)
+		}
+		return nil
+	})
+	return queries, err
+}
+
+// Query returns the named query, or ErrNotFound.
+func (db *DB) Query(ctx context.Context, name string) (*Query, error) {
+	var q *Query
+	err := db.with(ctx, func(conn *sqlite.Conn) error {
+		var err error
+		q, err = lookupQuery(conn, name)
+		return err
+	})
+	return q, err
+}
+
+func lookupQuery(conn *sqlite.Conn, name string) (*Query, error) {
+	var q *Query
+	err := sqlitex.Execute(conn, `SELECT name, COALESCE(description, ''), sql FROM queries WHERE name = ?`,
+		&sqlitex.ExecOptions{
+			Args: []any{name},
+			ResultFunc: func(stmt *sqlite.Stmt) error {
+				q = &Query{Name: stmt.ColumnText(0), Description: stmt.ColumnText(1), SQL: stmt.ColumnText(2)}
+				return nil
+			},
+		})
+	if err != nil {
+		return nil, fmt.Errorf("query %s: %w", name, err)
+	}
+	if q == nil {
+		return nil, fmt.Errorf("query %s: %w", name, ErrNotFound)
+	}
+	if q.Params, err = queryParams(conn, q.SQL); err != nil {
+		return nil, fmt.Errorf("query %s: %w", name, err)
+	}
+	return q, nil
+}
+
+// RunQuery runs the named query with params keyed by parameter name
+// (without ':'). Every parameter of the query must be given.
+func (db *DB) RunQuery(ctx context.Context, name string, params map[string]any) (*Table, error) {
+	var t *Table
+	err := db.with(ctx, func(conn *sqlite.Conn) error {
+		q, err := lookupQuery(conn, name)
+		if err != nil {
+			return err
+		}
+		if t, err = run(conn, q.SQL, params); err != nil {
+			return fmt.Errorf("query %s: %w", name, err)
+		}
+		return nil
+	})
+	return t, err
+}
+
+// RunSQL runs a single read-only SQL statement with named params, as
+// RunQuery does for stored queries.
+func (db *DB) RunSQL(ctx context.Context, sql string, params map[string]any) (*Table, error) {
+	var t *Table
+	err := db.with(ctx, func(conn *sqlite.Conn) error {
+		var err error
+		t, err = run(conn, sql, params)
+		return err
+	})
+	return t, err
+}
+
+// prepare prepares sql, which must be a single statement.
+func prepare(conn *sqlite.Conn, sql string) (*sqlite.Stmt, error) {
+	stmt, trailing, err := conn.PrepareTransient(sql)
+	if err != nil {
+		return nil, err
+	}
+	if rest := strings.TrimSpace(sql[len(sql)-trailing:]); rest != "" && rest != ";" {
+		stmt.Finalize()
+		return nil, fmt.Errorf("more than one statement")
+	}
+	return stmt, nil
+}
+
+func queryParams(conn *sqlite.Conn, sql string) ([]string, error) {
+	stmt, err := prepare(conn, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+	var params []string
+	for i := 1; i <= stmt.BindParamCount(); i++ {
+		if name := stmt.BindParamName(i); name != "" {
+			params = append(params, name[1:])
+		}
+	}
+	return params, nil
+}
+
+func run(conn *sqlite.Conn, sql string, params map[string]any) (*Table, error) {
+	stmt, err := prepare(conn, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Finalize()
+
+	var missing []string
+	for i := 1; i <= stmt.BindParamCount(); i++ {
+		name := stmt.BindParamName(i)
+		if name == "" {
+			return nil, fmt.Errorf("positional parameter %d: only named parameters are supported", i)
+		}
+		v, ok := params[name[1:]]
+		if !ok {
+			missing = append(missing, name[1:])
+			continue
+		}
+		if err := bind(stmt, i, v); err != nil {
+			return nil, fmt.Errorf("parameter %s: %w", name[1:], err)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("missing parameters: %s", strings.Join(missing, ", "))
+	}
+
+	t := &Table{Columns: make([]string, stmt.ColumnCount())}
+	for i := range t.Columns {
+		t.Columns[i] = stmt.ColumnName(i)
+	}
+	for {
+		hasRow, err := stmt.Step()
+		if err != nil {
+			return nil, err
+		}
+		if !hasRow {
+			break
+		}
+		row := make([]any, len(t.Columns))
+		for i := range row {
+			switch stmt.ColumnType(i) {
+			case sqlite.TypeInteger:
+				row[i] = stmt.ColumnInt64(i)
+			case sqlite.TypeFloat:
+				row[i] = stmt.ColumnFloat(i)
+			case sqlite.TypeText:
+				row[i] = stmt.ColumnText(i)
+			case sqlite.TypeBlob:
+				row[i] = stmt.ColumnBytes(i, make([]byte, stmt.ColumnLen(i)))
+			}
+		}
+		t.Rows = append(t.Rows, row)
+	}
+	return t, nil
+}
+
+func bind(stmt *sqlite.Stmt, i int, v any) error {
+	switch v := v.(type) {
+	case nil:
+		stmt.BindNull(i)
+	case string:
+		stmt.BindText(i, v)
+	case int:
+		stmt.BindInt64(i, int64(v))
+	case int64:
+		stmt.BindInt64(i, v)
+	case float64:
+		stmt.BindFloat(i, v)
+	case bool:
+		stmt.BindBool(i, v)
+	case []byte:
+		stmt.BindBytes(i, v)
+	default:
+		return fmt.Errorf("unsupported type %T", v)
+	}
+	return nil
+}
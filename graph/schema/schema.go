@@ -0,0 +1,169 @@
+// Package schema versions the CPG database schema. cpg-gen stores Version in
+// the database header (PRAGMA user_version) and in the cpg_meta table, along
+// with the provenance of the run that wrote it; readers call Check on the
+// stored version before relying on the tables, and refuse a database written
+// by a newer cpg-gen instead of misreading it. cpg-gen itself migrates older
+// databases forward when it patches or resumes them.
+//
+// Like graph/mem it depends only on the standard library, so programs that
+// read the database through database/sql can use it (see ReadSQL).
+package schema
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Version is the schema version this tree writes and reads. Bump it whenever
+// a table readers use changes shape, with a migration in cpg-gen that brings
+// the previous version forward.
+const Version = 2
+
+// MinVersion is the oldest schema version readers of this tree understand.
+const MinVersion = 1
+
+// Legacy is the version of databases written before schema versioning, which
+// have a zero user_version and no cpg_meta table; their META_DATA node holds
+// what provenance there is.
+const Legacy = 1
+
+// Keys of the cpg_meta table.
+const (
+	KeySchemaVersion    = "schema_version"    // Version when written
+	KeyGenerator        = "generator"         // "cpg-gen"
+	KeyGeneratorVersion = "generator_version" // module version or VCS revision of cpg-gen
+	KeyGoVersion        = "go_version"        // toolchain cpg-gen was built with
+	KeyGeneratedAt      = "generated_at"      // RFC 3339, UTC; SOURCE_DATE_EPOCH when set
+	KeyFlags            = "flags"             // JSON array of the command-line arguments
+	KeyConfig           = "config"            // JSON of the resolved configuration
+	KeyModules          = "modules"           // JSON array of ModuleMeta
+	KeyContentHash      = "content_hash"      // hex SHA-256 of the rows, independent of their order
+)
+
+// ModuleMeta is an analyzed module in the cpg_meta modules entry: its git
+// commit and whether the work tree had uncommitted changes, or for a
+// dependency analyzed from the module cache, its version.
+type ModuleMeta struct {
+	Path    string `json:"path"`
+	Prefix  string `json:"prefix,omitempty"`
+	Dir     string `json:"dir,omitempty"`
+	Commit  string `json:"commit,omitempty"`
+	Dirty   bool   `json:"dirty,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+// Meta is the schema version and cpg_meta entries of a database.
+type Meta struct {
+	Version int
+	Values  map[string]string
+}
+
+// Modules decodes the modules entry.
+func (m *Meta) Modules() ([]ModuleMeta, error) {
+	s, ok := m.Values[KeyModules]
+	if !ok {
+		return nil, nil
+	}
+	var mods []ModuleMeta
+	if err := json.Unmarshal([]byte(s), &mods); err != nil {
+		return nil, fmt.Errorf("cpg_meta %s: %w", KeyModules, err)
+	}
+	return mods, nil
+}
+
+// ErrVersion is wrapped by the errors Check returns.
+var ErrVersion = errors.New("unsupported schema version")
+
+// Check returns an error wrapping ErrVersion when a database of the given
+// schema version cannot be read by this tree.
+func Check(version int) error {
+	switch {
+	case version > Version:
+		return fmt.Errorf("%w %d: written by a newer cpg-gen (this one reads up to %d)", ErrVersion, version, Version)
+	case version < MinVersion:
+		return fmt.Errorf("%w %d: older than %d, regenerate the database", ErrVersion, version, MinVersion)
+	}
+	return nil
+}
+
+// VersionOf returns the schema version for a PRAGMA user_version value.
+func VersionOf(userVersion int) int {
+	if userVersion == 0 {
+		return Legacy
+	}
+	return userVersion
+}
+
+// MetaQuery selects the cpg_meta entries (key, value).
+const MetaQuery = `SELECT key, value FROM cpg_meta ORDER BY key`
+
+// LegacyQuery selects the properties of the META_DATA node, the provenance
+// of a Legacy database.
+const LegacyQuery = `SELECT properties FROM nodes WHERE id = 'META_DATA'`
+
+// LegacyValues maps the META_DATA node properties of a Legacy database to
+// cpg_meta entries, as far as it has them.
+func LegacyValues(properties string) map[string]string {
+	values := map[string]string{KeySchemaVersion: fmt.Sprint(Legacy)}
+	var props map[string]json.RawMessage
+	if json.Unmarshal([]byte(properties), &props) != nil {
+		return values
+	}
+	if raw, ok := props["generator"]; ok {
+		var s string
+		if json.Unmarshal(raw, &s) == nil {
+			values[KeyGenerator] = s
+		}
+	}
+	if raw, ok := props["config"]; ok {
+		values[KeyConfig] = string(raw)
+	}
+	if raw, ok := props["module"]; ok {
+		var path string
+		if json.Unmarshal(raw, &path) == nil {
+			data, _ := json.Marshal([]ModuleMeta{{Path: path}})
+			values[KeyModules] = string(data)
+		}
+	}
+	return values
+}
+
+// ReadSQL reads the schema version and cpg_meta entries of a database opened
+// with database/sql. A Legacy database gets the entries LegacyValues derives.
+// It does not call Check.
+func ReadSQL(ctx context.Context, db *sql.DB) (*Meta, error) {
+	var userVersion int
+	if err := db.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&userVersion); err != nil {
+		return nil, fmt.Errorf("schema version: %w", err)
+	}
+	m := &Meta{Version: VersionOf(userVersion)}
+	if m.Version == Legacy {
+		var props sql.NullString
+		err := db.QueryRowContext(ctx, LegacyQuery).Scan(&props)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("read META_DATA: %w", err)
+		}
+		m.Values = LegacyValues(props.String)
+		return m, nil
+	}
+	rows, err := db.QueryContext(ctx, MetaQuery)
+	if err != nil {
+		return nil, fmt.Errorf("read cpg_meta: %w", err)
+	}
+	defer rows.Close()
+	m.Values = make(map[string]string)
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, fmt.Errorf("read cpg_meta: %w", err)
+		}
+		m.Values[k] = v
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read cpg_meta: %w", err)
+	}
+	return m, nil
+}
@@ -0,0 +1,85 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// Functions resolves a Go-style symbol to the function nodes it may name, in
+// ID order. The symbol is "pkg.Func", "pkg.Type.Method" or a bare
+// "Func"/"Type.Method"; pkg is the package as recorded in the graph or any
+// trailing part of it ("scrape" for "prometheus/scrape"), and methods with a
+// pointer receiver match with or without the '*'. Standard library and
+// dependency stubs match by their import path ("fmt.Sprintf",
+// "net/http.Client.Do"). A full node ID resolves to itself.
+//
+// When some matches are in a package named exactly as given, only those are
+// returned. More than one result means the symbol is ambiguous; none is
+// ErrNotFound.
+func (db *DB) Functions(ctx context.Context, symbol string) ([]Node, error) {
+	var nodes []Node
+	err := db.with(ctx, func(conn *sqlite.Conn) error {
+		var err error
+		nodes, err = resolveFunctions(conn, symbol)
+		return err
+	})
+	return nodes, err
+}
+
+func resolveFunctions(conn *sqlite.Conn, symbol string) ([]Node, error) {
+	if symbol == "" {
+		return nil, fmt.Errorf("empty symbol")
+	}
+	exact, err := queryNodes(conn, []string{symbol})
+	if err != nil {
+		return nil, err
+	}
+	if len(exact) > 0 {
+		return exact, nil
+	}
+
+	// Every split at a '.' is a candidate package/name pair; the stub IDs
+	// spell the whole symbol out
+	var pkgs, names []string
+	stubs := []string{"ext::" + symbol}
+	for i := range len(symbol) {
+		if symbol[i] == '.' {
+			pkgs = append(pkgs, symbol[:i])
+			names = append(names, symbol[i+1:])
+		}
+	}
+	if i := strings.LastIndexByte(symbol, '.'); i > 0 {
+		recv, method := symbol[:i], symbol[i+1:]
+		stubs = append(stubs, "ext::("+recv+")."+method, "ext::(*"+recv+")."+method)
+	}
+	nodes, err := queryNodesWhere(conn, `kind = 'function' AND (
+	    id IN (SELECT value FROM json_each(?1))
+	    OR (name IN (?4, '*' || ?4) AND id NOT LIKE 'ext::%')
+	    OR id IN (
+	      SELECT n.id FROM nodes n
+	      JOIN json_each(?2) p JOIN json_each(?3) s ON s.key = p.key
+	      WHERE n.kind = 'function' AND n.id NOT LIKE 'ext::%'
+	        AND n.name IN (s.value, '*' || s.value)
+	        AND (n.package = p.value OR substr(n.package, -length(p.value) - 1) = '/' || p.value)))`,
+		jsonList(stubs), jsonList(pkgs), jsonList(names), symbol)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("function %s: %w", symbol, ErrNotFound)
+	}
+
+	var inPkg []Node
+	for _, n := range nodes {
+		if strings.HasPrefix(symbol, n.Package+".") {
+			inPkg = append(inPkg, n)
+		}
+	}
+	if len(inPkg) > 0 {
+		return inPkg, nil
+	}
+	return nodes, nil
+}
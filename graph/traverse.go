@@ -0,0 +1,231 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"zombiezen.com/go/sqlite"
+)
+
+// ErrNoPath is returned by ShortestPath when the target is not reachable.
+var ErrNoPath = errors.New("no path")
+
+// Options control a traversal.
+type Options struct {
+	Direction Direction
+	Kinds     []string // edge kinds to follow; empty follows every kind
+	Depth     int      // maximum number of edges from the start; 0 = unlimited
+	Limit     int      // stop expanding once this many nodes are reached; 0 = unlimited
+}
+
+// Subgraph is the result of a traversal: the nodes reached, how many edges
+// from the start each was first reached at, and the edges followed.
+type Subgraph struct {
+	Nodes []Node         // in order of depth, then ID
+	Depth map[string]int // node ID → depth; the start has depth 0
+	Edges []Edge
+}
+
+// Traverse walks the graph breadth-first from start, one depth level per
+// query, and returns everything reached within opts.Depth.
+func (db *DB) Traverse(ctx context.Context, start string, opts Options) (*Subgraph, error) {
+	var sg *Subgraph
+	err := db.with(ctx, func(conn *sqlite.Conn) error {
+		var err error
+		sg, err = traverse(conn, start, opts)
+		return err
+	})
+	return sg, err
+}
+
+func traverse(conn *sqlite.Conn, start string, opts Options) (*Subgraph, error) {
+	depth := map[string]int{start: 0}
+	order := []string{start}
+	var edges []Edge
+	frontier := []string{start}
+	for d := 1; len(frontier) > 0 && (opts.Depth <= 0 || d <= opts.Depth); d++ {
+		if opts.Limit > 0 && len(order) >= opts.Limit {
+			break
+		}
+		level, err := queryEdges(conn, frontier, opts.Direction, opts.Kinds)
+		if err != nil {
+			return nil, err
+		}
+		frontier = frontier[:0:0]
+		for _, e := range level {
+			next := e.Target
+			if opts.Direction == Backward {
+				next = e.Source
+			}
+			if _, seen := depth[next]; !seen {
+				if opts.Limit > 0 && len(order) >= opts.Limit {
+					continue
+				}
+				depth[next] = d
+				order = append(order, next)
+				frontier = append(frontier, next)
+			}
+			edges = append(edges, e)
+		}
+	}
+
+	nodes, err := queryNodes(conn, order)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Node, len(nodes))
+	for _, n := range nodes {
+		byID[n.ID] = n
+	}
+	sg := &Subgraph{Depth: depth}
+	for _, id := range order {
+		if n, ok := byID[id]; ok {
+			sg.Nodes = append(sg.Nodes, n)
+		}
+	}
+	sort.SliceStable(sg.Nodes, func(i, j int) bool {
+		if di, dj := depth[sg.Nodes[i].ID], depth[sg.Nodes[j].ID]; di != dj {
+			return di < dj
+		}
+		return sg.Nodes[i].ID < sg.Nodes[j].ID
+	})
+	for _, e := range edges {
+		// Drop edges into nodes cut off by Limit
+		if _, ok := depth[e.Source]; !ok {
+			continue
+		}
+		if _, ok := depth[e.Target]; !ok {
+			continue
+		}
+		sg.Edges = append(sg.Edges, e)
+	}
+	return sg, nil
+}
+
+// Callers returns the functions that reach funcID through call edges within
+// depth calls (0 = unlimited).
+func (db *DB) Callers(ctx context.Context, funcID string, depth int) (*Subgraph, error) {
+	return db.Traverse(ctx, funcID, Options{Direction: Backward, Kinds: []string{"call"}, Depth: depth})
+}
+
+// Callees returns the functions funcID reaches through call edges within
+// depth calls (0 = unlimited).
+func (db *DB) Callees(ctx context.Context, funcID string, depth int) (*Subgraph, error) {
+	return db.Traverse(ctx, funcID, Options{Direction: Forward, Kinds: []string{"call"}, Depth: depth})
+}
+
+// DefaultSliceDepth is the slice depth used when Slice is given 0, the same
+// bound as the backward_slice and forward_slice queries.
+const DefaultSliceDepth = 20
+
+// Slice returns the program slice of nodeID over data flow: Backward follows
+// dfg and param_in edges to everything that contributes to the node, Forward
+// follows dfg and param_out edges to everything it affects.
+func (db *DB) Slice(ctx context.Context, nodeID string, dir Direction, depth int) (*Subgraph, error) {
+	if depth <= 0 {
+		depth = DefaultSliceDepth
+	}
+	kinds := []string{"dfg", "param_out"}
+	if dir == Backward {
+		kinds = []string{"dfg", "param_in"}
+	}
+	return db.Traverse(ctx, nodeID, Options{Direction: dir, Kinds: kinds, Depth: depth})
+}
+
+// CFG returns the control flow graph of a function: the function node, its
+// basic blocks and the cfg edges between them (entry edges leave the
+// function node, exit edges return to it). Depth is nil.
+func (db *DB) CFG(ctx context.Context, funcID string) (*Subgraph, error) {
+	sg := new(Subgraph)
+	err := db.with(ctx, func(conn *sqlite.Conn) error {
+		ids := []string{funcID}
+		blocks, err := queryNodesWhere(conn, `kind = 'basic_block' AND parent_function = ?`, funcID)
+		if err != nil {
+			return err
+		}
+		fn, err := queryNodes(conn, []string{funcID})
+		if err != nil {
+			return err
+		}
+		if len(fn) == 0 {
+			return fmt.Errorf("function %s: %w", funcID, ErrNotFound)
+		}
+		sg.Nodes = append(fn, blocks...)
+		for _, b := range blocks {
+			ids = append(ids, b.ID)
+		}
+		edges, err := queryEdges(conn, ids, Forward, []string{"cfg"})
+		if err != nil {
+			return err
+		}
+		in := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			in[id] = true
+		}
+		for _, e := range edges {
+			if in[e.Target] {
+				sg.Edges = append(sg.Edges, e)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sg, nil
+}
+
+// ShortestPath returns the edges of a shortest path from one node to
+// another following opts (opts.Limit is ignored), or ErrNoPath; the path
+// from a node to itself is empty. With Direction Backward the path runs
+// against the edge direction and the edges are returned in walking order.
+func (db *DB) ShortestPath(ctx context.Context, from, to string, opts Options) ([]Edge, error) {
+	var path []Edge
+	err := db.with(ctx, func(conn *sqlite.Conn) error {
+		if from == to {
+			return nil
+		}
+		via := map[string]Edge{} // node → edge it was first reached through
+		frontier := []string{from}
+		for d := 1; len(frontier) > 0 && (opts.Depth <= 0 || d <= opts.Depth); d++ {
+			level, err := queryEdges(conn, frontier, opts.Direction, opts.Kinds)
+			if err != nil {
+				return err
+			}
+			frontier = frontier[:0:0]
+			for _, e := range level {
+				next := e.Target
+				if opts.Direction == Backward {
+					next = e.Source
+				}
+				if _, seen := via[next]; seen || next == from {
+					continue
+				}
+				via[next] = e
+				frontier = append(frontier, next)
+			}
+			if _, ok := via[to]; ok {
+				for id := to; id != from; {
+					e := via[id]
+					path = append(path, e)
+					if opts.Direction == Backward {
+						id = e.Target
+					} else {
+						id = e.Source
+					}
+				}
+				for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+					path[i], path[j] = path[j], path[i]
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("%s → %s: %w", from, to, ErrNoPath)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return path, nil
+}
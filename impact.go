@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cpg-gen/graph"
+	"cpg-gen/graph/schema"
+)
+
+// "cpg-gen impact" is the blast radius of a change: the hunks of git diff
+// -U0 against a revision, run in each analyzed module's directory, are mapped
+// to the functions and statements whose lines they touch, and from those to
+// the transitive callers, the HTTP and RPC endpoints comm_endpoints has for
+// any of them, and the tests that reach them.
+
+// impactStmtKinds are the statement node kinds reported as changed.
+var impactStmtKinds = []string{"assign", "branch", "case", "defer", "for", "go", "if", "inc_dec", "label", "return", "select", "send", "switch"}
+
+// runImpact implements "cpg-gen impact".
+func runImpact(args []string) error {
+	fs := flag.NewFlagSet("impact", flag.ContinueOnError)
+	since := fs.String("since", "", "Git revision to diff against, e.g. main or HEAD~3 (required)")
+	depth := fs.Int("depth", 8, "Maximum call depth of the transitive callers")
+	root := fs.String("root", "", "Directory of the primary module, for databases that do not record module directories in cpg_meta")
+	format := fs.String("format", "text", "Report format: text or json")
+	limit := fs.Int("limit", 50, "Maximum rows per section of the text report (0 = unlimited)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: cpg-gen impact [flags] -since <rev> <db>\n\n")
+		fmt.Fprintf(os.Stderr, "Maps the lines git diff -U0 <rev> changes in each analyzed module to functions\n")
+		fmt.Fprintf(os.Stderr, "and statements, and reports their transitive callers, affected endpoints and tests.\n")
+		fmt.Fprintf(os.Stderr, "Line numbers are those of the side of the diff the database was generated from:\n")
+		fmt.Fprintf(os.Stderr, "<rev> when cpg_meta records it as the module's commit, else the work tree.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	pos, err := parseInterspersed(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if len(pos) != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected 1 argument, got %d", len(pos))
+	}
+	if *since == "" {
+		fs.Usage()
+		return fmt.Errorf("-since is required")
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("-format %s: want text or json", *format)
+	}
+
+	ctx := context.Background()
+	db, err := graph.Open(pos[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	mods, err := impactModules(ctx, db, *root)
+	if err != nil {
+		return err
+	}
+	var hunks []hunk
+	for _, mod := range mods {
+		h, err := moduleHunks(mod, *since)
+		if err != nil {
+			return err
+		}
+		hunks = append(hunks, h...)
+	}
+	r, err := computeImpact(ctx, db, hunks, *depth)
+	if err != nil {
+		return err
+	}
+	r.Since = *since
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	return writeImpactReport(os.Stdout, r, *limit)
+}
+
+// impactModules returns the analyzed modules of the database that have a
+// directory, dependencies from the module cache excluded. root replaces the
+// primary module's directory.
+func impactModules(ctx context.Context, db *graph.DB, root string) ([]schema.ModuleMeta, error) {
+	meta, err := db.Meta(ctx)
+	if err != nil {
+		return nil, err
+	}
+	all, err := meta.Modules()
+	if err != nil {
+		return nil, err
+	}
+	var mods []schema.ModuleMeta
+	for _, m := range all {
+		if m.Version != "" {
+			continue
+		}
+		if m.Prefix == "" && root != "" {
+			m.Dir = root
+			root = ""
+		}
+		if m.Dir != "" {
+			mods = append(mods, m)
+		}
+	}
+	if root != "" {
+		mods = append(mods, schema.ModuleMeta{Dir: root})
+	}
+	if len(mods) == 0 {
+		return nil, fmt.Errorf("the database records no module directories; pass -root")
+	}
+	return mods, nil
+}
+
+// hunk is a changed line range of a file, with the file as the database
+// names it (relative to its module, under the module's prefix).
+type hunk struct {
+	File  string `json:"file"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// moduleHunks runs git diff in mod's directory and returns its hunks on the
+// side the database was generated from.
+func moduleHunks(mod schema.ModuleMeta, since string) ([]hunk, error) {
+	old := false
+	if mod.Commit != "" && !mod.Dirty {
+		rev, err := gitOutput(mod.Dir, "rev-parse", "--verify", since+"^{commit}")
+		if err != nil {
+			return nil, fmt.Errorf("%s: unknown revision %s", mod.Dir, since)
+		}
+		old = strings.TrimSpace(rev) == mod.Commit
+	}
+	out, err := gitOutput(mod.Dir, "diff", "-U0", "--relative", "--no-color", "--no-ext-diff", since, "--", ".")
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			return nil, fmt.Errorf("git diff %s in %s: %s", since, mod.Dir, strings.TrimSpace(string(exit.Stderr)))
+		}
+		return nil, fmt.Errorf("git diff %s in %s: %w", since, mod.Dir, err)
+	}
+	return parseHunks(out, mod.Prefix, old), nil
+}
+
+var hunkRe = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// parseHunks parses the output of git diff -U0 into the line ranges of the
+// old or the new side. A hunk that only removes lines on that side touches
+// the line it follows.
+func parseHunks(diff, prefix string, old bool) []hunk {
+	var hunks []hunk
+	var file string
+	inHeader := false // a removed "-- x" line reads "--- x" too
+	for _, line := range strings.Split(diff, "\n") {
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			inHeader = true
+		case inHeader && strings.HasPrefix(line, "--- "):
+			if old {
+				file = diffPath(line[4:], "a/", prefix)
+			}
+		case inHeader && strings.HasPrefix(line, "+++ "):
+			if !old {
+				file = diffPath(line[4:], "b/", prefix)
+			}
+		case strings.HasPrefix(line, "@@ "):
+			inHeader = false
+			m := hunkRe.FindStringSubmatch(line)
+			if m == nil || file == "" {
+				continue
+			}
+			start, count := m[3], m[4]
+			if old {
+				start, count = m[1], m[2]
+			}
+			s, _ := strconv.Atoi(start)
+			n := 1
+			if count != "" {
+				n, _ = strconv.Atoi(count)
+			}
+			h := hunk{File: file, Start: max(s, 1), End: max(s, 1)}
+			if n > 0 {
+				h.End = s + n - 1
+			}
+			hunks = append(hunks, h)
+		}
+	}
+	return hunks
+}
+
+// diffPath returns the database file name of a ---/+++ path of git diff, or
+// "" for /dev/null.
+func diffPath(p, side, prefix string) string {
+	p = strings.TrimSuffix(p, "\t")
+	if p == "/dev/null" {
+		return ""
+	}
+	if unq, err := strconv.Unquote(p); err == nil {
+		p = unq
+	}
+	p = filepath.ToSlash(strings.TrimPrefix(p, side))
+	if prefix != "" {
+		p = prefix + "/" + p
+	}
+	return p
+}
+
+// impactFunc is a function of an impact report.
+type impactFunc struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Package    string `json:"package"`
+	File       string `json:"file"`
+	Line       int    `json:"line"`
+	Depth      int    `json:"depth,omitempty"`      // callers: calls from a changed function
+	Hunks      int    `json:"hunks,omitempty"`      // changed: hunks touching it
+	Statements int    `json:"statements,omitempty"` // changed: statements starting on changed lines
+	Via        string `json:"via,omitempty"`        // tests: "tests" edge or "caller"
+}
+
+// impactEndpoint is a comm_endpoints row of a changed or calling function.
+type impactEndpoint struct {
+	Component    string `json:"component"`
+	Role         string `json:"role"`
+	EndpointType string `json:"endpoint_type"`
+	Method       string `json:"http_method,omitempty"`
+	Path         string `json:"url_path,omitempty"`
+	FunctionID   string `json:"function_id"`
+	Function     string `json:"function_name"`
+}
+
+// impactReport is the result of runImpact.
+type impactReport struct {
+	Since     string           `json:"since"`
+	Hunks     int              `json:"hunks"`
+	Outside   int              `json:"hunks_outside_functions"`
+	Changed   []impactFunc     `json:"changed"`
+	Callers   []impactFunc     `json:"callers"`
+	Endpoints []impactEndpoint `json:"endpoints"`
+	Tests     []impactFunc     `json:"tests"`
+}
+
+// computeImpact maps hunks to the functions they touch and collects the
+// callers, endpoints and tests of those.
+func computeImpact(ctx context.Context, db *graph.DB, hunks []hunk, depth int) (*impactReport, error) {
+	r := &impactReport{Hunks: len(hunks), Changed: []impactFunc{}, Callers: []impactFunc{}, Endpoints: []impactEndpoint{}, Tests: []impactFunc{}}
+	data, _ := json.Marshal(hunks)
+	params := map[string]any{"hunks": string(data), "stmt_kinds": jsonArray(impactStmtKinds)}
+
+	t, err := db.RunSQL(ctx, `WITH h AS (
+    SELECT key AS hunk, json_extract(value, '$.file') AS file,
+      json_extract(value, '$.start') AS start, json_extract(value, '$.end') AS "end"
+    FROM json_each(:hunks)
+  )
+  SELECT h.hunk, n.id, n.name, COALESCE(n.package, ''), n.file, COALESCE(n.line, 0),
+    (SELECT COUNT(*) FROM nodes s
+      WHERE s.parent_function = n.id AND s.file = h.file AND s.line BETWEEN h.start AND h."end"
+        AND s.kind IN (SELECT value FROM json_each(:stmt_kinds)))
+  FROM h LEFT JOIN nodes n ON n.kind = 'function' AND n.file = h.file
+    AND n.line <= h."end" AND COALESCE(n.end_line, n.line) >= h.start
+  ORDER BY n.file, n.line, n.id`, params)
+	if err != nil {
+		return nil, fmt.Errorf("changed functions: %w", err)
+	}
+	index := make(map[string]int) // function ID → r.Changed index
+	var changed []string
+	touched := make(map[int64]bool)
+	for _, row := range t.Rows {
+		if row[1] == nil {
+			continue
+		}
+		touched[row[0].(int64)] = true
+		id := row[1].(string)
+		i, ok := index[id]
+		if !ok {
+			i = len(r.Changed)
+			index[id] = i
+			r.Changed = append(r.Changed, impactFunc{ID: id, Name: cellText(row[2]), Package: cellText(row[3]),
+				File: cellText(row[4]), Line: int(row[5].(int64))})
+			changed = append(changed, id)
+		}
+		r.Changed[i].Hunks++
+		r.Changed[i].Statements += int(row[6].(int64))
+	}
+	r.Outside = len(hunks) - len(touched)
+
+	t, err = db.RunSQL(ctx, `WITH RECURSIVE callers(id, depth) AS (
+    SELECT value, 0 FROM json_each(:changed)
+    UNION
+    SELECT e.source, c.depth + 1
+    FROM callers c
+    JOIN edges e ON e.target = c.id AND e.kind = 'call'
+    WHERE c.depth < :depth
+  )
+  SELECT n.id, n.name, COALESCE(n.package, ''), COALESCE(n.file, ''), COALESCE(n.line, 0), MIN(c.depth),
+    json_extract(n.properties, '$.test_kind') IS NOT NULL
+  FROM callers c JOIN nodes n ON n.id = c.id
+  WHERE n.kind = 'function' AND n.id NOT IN (SELECT value FROM json_each(:changed))
+  GROUP BY n.id
+  ORDER BY 6, n.package, n.name, n.id`, map[string]any{"changed": jsonArray(changed), "depth": int64(depth)})
+	if err != nil {
+		return nil, fmt.Errorf("callers: %w", err)
+	}
+	tests := make(map[string]bool)
+	affected := append([]string{}, changed...)
+	for _, row := range t.Rows {
+		f := impactFunc{ID: row[0].(string), Name: cellText(row[1]), Package: cellText(row[2]), File: cellText(row[3]),
+			Line: int(row[4].(int64)), Depth: int(row[5].(int64))}
+		r.Callers = append(r.Callers, f)
+		affected = append(affected, f.ID)
+		if row[6].(int64) == 1 {
+			f.Via = "caller"
+			r.Tests = append(r.Tests, f)
+			tests[f.ID] = true
+		}
+	}
+
+	// Test links exist when tests were loaded (-skip-tests=false)
+	t, err = db.RunSQL(ctx, `SELECT DISTINCT t.id, t.name, COALESCE(t.package, ''), COALESCE(t.file, ''), COALESCE(t.line, 0)
+  FROM edges e JOIN nodes t ON t.id = e.source
+  WHERE e.kind = 'tests' AND e.target IN (SELECT value FROM json_each(:changed))
+  ORDER BY t.package, t.name, t.id`, map[string]any{"changed": jsonArray(changed)})
+	if err != nil {
+		return nil, fmt.Errorf("tests: %w", err)
+	}
+	for _, row := range t.Rows {
+		if id := row[0].(string); !tests[id] {
+			r.Tests = append(r.Tests, impactFunc{ID: id, Name: cellText(row[1]), Package: cellText(row[2]), File: cellText(row[3]),
+				Line: int(row[4].(int64)), Via: "tests"})
+			tests[id] = true
+		}
+	}
+
+	t, err = db.RunSQL(ctx, `SELECT 1 FROM sqlite_master WHERE name = 'comm_endpoints'`, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.Rows) == 0 {
+		return r, nil // comm phase skipped
+	}
+	t, err = db.RunSQL(ctx, `SELECT component, role, endpoint_type, http_method, url_path, function_id, function_name
+  FROM comm_endpoints WHERE function_id IN (SELECT value FROM json_each(:functions))
+  ORDER BY component, url_path, function_id, role`, map[string]any{"functions": jsonArray(affected)})
+	if err != nil {
+		return nil, fmt.Errorf("endpoints: %w", err)
+	}
+	for _, row := range t.Rows {
+		r.Endpoints = append(r.Endpoints, impactEndpoint{Component: cellText(row[0]), Role: cellText(row[1]), EndpointType: cellText(row[2]),
+			Method: cellText(row[3]), Path: cellText(row[4]), FunctionID: cellText(row[5]), Function: cellText(row[6])})
+	}
+	return r, nil
+}
+
+// writeImpactReport writes the text report: the counts, then each section
+// as a table of at most limit rows.
+func writeImpactReport(w io.Writer, r *impactReport, limit int) error {
+	fmt.Fprintf(w, "changes since %s: %d hunks, %d outside functions\n", r.Since, r.Hunks, r.Outside)
+	fmt.Fprintf(w, "changed functions: %d\n", len(r.Changed))
+	fmt.Fprintf(w, "callers:           %d\n", len(r.Callers))
+	fmt.Fprintf(w, "endpoints:         %d\n", len(r.Endpoints))
+	fmt.Fprintf(w, "tests:             %d\n", len(r.Tests))
+
+	funcs := func(fs []impactFunc, extra string, value func(impactFunc) []any) *graph.Table {
+		t := &graph.Table{Columns: append([]string{"id", "name", "file", "line"}, strings.Split(extra, ",")...)}
+		for _, f := range fs {
+			t.Rows = append(t.Rows, append([]any{f.ID, f.Name, f.File, int64(f.Line)}, value(f)...))
+		}
+		return t
+	}
+	endpoints := &graph.Table{Columns: []string{"component", "role", "endpoint_type", "http_method", "url_path", "function_name"}}
+	for _, e := range r.Endpoints {
+		endpoints.Rows = append(endpoints.Rows, []any{e.Component, e.Role, e.EndpointType, e.Method, e.Path, e.Function})
+	}
+	return writeSections(w, []reportSection{
+		{"Changed functions", funcs(r.Changed, "hunks,statements", func(f impactFunc) []any { return []any{int64(f.Hunks), int64(f.Statements)} })},
+		{"Callers", funcs(r.Callers, "depth", func(f impactFunc) []any { return []any{int64(f.Depth)} })},
+		{"Endpoints", endpoints},
+		{"Tests", funcs(r.Tests, "via", func(f impactFunc) []any { return []any{f.Via} })},
+	}, limit)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseHunks(t *testing.T) {
+	const modified = `diff --git a/scrape/scrape.go b/scrape/scrape.go
+index 1111111..2222222 100644
+--- a/scrape/scrape.go
++++ b/scrape/scrape.go
+@@ -10,2 +10,3 @@ func run() {
+-	a()
+-	b()
++	a()
++	b()
++	c()
+@@ -40 +41,0 @@ func stop() {
+-	d()
+`
+	const added = `diff --git a/new.go b/new.go
+new file mode 100644
+index 0000000..3333333
+--- /dev/null
++++ b/new.go
+@@ -0,0 +1,4 @@
++package main
++
++func f() {
++}
+`
+	const removedDashes = `diff --git a/sql.go b/sql.go
+index 4444444..5555555 100644
+--- a/sql.go
++++ b/sql.go
+@@ -3,2 +3 @@ const q = ` + "`" + `
+--- comment
+--- x
++SELECT 1
+@@ -9 +8 @@ const q = ` + "`" + `
+-	x
++	y
+`
+	const quoted = `diff --git "a/dir with space/f.go" "b/dir with space/f.go"
+index 6666666..7777777 100644
+--- "a/dir with space/f.go"
++++ "b/dir with space/f.go"
+@@ -1 +1 @@
+-package a
++package b
+`
+
+	tests := []struct {
+		name   string
+		diff   string
+		prefix string
+		old    bool
+		want   []hunk
+	}{
+		{
+			name: "new side",
+			diff: modified,
+			want: []hunk{
+				{File: "scrape/scrape.go", Start: 10, End: 12},
+				{File: "scrape/scrape.go", Start: 41, End: 41},
+			},
+		},
+		{
+			name: "old side",
+			diff: modified,
+			old:  true,
+			want: []hunk{
+				{File: "scrape/scrape.go", Start: 10, End: 11},
+				{File: "scrape/scrape.go", Start: 40, End: 40},
+			},
+		},
+		{
+			name:   "prefix",
+			diff:   modified,
+			prefix: "adapter",
+			want: []hunk{
+				{File: "adapter/scrape/scrape.go", Start: 10, End: 12},
+				{File: "adapter/scrape/scrape.go", Start: 41, End: 41},
+			},
+		},
+		{
+			name: "added file",
+			diff: added,
+			want: []hunk{{File: "new.go", Start: 1, End: 4}},
+		},
+		{
+			name: "added file old side",
+			diff: added,
+			old:  true,
+		},
+		{
+			name: "removed lines that look like headers",
+			diff: removedDashes,
+			old:  true,
+			want: []hunk{
+				{File: "sql.go", Start: 3, End: 4},
+				{File: "sql.go", Start: 9, End: 9},
+			},
+		},
+		{
+			name: "quoted path",
+			diff: quoted,
+			want: []hunk{{File: "dir with space/f.go", Start: 1, End: 1}},
+		},
+		{
+			name: "several files",
+			diff: modified + added,
+			want: []hunk{
+				{File: "scrape/scrape.go", Start: 10, End: 12},
+				{File: "scrape/scrape.go", Start: 41, End: 41},
+				{File: "new.go", Start: 1, End: 4},
+			},
+		},
+		{
+			name: "empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseHunks(tt.diff, tt.prefix, tt.old)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHunks() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"cpg-gen/graph/schema"
+)
+
+// fingerprintVersion is folded into every fingerprint; bump it whenever the
+// node/edge emission changes so existing databases are fully regenerated.
+const fingerprintVersion = "1"
+
+// PackageFingerprint identifies the inputs that produced one package's slice
+// of the graph: its source files plus the fingerprints of known-module
+// dependencies and the exported API of external ones.
+type PackageFingerprint struct {
+	RelPkg      string
+	PkgPath     string
+	Fingerprint string
+	Files       []string // module-relative, non-skipped files
+}
+
+// FingerprintPackages computes a content fingerprint for every known-module
+// package. Because a package's fingerprint includes those of its known-module
+// imports, a change anywhere below a package also changes the package itself,
+// which makes dependents dirty along with the edited package.
+func FingerprintPackages(pkgs []*packages.Package, salt string) []PackageFingerprint {
+	memo := make(map[*packages.Package]string)
+	apiMemo := make(map[*packages.Package]string)
+	files := make(map[*packages.Package][]string)
+
+	var fp func(pkg *packages.Package) string
+	fp = func(pkg *packages.Package) string {
+		if h, ok := memo[pkg]; ok {
+			return h
+		}
+		memo[pkg] = "" // import cycles are impossible in Go, but never recurse forever
+
+		h := sha256.New()
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00", fingerprintVersion, salt, pkg.PkgPath)
+
+		var rels []string
+		for _, f := range pkg.CompiledGoFiles {
+			rel := modSet.RelFile(f)
+			if rel == "" || shouldSkipFile(rel) {
+				continue
+			}
+			content, err := os.ReadFile(f)
+			if err != nil {
+				continue
+			}
+			sum := sha256.Sum256(content)
+			fmt.Fprintf(h, "file %s %x\n", rel, sum)
+			rels = append(rels, rel)
+		}
+		files[pkg] = rels
+
+		imps := make([]string, 0, len(pkg.Imports))
+		for path := range pkg.Imports {
+			imps = append(imps, path)
+		}
+		sort.Strings(imps)
+		for _, path := range imps {
+			imp := pkg.Imports[path]
+			if modSet.IsKnownPkg(imp.PkgPath) {
+				fmt.Fprintf(h, "dep %s %s\n", path, fp(imp))
+			} else {
+				fmt.Fprintf(h, "ext %s %s\n", path, apiHash(imp, apiMemo))
+			}
+		}
+
+		memo[pkg] = hex.EncodeToString(h.Sum(nil))
+		return memo[pkg]
+	}
+
+	result := make([]PackageFingerprint, 0, len(pkgs))
+	for _, pkg := range pkgs {
+		sum := fp(pkg)
+		result = append(result, PackageFingerprint{
+			RelPkg:      modSet.RelPkg(pkg.PkgPath),
+			PkgPath:     pkg.PkgPath,
+			Fingerprint: sum,
+			Files:       files[pkg],
+		})
+	}
+	return result
+}
+
+// apiHash hashes the exported API of an external package — the information
+// its export data carries for importers. External callees become ext:: stubs
+// keyed by name and signature, so this is all that can affect our nodes.
+func apiHash(pkg *packages.Package, memo map[*packages.Package]string) string {
+	if h, ok := memo[pkg]; ok {
+		return h
+	}
+	h := sha256.New()
+	if pkg.Types != nil {
+		scope := pkg.Types.Scope()
+		for _, name := range scope.Names() { // sorted
+			obj := scope.Lookup(name)
+			if !obj.Exported() {
+				continue
+			}
+			fmt.Fprintln(h, types.ObjectString(obj, nil))
+			if tn, ok := obj.(*types.TypeName); ok {
+				if named, ok := tn.Type().(*types.Named); ok {
+					for m := range named.Methods() {
+						fmt.Fprintln(h, types.ObjectString(m, nil))
+					}
+				}
+			}
+		}
+	}
+	memo[pkg] = hex.EncodeToString(h.Sum(nil))
+	return memo[pkg]
+}
+
+// writeFingerprints replaces the package_fingerprints table used by -incremental.
+func writeFingerprints(conn *sqlite.Conn, fingerprints []PackageFingerprint) error {
+	ddl := `
+CREATE TABLE IF NOT EXISTS package_fingerprints (
+    package TEXT PRIMARY KEY,
+    pkg_path TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    files TEXT NOT NULL
+);
+DELETE FROM package_fingerprints;`
+	if err := sqlitex.ExecuteScript(conn, ddl, nil); err != nil {
+		return fmt.Errorf("package fingerprints DDL: %w", err)
+	}
+
+	stmt, err := conn.Prepare(`INSERT OR REPLACE INTO package_fingerprints (package, pkg_path, fingerprint, files) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("prepare fingerprint insert: %w", err)
+	}
+	defer func() { _ = stmt.Finalize() }()
+
+	for _, f := range fingerprints {
+		files, _ := json.Marshal(f.Files)
+		stmt.BindText(1, f.RelPkg)
+		stmt.BindText(2, f.PkgPath)
+		stmt.BindText(3, f.Fingerprint)
+		stmt.BindText(4, string(files))
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("insert fingerprint %s: %w", f.RelPkg, err)
+		}
+		_ = stmt.Reset()
+	}
+	return nil
+}
+
+// IncrementalPlan describes which parts of an existing database are stale.
+type IncrementalPlan struct {
+	DirtyPkgs  map[string]bool // relative package → dirty (changed, new, or dependent)
+	DirtyPaths map[string]bool // full import paths of dirty packages that still exist
+	Removed    []string        // relative packages present in the DB but no longer loaded
+	StaleFiles []string        // files whose sources rows are replaced
+	dirtyFiles map[string]bool // current files of dirty packages
+	Total      int             // packages in the current load
+	Compact    bool            // the database uses the compact schema
+}
+
+// PlanIncremental compares current fingerprints with those stored in the
+// database at path. It returns nil when there is no usable previous database.
+func PlanIncremental(path string, fingerprints []PackageFingerprint, prog *Progress) (*IncrementalPlan, error) {
+	if _, err := os.Stat(path); err != nil {
+		prog.Log("Incremental: %s does not exist, doing a full build", path)
+		return nil, nil
+	}
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadOnly)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	var hasTable bool
+	if err := sqlitex.ExecuteTransient(conn,
+		`SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'package_fingerprints'`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			hasTable = true
+			return nil
+		}}); err != nil {
+		return nil, err
+	}
+	if !hasTable {
+		prog.Log("Incremental: %s has no package fingerprints, doing a full build", path)
+		return nil, nil
+	}
+	version, err := readSchemaVersion(conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := schema.Check(version); err != nil {
+		prog.Log("Incremental: %s: %v, doing a full build", path, err)
+		return nil, nil
+	}
+
+	type stored struct {
+		fingerprint string
+		files       []string
+	}
+	old := make(map[string]stored)
+	if err := sqlitex.ExecuteTransient(conn,
+		`SELECT package, fingerprint, files FROM package_fingerprints`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			var files []string
+			_ = json.Unmarshal([]byte(stmt.ColumnText(2)), &files)
+			old[stmt.ColumnText(0)] = stored{stmt.ColumnText(1), files}
+			return nil
+		}}); err != nil {
+		return nil, fmt.Errorf("read fingerprints: %w", err)
+	}
+
+	plan := &IncrementalPlan{
+		DirtyPkgs:  make(map[string]bool),
+		DirtyPaths: make(map[string]bool),
+		dirtyFiles: make(map[string]bool),
+		Total:      len(fingerprints),
+	}
+	if plan.Compact, err = isCompact(conn); err != nil {
+		return nil, err
+	}
+	current := make(map[string]bool, len(fingerprints))
+	stale := make(map[string]bool)
+	for _, f := range fingerprints {
+		current[f.RelPkg] = true
+		prev, ok := old[f.RelPkg]
+		if ok && prev.fingerprint == f.Fingerprint {
+			continue
+		}
+		plan.DirtyPkgs[f.RelPkg] = true
+		plan.DirtyPaths[f.PkgPath] = true
+		for _, file := range f.Files {
+			plan.dirtyFiles[file] = true
+			stale[file] = true
+		}
+		for _, file := range prev.files {
+			stale[file] = true
+		}
+	}
+	for relPkg, prev := range old {
+		if current[relPkg] {
+			continue
+		}
+		plan.Removed = append(plan.Removed, relPkg)
+		plan.DirtyPkgs[relPkg] = true
+		for _, file := range prev.files {
+			stale[file] = true
+		}
+	}
+	sort.Strings(plan.Removed)
+	for file := range stale {
+		plan.StaleFiles = append(plan.StaleFiles, file)
+	}
+	sort.Strings(plan.StaleFiles)
+	return plan, nil
+}
+
+// UpToDate reports whether nothing changed since the database was written.
+func (p *IncrementalPlan) UpToDate() bool {
+	return len(p.DirtyPkgs) == 0
+}
+
+// Full reports whether every current package is dirty, in which case a full
+// rewrite is cheaper than patching.
+func (p *IncrementalPlan) Full() bool {
+	return len(p.DirtyPaths) == p.Total
+}
+
+// Packages filters pkgs to the dirty ones.
+func (p *IncrementalPlan) Packages(pkgs []*packages.Package) []*packages.Package {
+	var dirty []*packages.Package
+	for _, pkg := range pkgs {
+		if p.DirtyPaths[pkg.PkgPath] {
+			dirty = append(dirty, pkg)
+		}
+	}
+	return dirty
+}
+
+// InScope reports whether a node ID belongs to a dirty package. Node IDs
+// produced by FuncID, StmtID and BlockID start with "<relPkg>::".
+func (p *IncrementalPlan) InScope(id string) bool {
+	if rel, ok := strings.CutPrefix(id, "pkg::"); ok {
+		return p.DirtyPkgs[rel]
+	}
+	if rel, ok := strings.CutPrefix(id, "file::"); ok {
+		return p.dirtyFiles[rel]
+	}
+	if strings.HasPrefix(id, "ext::") {
+		return false
+	}
+	pkg, _, ok := strings.Cut(id, "::")
+	return ok && p.DirtyPkgs[pkg]
+}
+
+// Lookups rebuilds the position and definition lookups for the clean part of
+// the graph from the existing database, so that edges from dirty packages into
+// clean ones resolve to the same node IDs a full run would produce.
+func (p *IncrementalPlan) Lookups(path string, pkgs []*packages.Package, fset *token.FileSet) (*PosLookup, *FuncLookup, *DefLookup, error) {
+	posLookup := NewPosLookup()
+	funcLookup := NewFuncLookup()
+	defLookup := NewDefLookup()
+	if !flagSkipTests {
+		defLookup.IndexPositions(fset)
+	}
+
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadOnly)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("open %s: %w", path, err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// rowid order is insertion order, which preserves PosLookup's first-wins rule;
+	// the compact nodes view has no rowid, but compact_nodes keys keep the order.
+	// Basic blocks carry positions but are never registered by the AST walk.
+	query := `SELECT id, kind, file, line, col, package FROM nodes
+		 WHERE file IS NOT NULL AND line IS NOT NULL AND kind != 'basic_block' ORDER BY rowid`
+	if p.Compact {
+		query = `SELECT n.id, k.name, n.file, n.line, n.col, n.package FROM compact_nodes n JOIN kinds k ON k.id = n.kind
+		 WHERE n.file IS NOT NULL AND n.line IS NOT NULL AND k.name != 'basic_block' ORDER BY n.key`
+	}
+	if err := sqlitex.ExecuteTransient(conn, query,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			if p.DirtyPkgs[stmt.ColumnText(5)] {
+				return nil
+			}
+			id, file := stmt.ColumnText(0), stmt.ColumnText(2)
+			line, col := stmt.ColumnInt(3), stmt.ColumnInt(4)
+			posLookup.Set(file, line, col, id)
+			if stmt.ColumnText(1) == "function" {
+				funcLookup.Set(file, line, col, id)
+			}
+			return nil
+		}}); err != nil {
+		return nil, nil, nil, fmt.Errorf("seed lookups: %w", err)
+	}
+
+	// SSA and go/types report declared functions at their name identifier,
+	// which the nodes table does not store. Recover those from the syntax.
+	for _, pkg := range pkgs {
+		if p.DirtyPaths[pkg.PkgPath] {
+			continue
+		}
+		for i, file := range pkg.Syntax {
+			if i >= len(pkg.CompiledGoFiles) {
+				continue
+			}
+			relFile := modSet.RelFile(pkg.CompiledGoFiles[i])
+			if relFile == "" || shouldSkipFile(relFile) {
+				continue
+			}
+			for _, decl := range file.Decls {
+				fd, ok := decl.(*ast.FuncDecl)
+				if !ok || fd.Name == nil {
+					continue
+				}
+				pos := fset.Position(fd.Pos())
+				id := funcLookup.Get(relFile, pos.Line, pos.Column)
+				if id == "" {
+					continue
+				}
+				name := fset.Position(fd.Name.Pos())
+				funcLookup.Set(relFile, name.Line, name.Column, id)
+				posLookup.Set(relFile, name.Line, name.Column, id)
+			}
+		}
+	}
+
+	// References into clean packages resolve by declaration position.
+	defLookup.fallback = func(obj types.Object) string {
+		if obj.Pkg() == nil || p.DirtyPaths[obj.Pkg().Path()] || !obj.Pos().IsValid() {
+			return ""
+		}
+		pos := fset.Position(obj.Pos())
+		relFile := modSet.RelFile(pos.Filename)
+		if relFile == "" {
+			return ""
+		}
+		return posLookup.Get(relFile, pos.Line, pos.Column)
+	}
+
+	return posLookup, funcLookup, defLookup, nil
+}
+
+// baseTables are the tables UpdateDB patches in place; every other table,
+// view and index in the database is derived and rebuilt by finishDB.
+var baseTables = []string{"nodes", "edges", "sources", "metrics", "package_fingerprints", "diagnostics", "package_coverage",
+	"build_configs", "node_configs", "edge_configs", "modules", "module_requires", "cpg_meta"}
+
+// BeginUpdate prepares an existing database for patching: derived tables
+// are dropped, the rows of dirty packages are deleted, and the returned sink
+// accepts only the dirty part of the graph. Call it after plan.Lookups, which
+// reads the rows deleted here. UpdateDB completes the database.
+func BeginUpdate(path string, plan *IncrementalPlan, prog *Progress) (*DBSink, error) {
+	prog.Log("Updating SQLite %s (%d dirty, %d removed packages)...", path, len(plan.DirtyPaths), len(plan.Removed))
+
+	conn, err := openDB(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateDB(conn, prog); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	// A compact database is patched in the regular schema
+	if _, err := expandCompact(conn, prog); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := dropDerived(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := createDiagnosticTables(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := createModuleTables(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if err := createBuildTables(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("begin tx: %w", err)
+	}
+	err = deleteDirtyRows(conn, plan)
+	endFn(&err)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	sink := newDBSink(conn, path, prog)
+	sink.scope = plan.InScope
+	return sink, nil
+}
+
+// UpdateDB flushes the sink, removes external stubs nothing points to any
+// more, recomputes fan-in/fan-out over the merged call edges, records the new
+// fingerprints and rebuilds every derived table.
+func UpdateDB(sink *DBSink, escapeResults []EscapeResult, git GitResults, fingerprints []PackageFingerprint, phases PhaseSet, validate bool, prog *Progress) error {
+	if err := sink.Finish(); err != nil {
+		return err
+	}
+	conn := sink.conn
+
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, `DELETE FROM nodes WHERE id LIKE 'ext::%'
+	  AND NOT EXISTS (SELECT 1 FROM edges e WHERE e.source = nodes.id OR e.target = nodes.id)`, nil); err != nil {
+		err = fmt.Errorf("incremental orphan stubs: %w", err)
+		endFn(&err)
+		return err
+	}
+	// Fan-in/fan-out of clean functions change when dirty callers change
+	if err := computeFanInOut(conn); err != nil {
+		endFn(&err)
+		return err
+	}
+	if err := writeFingerprints(conn, fingerprints); err != nil {
+		endFn(&err)
+		return err
+	}
+	if err := writeExtractCheckpoint(conn, escapeResults, git, phases); err != nil {
+		endFn(&err)
+		return err
+	}
+	endFn(&err)
+	if err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+
+	return finishDB(conn, sink.path, escapeResults, git, phases, validate, prog)
+}
+
+// dropDerived removes every view, index and non-base table.
+func dropDerived(conn *sqlite.Conn) error {
+	type object struct{ typ, name, sql string }
+	var objects []object
+	if err := sqlitex.ExecuteTransient(conn,
+		`SELECT type, name, COALESCE(sql, '') FROM sqlite_master WHERE name NOT LIKE 'sqlite_%'`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			objects = append(objects, object{stmt.ColumnText(0), stmt.ColumnText(1), stmt.ColumnText(2)})
+			return nil
+		}}); err != nil {
+		return fmt.Errorf("list schema: %w", err)
+	}
+
+	// Views first, then virtual tables (which take their shadow tables along),
+	// then plain tables, then indexes that survive on base tables.
+	rank := func(o object) int {
+		switch {
+		case o.typ == "view":
+			return 0
+		case o.typ == "table" && strings.HasPrefix(strings.ToUpper(o.sql), "CREATE VIRTUAL"):
+			return 1
+		case o.typ == "table":
+			return 2
+		default:
+			return 3
+		}
+	}
+	sort.SliceStable(objects, func(i, j int) bool { return rank(objects[i]) < rank(objects[j]) })
+
+	for _, o := range objects {
+		if o.typ == "table" && slices.Contains(baseTables, o.name) {
+			continue
+		}
+		if o.typ != "view" && o.typ != "table" && o.typ != "index" {
+			continue
+		}
+		q := fmt.Sprintf(`DROP %s IF EXISTS "%s"`, strings.ToUpper(o.typ), o.name)
+		if err := sqlitex.ExecuteTransient(conn, q, nil); err != nil {
+			return fmt.Errorf("drop %s %s: %w", o.typ, o.name, err)
+		}
+	}
+	return nil
+}
+
+// deleteDirtyRows deletes the rows of dirty and removed packages, the edges
+// derived by SQL stages, and the fingerprints of dirty packages. Dropping the
+// fingerprints first means an interrupted update leaves those packages dirty
+// for the next run instead of silently missing.
+func deleteDirtyRows(conn *sqlite.Conn, plan *IncrementalPlan) error {
+	script := `
+CREATE TEMP TABLE dirty_pkgs (package TEXT PRIMARY KEY);
+CREATE TEMP TABLE stale_files (file TEXT PRIMARY KEY);`
+	if err := sqlitex.ExecuteScript(conn, script, nil); err != nil {
+		return fmt.Errorf("incremental temp tables: %w", err)
+	}
+	if err := insertStrings(conn, `INSERT OR IGNORE INTO dirty_pkgs VALUES (?)`, sortedKeys(plan.DirtyPkgs)); err != nil {
+		return err
+	}
+	if err := insertStrings(conn, `INSERT OR IGNORE INTO stale_files VALUES (?)`, plan.StaleFiles); err != nil {
+		return err
+	}
+
+	// Edges produced by SQL stages are derived and recomputed by finishDB.
+	deletes := []struct{ name, sql string }{
+		{"fingerprints", `DELETE FROM package_fingerprints WHERE package IN (SELECT package FROM dirty_pkgs)`},
+		{"dead nodes", `CREATE TEMP TABLE dead_nodes AS
+		  SELECT id FROM nodes
+		  WHERE (package IN (SELECT package FROM dirty_pkgs) AND id NOT LIKE 'ext::%')
+		     OR id = 'META_DATA'`},
+		{"dead nodes index", `CREATE UNIQUE INDEX temp.idx_dead_nodes ON dead_nodes(id)`},
+		{"derived edges", `DELETE FROM edges
+		  WHERE kind IN ('eog', 'tests') OR (kind = 'dfg' AND properties LIKE '{"heuristic":true%')`},
+		{"stale edges", `DELETE FROM edges
+		  WHERE source IN (SELECT id FROM dead_nodes) OR target IN (SELECT id FROM dead_nodes)`},
+		{"stale metrics", `DELETE FROM metrics WHERE function_id IN (SELECT id FROM dead_nodes)`},
+		{"stale nodes", `DELETE FROM nodes WHERE id IN (SELECT id FROM dead_nodes)`},
+		{"stale sources", `DELETE FROM sources WHERE file IN (SELECT file FROM stale_files)`},
+		{"stale diagnostics", `DELETE FROM diagnostics WHERE package IN (SELECT package FROM dirty_pkgs)`},
+		{"stale coverage", `DELETE FROM package_coverage WHERE package IN (SELECT package FROM dirty_pkgs)`},
+		// Every run loads all packages, so the module graph is recorded afresh
+		{"modules", `DELETE FROM modules`},
+		{"module requires", `DELETE FROM module_requires`},
+	}
+	for _, d := range deletes {
+		if err := sqlitex.ExecuteTransient(conn, d.sql, nil); err != nil {
+			return fmt.Errorf("incremental %s: %w", d.name, err)
+		}
+	}
+
+	return sqlitex.ExecuteScript(conn, `
+DROP TABLE temp.dead_nodes;
+DROP TABLE temp.dirty_pkgs;
+DROP TABLE temp.stale_files;`, nil)
+}
+
+// insertStrings runs a single-parameter insert statement for each value.
+func insertStrings(conn *sqlite.Conn, query string, values []string) error {
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = stmt.Finalize() }()
+	for _, v := range values {
+		stmt.BindText(1, v)
+		if _, err := stmt.Step(); err != nil {
+			return err
+		}
+		_ = stmt.Reset()
+	}
+	return nil
+}
@@ -4,9 +4,11 @@ import (
 	"fmt"
 	"go/token"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
+	"golang.org/x/mod/modfile"
 	"golang.org/x/tools/go/packages"
 )
 
@@ -14,39 +16,89 @@ import (
 type LoadResult struct {
 	Packages []*packages.Package
 	Fset     *token.FileSet
+	Modules  []ResolvedModule // build list modules providing the loaded packages
+	// Diagnostics holds the load and type-check errors; the caller emits
+	// them once the sink exists.
+	Diagnostics []Diagnostic
 }
 
-// CreateTempGoWork writes a temporary go.work file that includes all modules
-// in the ModuleSet. Returns the path to the temp file (caller must os.Remove).
-func CreateTempGoWork(ms *ModuleSet) (string, error) {
-	var buf strings.Builder
-	buf.WriteString("go 1.25.7\n\nuse (\n")
+// CreateTempGoWork writes a temporary go.work file that includes all
+// workspace modules in the ModuleSet. When the repository has its own go.work
+// (source, "" for none), its go and toolchain versions, use directives and
+// replace directives are carried over and its go.work.sum is copied next to
+// the temporary file. Returns the path to the temp file (see Workspace.Remove).
+func CreateTempGoWork(ms *ModuleSet, source string) (string, error) {
+	wf := new(modfile.WorkFile)
+	wf.Syntax = new(modfile.FileSyntax)
+	goVersion := "1.25.7"
+	var sum []byte
+	if source != "" {
+		base, err := readGoWork(source)
+		if err != nil {
+			return "", err
+		}
+		if base.Go != nil {
+			goVersion = base.Go.Version
+		}
+		if base.Toolchain != nil {
+			if err := wf.AddToolchainStmt(base.Toolchain.Name); err != nil {
+				return "", fmt.Errorf("go.work toolchain: %w", err)
+			}
+		}
+		for _, u := range base.Use {
+			if err := wf.AddUse(useDir(source, u.Path), u.ModulePath); err != nil {
+				return "", fmt.Errorf("go.work use %s: %w", u.Path, err)
+			}
+		}
+		for _, r := range base.Replace {
+			newPath := r.New.Path
+			if r.New.Version == "" {
+				newPath = useDir(source, newPath)
+			}
+			if err := wf.AddReplace(r.Old.Path, r.Old.Version, newPath, r.New.Version); err != nil {
+				return "", fmt.Errorf("go.work replace %s: %w", r.Old.Path, err)
+			}
+		}
+		sum, _ = os.ReadFile(source + ".sum")
+	}
+	if err := wf.AddGoStmt(goVersion); err != nil {
+		return "", fmt.Errorf("go.work go version: %w", err)
+	}
 
-	// Collect top-level module dirs for dedup against discovered sub-modules.
-	topDirs := make(map[string]bool, len(ms.Dirs()))
-	for _, m := range ms.Dirs() {
-		buf.WriteString("\t" + m.Dir + "\n")
-		topDirs[m.Dir] = true
+	// Collect used dirs for dedup against the modules and discovered sub-modules.
+	used := make(map[string]bool, len(ms.Dirs()))
+	for _, u := range wf.Use {
+		used[u.Path] = true
+	}
+	use := func(dir string) error {
+		if used[dir] {
+			return nil
+		}
+		used[dir] = true
+		return wf.AddUse(dir, "")
+	}
+	for _, m := range ms.Workspace() {
+		if err := use(m.Dir); err != nil {
+			return "", fmt.Errorf("go.work use %s: %w", m.Dir, err)
+		}
 	}
 
 	// Walk ALL module directories (not just primary) to find nested sub-modules
 	// with their own go.mod. Deduplicate against already-listed top-level dirs.
-	for _, m := range ms.Dirs() {
+	for _, m := range ms.Workspace() {
 		for _, d := range findSubModules(m.Dir) {
-			if !topDirs[d] {
-				buf.WriteString("\t" + d + "\n")
-				topDirs[d] = true // prevent duplicates across module walks
+			if err := use(d); err != nil {
+				return "", fmt.Errorf("go.work use %s: %w", d, err)
 			}
 		}
 	}
-
-	buf.WriteString(")\n")
+	wf.Cleanup()
 
 	f, err := os.CreateTemp("", "cpg-workspace-*.work")
 	if err != nil {
 		return "", fmt.Errorf("create temp go.work: %w", err)
 	}
-	if _, err := f.WriteString(buf.String()); err != nil {
+	if _, err := f.Write(modfile.Format(wf.Syntax)); err != nil {
 		f.Close()
 		os.Remove(f.Name())
 		return "", fmt.Errorf("write go.work: %w", err)
@@ -55,6 +107,12 @@ func CreateTempGoWork(ms *ModuleSet) (string, error) {
 		os.Remove(f.Name())
 		return "", err
 	}
+	if len(sum) > 0 {
+		if err := os.WriteFile(f.Name()+".sum", sum, 0o644); err != nil {
+			os.Remove(f.Name())
+			return "", fmt.Errorf("write go.work.sum: %w", err)
+		}
+	}
 	return f.Name(), nil
 }
 
@@ -82,9 +140,14 @@ func findSubModules(dir string) []string {
 }
 
 // LoadPackages loads all Go packages from all modules via a workspace,
-// filtering to only packages belonging to known modules.
-func LoadPackages(goworkPath string, prog *Progress) (*LoadResult, error) {
-	prog.Log("Loading packages via workspace (%d modules)...", len(modSet.Dirs()))
+// filtering to only packages belonging to known modules. A nil build loads
+// the host configuration.
+func LoadPackages(goworkPath string, build *BuildConfig, prog *Progress) (*LoadResult, error) {
+	var buildName string
+	if build != nil {
+		buildName = ", " + build.Name
+	}
+	prog.Begin("load", "Loading packages via workspace (%d modules%s)...", len(modSet.Dirs()), buildName)
 
 	fset := token.NewFileSet()
 	cfg := &packages.Config{
@@ -96,21 +159,31 @@ func LoadPackages(goworkPath string, prog *Progress) (*LoadResult, error) {
 			packages.NeedTypes |
 			packages.NeedSyntax |
 			packages.NeedTypesInfo |
-			packages.NeedTypesSizes,
+			packages.NeedTypesSizes |
+			packages.NeedModule,
 		Dir:   modSet.PrimaryDir(),
 		Fset:  fset,
-		Tests: false,
+		Tests: !flagSkipTests,
 		Env:   replaceEnv(os.Environ(), "GOWORK", goworkPath),
 	}
+	if build != nil {
+		cfg.Env = build.Env(cfg.Env)
+		cfg.BuildFlags = build.BuildFlags()
+	}
 
 	initial, err := packages.Load(cfg, modSet.LoadPatterns()...)
 	if err != nil {
 		return nil, fmt.Errorf("packages.Load: %w", err)
 	}
+	if cfg.Tests {
+		initial = testVariants(initial)
+	}
 
-	// Filter to known module packages only
+	// Filter to known module packages only, then add the packages of
+	// dependency modules the workspace imports
 	filtered := make([]*packages.Package, 0, len(initial))
 	var errCount int
+	var diags []Diagnostic
 	for _, pkg := range initial {
 		if !modSet.IsKnownPkg(pkg.PkgPath) {
 			continue
@@ -118,9 +191,29 @@ func LoadPackages(goworkPath string, prog *Progress) (*LoadResult, error) {
 		if len(pkg.Errors) > 0 {
 			errCount++
 			prog.Verbose("  warning: %s has %d errors: %v", pkg.PkgPath, len(pkg.Errors), pkg.Errors[0])
+			msgs := make([]string, len(pkg.Errors))
+			for i, e := range pkg.Errors {
+				msgs[i] = e.Error()
+			}
+			prog.Report("type_error", Fields{"package": pkg.PkgPath, "errors": msgs})
+			diags = append(diags, loadDiagnostics(pkg)...)
 		}
 		filtered = append(filtered, pkg)
 	}
+	deps := depPackages(initial)
+	for _, pkg := range deps {
+		if pkg.Module != nil && pkg.Module.Dir != "" {
+			if pinned, moved := modSet.MoveDep(pkg.Module.Path, pkg.Module.Dir, pkg.Module.Version); moved && pinned != pkg.Module.Version {
+				prog.Warn("dependency %s: the workspace selects %s (%s), not %s as pinned in go.mod",
+					pkg.Module.Path, pkg.Module.Version, pkg.Module.Dir, pinned)
+			}
+		}
+		if len(pkg.Errors) > 0 {
+			errCount++
+			diags = append(diags, loadDiagnostics(pkg)...)
+		}
+	}
+	filtered = append(filtered, deps...)
 
 	// Count files and LOC (respecting skip filters)
 	var fileCount, loc int
@@ -137,21 +230,65 @@ func LoadPackages(goworkPath string, prog *Progress) (*LoadResult, error) {
 		}
 	}
 
-	prog.Log("Loaded %d packages (%d files, ~%dk LOC)", len(filtered), fileCount, loc/1000)
+	prog.End("load", Fields{"packages": len(filtered), "files": fileCount, "loc": loc, "type_error_packages": errCount},
+		"Loaded %d packages (%d files, ~%dk LOC)", len(filtered), fileCount, loc/1000)
 	if errCount > 0 {
 		prog.Log("  %d packages had type-check errors (continuing)", errCount)
 	}
 
 	return &LoadResult{
-		Packages: filtered,
-		Fset:     fset,
+		Packages:    filtered,
+		Fset:        fset,
+		Modules:     resolvedModules(initial),
+		Diagnostics: diags,
 	}, nil
 }
 
+// testVariants reduces a package list loaded with Tests: true to one package
+// per import path. A package with internal tests is replaced by its test
+// variant ("p [p.test]"), which type-checks the production files together
+// with the _test.go files; external test packages ("p_test [p.test]") are
+// kept and the generated test mains ("p.test") dropped.
+func testVariants(pkgs []*packages.Package) []*packages.Package {
+	hasVariant := make(map[string]bool)
+	for _, pkg := range pkgs {
+		if pkg.ID != pkg.PkgPath {
+			hasVariant[pkg.PkgPath] = true
+		}
+	}
+	out := pkgs[:0]
+	for _, pkg := range pkgs {
+		switch {
+		case pkg.Name == "main" && strings.HasSuffix(pkg.PkgPath, ".test"):
+		case pkg.ID == pkg.PkgPath && hasVariant[pkg.PkgPath]:
+		default:
+			out = append(out, pkg)
+		}
+	}
+	return out
+}
+
+// depPackages returns the packages of dependency modules reachable from the
+// loaded roots, one per import path. NeedDeps gives them syntax and type info
+// like the roots.
+func depPackages(roots []*packages.Package) []*packages.Package {
+	var deps []*packages.Package
+	seen := make(map[string]bool)
+	packages.Visit(roots, nil, func(pkg *packages.Package) {
+		if seen[pkg.PkgPath] || !modSet.IsDepPkg(pkg.PkgPath) {
+			return
+		}
+		seen[pkg.PkgPath] = true
+		deps = append(deps, pkg)
+	})
+	return deps
+}
+
 // Skip flags, set by main before any pipeline phase runs.
 var (
 	flagSkipTests     = true
 	flagSkipGenerated = true
+	flagSkipPatterns  []string // see SkipConfig for pattern syntax
 )
 
 // replaceEnv returns a copy of environ with key set to val, replacing any
@@ -168,14 +305,36 @@ func replaceEnv(environ []string, key, val string) []string {
 	return append(result, prefix+val)
 }
 
-// shouldSkipFile returns true for generated/test files that should be excluded.
-func shouldSkipFile(path string) bool {
-	base := BaseName(path)
+// shouldSkipFile returns true for generated/test files and files matching the
+// configured skip patterns.
+func shouldSkipFile(file string) bool {
+	base := BaseName(file)
 	if flagSkipTests && strings.HasSuffix(base, "_test.go") {
 		return true
 	}
 	if flagSkipGenerated && strings.HasSuffix(base, ".pb.go") {
 		return true
 	}
+	if len(flagSkipPatterns) > 0 {
+		rel := file
+		if filepath.IsAbs(file) {
+			rel = modSet.RelFile(file)
+		}
+		rel = filepath.ToSlash(rel)
+		for _, pat := range flagSkipPatterns {
+			if dir, ok := strings.CutSuffix(pat, "/"); ok {
+				if rel == dir || strings.HasPrefix(rel, dir+"/") {
+					return true
+				}
+				continue
+			}
+			if ok, _ := path.Match(pat, rel); ok {
+				return true
+			}
+			if ok, _ := path.Match(pat, base); ok {
+				return true
+			}
+		}
+	}
 	return false
 }
@@ -1,136 +1,286 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
+	"path"
 	"runtime/debug"
 	"strings"
+
+	"cpg-gen/graph/schema"
 )
 
 func main() {
-	if err := run(); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	var err error
+	switch {
+	case len(os.Args) > 1 && os.Args[1] == "query":
+		err = runQuery(os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == "diff":
+		err = runDiff(os.Args[2:])
+	case len(os.Args) > 1 && os.Args[1] == "impact":
+		err = runImpact(os.Args[2:])
+	default:
+		err = run()
+	}
+	if err != nil {
+		if !errors.As(err, new(reportedError)) {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
 		os.Exit(1)
 	}
 }
 
+// reportedError wraps an error run already emitted as a progress event, so
+// main does not print a non-JSON line into -progress=json output.
+type reportedError struct{ error }
+
+func (e reportedError) Unwrap() error { return e.error }
+
 // run is the real entry point. Using a separate function ensures all defers
 // (including temp file cleanup) execute even on error paths, unlike os.Exit
 // which skips deferred calls.
-func run() error {
+func run() (err error) {
+	configFile := flag.String("config", "", "YAML or JSON project config (modules, skip rules, memory limit, phases, output); explicit flags override it")
 	skipGenerated := flag.Bool("skip-generated", true, "Skip .pb.go files")
-	skipTests := flag.Bool("skip-tests", true, "Skip _test.go files")
+	skipTests := flag.Bool("skip-tests", true, "Skip _test.go files; false loads test packages and links tests to the code they reach")
 	verbose := flag.Bool("verbose", false, "Print detailed progress")
+	progressFormat := flag.String("progress", "text", "Progress output on stderr: text, or json for one JSON event per line (phase start/end with counters, warnings, type errors)")
 	validate := flag.Bool("validate", false, "Run validation queries after write")
-	modules := flag.String("modules", "", "Comma-separated dir:modpath:name triples for additional modules (e.g. ./adapter:sigs.k8s.io/prometheus-adapter:adapter)")
+	incremental := flag.Bool("incremental", false, "Patch an existing output DB, regenerating only packages whose content fingerprint changed (and their dependents)")
+	resume := flag.Bool("resume", false, "Finish an interrupted run on the existing output DB, running only the SQL stages without a checkpoint")
+	compact := flag.Bool("compact", false, "Write the compact schema: integer node keys, a kinds lookup table and properties stored once, behind views with the regular table shapes (smaller file, slower property lookups); kept by -incremental and -resume")
+	jobs := flag.Int("j", 0, "Worker count for AST walking and SSA edge extraction (0 = one per CPU)")
+	stageJobs := flag.Int("stage-jobs", 1, "Connections for the SQL stages; stages that touch disjoint tables overlap when > 1")
+	blame := flag.Bool("blame", false, "Run git blame on every source file (part of the git phase) for per-function ownership, with CODEOWNERS owners added to dashboard_hotspots")
+	blameTimeout := flag.Duration("blame-timeout", defaultBlameTimeout, "Time budget for -blame; files not blamed by then are left out")
+	memoryLimit := flag.String("memory-limit", defaultMemoryLimit, "Soft memory limit for the Go runtime (e.g. 8GiB, 512MiB, off)")
+	phases := flag.String("phases", "", "Comma-separated phases to run, plus their dependencies (default all; see below)")
+	skipPhases := flag.String("skip-phases", "", "Comma-separated phases to skip, together with the phases that depend on them")
+	var buildSpecs []string
+	flag.Func("build", "Build configuration goos/goarch[,tag=<tag>...] to load, e.g. linux/amd64 or windows/amd64,tag=stringlabels; repeat for a matrix merged into one graph (default: host only)", func(s string) error {
+		buildSpecs = append(buildSpecs, s)
+		return nil
+	})
+	deps := flag.String("deps", "", "Comma-separated dependency module paths to analyze in full instead of as ext:: stubs, read offline from the vendor directory or GOMODCACHE at the version go.mod pins (e.g. github.com/prometheus/common)")
+	modules := flag.String("modules", "", "Comma-separated dir:modpath:name triples for additional modules (e.g. ./adapter:sigs.k8s.io/prometheus-adapter:adapter); modpath may be omitted (dir::name or dir:name) to read it from go.mod")
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: cpg-gen [flags] <primary-dir> <output.db>\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: cpg-gen [flags] <primary-dir> <output.db>\n")
+		fmt.Fprintf(os.Stderr, "       cpg-gen -config cpg.yaml [flags] [<primary-dir> <output.db>]\n")
+		fmt.Fprintf(os.Stderr, "       cpg-gen query [flags] <db> [<query>]\n")
+		fmt.Fprintf(os.Stderr, "       cpg-gen diff [flags] <old.db> <new.db>\n")
+		fmt.Fprintf(os.Stderr, "       cpg-gen impact [flags] -since <rev> <db>\n\n")
 		fmt.Fprintf(os.Stderr, "Generates a Code Property Graph (CPG) SQLite database from Go modules.\n\n")
 		fmt.Fprintf(os.Stderr, "Flags:\n")
 		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nPhases:\n%s", phaseUsage())
 	}
 	flag.Parse()
 
-	if flag.NArg() != 2 {
+	cfg := DefaultConfig()
+	if *configFile != "" {
+		var err error
+		if cfg, err = LoadConfig(*configFile); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case flag.NArg() == 2:
+		cfg.Root = flag.Arg(0)
+		cfg.Output.Path = flag.Arg(1)
+	case flag.NArg() == 0 && *configFile != "":
+		// root and output come from the config file
+	default:
 		flag.Usage()
 		return fmt.Errorf("expected 2 arguments, got %d", flag.NArg())
 	}
 
-	promDir, err := filepath.Abs(flag.Arg(0))
-	if err != nil {
-		return fmt.Errorf("invalid primary dir: %w", err)
+	// Explicitly set flags take precedence over the config file
+	var flagErr error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "skip-generated":
+			cfg.Skip.Generated = *skipGenerated
+		case "skip-tests":
+			cfg.Skip.Tests = *skipTests
+		case "validate":
+			cfg.Output.Validate = *validate
+		case "incremental":
+			cfg.Output.Incremental = *incremental
+		case "resume":
+			cfg.Output.Resume = *resume
+		case "compact":
+			cfg.Output.Compact = *compact
+		case "j":
+			cfg.Jobs = *jobs
+		case "stage-jobs":
+			cfg.StageJobs = *stageJobs
+		case "blame":
+			cfg.Blame.Enabled = *blame
+		case "blame-timeout":
+			cfg.Blame.Timeout = blameTimeout.String()
+		case "memory-limit":
+			cfg.MemoryLimit = *memoryLimit
+		case "phases":
+			cfg.Phases = splitList(*phases)
+		case "skip-phases":
+			cfg.SkipPhases = splitList(*skipPhases)
+		case "build":
+			cfg.Builds = buildSpecs
+		case "deps":
+			cfg.Deps = splitList(*deps)
+		case "modules":
+			extra, err := ParseModuleSpecs(*modules)
+			if err != nil {
+				flagErr = err
+			}
+			cfg.Modules = append(cfg.Modules, extra...)
+		}
+	})
+	if flagErr != nil {
+		return flagErr
 	}
-	outputPath := flag.Arg(1)
 
-	// Set memory limit for GC pressure
-	debug.SetMemoryLimit(8 * 1024 * 1024 * 1024) // 8 GiB
+	if err := cfg.Resolve(); err != nil {
+		return err
+	}
+	outputPath := cfg.Output.Path
 
-	// Wire skip flags into the package-level config used by shouldSkipFile
-	flagSkipGenerated = *skipGenerated
-	flagSkipTests = *skipTests
+	// Set memory limit for GC pressure (0 = leave the runtime default)
+	if limit, _ := ParseMemoryLimit(cfg.MemoryLimit); limit > 0 {
+		debug.SetMemoryLimit(limit)
+	}
 
-	prog := NewProgress(*verbose)
+	// Wire skip rules into the package-level config used by shouldSkipFile
+	flagSkipGenerated = cfg.Skip.Generated
+	flagSkipTests = cfg.Skip.Tests
+	flagSkipPatterns = cfg.Skip.Patterns
+	flagJobs = cfg.Jobs
+	flagStageJobs = cfg.StageJobs
+	flagCompact = cfg.Output.Compact
 
-	// Build ModuleSet from primary dir + extra modules
-	primary := ModuleInfo{
-		ModPath: "github.com/prometheus/prometheus",
-		Dir:     promDir,
-		Prefix:  "", // primary module keeps paths unprefixed for backward compat
-	}
-
-	var extras []ModuleInfo
-	if *modules != "" {
-		for _, spec := range strings.Split(*modules, ",") {
-			parts := strings.SplitN(strings.TrimSpace(spec), ":", 3)
-			if len(parts) != 3 {
-				prog.Log("Warning: invalid --modules spec %q (want dir:modpath:name)", spec)
-				continue
-			}
-			dir, err := filepath.Abs(parts[0])
+	if *progressFormat != "text" && *progressFormat != "json" {
+		return fmt.Errorf("invalid -progress %q (want text or json)", *progressFormat)
+	}
+	prog := NewProgress(*verbose, *progressFormat == "json")
+	if prog.JSON() {
+		defer func() {
 			if err != nil {
-				prog.Log("Warning: invalid module dir %q: %v", parts[0], err)
-				continue
+				prog.Error(err)
+				err = reportedError{err}
 			}
-			extras = append(extras, ModuleInfo{
-				Dir:     dir,
-				ModPath: parts[1],
-				Prefix:  parts[2],
-			})
-		}
+		}()
 	}
 
-	modSet = NewModuleSet(primary, extras)
-	prog.Log("Analyzing %d modules: %s", len(modSet.Dirs()), moduleNames(modSet))
-
-	// Create temporary go.work for unified type universe
-	goworkPath, err := CreateTempGoWork(modSet)
+	// Build ModuleSet from primary dir + extra modules
+	ms, err := cfg.ModuleSet()
 	if err != nil {
 		return err
 	}
-	defer os.Remove(goworkPath)
-	prog.Verbose("Created workspace: %s", goworkPath)
+	modSet = ms
+	prog.Begin("run", "Analyzing %d modules: %s", len(modSet.Dirs()), moduleNames(modSet))
 
-	cpg := NewCPG()
+	// The graph and the Go-side results are already in the DB; skip to the SQL stages
+	if cfg.Output.Resume {
+		return ResumeDB(outputPath, cfg.Output.Validate, prog)
+	}
 
-	// Phase 1: Load packages (all modules, single type universe)
-	loadResult, err := LoadPackages(goworkPath, prog)
+	// Create temporary go.work for unified type universe (or use the
+	// repository's own for a vendored build)
+	ws, err := PrepareWorkspace(modSet, prog)
 	if err != nil {
 		return err
 	}
+	defer ws.Remove()
 
-	// Phase 2: Walk AST → nodes + AST edges + position lookup
-	posLookup, funcLookup := WalkAST(loadResult.Packages, loadResult.Fset, cpg, prog)
-
-	// Phase 3: Build SSA
-	ssaResult := BuildSSA(loadResult.Packages, prog)
-
-	// Phase 4: Extract CFG + DFG from SSA
-	ExtractCFGAndDFG(ssaResult, loadResult.Fset, posLookup, funcLookup, cpg, prog)
-
-	// Phase 4b: Extract CDG from post-dominator tree
-	ExtractCDG(ssaResult, loadResult.Fset, funcLookup, cpg, prog)
-
-	// Phase 4c: Extract channel send→receive flow edges
-	ExtractChannelFlow(ssaResult, loadResult.Fset, posLookup, cpg, prog)
-
-	// Phase 4d: Extract panic/recover flow edges
-	ExtractPanicRecover(ssaResult, loadResult.Fset, posLookup, funcLookup, cpg, prog)
-
-	// Phase 5: Build VTA call graph → call edges
-	BuildCallGraph(ssaResult, loadResult.Fset, posLookup, funcLookup, cpg, prog)
+	// Phase 1: Load packages (all modules, single type universe). With
+	// -build configurations the first one is loaded here and the rest are
+	// loaded in turn below.
+	builds := cfg.BuildConfigs()
+	var build *BuildConfig
+	if len(builds) > 0 {
+		build = &builds[0]
+	}
+	loadResult, err := LoadPackages(ws.GoWork, build, prog)
+	if err != nil {
+		return err
+	}
 
-	// Phase 6: Extract type relationships (implements, embeds)
-	ExtractTypeRelationships(loadResult.Packages, loadResult.Fset, posLookup, cpg, prog)
+	// Phase 1b: Fingerprint packages; in incremental mode, plan which are dirty
+	fingerprints := FingerprintPackages(loadResult.Packages, cfg.FingerprintSalt())
+	var plan *IncrementalPlan
+	if cfg.Output.Incremental {
+		if plan, err = PlanIncremental(outputPath, fingerprints, prog); err != nil {
+			return err
+		}
+		// A compact database stays compact, even when rebuilt in full
+		if plan != nil && plan.Compact {
+			flagCompact = true
+		}
+		switch {
+		case plan == nil:
+		case plan.UpToDate():
+			prog.Log("Incremental: all %d packages up to date, nothing to do", plan.Total)
+			return nil
+		case plan.Full():
+			prog.Log("Incremental: all %d packages changed, doing a full build", plan.Total)
+			plan = nil
+		default:
+			prog.Log("Incremental: %d of %d packages dirty, %d removed", len(plan.DirtyPaths), plan.Total, len(plan.Removed))
+		}
+	}
 
-	// Phase 7: Compute function metrics
-	ComputeMetrics(loadResult.Packages, loadResult.Fset, funcLookup, cpg, prog)
+	// Every phase streams into the database through cpg as it goes.
+	var cpg *DBSink
+	var lookups *graphLookups
+	if plan != nil {
+		lookups = new(graphLookups)
+		lookups.pos, lookups.fn, lookups.def, err = plan.Lookups(outputPath, loadResult.Packages, loadResult.Fset)
+		if err != nil {
+			return err
+		}
+		if cpg, err = BeginUpdate(outputPath, plan, prog); err != nil {
+			return err
+		}
+	} else if cpg, err = CreateDB(outputPath, prog); err != nil {
+		return err
+	}
+	defer cpg.Close()
+	if err := cpg.AddModules(loadResult.Modules); err != nil {
+		return err
+	}
+	if err := cpg.AddMeta(runMeta(cfg, os.Args[1:])); err != nil {
+		return err
+	}
 
-	// Phase 7b: Fill fan-in/fan-out from call graph
-	ComputeFanInOut(cpg)
+	// Phases 2-7: extract the graph, once per build configuration
+	if len(builds) == 0 {
+		extractGraph(cfg, loadResult, plan, lookups, cpg, prog)
+	}
+	for i := range builds {
+		prog.Begin("build", "Extracting build configuration %s (%d of %d)", builds[i].Name, i+1, len(builds))
+		if i > 0 {
+			loadResult = nil // let the previous configuration be collected
+			if loadResult, err = LoadPackages(ws.GoWork, &builds[i], prog); err != nil {
+				return err
+			}
+			if err := cpg.AddModules(loadResult.Modules); err != nil {
+				return err
+			}
+		}
+		if err := cpg.SetBuild(builds[i]); err != nil {
+			return err
+		}
+		extractGraph(cfg, loadResult, nil, nil, cpg, prog)
+		prog.End("build", Fields{"build": builds[i].Name}, "")
+	}
 
-	// Add META_DATA node with generator info
+	// Add META_DATA node with generator info. It is graph content (see
+	// contentHash), so it holds only the part of the config that decides
+	// what the graph contains; cpg_meta keeps the full config and the root.
+	graphCfg := cfg.GraphConfig()
 	cpg.AddNode(Node{
 		ID:   "META_DATA",
 		Kind: "meta_data",
@@ -138,34 +288,136 @@ func run() error {
 		Properties: map[string]any{
 			"language":  "go",
 			"version":   "1.0",
+			"schema":    schema.Version,
 			"generator": "cpg-gen",
-			"root":      promDir,
+			"module":    modSet.Primary().ModPath,
 			"modules":   len(modSet.Dirs()),
+			"config":    &graphCfg,
+			"phases":    cfg.PhaseSet().List(),
 		},
 	})
 
 	// Phase 7c: Escape analysis from Go compiler (all modules)
-	escapeResults := RunEscapeAnalysis(prog)
+	var escapeResults []EscapeResult
+	if cfg.PhaseEnabled("escape") {
+		escapeResults = RunEscapeAnalysis(prog)
+	}
 
-	// Phase 7d: Git history for diff-aware analysis (all modules)
-	gitHistory := RunGitHistory(prog)
+	// Phase 7d: Git history for diff-aware analysis, and with -blame
+	// per-function ownership (all modules)
+	var git GitResults
+	if cfg.PhaseEnabled("git") {
+		git.History, git.Commits = RunGitHistory(prog)
+		if cfg.Blame.Enabled {
+			git.Blame = RunGitBlame(cfg.BlameTimeout(), prog)
+			git.Owners = ReadCodeOwners(prog)
+		}
+	}
 
-	// Phase 8: Write SQLite
-	if err := WriteDB(outputPath, cpg, escapeResults, gitHistory, *validate, prog); err != nil {
+	// Phase 8: Finish SQLite (fan-in/fan-out, derived tables); in incremental
+	// mode this patches the existing DB
+	if plan != nil {
+		if err := UpdateDB(cpg, escapeResults, git, fingerprints, cfg.PhaseSet(), cfg.Output.Validate, prog); err != nil {
+			return err
+		}
+	} else if err := WriteDB(cpg, escapeResults, git, fingerprints, cfg.PhaseSet(), cfg.Output.Validate, prog); err != nil {
+		return err
+	}
+	if err := cpg.Close(); err != nil {
 		return err
 	}
 
-	prog.Log("Done. %d nodes, %d edges.", len(cpg.Nodes), len(cpg.Edges))
+	prog.End("run", Fields{"nodes": cpg.NodeCount(), "edges": cpg.EdgeCount()}, "Done. %d nodes, %d edges.", cpg.NodeCount(), cpg.EdgeCount())
 	return nil
 }
 
+// graphLookups are the position and declaration lookups of the clean part of
+// the graph in incremental mode (see IncrementalPlan.Lookups).
+type graphLookups struct {
+	pos *PosLookup
+	fn  *FuncLookup
+	def *DefLookup
+}
+
+// extractGraph runs the Go-side phases (AST walk through metrics) over one
+// loaded configuration, streaming into cpg. In incremental mode plan and
+// lookups restrict the walk and the SSA extraction to the dirty packages.
+func extractGraph(cfg *Config, loadResult *LoadResult, plan *IncrementalPlan, lookups *graphLookups, cpg *DBSink, prog *Progress) {
+	// Phase 2: Walk AST → nodes + AST edges + position lookup
+	walkPkgs := loadResult.Packages
+	var posLookup *PosLookup
+	var funcLookup *FuncLookup
+	if plan != nil {
+		walkPkgs = plan.Packages(loadResult.Packages)
+		posLookup, funcLookup = lookups.pos, lookups.fn
+		WalkASTWith(walkPkgs, loadResult.Fset, cpg, posLookup, funcLookup, lookups.def, prog)
+	} else {
+		posLookup, funcLookup = WalkAST(walkPkgs, loadResult.Fset, cpg, prog)
+	}
+	for _, d := range loadResult.Diagnostics {
+		cpg.AddDiagnostic(d)
+	}
+
+	// Phase 3: Build SSA (only when a phase consumes it)
+	var ssaResult *SSAResult
+	if cfg.PhaseEnabled("cfg") || cfg.PhaseEnabled("dfg") || cfg.PhaseEnabled("cdg") ||
+		cfg.PhaseEnabled("chan") || cfg.PhaseEnabled("panic") || cfg.PhaseEnabled("call") {
+		ssaResult = BuildSSA(loadResult.Packages, prog)
+		if plan != nil {
+			ssaResult.Scope = plan.DirtyPaths
+		}
+		for _, d := range ssaResult.Diagnostics {
+			cpg.AddDiagnostic(d)
+		}
+	}
+
+	// Phase 4: Extract CFG + DFG from SSA
+	if cfg.PhaseEnabled("cfg") || cfg.PhaseEnabled("dfg") {
+		ExtractCFGAndDFG(ssaResult, loadResult.Fset, posLookup, funcLookup, cpg,
+			cfg.PhaseEnabled("cfg"), cfg.PhaseEnabled("dfg"), prog)
+	}
+
+	// Phase 4b: Extract CDG from post-dominator tree
+	if cfg.PhaseEnabled("cdg") {
+		ExtractCDG(ssaResult, loadResult.Fset, funcLookup, cpg, prog)
+	}
+
+	// Phase 4c: Extract channel send→receive flow edges
+	if cfg.PhaseEnabled("chan") {
+		ExtractChannelFlow(ssaResult, loadResult.Fset, posLookup, cpg, prog)
+	}
+
+	// Phase 4d: Extract panic/recover flow edges
+	if cfg.PhaseEnabled("panic") {
+		ExtractPanicRecover(ssaResult, loadResult.Fset, posLookup, funcLookup, cpg, prog)
+	}
+
+	// Phase 5: Build VTA call graph → call edges
+	if cfg.PhaseEnabled("call") {
+		BuildCallGraph(ssaResult, loadResult.Fset, posLookup, funcLookup, cpg, prog)
+	}
+
+	// Phase 6: Extract type relationships (implements, embeds)
+	if cfg.PhaseEnabled("types") {
+		ExtractTypeRelationships(loadResult.Packages, loadResult.Fset, posLookup, cpg, prog)
+	}
+
+	// Phase 7: Compute function metrics
+	if cfg.PhaseEnabled("metrics") {
+		ComputeMetrics(walkPkgs, loadResult.Fset, funcLookup, cpg, prog)
+	}
+}
+
 // moduleNames returns a human-readable list of module prefixes.
 func moduleNames(ms *ModuleSet) string {
 	names := make([]string, len(ms.Dirs()))
 	for i, m := range ms.Dirs() {
-		if m.Prefix == "" {
-			names[i] = "prometheus (primary)"
-		} else {
+		switch {
+		case m.Prefix == "":
+			names[i] = path.Base(m.ModPath) + " (primary)"
+		case m.Dep:
+			names[i] = m.Prefix + " (" + m.ModPath + "@" + m.Version + ")"
+		default:
 			names[i] = m.Prefix
 		}
 	}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"cpg-gen/graph/schema"
+)
+
+// The database records the schema version it was written in twice: in the
+// header (PRAGMA user_version, readable without knowing any table) and in
+// cpg_meta, which also holds the provenance of the run: the cpg-gen and Go
+// versions, the module commits, the flags and when it ran. Readers check
+// the version with schema.Check; -incremental and -resume bring an older
+// database forward with the migrations below before touching it.
+
+// createMetaTable creates the cpg_meta key/value table.
+func createMetaTable(conn *sqlite.Conn) error {
+	if err := sqlitex.ExecuteTransient(conn, `CREATE TABLE IF NOT EXISTS cpg_meta (
+    key TEXT PRIMARY KEY,
+    value TEXT NOT NULL
+)`, nil); err != nil {
+		return fmt.Errorf("cpg_meta: %w", err)
+	}
+	return nil
+}
+
+// readSchemaVersion returns the schema version of an open database.
+func readSchemaVersion(conn *sqlite.Conn) (int, error) {
+	var v int
+	if err := sqlitex.ExecuteTransient(conn, `PRAGMA user_version`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			v = stmt.ColumnInt(0)
+			return nil
+		}}); err != nil {
+		return 0, fmt.Errorf("schema version: %w", err)
+	}
+	return schema.VersionOf(v), nil
+}
+
+// setSchemaVersion stores the schema version in the header and cpg_meta.
+func setSchemaVersion(conn *sqlite.Conn, version int) error {
+	if err := sqlitex.ExecuteTransient(conn, fmt.Sprintf(`PRAGMA user_version = %d`, version), nil); err != nil {
+		return fmt.Errorf("schema version: %w", err)
+	}
+	if err := sqlitex.Execute(conn, `INSERT OR REPLACE INTO cpg_meta (key, value) VALUES (?, ?)`,
+		&sqlitex.ExecOptions{Args: []any{schema.KeySchemaVersion, fmt.Sprint(version)}}); err != nil {
+		return fmt.Errorf("schema version: %w", err)
+	}
+	return nil
+}
+
+// writeMeta replaces the cpg_meta entries with values and the current
+// schema version.
+func writeMeta(conn *sqlite.Conn, values map[string]string) error {
+	if err := sqlitex.ExecuteTransient(conn, `DELETE FROM cpg_meta`, nil); err != nil {
+		return fmt.Errorf("cpg_meta: %w", err)
+	}
+	stmt, err := conn.Prepare(`INSERT INTO cpg_meta (key, value) VALUES (?, ?)`)
+	if err != nil {
+		return fmt.Errorf("cpg_meta: %w", err)
+	}
+	for _, k := range sortedKeys(values) {
+		stmt.BindText(1, k)
+		stmt.BindText(2, values[k])
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("cpg_meta %s: %w", k, err)
+		}
+		_ = stmt.Reset()
+	}
+	return setSchemaVersion(conn, schema.Version)
+}
+
+// runMeta returns the cpg_meta entries describing this run: args are the
+// command-line arguments, cfg the configuration they resolved to.
+func runMeta(cfg *Config, args []string) map[string]string {
+	flags, _ := json.Marshal(append([]string{}, args...))
+	config, _ := json.Marshal(cfg)
+	var mods []schema.ModuleMeta
+	for _, mod := range modSet.Dirs() {
+		mods = append(mods, moduleMeta(mod))
+	}
+	modules, _ := json.Marshal(mods)
+	return map[string]string{
+		schema.KeyGenerator:        "cpg-gen",
+		schema.KeyGeneratorVersion: generatorVersion(),
+		schema.KeyGoVersion:        runtime.Version(),
+		schema.KeyGeneratedAt:      generatedAt().Format(time.RFC3339),
+		schema.KeyFlags:            string(flags),
+		schema.KeyConfig:           string(config),
+		schema.KeyModules:          string(modules),
+	}
+}
+
+// generatedAt returns the time to record for the run: SOURCE_DATE_EPOCH when
+// set, as for reproducible builds, otherwise now.
+func generatedAt() time.Time {
+	if s := os.Getenv("SOURCE_DATE_EPOCH"); s != "" {
+		if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return time.Unix(sec, 0).UTC()
+		}
+	}
+	return time.Now().UTC()
+}
+
+// generatorVersion returns the module version cpg-gen was installed at, or
+// for a build from a checkout the VCS revision, marked when the checkout had
+// local changes.
+func generatorVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	var revision string
+	var modified bool
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if revision == "" {
+		return "(devel)"
+	}
+	if modified {
+		revision += "+dirty"
+	}
+	return revision
+}
+
+// moduleMeta describes an analyzed module: the commit its directory is
+// checked out at and whether it has uncommitted changes, or the version of
+// a dependency read from the module cache.
+func moduleMeta(mod ModuleInfo) schema.ModuleMeta {
+	m := schema.ModuleMeta{Path: mod.ModPath, Prefix: mod.Prefix, Dir: mod.Dir}
+	if mod.Dep {
+		m.Version = mod.Version
+		return m
+	}
+	out, err := gitOutput(mod.Dir, "rev-parse", "HEAD")
+	if err != nil {
+		return m // not a git checkout
+	}
+	m.Commit = strings.TrimSpace(out)
+	status, err := gitOutput(mod.Dir, "status", "--porcelain", "--", ".")
+	m.Dirty = err == nil && strings.TrimSpace(status) != ""
+	return m
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// AddMeta records the cpg_meta entries of the run.
+func (s *DBSink) AddMeta(values map[string]string) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	if err := writeMeta(s.conn, values); err != nil {
+		s.err = err
+		return err
+	}
+	return nil
+}
+
+// A migration brings a database at schema version Version-1 to Version. It
+// runs in the transaction that also records the new version.
+type migration struct {
+	Version int
+	Name    string
+	Run     func(conn *sqlite.Conn) error
+}
+
+// migrations are the schema changes since schema.Legacy, in version order.
+var migrations = []migration{
+	{Version: 2, Name: "cpg_meta table, filled from the META_DATA node", Run: migrateMeta},
+}
+
+// migrateDB brings the database to schema.Version, or fails if it was
+// written by a newer cpg-gen.
+func migrateDB(conn *sqlite.Conn, prog *Progress) error {
+	version, err := readSchemaVersion(conn)
+	if err != nil {
+		return err
+	}
+	if err := schema.Check(version); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		prog.Log("Migrating schema to version %d: %s", m.Version, m.Name)
+		endFn, err := sqlitex.ImmediateTransaction(conn)
+		if err != nil {
+			return fmt.Errorf("migrate: begin tx: %w", err)
+		}
+		err = m.Run(conn)
+		if err == nil {
+			err = setSchemaVersion(conn, m.Version)
+		}
+		endFn(&err)
+		if err != nil {
+			return fmt.Errorf("migrate to schema version %d: %w", m.Version, err)
+		}
+	}
+	return nil
+}
+
+// migrateMeta creates cpg_meta with what the META_DATA node knows.
+func migrateMeta(conn *sqlite.Conn) error {
+	if err := createMetaTable(conn); err != nil {
+		return err
+	}
+	values := schema.LegacyValues("")
+	if err := sqlitex.ExecuteTransient(conn, schema.LegacyQuery, &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			values = schema.LegacyValues(stmt.ColumnText(0))
+			return nil
+		}}); err != nil {
+		return err
+	}
+	for _, k := range sortedKeys(values) {
+		if err := sqlitex.Execute(conn, `INSERT OR REPLACE INTO cpg_meta (key, value) VALUES (?, ?)`,
+			&sqlitex.ExecOptions{Args: []any{k, values[k]}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
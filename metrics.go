@@ -9,9 +9,9 @@ import (
 
 // ComputeMetrics calculates cyclomatic complexity, LOC, and num_params for all functions.
 // Handles both FuncDecl (named functions/methods) and FuncLit (anonymous function literals).
-// Fan-in/fan-out are computed later by ComputeFanInOut after call graph construction.
-func ComputeMetrics(pkgs []*packages.Package, fset *token.FileSet, funcLookup *FuncLookup, cpg *CPG, prog *Progress) {
-	prog.Log("Computing metrics...")
+// Fan-in/fan-out are filled in by computeFanInOut once the call edges are in the database.
+func ComputeMetrics(pkgs []*packages.Package, fset *token.FileSet, funcLookup *FuncLookup, cpg Sink, prog *Progress) {
+	prog.Begin("metrics", "Computing metrics...")
 
 	var count int
 
@@ -68,12 +68,12 @@ func ComputeMetrics(pkgs []*packages.Package, fset *token.FileSet, funcLookup *F
 				endLine := fset.Position(endPos).Line
 				loc := endLine - line + 1
 
-				cpg.Metrics[funcID] = &Metrics{
+				cpg.AddMetrics(Metrics{
 					FunctionID:           funcID,
 					CyclomaticComplexity: complexity,
 					LOC:                  loc,
 					NumParams:            countParams(funcType),
-				}
+				})
 				count++
 
 				return true
@@ -81,7 +81,7 @@ func ComputeMetrics(pkgs []*packages.Package, fset *token.FileSet, funcLookup *F
 		}
 	}
 
-	prog.Log("Computed metrics for %d functions", count)
+	prog.End("metrics", Fields{"functions": count}, "Computed metrics for %d functions", count)
 }
 
 // countParams returns the total number of parameters in a function signature.
@@ -1,6 +1,10 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"hash/maphash"
+	"sort"
+)
 
 // Node represents a vertex in the Code Property Graph.
 type Node struct {
@@ -34,12 +38,43 @@ type Metrics struct {
 	NumParams            int
 }
 
-// edgeKey is the deduplication key for edges.
-type edgeKey struct {
-	Source, Target, Kind string
+// Sink receives graph elements from the extraction phases. Implementations
+// deduplicate: the first node with a given ID, the first edge with a given
+// (source, target, kind), the first source per file and the first metrics
+// per function win; identical diagnostics are kept once and coverage counts
+// add up.
+type Sink interface {
+	AddNode(n Node)
+	AddEdge(e Edge)
+	AddSource(file, content string)
+	AddMetrics(m Metrics)
+	AddDiagnostic(d Diagnostic)
+	AddCoverage(c Coverage)
 }
 
-// CPG accumulates the entire Code Property Graph in memory before flushing to SQLite.
+// edgeKey is a 128-bit hash of (source, target, kind), used to deduplicate
+// edges without retaining their ID strings.
+type edgeKey [2]uint64
+
+var edgeSeeds = [2]maphash.Seed{maphash.MakeSeed(), maphash.MakeSeed()}
+
+func keyOf(e Edge) edgeKey {
+	var k edgeKey
+	for i, seed := range edgeSeeds {
+		var h maphash.Hash
+		h.SetSeed(seed)
+		h.WriteString(e.Source)
+		h.WriteByte(0)
+		h.WriteString(e.Target)
+		h.WriteByte(0)
+		h.WriteString(e.Kind)
+		k[i] = h.Sum64()
+	}
+	return k
+}
+
+// CPG is an in-memory Sink. The parallel phases give each unit of work its
+// own CPG as a shard and replay it into the real sink with EmitTo.
 type CPG struct {
 	Nodes    []Node
 	Edges    []Edge
@@ -47,6 +82,10 @@ type CPG struct {
 	edgeSeen map[edgeKey]struct{}
 	Sources  map[string]string   // file → content
 	Metrics  map[string]*Metrics // function_id → metrics
+
+	Diagnostics []Diagnostic
+	diagSeen    map[Diagnostic]struct{}
+	Coverage    map[coverageKey]*Coverage
 }
 
 // NewCPG creates an empty CPG ready for population.
@@ -56,6 +95,8 @@ func NewCPG() *CPG {
 		edgeSeen: make(map[edgeKey]struct{}),
 		Sources:  make(map[string]string),
 		Metrics:  make(map[string]*Metrics),
+		diagSeen: make(map[Diagnostic]struct{}),
+		Coverage: make(map[coverageKey]*Coverage),
 	}
 }
 
@@ -70,7 +111,7 @@ func (g *CPG) AddNode(n Node) {
 
 // AddEdge appends an edge if no edge with the same (source, target, kind) already exists.
 func (g *CPG) AddEdge(e Edge) {
-	k := edgeKey{e.Source, e.Target, e.Kind}
+	k := keyOf(e)
 	if _, dup := g.edgeSeen[k]; dup {
 		return
 	}
@@ -78,6 +119,73 @@ func (g *CPG) AddEdge(e Edge) {
 	g.Edges = append(g.Edges, e)
 }
 
+// AddSource records a file's content (first wins).
+func (g *CPG) AddSource(file, content string) {
+	if _, ok := g.Sources[file]; !ok {
+		g.Sources[file] = content
+	}
+}
+
+// AddMetrics records a function's metrics (first wins).
+func (g *CPG) AddMetrics(m Metrics) {
+	if _, ok := g.Metrics[m.FunctionID]; !ok {
+		g.Metrics[m.FunctionID] = &m
+	}
+}
+
+// AddDiagnostic appends a diagnostic unless an identical one was already added.
+func (g *CPG) AddDiagnostic(d Diagnostic) {
+	if _, dup := g.diagSeen[d]; dup {
+		return
+	}
+	g.diagSeen[d] = struct{}{}
+	g.Diagnostics = append(g.Diagnostics, d)
+}
+
+// AddCoverage adds c's counts to the package's totals for the check.
+func (g *CPG) AddCoverage(c Coverage) {
+	k := coverageKey{c.Package, c.Check}
+	if cur, ok := g.Coverage[k]; ok {
+		cur.Total += c.Total
+		cur.Failed += c.Failed
+		return
+	}
+	g.Coverage[k] = &c
+}
+
+// EmitTo replays the buffered nodes, edges, sources, metrics and diagnostics
+// into sink in insertion order (sources, metrics and coverage sorted by key).
+func (g *CPG) EmitTo(sink Sink) {
+	for _, n := range g.Nodes {
+		sink.AddNode(n)
+	}
+	for _, e := range g.Edges {
+		sink.AddEdge(e)
+	}
+	for _, file := range sortedKeys(g.Sources) {
+		sink.AddSource(file, g.Sources[file])
+	}
+	for _, id := range sortedKeys(g.Metrics) {
+		sink.AddMetrics(*g.Metrics[id])
+	}
+	for _, d := range g.Diagnostics {
+		sink.AddDiagnostic(d)
+	}
+	for _, c := range sortedCoverage(g.Coverage) {
+		sink.AddCoverage(*c)
+	}
+}
+
+// sortedKeys returns the keys of a string-keyed map in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 // PropsJSON marshals a properties map to JSON string, or "" if empty.
 func PropsJSON(m map[string]any) string {
 	if len(m) == 0 {
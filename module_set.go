@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
+
+	"golang.org/x/mod/modfile"
 )
 
 // ModuleInfo describes one Go module in the analysis set.
@@ -10,6 +14,12 @@ type ModuleInfo struct {
 	ModPath string // e.g. "github.com/prometheus/prometheus"
 	Dir     string // absolute path to module root
 	Prefix  string // node ID prefix: "" for primary, "adapter", "client_golang", etc.
+
+	// Dep marks a dependency analyzed from the module cache or a vendor
+	// directory (see resolveDep). Its packages are loaded as imports of the
+	// workspace modules rather than as workspace modules themselves.
+	Dep     bool
+	Version string // pinned version of a Dep module
 }
 
 // ModuleSet holds all modules under analysis. It provides path resolution
@@ -118,6 +128,25 @@ func (ms *ModuleSet) RelFile(absPath string) string {
 	return bestPrefix + "/" + bestRel
 }
 
+// ReadModulePath returns the module path declared in dir/go.mod.
+func ReadModulePath(dir string) (string, error) {
+	gomod := filepath.Join(dir, "go.mod")
+	data, err := os.ReadFile(gomod)
+	if err != nil {
+		return "", fmt.Errorf("read %s: %w", gomod, err)
+	}
+	modPath := modfile.ModulePath(data)
+	if modPath == "" {
+		return "", fmt.Errorf("%s: no module directive", gomod)
+	}
+	return modPath, nil
+}
+
+// Primary returns the first (primary) module.
+func (ms *ModuleSet) Primary() ModuleInfo {
+	return ms.modules[0]
+}
+
 // PrimaryDir returns the first (primary) module's directory.
 func (ms *ModuleSet) PrimaryDir() string {
 	return ms.modules[0].Dir
@@ -129,11 +158,54 @@ func (ms *ModuleSet) Dirs() []ModuleInfo {
 	return ms.modules
 }
 
-// LoadPatterns returns the "dir/..." patterns for packages.Load.
+// Workspace returns the modules that make up the go.work workspace: all but
+// the dependencies (escape analysis and git history run on these only).
+func (ms *ModuleSet) Workspace() []ModuleInfo {
+	var mods []ModuleInfo
+	for _, m := range ms.modules {
+		if !m.Dep {
+			mods = append(mods, m)
+		}
+	}
+	return mods
+}
+
+// IsDepPkg returns true if pkgPath belongs to a dependency module. Nested
+// module paths resolve to the longest match, as in RelPkg.
+func (ms *ModuleSet) IsDepPkg(pkgPath string) bool {
+	dep, bestLen := false, -1
+	for _, m := range ms.modules {
+		if (pkgPath == m.ModPath || strings.HasPrefix(pkgPath, m.ModPath+"/")) && len(m.ModPath) > bestLen {
+			dep, bestLen = m.Dep, len(m.ModPath)
+		}
+	}
+	return dep
+}
+
+// MoveDep points dependency modPath at the directory and version the go
+// command actually loaded it from, which differs from what resolveDep found
+// when the workspace's build list selects another version or ignores the
+// vendor directory. It returns the previous version and whether anything
+// changed.
+func (ms *ModuleSet) MoveDep(modPath, dir, version string) (string, bool) {
+	for i := range ms.modules {
+		m := &ms.modules[i]
+		if !m.Dep || m.ModPath != modPath || m.Dir == dir {
+			continue
+		}
+		prev := m.Version
+		m.Dir, m.Version = dir, version
+		return prev, true
+	}
+	return "", false
+}
+
+// LoadPatterns returns the "dir/..." patterns for packages.Load. Dependency
+// modules are not listed: only the packages the workspace imports are loaded.
 func (ms *ModuleSet) LoadPatterns() []string {
-	patterns := make([]string, len(ms.modules))
-	for i, m := range ms.modules {
-		patterns[i] = m.ModPath + "/..."
+	var patterns []string
+	for _, m := range ms.Workspace() {
+		patterns = append(patterns, m.ModPath+"/...")
 	}
 	return patterns
 }
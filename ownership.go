@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// With -blame the git phase also runs git blame over every source file of
+// the workspace modules and reads their CODEOWNERS files. The ownership
+// stage then folds the blamed lines into a function_ownership row per
+// function (who wrote most of it, who touched it last and when) and adds
+// the owners to dashboard_hotspots, so a hotspot names who to talk to.
+
+// defaultBlameTimeout is the time budget of git blame when -blame-timeout is
+// not given. Files not blamed within it are left out of function_ownership.
+const defaultBlameTimeout = 2 * time.Minute
+
+// GitBlameEntry is a run of consecutive lines of a file that git blame
+// attributes to the same commit.
+type GitBlameEntry struct {
+	RelFile string
+	Line    int // first line of the run
+	Lines   int
+	Author  string
+	Time    int64  // author time, Unix seconds
+	Commit  string // short SHA
+}
+
+// CodeOwners holds the CODEOWNERS rules of the repository a workspace module
+// lives in. The rules match paths relative to the repository root; Base is
+// the module directory relative to it.
+type CodeOwners struct {
+	Prefix string
+	Base   string
+	Rules  []CodeOwnersRule
+}
+
+// CodeOwnersRule is one CODEOWNERS line. A rule without owners leaves the
+// files it matches unowned.
+type CodeOwnersRule struct {
+	Pattern string
+	Owners  []string
+}
+
+// codeOwnersFiles are the places GitHub and GitLab look for CODEOWNERS, in
+// the order they look.
+var codeOwnersFiles = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+// blameFile is a source file to blame: its path relative to the module
+// directory and as the nodes record it.
+type blameFile struct {
+	dir, rel, file string
+}
+
+// RunGitBlame blames the source files of the workspace modules on a pool of
+// workers, one git blame per file. Files still unblamed when the time budget
+// runs out are skipped; the runs come back in file order either way.
+func RunGitBlame(timeout time.Duration, prog *Progress) []GitBlameEntry {
+	var files []blameFile
+	for _, mod := range modSet.Workspace() {
+		rels, err := blameSources(mod.Dir)
+		if err != nil {
+			prog.Verbose("Git blame for %s: failed: %v", mod.Dir, err)
+			continue
+		}
+		for _, rel := range rels {
+			file := rel
+			if mod.Prefix != "" {
+				file = mod.Prefix + "/" + rel
+			}
+			if !shouldSkipFile(file) {
+				files = append(files, blameFile{mod.Dir, rel, file})
+			}
+		}
+	}
+	prog.Begin("blame", "Running git blame on %d files (budget %s)...", len(files), timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	results := make([][]GitBlameEntry, len(files))
+	blamed := make([]bool, len(files))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workerCount(len(files)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				entries, err := blameOne(ctx, files[i])
+				if err != nil {
+					if ctx.Err() == nil {
+						prog.Verbose("Git blame %s: %v", files[i].file, err)
+					}
+					continue
+				}
+				results[i], blamed[i] = entries, true
+			}
+		}()
+	}
+feed:
+	for i := range files {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	var all []GitBlameEntry
+	done := 0
+	for i := range files {
+		if blamed[i] {
+			done++
+		}
+		all = append(all, results[i]...)
+	}
+	if ctx.Err() != nil && done < len(files) {
+		prog.Warn("git blame: time budget of %s ran out after %d of %d files", timeout, done, len(files))
+	}
+	prog.End("blame", Fields{"files": done, "runs": len(all)}, "Git blame: %d runs across %d files", len(all), done)
+	return all
+}
+
+// blameSources lists the tracked .go files of the module in dir, relative to
+// it, leaving out what the go command ignores and nested modules.
+func blameSources(dir string) ([]string, error) {
+	out, err := gitOutput(dir, "ls-files", "-z", "--", "*.go", ":(glob)**/go.mod")
+	if err != nil {
+		return nil, err
+	}
+	var sources, nested []string
+	for _, rel := range strings.Split(out, "\x00") {
+		switch {
+		case rel == "" || rel == "go.mod":
+		case path.Base(rel) == "go.mod":
+			nested = append(nested, path.Dir(rel)+"/")
+		default:
+			sources = append(sources, rel)
+		}
+	}
+	var files []string
+	for _, rel := range sources {
+		if ignoredByGo(rel) || !strings.HasSuffix(rel, ".go") {
+			continue
+		}
+		inNested := false
+		for _, n := range nested {
+			if strings.HasPrefix(rel, n) {
+				inNested = true
+				break
+			}
+		}
+		if !inNested {
+			files = append(files, rel)
+		}
+	}
+	return files, nil
+}
+
+// ignoredByGo reports whether a module-relative path lies in a directory the
+// go command skips: vendor, testdata, or one starting with "." or "_".
+func ignoredByGo(rel string) bool {
+	dirs := strings.Split(rel, "/")
+	for _, d := range dirs[:len(dirs)-1] {
+		if d == "vendor" || d == "testdata" || strings.HasPrefix(d, ".") || strings.HasPrefix(d, "_") {
+			return true
+		}
+	}
+	return false
+}
+
+// blameOne runs git blame --line-porcelain on one file and collapses its
+// lines into runs. Whitespace-only changes keep their earlier author.
+func blameOne(ctx context.Context, f blameFile) ([]GitBlameEntry, error) {
+	cmd := exec.CommandContext(ctx, "git", "blame", "-w", "--line-porcelain", "--", f.rel)
+	cmd.Dir = f.dir
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var runs []GitBlameEntry
+	var line int
+	var author, commit string
+	var authorTime int64
+	for scanner.Scan() {
+		text := scanner.Text()
+		switch {
+		case strings.HasPrefix(text, "\t"):
+			// Content line: every header of the line has been seen
+			if n := len(runs); n > 0 && runs[n-1].Commit == commit && runs[n-1].Line+runs[n-1].Lines == line {
+				runs[n-1].Lines++
+				continue
+			}
+			runs = append(runs, GitBlameEntry{RelFile: f.file, Line: line, Lines: 1, Author: author, Time: authorTime, Commit: commit})
+		case strings.HasPrefix(text, "author "):
+			author = strings.TrimPrefix(text, "author ")
+		case strings.HasPrefix(text, "author-time "):
+			authorTime, _ = strconv.ParseInt(strings.TrimPrefix(text, "author-time "), 10, 64)
+		default:
+			// Header line: "<sha> <orig_line> <final_line> [<num_lines>]"
+			parts := strings.Fields(text)
+			if len(parts) >= 3 && len(parts[0]) >= 40 && isHex(parts[0]) {
+				commit = parts[0][:12]
+				line, _ = strconv.Atoi(parts[2])
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		_ = cmd.Wait()
+		return nil, err
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadCodeOwners reads the CODEOWNERS file of the repository of every
+// workspace module, when it has one.
+func ReadCodeOwners(prog *Progress) []CodeOwners {
+	var all []CodeOwners
+	for _, mod := range modSet.Workspace() {
+		top, err := gitOutput(mod.Dir, "rev-parse", "--show-toplevel")
+		if err != nil {
+			continue // not a git checkout
+		}
+		base, err := gitOutput(mod.Dir, "rev-parse", "--show-prefix")
+		if err != nil {
+			continue
+		}
+		for _, name := range codeOwnersFiles {
+			data, err := os.ReadFile(filepath.Join(strings.TrimSpace(top), name))
+			if err != nil {
+				continue
+			}
+			rules := parseCodeOwners(string(data))
+			prog.Verbose("CODEOWNERS for %s: %s, %d rules", mod.ModPath, name, len(rules))
+			all = append(all, CodeOwners{
+				Prefix: mod.Prefix,
+				Base:   strings.TrimSuffix(strings.TrimSpace(base), "/"),
+				Rules:  rules,
+			})
+			break
+		}
+	}
+	return all
+}
+
+// parseCodeOwners parses the lines "<pattern> <owner>..." of a CODEOWNERS
+// file. Comments and GitLab section headers are skipped.
+func parseCodeOwners(data string) []CodeOwnersRule {
+	var rules []CodeOwnersRule
+	for _, line := range strings.Split(data, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "[") || strings.HasPrefix(fields[0], "^[") {
+			continue
+		}
+		rules = append(rules, CodeOwnersRule{Pattern: fields[0], Owners: fields[1:]})
+	}
+	return rules
+}
+
+// Owners returns the owners the last matching rule gives a path relative to
+// the repository root, or nil when no rule matches.
+func (co *CodeOwners) Owners(file string) []string {
+	segs := strings.Split(file, "/")
+	for i := len(co.Rules) - 1; i >= 0; i-- {
+		if co.Rules[i].Match(segs) {
+			return co.Rules[i].Owners
+		}
+	}
+	return nil
+}
+
+// Match reports whether the rule matches a path split into its segments,
+// with gitignore rules: a pattern without a slash but at its end matches at
+// any depth, "*" stays within a segment and "**" spans any number of them. A
+// pattern naming a directory matches everything below it, but one ending in
+// a wildcard only matches files directly in the directory ("docs/*").
+func (r CodeOwnersRule) Match(segs []string) bool {
+	p := r.Pattern
+	dirOnly := strings.HasSuffix(p, "/")
+	p = strings.TrimSuffix(p, "/")
+	anchored := strings.Contains(p, "/")
+	p = strings.TrimPrefix(p, "/")
+	if p == "" {
+		return false
+	}
+	pat := strings.Split(p, "/")
+	if !anchored {
+		pat = append([]string{"**"}, pat...)
+	}
+	last := pat[len(pat)-1]
+	for k := len(segs); k >= 1; k-- {
+		if k == len(segs) && dirOnly {
+			continue
+		}
+		if k < len(segs) && last != "**" && strings.ContainsAny(last, "*?[") {
+			break
+		}
+		if globSegments(pat, segs[:k]) {
+			return true
+		}
+	}
+	return false
+}
+
+// globSegments reports whether the pattern segments match all of segs.
+func globSegments(pat, segs []string) bool {
+	if len(pat) == 0 {
+		return len(segs) == 0
+	}
+	if pat[0] == "**" {
+		for i := 0; i <= len(segs); i++ {
+			if globSegments(pat[1:], segs[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segs) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pat[0], segs[0]); !ok {
+		return false
+	}
+	return globSegments(pat[1:], segs[1:])
+}
+
+// fileOwners returns the CODEOWNERS owners of a node file path, space
+// separated, or "" when none apply. The file belongs to the module with the
+// longest matching prefix.
+func fileOwners(owners []CodeOwners, file string) string {
+	best := -1
+	for i, co := range owners {
+		if co.Prefix != "" && !strings.HasPrefix(file, co.Prefix+"/") {
+			continue
+		}
+		if best < 0 || len(co.Prefix) > len(owners[best].Prefix) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	co := &owners[best]
+	rel := file
+	if co.Prefix != "" {
+		rel = strings.TrimPrefix(file, co.Prefix+"/")
+	}
+	if co.Base != "" {
+		rel = co.Base + "/" + rel
+	}
+	return strings.Join(co.Owners(rel), " ")
+}
+
+// applyOwnership creates function_ownership from the blame runs overlapping
+// each function's lines and adds the primary author and CODEOWNERS owners to
+// dashboard_hotspots. Ages count back from the newest blamed commit rather
+// than from now, so the rows only depend on the checkout.
+func applyOwnership(conn *sqlite.Conn, git GitResults, prog *Progress) error {
+	ddl := `
+CREATE TEMP TABLE blame_runs (
+    file TEXT NOT NULL,
+    line INTEGER NOT NULL,
+    end_line INTEGER NOT NULL,
+    author TEXT NOT NULL,
+    time INTEGER NOT NULL,
+    commit_id TEXT NOT NULL
+);
+CREATE INDEX temp.idx_blame_runs ON blame_runs(file, line);
+
+CREATE TEMP TABLE file_owners (
+    file TEXT PRIMARY KEY,
+    owners TEXT NOT NULL
+);
+
+CREATE TABLE function_ownership (
+    function_id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    package TEXT,
+    file TEXT,
+    lines INTEGER NOT NULL,     -- blamed lines of the function
+    primary_author TEXT,        -- author of most of them
+    primary_share REAL,         -- fraction of the lines by primary_author
+    author_count INTEGER NOT NULL,
+    last_commit TEXT,           -- newest commit touching the function
+    last_author TEXT,
+    last_modified TEXT,         -- author date of last_commit, RFC 3339
+    age_days INTEGER,           -- days from last_modified to the newest blamed commit
+    owners TEXT                 -- CODEOWNERS owners of the file, space separated
+);`
+	if err := sqlitex.ExecuteScript(conn, ddl, nil); err != nil {
+		return fmt.Errorf("ownership DDL: %w", err)
+	}
+
+	stmt, err := conn.Prepare(`INSERT INTO blame_runs (file, line, end_line, author, time, commit_id) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	for _, b := range git.Blame {
+		stmt.BindText(1, b.RelFile)
+		stmt.BindInt64(2, int64(b.Line))
+		stmt.BindInt64(3, int64(b.Line+b.Lines-1))
+		stmt.BindText(4, b.Author)
+		stmt.BindInt64(5, b.Time)
+		stmt.BindText(6, b.Commit)
+		if _, err := stmt.Step(); err != nil {
+			_ = stmt.Finalize()
+			return fmt.Errorf("blame runs: %w", err)
+		}
+		_ = stmt.Reset()
+	}
+	_ = stmt.Finalize()
+
+	if len(git.Owners) > 0 {
+		var files []string
+		if err := sqlitex.ExecuteTransient(conn, `SELECT DISTINCT file FROM blame_runs ORDER BY file`,
+			&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+				files = append(files, stmt.ColumnText(0))
+				return nil
+			}}); err != nil {
+			return fmt.Errorf("file owners: %w", err)
+		}
+		ins, err := conn.Prepare(`INSERT INTO file_owners (file, owners) VALUES (?, ?)`)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			owners := fileOwners(git.Owners, file)
+			if owners == "" {
+				continue
+			}
+			ins.BindText(1, file)
+			ins.BindText(2, owners)
+			if _, err := ins.Step(); err != nil {
+				_ = ins.Finalize()
+				return fmt.Errorf("file owners: %w", err)
+			}
+			_ = ins.Reset()
+		}
+		_ = ins.Finalize()
+	}
+
+	fill := `
+INSERT INTO function_ownership
+WITH overlap AS (
+  SELECT n.id AS function_id, b.author, b.time, b.commit_id,
+    MIN(b.end_line, n.end_line) - MAX(b.line, n.line) + 1 AS lines
+  FROM nodes n
+  JOIN blame_runs b ON b.file = n.file AND b.line <= n.end_line AND b.end_line >= n.line
+  WHERE n.kind = 'function' AND n.end_line IS NOT NULL
+),
+by_author AS (
+  SELECT function_id, author, SUM(lines) AS lines,
+    ROW_NUMBER() OVER (PARTITION BY function_id ORDER BY SUM(lines) DESC, author) AS rank
+  FROM overlap GROUP BY function_id, author
+),
+latest AS (
+  SELECT function_id, commit_id, author, time,
+    ROW_NUMBER() OVER (PARTITION BY function_id ORDER BY time DESC, commit_id) AS rank
+  FROM overlap
+),
+totals AS (
+  SELECT function_id, SUM(lines) AS lines, COUNT(DISTINCT author) AS authors
+  FROM overlap GROUP BY function_id
+)
+SELECT n.id, n.name, n.package, n.file, t.lines,
+  a.author, ROUND(CAST(a.lines AS REAL) / t.lines, 3), t.authors,
+  l.commit_id, l.author, strftime('%Y-%m-%dT%H:%M:%SZ', l.time, 'unixepoch'),
+  ((SELECT MAX(time) FROM blame_runs) - l.time) / 86400,
+  fo.owners
+FROM totals t
+JOIN nodes n ON n.id = t.function_id
+JOIN by_author a ON a.function_id = t.function_id AND a.rank = 1
+JOIN latest l ON l.function_id = t.function_id AND l.rank = 1
+LEFT JOIN file_owners fo ON fo.file = n.file;
+
+CREATE INDEX idx_function_ownership_author ON function_ownership(primary_author);
+
+ALTER TABLE dashboard_hotspots ADD COLUMN primary_author TEXT;
+ALTER TABLE dashboard_hotspots ADD COLUMN owners TEXT;
+UPDATE dashboard_hotspots SET
+  primary_author = (SELECT o.primary_author FROM function_ownership o WHERE o.function_id = dashboard_hotspots.function_id),
+  owners = (SELECT fo.owners FROM file_owners fo WHERE fo.file = dashboard_hotspots.file);
+
+INSERT INTO queries (name, description, sql) VALUES
+  ('hotspot_owners', 'Hotspots with the author of most of their lines and their CODEOWNERS owners',
+   'SELECT function_id, name, package, hotspot_score, primary_author, owners FROM dashboard_hotspots ORDER BY hotspot_score DESC LIMIT 20'),
+  ('author_functions', 'Functions by primary author, with how much of each they wrote',
+   'SELECT primary_author, COUNT(*) AS functions, SUM(lines) AS lines FROM function_ownership GROUP BY primary_author ORDER BY lines DESC'),
+  ('stale_functions', 'Functions untouched the longest before the newest commit, with who last changed them',
+   'SELECT function_id, name, file, last_author, last_modified, age_days FROM function_ownership ORDER BY age_days DESC LIMIT 30');
+
+INSERT INTO schema_docs (category, name, description, example) VALUES
+('table', 'function_ownership', 'Per-function authorship from git blame (-blame): primary author, author count, last commit and its age, CODEOWNERS owners', 'SELECT * FROM function_ownership ORDER BY author_count DESC LIMIT 20');
+
+DROP TABLE blame_runs;
+DROP TABLE file_owners;
+`
+	if err := sqlitex.ExecuteScript(conn, fill, nil); err != nil {
+		return fmt.Errorf("ownership: %w", err)
+	}
+
+	var functions, authors int
+	sqlitex.ExecuteTransient(conn, "SELECT COUNT(*), COUNT(DISTINCT primary_author) FROM function_ownership",
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			functions = stmt.ColumnInt(0)
+			authors = stmt.ColumnInt(1)
+			return nil
+		}})
+
+	prog.Log("Ownership: %d functions, %d primary authors, %d CODEOWNERS files", functions, authors, len(git.Owners))
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCodeOwnersRuleMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		file    string
+		want    bool
+	}{
+		{"*", "main.go", true},
+		{"*", "scrape/scrape.go", true},
+		{"*.go", "main.go", true},
+		{"*.go", "scrape/scrape.go", true},
+		{"*.go", "README.md", false},
+		{"scrape.go", "scrape/scrape.go", true},
+		{"scrape", "scrape/scrape.go", true},
+		{"scrape", "cmd/scrape/main.go", true},
+		{"scrape/", "cmd/scrape/main.go", true},
+		{"scrape/", "scrape", false},
+		{"/scrape", "scrape/scrape.go", true},
+		{"/scrape", "cmd/scrape/main.go", false},
+		{"/scrape/", "scrape", false},
+		{"storage/remote", "storage/remote/queue.go", true},
+		{"storage/remote", "tsdb/storage/remote/queue.go", false},
+		{"docs/*", "docs/index.md", true},
+		{"docs/*", "docs/api/index.md", false},
+		{"docs/**", "docs/api/index.md", true},
+		{"**/remote", "storage/remote/queue.go", true},
+		{"**/remote", "remote/queue.go", true},
+		{"storage/**/queue.go", "storage/remote/queue.go", true},
+		{"storage/**/queue.go", "storage/queue.go", true},
+		{"storage/**/queue.go", "tsdb/queue.go", false},
+		{"web/api/v?/*.go", "web/api/v1/api.go", true},
+		{"web/api/v?/*.go", "web/api/v10/api.go", false},
+		{"/", "main.go", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.file, func(t *testing.T) {
+			r := CodeOwnersRule{Pattern: tt.pattern}
+			if got := r.Match(strings.Split(tt.file, "/")); got != tt.want {
+				t.Errorf("%q.Match(%q) = %v, want %v", tt.pattern, tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCodeOwnersOwners(t *testing.T) {
+	co := &CodeOwners{Rules: parseCodeOwners(`# Default owners
+*                @org/maintainers
+[Storage]
+/storage/        @alice @bob # remote and local
+/storage/remote/generated.go
+docs/*           @carol
+`)}
+	tests := []struct {
+		file string
+		want []string
+	}{
+		{"main.go", []string{"@org/maintainers"}},
+		{"storage/remote/queue.go", []string{"@alice", "@bob"}},
+		{"storage/remote/generated.go", nil},
+		{"docs/index.md", []string{"@carol"}},
+		{"docs/api/index.md", []string{"@org/maintainers"}},
+	}
+	for _, tt := range tests {
+		if got := co.Owners(tt.file); !slices.Equal(got, tt.want) {
+			t.Errorf("Owners(%q) = %q, want %q", tt.file, got, tt.want)
+		}
+	}
+}
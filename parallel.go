@@ -0,0 +1,80 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// flagJobs is the worker count for the parallel extraction phases (-j).
+// Zero or negative means one worker per CPU (GOMAXPROCS).
+var flagJobs int
+
+// workerCount returns how many workers to start for n units of work.
+func workerCount(n int) int {
+	w := flagJobs
+	if w <= 0 {
+		w = runtime.GOMAXPROCS(0)
+	}
+	return max(1, min(w, n))
+}
+
+// runSharded calls fn for every index in [0, n) on a pool of workers.
+// Indices are handed out in contiguous chunks; each chunk writes into its own
+// shard CPG, and shards are replayed into sink strictly in chunk order as
+// they complete. The emitted graph is therefore identical to a serial run
+// over the same index order, whatever the scheduling or worker count.
+//
+// fn must only write to its shard and to concurrency-safe state
+// (PosLookup, FuncLookup, DefLookup, or slots owned by index i).
+func runSharded(n int, sink Sink, fn func(i int, shard *CPG)) {
+	if n == 0 {
+		return
+	}
+	workers := workerCount(n)
+	// Several chunks per worker keeps the pool busy when unit sizes vary
+	// (one huge package, thousands of tiny functions).
+	size := max(1, n/(workers*16))
+	chunks := (n + size - 1) / size
+
+	type result struct {
+		chunk int
+		shard *CPG
+	}
+	next := make(chan int)
+	done := make(chan result, workers)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range next {
+				shard := NewCPG()
+				for i := c * size; i < min(n, (c+1)*size); i++ {
+					fn(i, shard)
+				}
+				done <- result{c, shard}
+			}
+		}()
+	}
+	go func() {
+		for c := range chunks {
+			next <- c
+		}
+		close(next)
+		wg.Wait()
+		close(done)
+	}()
+
+	// Replay in chunk order, holding back shards that finish early
+	held := make(map[int]*CPG)
+	merged := 0
+	for r := range done {
+		held[r.chunk] = r.shard
+		for shard, ok := held[merged]; ok; shard, ok = held[merged] {
+			shard.EmitTo(sink)
+			delete(held, merged)
+			merged++
+		}
+	}
+}
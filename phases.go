@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// phaseSpec declares one selectable pipeline phase. Go phases run in run();
+// SQL phases are stages of finishDB. AST walking and the core SQL stages
+// (indexes, node/edge properties, findings and queries tables, schema docs)
+// always run because every other phase builds on them.
+type phaseSpec struct {
+	Name string
+	Deps []string // phases that must also run
+	Desc string
+}
+
+// phaseSpecs lists every phase in pipeline order.
+var phaseSpecs = []phaseSpec{
+	{"cfg", nil, "SSA basic blocks and control-flow edges"},
+	{"dfg", nil, "SSA def-use and closure capture edges, heuristic DFG through external calls"},
+	{"cdg", []string{"cfg"}, "Control dependence, dominator and post-dominator edges between basic blocks"},
+	{"chan", nil, "Channel send→receive edges"},
+	{"panic", nil, "panic→recover edges"},
+	{"call", nil, "VTA call graph: call, call_site, param_in/param_out, call_to_return edges"},
+	{"types", nil, "implements, embeds, alias_of and satisfies_method edges"},
+	{"metrics", nil, "Cyclomatic complexity, LOC, parameter counts, fan-in/fan-out"},
+	{"escape", nil, "Compiler escape analysis (go build -gcflags=-m) annotations"},
+	{"eog", nil, "Evaluation order edges for call arguments"},
+	{"fts", nil, "FTS5 full-text index over sources"},
+	{"taint", []string{"dfg", "call"}, "Taint model, taint flow states and index sensitivity"},
+	{"analysis", []string{"call", "metrics"}, "API surface, risk scores, dead code, stability, cohesion and concurrency findings"},
+	{"dashboard", []string{"call", "metrics"}, "Dashboard tables, graph intelligence, file and dependency analysis"},
+	{"tests", []string{"call", "dashboard"}, "tests edges from test functions to the code they reach, v_untested_functions (needs -skip-tests=false)"},
+	{"typesys", []string{"types"}, "Type hierarchy, implementation map and method sets"},
+	{"navigation", nil, "Symbol index, xrefs, file outlines and Go pattern summaries"},
+	{"git", []string{"dashboard"}, "Git history: churn, authors, co-change coupling; per-function ownership with -blame"},
+	{"scip", nil, "SCIP-style cross-repository symbol identifiers"},
+	{"comm", nil, "Communication patterns, session types and Honda corrections"},
+}
+
+func lookupPhase(name string) (phaseSpec, bool) {
+	for _, p := range phaseSpecs {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return phaseSpec{}, false
+}
+
+func phaseNames() []string {
+	names := make([]string, len(phaseSpecs))
+	for i, p := range phaseSpecs {
+		names[i] = p.Name
+	}
+	return names
+}
+
+// PhaseSet is the resolved set of phases that run.
+type PhaseSet map[string]bool
+
+// ResolvePhases expands a selection: every phase when phases is empty,
+// otherwise the listed ones plus their transitive dependencies. Skipped
+// phases are then removed together with every phase that depends on them;
+// skipping a dependency of an explicitly listed phase is an error.
+func ResolvePhases(phases, skip []string) (PhaseSet, error) {
+	for _, list := range [][]string{phases, skip} {
+		for _, name := range list {
+			if _, ok := lookupPhase(name); !ok {
+				return nil, fmt.Errorf("unknown phase %q (known: %s)", name, strings.Join(phaseNames(), ", "))
+			}
+		}
+	}
+
+	set := make(PhaseSet)
+	if len(phases) == 0 {
+		for _, p := range phaseSpecs {
+			set[p.Name] = true
+		}
+	} else {
+		var add func(name string)
+		add = func(name string) {
+			if set[name] {
+				return
+			}
+			set[name] = true
+			p, _ := lookupPhase(name)
+			for _, dep := range p.Deps {
+				add(dep)
+			}
+		}
+		for _, name := range phases {
+			add(name)
+		}
+	}
+
+	skipped := make(map[string]bool)
+	for _, name := range skip {
+		skipped[name] = true
+	}
+	for _, name := range phases {
+		if skipped[name] {
+			return nil, fmt.Errorf("phase %q is both selected and skipped", name)
+		}
+	}
+	// Phases are declared after their dependencies, so one pass in order
+	// propagates a skip to every transitive dependent.
+	for _, p := range phaseSpecs {
+		for _, dep := range p.Deps {
+			if skipped[dep] && set[p.Name] {
+				if len(phases) > 0 && !skipped[p.Name] && slices.Contains(phases, p.Name) {
+					return nil, fmt.Errorf("phase %q requires %q, which is skipped", p.Name, dep)
+				}
+				skipped[p.Name] = true
+			}
+		}
+	}
+	for name := range skipped {
+		delete(set, name)
+	}
+	return set, nil
+}
+
+// Enabled reports whether the named phase runs.
+func (s PhaseSet) Enabled(name string) bool {
+	return s[name]
+}
+
+// List returns the enabled phases in pipeline order.
+func (s PhaseSet) List() []string {
+	var names []string
+	for _, p := range phaseSpecs {
+		if s[p.Name] {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// writePhases records every phase and whether it ran, so consumers can tell
+// a table that was never built from one that is empty.
+func writePhases(conn *sqlite.Conn, phases PhaseSet) error {
+	script := `
+CREATE TABLE pipeline_phases (
+    name TEXT PRIMARY KEY,
+    ran INTEGER NOT NULL,      -- 1 if the phase ran in this build
+    depends_on TEXT NOT NULL,  -- JSON array of phase names
+    description TEXT NOT NULL
+);
+INSERT INTO schema_docs (category, name, description, example) VALUES
+('table', 'pipeline_phases', 'Pipeline phases and whether each ran (see -phases/-skip-phases); a table from a phase with ran=0 is absent, not empty',
+ 'SELECT name FROM pipeline_phases WHERE ran = 0');`
+	if err := sqlitex.ExecuteScript(conn, script, nil); err != nil {
+		return fmt.Errorf("pipeline_phases: %w", err)
+	}
+
+	stmt, err := conn.Prepare(`INSERT INTO pipeline_phases (name, ran, depends_on, description) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("pipeline_phases: %w", err)
+	}
+	defer func() { _ = stmt.Finalize() }()
+	for _, p := range phaseSpecs {
+		deps, _ := json.Marshal(append([]string{}, p.Deps...))
+		stmt.BindText(1, p.Name)
+		stmt.BindBool(2, phases.Enabled(p.Name))
+		stmt.BindText(3, string(deps))
+		stmt.BindText(4, p.Desc)
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("pipeline_phases %s: %w", p.Name, err)
+		}
+		_ = stmt.Reset()
+	}
+	return nil
+}
+
+// phaseUsage formats the phase list for -help.
+func phaseUsage() string {
+	var b strings.Builder
+	for _, p := range phaseSpecs {
+		deps := ""
+		if len(p.Deps) > 0 {
+			deps = " (needs " + strings.Join(p.Deps, ", ") + ")"
+		}
+		fmt.Fprintf(&b, "  %-11s %s%s\n", p.Name, p.Desc, deps)
+	}
+	return b.String()
+}
+
+// splitList parses a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -1,29 +1,57 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sync"
 	"time"
 )
 
-// Progress reports pipeline progress to stderr with elapsed time.
+// Progress reports pipeline progress to stderr with elapsed time, either as
+// "[mm:ss] message" lines or, with -progress=json, as one JSON event per line
+// (see progressEvent). It is safe for concurrent use.
 type Progress struct {
 	start   time.Time
 	verbose bool
+	json    bool
+
+	mu     sync.Mutex
+	out    io.Writer
+	phases map[string]time.Time // start of each running phase
+}
+
+// Fields holds the structured counters attached to an event.
+type Fields map[string]any
+
+// progressEvent is one line of -progress=json output.
+type progressEvent struct {
+	ElapsedMS  int64  `json:"elapsed_ms"`
+	Event      string `json:"event"` // log, warning, phase_start, phase_end, error, or a Report kind
+	Phase      string `json:"phase,omitempty"`
+	Message    string `json:"message,omitempty"`
+	DurationMS *int64 `json:"duration_ms,omitempty"` // phase_end only
+	Fields     Fields `json:"fields,omitempty"`
 }
 
-// NewProgress creates a progress reporter.
-func NewProgress(verbose bool) *Progress {
-	return &Progress{start: time.Now(), verbose: verbose}
+// NewProgress creates a progress reporter. jsonEvents selects JSON lines.
+func NewProgress(verbose, jsonEvents bool) *Progress {
+	return &Progress{
+		start:   time.Now(),
+		verbose: verbose,
+		json:    jsonEvents,
+		out:     os.Stderr,
+		phases:  make(map[string]time.Time),
+	}
 }
 
+// JSON reports whether events are written as JSON lines.
+func (p *Progress) JSON() bool { return p.json }
+
 // Log prints a progress message with elapsed time prefix.
 func (p *Progress) Log(format string, args ...any) {
-	elapsed := time.Since(p.start)
-	mins := int(elapsed.Minutes())
-	secs := int(elapsed.Seconds()) % 60
-	msg := fmt.Sprintf(format, args...)
-	fmt.Fprintf(os.Stderr, "[%02d:%02d] %s\n", mins, secs, msg)
+	p.emit(progressEvent{Event: "log", Message: fmt.Sprintf(format, args...)})
 }
 
 // Verbose prints only when verbose mode is enabled.
@@ -32,3 +60,74 @@ func (p *Progress) Verbose(format string, args ...any) {
 		p.Log(format, args...)
 	}
 }
+
+// Warn reports a problem the pipeline continues past.
+func (p *Progress) Warn(format string, args ...any) {
+	p.emit(progressEvent{Event: "warning", Message: fmt.Sprintf(format, args...)})
+}
+
+// Begin marks the start of a phase and prints its message.
+func (p *Progress) Begin(phase, format string, args ...any) {
+	p.mu.Lock()
+	p.phases[phase] = time.Now()
+	p.mu.Unlock()
+	p.emit(progressEvent{Event: "phase_start", Phase: phase, Message: fmt.Sprintf(format, args...)})
+}
+
+// End marks the end of a phase started with Begin, attaching its counters.
+// Text output prints only the message, and nothing when format is empty.
+func (p *Progress) End(phase string, fields Fields, format string, args ...any) {
+	p.mu.Lock()
+	started, ok := p.phases[phase]
+	delete(p.phases, phase)
+	p.mu.Unlock()
+
+	ev := progressEvent{Event: "phase_end", Phase: phase, Fields: fields}
+	if format != "" {
+		ev.Message = fmt.Sprintf(format, args...)
+	}
+	if ok {
+		ms := time.Since(started).Milliseconds()
+		ev.DurationMS = &ms
+	}
+	p.emit(ev)
+}
+
+// Report emits a structured event with no text form, such as a per-package
+// type error or a batch flush; text output ignores it.
+func (p *Progress) Report(event string, fields Fields) {
+	if p.json {
+		p.emit(progressEvent{Event: event, Fields: fields})
+	}
+}
+
+// Error reports the error that ended the run.
+func (p *Progress) Error(err error) {
+	p.emit(progressEvent{Event: "error", Message: err.Error()})
+}
+
+func (p *Progress) emit(ev progressEvent) {
+	elapsed := time.Since(p.start)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.json {
+		ev.ElapsedMS = elapsed.Milliseconds()
+		b, err := json.Marshal(ev)
+		if err != nil {
+			b, _ = json.Marshal(progressEvent{ElapsedMS: ev.ElapsedMS, Event: "error", Message: err.Error()})
+		}
+		p.out.Write(append(b, '\n'))
+		return
+	}
+	if ev.Message == "" {
+		return
+	}
+	msg := ev.Message
+	if ev.Event == "warning" {
+		msg = "Warning: " + msg
+	}
+	mins := int(elapsed.Minutes())
+	secs := int(elapsed.Seconds()) % 60
+	fmt.Fprintf(p.out, "[%02d:%02d] %s\n", mins, secs, msg)
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"cpg-gen/graph"
+	"cpg-gen/graph/mem"
+)
+
+// funcParams are the query parameters that take a function node ID, in the
+// order -func fills them.
+var funcParams = []string{"function_id", "function_a", "function_b", "start", "end", "id"}
+
+// runQuery implements "cpg-gen query": it lists the named queries of a CPG
+// database, runs one of them or matches a path pattern.
+func runQuery(args []string) (err error) {
+	fs := flag.NewFlagSet("query", flag.ContinueOnError)
+	format := fs.String("format", "table", "Output format: table, csv, json or dot")
+	list := fs.Bool("list", false, "List the queries with their parameters and descriptions (the default without a query name)")
+	match := fs.String("match", "", "Path pattern to match instead of a named query, e.g. '(f:function {package:\"scrape\"})-[:call*1..4]->(g {external:true})'")
+	limit := fs.Int("limit", 1000, "Maximum rows of a -match or -from result (0 = unlimited)")
+	maxHops := fs.Int("max-hops", graph.DefaultMaxHops, "Upper bound of -match relationships written without one ('*' and '*n..'), and of -from traversals")
+	explain := fs.Bool("explain", false, "Print the SQL a -match pattern compiles to instead of running it")
+	timeout := fs.Duration("timeout", 0, "Abandon the query after this long (e.g. 30s; 0 = no limit)")
+	from := fs.String("from", "", "Function symbol or node ID to traverse the graph from in memory: the nodes within -max-hops, or the shortest path to -to")
+	to := fs.String("to", "", "Function symbol or node ID a -from traversal finds the shortest path to")
+	edgeKinds := fs.String("edges", "call", "Comma-separated edge kinds a -from traversal follows (empty = every kind)")
+	dir := fs.String("dir", "forward", "Direction a -from traversal follows edges in: forward, backward or both")
+	params := make(map[string]any)
+	fs.Func("param", "Query parameter name=value; repeat for each parameter", func(s string) error {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("want name=value")
+		}
+		params[strings.TrimPrefix(name, ":")] = value
+		return nil
+	})
+	var funcs []string
+	fs.Func("func", "Function symbol (pkg.Func, pkg.Type.Method) or node ID for the query's next function parameter ("+strings.Join(funcParams, ", ")+"); name=symbol binds a given parameter", func(s string) error {
+		funcs = append(funcs, s)
+		return nil
+	})
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: cpg-gen query [flags] <db> [<query>]\n")
+		fmt.Fprintf(os.Stderr, "       cpg-gen query [flags] -match <pattern> <db>\n")
+		fmt.Fprintf(os.Stderr, "       cpg-gen query [flags] -from <symbol> [-to <symbol>] <db>\n\n")
+		fmt.Fprintf(os.Stderr, "Runs a named query of the queries table, lists them, or matches a path pattern:\n")
+		fmt.Fprintf(os.Stderr, "nodes (var:kind {key:value, ...}) joined by -[var:kind*min..max]-> or <-[...]-.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		fs.PrintDefaults()
+	}
+
+	pos, err := parseInterspersed(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if len(pos) < 1 || len(pos) > 2 {
+		fs.Usage()
+		return fmt.Errorf("expected 1 or 2 arguments, got %d", len(pos))
+	}
+	write, ok := tableWriters[*format]
+	if !ok {
+		return fmt.Errorf("-format %s: want table, csv, json or dot", *format)
+	}
+
+	if *match != "" && *from != "" {
+		return fmt.Errorf("-match and -from are exclusive")
+	}
+	if *to != "" && *from == "" {
+		return fmt.Errorf("-to needs -from")
+	}
+	if (*match != "" || *from != "") && len(pos) != 1 {
+		return fmt.Errorf("-match and -from take no query name")
+	}
+	if *match != "" {
+		if *explain {
+			p, err := graph.ParsePattern(*match)
+			if err != nil {
+				return err
+			}
+			sql, params, err := p.SQL(graph.MatchOptions{Limit: *limit, MaxHops: *maxHops})
+			if err != nil {
+				return err
+			}
+			fmt.Println(sql)
+			for i := 1; i <= len(params); i++ {
+				name := fmt.Sprintf("p%d", i)
+				fmt.Printf("-- :%s = %#v\n", name, params[name])
+			}
+			return nil
+		}
+	}
+
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+		defer func() {
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				err = fmt.Errorf("timed out after %s", *timeout)
+			}
+		}()
+	}
+	db, err := graph.Open(pos[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *match != "" {
+		t, err := db.Match(ctx, *match, graph.MatchOptions{Limit: *limit, MaxHops: *maxHops})
+		if err != nil {
+			return err
+		}
+		if t.Truncated {
+			fmt.Fprintf(os.Stderr, "warning: result cut off at -limit %d rows\n", *limit)
+		}
+		return write(os.Stdout, db, t)
+	}
+	if *from != "" {
+		d, ok := map[string]mem.Direction{"forward": mem.Forward, "backward": mem.Backward, "both": mem.Both}[*dir]
+		if !ok {
+			return fmt.Errorf("-dir %s: want forward, backward or both", *dir)
+		}
+		t, err := traverseMemory(ctx, db, *from, *to, splitList(*edgeKinds), d, *maxHops, *limit)
+		if err != nil {
+			return err
+		}
+		if t.Truncated {
+			fmt.Fprintf(os.Stderr, "warning: result cut off at -limit %d rows\n", *limit)
+		}
+		return write(os.Stdout, db, t)
+	}
+
+	if len(pos) == 1 || *list {
+		if *format == "dot" {
+			return fmt.Errorf("-format dot: query list is not a graph")
+		}
+		queries, err := db.Queries(ctx)
+		if err != nil {
+			return err
+		}
+		t := &graph.Table{Columns: []string{"name", "params", "description"}}
+		for _, q := range queries {
+			if len(pos) == 2 && q.Name != pos[1] {
+				continue
+			}
+			t.Rows = append(t.Rows, []any{q.Name, strings.Join(q.Params, " "), q.Description})
+		}
+		return write(os.Stdout, db, t)
+	}
+
+	q, err := db.Query(ctx, pos[1])
+	if errors.Is(err, graph.ErrNotFound) {
+		return fmt.Errorf("no query %s (cpg-gen query %s lists them)", pos[1], pos[0])
+	}
+	if err != nil {
+		return err
+	}
+	if err := bindFuncs(ctx, db, q, funcs, params); err != nil {
+		return err
+	}
+	t, err := db.RunQuery(ctx, q.Name, params)
+	if err != nil {
+		return err
+	}
+	return write(os.Stdout, db, t)
+}
+
+// parseInterspersed parses args with fs, letting flags follow the positional
+// arguments, and returns the positional arguments in order.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var pos []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return pos, nil
+		}
+		pos = append(pos, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// bindFuncs resolves the -func symbols and binds each to its parameter:
+// the one named as name=symbol, else the next of q's funcParams not set yet.
+// Parameter values are always bound as text.
+func bindFuncs(ctx context.Context, db *graph.DB, q *graph.Query, funcs []string, params map[string]any) error {
+	for _, f := range funcs {
+		name, symbol, named := strings.Cut(f, "=")
+		if !named {
+			symbol, name = f, ""
+			for _, p := range funcParams {
+				if _, set := params[p]; !set && slices.Contains(q.Params, p) {
+					name = p
+					break
+				}
+			}
+			if name == "" {
+				return fmt.Errorf("-func %s: query %s has no unset function parameter (its parameters: %s)", f, q.Name, strings.Join(q.Params, ", "))
+			}
+		} else if !slices.Contains(q.Params, name) {
+			return fmt.Errorf("-func %s: query %s has no parameter %s", f, q.Name, name)
+		}
+		id, err := resolveFunc(ctx, db, symbol)
+		if err != nil {
+			return fmt.Errorf("-func %s: %w", f, err)
+		}
+		params[name] = id
+	}
+	return nil
+}
+
+// resolveFunc returns the ID of the one function symbol names (see
+// graph.DB.Functions).
+func resolveFunc(ctx context.Context, db *graph.DB, symbol string) (string, error) {
+	nodes, err := db.Functions(ctx, symbol)
+	if err != nil {
+		return "", err
+	}
+	if len(nodes) > 1 {
+		var b strings.Builder
+		for i, n := range nodes {
+			if i == 10 {
+				fmt.Fprintf(&b, "\n\t... and %d more", len(nodes)-i)
+				break
+			}
+			fmt.Fprintf(&b, "\n\t%s", n.ID)
+		}
+		return "", fmt.Errorf("ambiguous, %d functions match:%s", len(nodes), b.String())
+	}
+	return nodes[0].ID, nil
+}
+
+// traverseMemory loads the edges of the given kinds into memory and returns
+// the shortest path from one node to another as one row per edge, or
+// without to the nodes within maxHops of from with their depth.
+func traverseMemory(ctx context.Context, db *graph.DB, from, to string, kinds []string, dir mem.Direction, maxHops, limit int) (*graph.Table, error) {
+	fromID, err := resolveFunc(ctx, db, from)
+	if err != nil {
+		return nil, fmt.Errorf("-from %s: %w", from, err)
+	}
+	var toID string
+	if to != "" {
+		if toID, err = resolveFunc(ctx, db, to); err != nil {
+			return nil, fmt.Errorf("-to %s: %w", to, err)
+		}
+	}
+	g, err := db.Memory(ctx, mem.LoadOptions{EdgeKinds: kinds})
+	if err != nil {
+		return nil, err
+	}
+	mask := g.Mask(kinds...)
+
+	t := new(graph.Table)
+	var ids []string
+	if to != "" {
+		path, err := g.ShortestPath(fromID, toID, dir, mask, maxHops)
+		if errors.Is(err, mem.ErrNoPath) {
+			return nil, fmt.Errorf("no path from %s to %s within %d edges", fromID, toID, maxHops)
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.Columns = []string{"step", "source", "source_name", "target", "target_name", "kind"}
+		for i, e := range path {
+			t.Rows = append(t.Rows, []any{int64(i + 1), e.Source, nil, e.Target, nil, e.Kind})
+			ids = append(ids, e.Source, e.Target)
+		}
+	} else {
+		reached, err := g.Neighborhood(fromID, dir, mask, maxHops)
+		if err != nil {
+			return nil, err
+		}
+		if limit > 0 && len(reached) > limit {
+			reached, t.Truncated = reached[:limit], true
+		}
+		t.Columns = []string{"id", "name", "kind", "package", "depth"}
+		for _, r := range reached {
+			t.Rows = append(t.Rows, []any{r.ID, nil, g.Kind(r.ID), nil, int64(r.Depth)})
+			ids = append(ids, r.ID)
+		}
+	}
+
+	// Names and packages come from the database
+	nodes, err := db.Nodes(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]graph.Node, len(nodes))
+	for _, n := range nodes {
+		byID[n.ID] = n
+	}
+	for _, row := range t.Rows {
+		if to != "" {
+			row[2], row[4] = byID[row[1].(string)].Name, byID[row[3].(string)].Name
+		} else {
+			row[1], row[3] = byID[row[0].(string)].Name, byID[row[0].(string)].Package
+		}
+	}
+	return t, nil
+}
+
+var tableWriters = map[string]func(io.Writer, *graph.DB, *graph.Table) error{
+	"table": writeTable,
+	"csv":   writeCSV,
+	"json":  writeJSON,
+	"dot":   writeDOT,
+}
+
+func writeTable(w io.Writer, _ *graph.DB, t *graph.Table) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(t.Columns, "\t"))
+	for _, row := range t.Rows {
+		for i, v := range row {
+			if i > 0 {
+				fmt.Fprint(tw, "\t")
+			}
+			if v == nil {
+				fmt.Fprint(tw, "NULL")
+			} else {
+				// Keep multi-line values (SQL, properties) on the row
+				fmt.Fprint(tw, strings.Join(strings.Fields(cellText(v)), " "))
+			}
+		}
+		fmt.Fprintln(tw)
+	}
+	return tw.Flush()
+}
+
+// reportSection is a titled table of a subcommand's text report.
+type reportSection struct {
+	title string
+	t     *graph.Table
+}
+
+// writeSections writes the non-empty sections as tables of at most limit
+// rows (0 = unlimited).
+func writeSections(w io.Writer, sections []reportSection, limit int) error {
+	for _, s := range sections {
+		if len(s.t.Rows) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s:\n", s.title)
+		rows := s.t.Rows
+		if limit > 0 && len(rows) > limit {
+			rows = rows[:limit]
+		}
+		if err := writeTable(w, nil, &graph.Table{Columns: s.t.Columns, Rows: rows}); err != nil {
+			return err
+		}
+		if more := len(s.t.Rows) - len(rows); more > 0 {
+			fmt.Fprintf(w, "... and %d more\n", more)
+		}
+	}
+	return nil
+}
+
+func writeCSV(w io.Writer, _ *graph.DB, t *graph.Table) error {
+	cw := csv.NewWriter(w)
+	cw.Write(t.Columns)
+	record := make([]string, len(t.Columns))
+	for _, row := range t.Rows {
+		for i, v := range row {
+			record[i] = cellText(v)
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSON writes the rows as an array of objects with the keys in column
+// order.
+func writeJSON(w io.Writer, _ *graph.DB, t *graph.Table) error {
+	var b strings.Builder
+	b.WriteString("[")
+	for r, row := range t.Rows {
+		if r > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n  {")
+		for i, v := range row {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			key, _ := json.Marshal(t.Columns[i])
+			if s, ok := v.([]byte); ok {
+				v = string(s)
+			}
+			val, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("column %s: %w", t.Columns[i], err)
+			}
+			b.Write(key)
+			b.WriteString(": ")
+			b.Write(val)
+		}
+		b.WriteString("}")
+	}
+	if len(t.Rows) > 0 {
+		b.WriteString("\n")
+	}
+	b.WriteString("]\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// dotEdgeColumns are the column pairs a result is drawn as edges from, with
+// the columns labelling each end ("" labels a node with its ID).
+var dotEdgeColumns = []dotEdgeColumn{
+	{"source", "target", "source_name", "target_name"},
+	{"caller_id", "callee_id", "caller_name", "callee_name"},
+	{"block_id", "successor_id", "block_name", "successor_name"},
+	{"source_package", "target_package", "", ""},
+	{"source_component", "target_component", "", ""},
+}
+
+type dotEdgeColumn struct{ source, target, sourceLabel, targetLabel string }
+
+// dotEdgeLabels are the columns that label an edge, first present wins.
+var dotEdgeLabels = []string{"kind", "branch_label", "call_count", "weight", "protocol_name"}
+
+// writeDOT writes the result as a Graphviz digraph. A result with a pair of
+// dotEdgeColumns is drawn edge by edge; "a -> b -> c" path columns and the
+// node variables of a -match (columns x with an x_name companion) are drawn
+// as chains; a result listing nodes by id (call chains, slices, impact sets)
+// is drawn with the edges the graph has between them.
+func writeDOT(w io.Writer, db *graph.DB, t *graph.Table) error {
+	col := func(name string) int { return slices.Index(t.Columns, name) }
+	labels := make(map[string]string)
+	var order []string
+	node := func(id, label string) {
+		if _, ok := labels[id]; !ok {
+			order = append(order, id)
+			labels[id] = id
+		}
+		if label != "" {
+			labels[id] = label
+		}
+	}
+	type edge struct{ source, target, label string }
+	var edges []edge
+	cell := func(row []any, i int) string {
+		if i < 0 {
+			return ""
+		}
+		return cellText(row[i])
+	}
+
+	pair := slices.IndexFunc(dotEdgeColumns, func(c dotEdgeColumn) bool {
+		return col(c.source) >= 0 && col(c.target) >= 0
+	})
+	switch {
+	case pair >= 0:
+		c := dotEdgeColumns[pair]
+		label := -1
+		for _, l := range dotEdgeLabels {
+			if label = col(l); label >= 0 {
+				break
+			}
+		}
+		for _, row := range t.Rows {
+			source, target := cell(row, col(c.source)), cell(row, col(c.target))
+			if source == "" {
+				continue
+			}
+			node(source, cell(row, col(c.sourceLabel)))
+			if target == "" {
+				// A node without successors, e.g. a function's exit block
+				continue
+			}
+			node(target, cell(row, col(c.targetLabel)))
+			edges = append(edges, edge{source, target, cell(row, label)})
+		}
+	case col("path") >= 0:
+		for _, row := range t.Rows {
+			path := strings.Split(cell(row, col("path")), " -> ")
+			for i, id := range path {
+				node(id, "")
+				if i > 0 {
+					edges = append(edges, edge{path[i-1], id, ""})
+				}
+			}
+		}
+	case slices.ContainsFunc(t.Columns, func(c string) bool { return col(c+"_name") >= 0 }):
+		var vars []string
+		for _, c := range t.Columns {
+			if col(c+"_name") >= 0 {
+				vars = append(vars, c)
+			}
+		}
+		for _, row := range t.Rows {
+			for i, v := range vars {
+				node(cell(row, col(v)), cell(row, col(v+"_name")))
+				if i > 0 {
+					edges = append(edges, edge{cell(row, col(vars[i-1])), cell(row, col(v)), ""})
+				}
+			}
+		}
+	case col("id") >= 0 || col("function_id") >= 0 || col("node_id") >= 0:
+		idCol := col("id")
+		if idCol < 0 {
+			idCol = col("function_id")
+		}
+		if idCol < 0 {
+			idCol = col("node_id")
+		}
+		nameCol := col("name")
+		if nameCol < 0 {
+			nameCol = col("function_name")
+		}
+		var ids []string
+		for _, row := range t.Rows {
+			if id := cell(row, idCol); id != "" {
+				node(id, cell(row, nameCol))
+				ids = append(ids, id)
+			}
+		}
+		between, err := db.RunSQL(context.Background(), `SELECT source, target, kind FROM edges
+		  WHERE source IN (SELECT value FROM json_each(:ids)) AND target IN (SELECT value FROM json_each(:ids))
+		  ORDER BY source, target, kind`, map[string]any{"ids": jsonArray(ids)})
+		if err != nil {
+			return err
+		}
+		for _, row := range between.Rows {
+			edges = append(edges, edge{cellText(row[0]), cellText(row[1]), cellText(row[2])})
+		}
+	default:
+		return fmt.Errorf("-format dot: result has no edge, path or node ID columns (columns: %s)", strings.Join(t.Columns, ", "))
+	}
+
+	var b strings.Builder
+	b.WriteString("digraph cpg {\n  node [shape=box];\n")
+	for _, id := range order {
+		fmt.Fprintf(&b, "  %s [label=%s];\n", dotQuote(id), dotQuote(labels[id]))
+	}
+	for _, e := range edges {
+		fmt.Fprintf(&b, "  %s -> %s", dotQuote(e.source), dotQuote(e.target))
+		if e.label != "" {
+			fmt.Fprintf(&b, " [label=%s]", dotQuote(e.label))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func jsonArray(ss []string) string {
+	b, _ := json.Marshal(append([]string{}, ss...))
+	return string(b)
+}
+
+// cellText formats a query result value; NULL is empty.
+func cellText(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math"
+	"math/bits"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+
+	"cpg-gen/graph/schema"
+)
+
+// Two runs over the same code write the same rows: the phases emit in a
+// sorted order, finding ids are derived from the findings themselves rather
+// than from the order the stages inserted them in, and cpg_meta records a
+// hash of the content that ignores row order and the timings of the run.
+// Databases can then be cached by that hash and compared without noise.
+
+// findingIDBits keeps finding ids exact as JavaScript numbers in the viewer.
+const findingIDBits = 52
+
+// stableFindingIDs renumbers the findings with ids hashed from their
+// category, severity, node, position, message and details. Identical
+// findings are told apart by their ordinal; a hash collision takes the next
+// free id, in content order.
+func stableFindingIDs(conn *sqlite.Conn, prog *Progress) error {
+	type renumber struct{ old, new int64 }
+	var ids []renumber
+	used := make(map[int64]bool)
+	var prev string
+	var dup int
+	if err := sqlitex.ExecuteTransient(conn, `SELECT id, category, severity, node_id, file, line, message, details
+  FROM findings ORDER BY category, severity, node_id, file, line, message, details`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			h := sha256.New()
+			for i := 1; i < stmt.ColumnCount(); i++ {
+				hashColumn(h, stmt, i)
+			}
+			key := string(h.Sum(nil))
+			if key == prev {
+				dup++
+			} else {
+				prev, dup = key, 0
+			}
+			var n [8]byte
+			binary.BigEndian.PutUint64(n[:], uint64(dup))
+			h.Write(n[:])
+			id := int64(binary.BigEndian.Uint64(h.Sum(nil)) >> (64 - findingIDBits))
+			for id == 0 || used[id] {
+				id = (id + 1) & (1<<findingIDBits - 1)
+			}
+			used[id] = true
+			ids = append(ids, renumber{stmt.ColumnInt64(0), id})
+			return nil
+		}}); err != nil {
+		return fmt.Errorf("finding ids: %w", err)
+	}
+	// Move the old ids out of the way first so no update hits a taken id.
+	if err := sqlitex.ExecuteTransient(conn, `UPDATE findings SET id = -id`, nil); err != nil {
+		return fmt.Errorf("finding ids: %w", err)
+	}
+	stmt, err := conn.Prepare(`UPDATE findings SET id = ? WHERE id = ?`)
+	if err != nil {
+		return fmt.Errorf("finding ids: %w", err)
+	}
+	for _, r := range ids {
+		stmt.BindInt64(1, r.new)
+		stmt.BindInt64(2, -r.old)
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("finding %d: %w", r.old, err)
+		}
+		_ = stmt.Reset()
+	}
+	prog.Verbose("Derived ids for %d findings", len(ids))
+	return nil
+}
+
+// hashColumn writes column i of the current row to h, tagged with its type
+// and length so that different rows cannot encode alike.
+func hashColumn(h hash.Hash, stmt *sqlite.Stmt, i int) {
+	var buf [9]byte
+	switch stmt.ColumnType(i) {
+	case sqlite.TypeNull:
+		buf[0] = 'n'
+		h.Write(buf[:1])
+	case sqlite.TypeInteger:
+		buf[0] = 'i'
+		binary.BigEndian.PutUint64(buf[1:], uint64(stmt.ColumnInt64(i)))
+		h.Write(buf[:])
+	case sqlite.TypeFloat:
+		buf[0] = 'f'
+		binary.BigEndian.PutUint64(buf[1:], math.Float64bits(stmt.ColumnFloat(i)))
+		h.Write(buf[:])
+	default:
+		b := make([]byte, stmt.ColumnLen(i))
+		stmt.ColumnBytes(i, b)
+		buf[0] = 's'
+		binary.BigEndian.PutUint64(buf[1:], uint64(len(b)))
+		h.Write(buf[:])
+		h.Write(b)
+	}
+}
+
+// contentHashed reports whether table counts towards the content hash. The
+// provenance and timings of the run, the package fingerprints (salted with
+// the directories, for -incremental) and the tables SQLite and FTS5
+// maintain themselves are left out.
+func contentHashed(table string) bool {
+	switch table {
+	case "cpg_meta", "pipeline_runs", "pipeline_checkpoints", "package_fingerprints":
+		return false
+	}
+	return !strings.HasPrefix(table, "sqlite_") && !strings.HasPrefix(table, "sources_fts") && !strings.HasPrefix(table, "diff_")
+}
+
+// contentHash returns the hex SHA-256 content hash of the database: the sum
+// modulo 2^256 of the hashes of every row, each prefixed with its table name,
+// so it depends on what the tables hold but not on the order of their rows.
+func contentHash(conn *sqlite.Conn) (string, error) {
+	var tables []string
+	if err := sqlitex.ExecuteTransient(conn, `SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			if name := stmt.ColumnText(0); contentHashed(name) {
+				tables = append(tables, name)
+			}
+			return nil
+		}}); err != nil {
+		return "", fmt.Errorf("content hash: %w", err)
+	}
+	var sum [4]uint64
+	h := sha256.New()
+	var digest [sha256.Size]byte
+	for _, table := range tables {
+		if err := sqlitex.ExecuteTransient(conn, fmt.Sprintf(`SELECT * FROM %q`, table),
+			&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+				h.Reset()
+				h.Write([]byte(table))
+				h.Write([]byte{0})
+				for i := 0; i < stmt.ColumnCount(); i++ {
+					hashColumn(h, stmt, i)
+				}
+				h.Sum(digest[:0])
+				var carry uint64
+				for i := range sum {
+					sum[i], carry = bits.Add64(sum[i], binary.BigEndian.Uint64(digest[8*(3-i):]), carry)
+				}
+				return nil
+			}}); err != nil {
+			return "", fmt.Errorf("content hash %s: %w", table, err)
+		}
+	}
+	var out [32]byte
+	for i, w := range sum {
+		binary.BigEndian.PutUint64(out[8*(3-i):], w)
+	}
+	return hex.EncodeToString(out[:]), nil
+}
+
+// writeContentHash records the content hash in cpg_meta.
+func writeContentHash(conn *sqlite.Conn, prog *Progress) error {
+	prog.Begin("content_hash", "Hashing database content ...")
+	sum, err := contentHash(conn)
+	if err != nil {
+		return err
+	}
+	if err := sqlitex.Execute(conn, `INSERT OR REPLACE INTO cpg_meta (key, value) VALUES (?, ?)`,
+		&sqlitex.ExecOptions{Args: []any{schema.KeyContentHash, sum}}); err != nil {
+		return fmt.Errorf("content hash: %w", err)
+	}
+	prog.End("content_hash", Fields{"hash": sum}, "Content hash %s", sum)
+	return nil
+}
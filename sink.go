@@ -0,0 +1,470 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// sourceBatchBytes bounds the buffered source text of one batch, since a
+// single file can be larger than thousands of node rows.
+const sourceBatchBytes = 64 << 20
+
+// DBSink streams graph elements into the base tables (nodes, edges, sources,
+// metrics, diagnostics, package_coverage) of a SQLite database as the phases emit them. Rows are buffered and
+// flushed every batchSize rows, each batch in its own transaction, so peak
+// memory is one batch plus the compact edge dedupe set instead of the whole
+// graph. Nodes, sources and metrics are deduplicated by the tables' primary
+// keys (INSERT OR IGNORE keeps the first row); coverage counts are summed.
+//
+// DBSink is not safe for concurrent use: the parallel phases fill per-worker
+// shards and replay them from one goroutine (see runSharded).
+type DBSink struct {
+	conn *sqlite.Conn
+	path string
+	prog *Progress
+
+	// scope, when set, restricts the sink to the part being regenerated
+	// (incremental mode): nodes it accepts plus edges touching such nodes.
+	// External stubs and META_DATA are shared and always kept.
+	scope func(id string) bool
+
+	// build names the configuration being extracted once SetBuild is called;
+	// every node and edge added from then on is also recorded as a member of
+	// it in node_configs/edge_configs. buildEdgeSeen dedupes per build.
+	build         string
+	builds        int
+	buildEdgeSeen map[edgeKey]struct{}
+	nodeConfigs   []string
+	edgeConfigs   []Edge
+
+	nodes        []Node
+	edges        []Edge
+	sources      []sourceRow
+	metrics      []Metrics
+	diagnostics  []Diagnostic
+	coverage     map[coverageKey]*Coverage
+	pendingBytes int
+
+	edgeSeen map[edgeKey]struct{}
+	diagSeen map[Diagnostic]struct{}
+
+	nodeCount, edgeCount, sourceCount, metricsCount, diagnosticCount int
+
+	// err is the first flush error. Later rows are dropped and every
+	// subsequent Flush returns it, like bufio.Writer.
+	err error
+}
+
+type sourceRow struct {
+	file, content string
+}
+
+func newDBSink(conn *sqlite.Conn, path string, prog *Progress) *DBSink {
+	return &DBSink{
+		conn:     conn,
+		path:     path,
+		prog:     prog,
+		coverage: make(map[coverageKey]*Coverage),
+		edgeSeen: make(map[edgeKey]struct{}),
+		diagSeen: make(map[Diagnostic]struct{}),
+	}
+}
+
+// AddNode buffers a node. A node whose ID is already stored is ignored on flush.
+func (s *DBSink) AddNode(n Node) {
+	if s.err != nil {
+		return
+	}
+	if s.scope != nil && !s.scope(n.ID) && !strings.HasPrefix(n.ID, "ext::") && n.ID != "META_DATA" {
+		return
+	}
+	if s.build != "" && n.ID != "META_DATA" {
+		s.nodeConfigs = append(s.nodeConfigs, n.ID)
+	}
+	s.nodes = append(s.nodes, n)
+	s.maybeFlush()
+}
+
+// AddEdge buffers an edge unless one with the same (source, target, kind) was already added.
+func (s *DBSink) AddEdge(e Edge) {
+	if s.err != nil {
+		return
+	}
+	if s.scope != nil && !s.scope(e.Source) && !s.scope(e.Target) {
+		return
+	}
+	k := keyOf(e)
+	if s.build != "" {
+		if _, dup := s.buildEdgeSeen[k]; !dup {
+			s.buildEdgeSeen[k] = struct{}{}
+			s.edgeConfigs = append(s.edgeConfigs, Edge{Source: e.Source, Target: e.Target, Kind: e.Kind})
+		}
+	}
+	if _, dup := s.edgeSeen[k]; dup {
+		s.maybeFlush()
+		return
+	}
+	s.edgeSeen[k] = struct{}{}
+	s.edges = append(s.edges, e)
+	s.maybeFlush()
+}
+
+// SetBuild starts the extraction of build configuration b: the buffered
+// rows are flushed, b is recorded in build_configs, and the nodes and edges
+// added until the next SetBuild are recorded as members of b.
+func (s *DBSink) SetBuild(b BuildConfig) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	if err := insertBuildConfig(s.conn, b, s.builds); err != nil {
+		s.err = err
+		return err
+	}
+	s.build = b.Name
+	s.builds++
+	s.buildEdgeSeen = make(map[edgeKey]struct{})
+	return nil
+}
+
+// AddModules records the resolved build list modules (see writeModules).
+// Several build configurations add to the same tables.
+func (s *DBSink) AddModules(mods []ResolvedModule) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	if err := writeModules(s.conn, mods); err != nil {
+		s.err = err
+		return err
+	}
+	return nil
+}
+
+// AddSource buffers a file's content for the sources table.
+func (s *DBSink) AddSource(file, content string) {
+	if s.err != nil {
+		return
+	}
+	s.sources = append(s.sources, sourceRow{file, content})
+	s.pendingBytes += len(content)
+	s.maybeFlush()
+}
+
+// AddMetrics buffers a function's metrics. Fan-in/fan-out are derived later
+// from the stored call edges (computeFanInOut).
+func (s *DBSink) AddMetrics(m Metrics) {
+	if s.err != nil {
+		return
+	}
+	s.metrics = append(s.metrics, m)
+	s.maybeFlush()
+}
+
+// AddDiagnostic buffers a diagnostic unless an identical one was already added.
+// In incremental mode only diagnostics of dirty packages are kept.
+func (s *DBSink) AddDiagnostic(d Diagnostic) {
+	if s.err != nil {
+		return
+	}
+	if s.scope != nil && !s.scope("pkg::"+d.Package) {
+		return
+	}
+	if _, dup := s.diagSeen[d]; dup {
+		return
+	}
+	s.diagSeen[d] = struct{}{}
+	s.diagnostics = append(s.diagnostics, d)
+	s.maybeFlush()
+}
+
+// AddCoverage adds c's counts to the package's totals for the check.
+func (s *DBSink) AddCoverage(c Coverage) {
+	if s.err != nil {
+		return
+	}
+	if s.scope != nil && !s.scope("pkg::"+c.Package) {
+		return
+	}
+	k := coverageKey{c.Package, c.Check}
+	if cur, ok := s.coverage[k]; ok {
+		cur.Total += c.Total
+		cur.Failed += c.Failed
+		return
+	}
+	s.coverage[k] = &c
+}
+
+func (s *DBSink) pending() int {
+	return len(s.nodes) + len(s.edges) + len(s.sources) + len(s.metrics) + len(s.diagnostics) + len(s.coverage) +
+		len(s.nodeConfigs) + len(s.edgeConfigs)
+}
+
+func (s *DBSink) maybeFlush() {
+	if s.pending() >= batchSize || s.pendingBytes >= sourceBatchBytes {
+		s.err = s.flush()
+	}
+}
+
+// Flush writes all buffered rows. It returns the first error of any flush so far.
+func (s *DBSink) Flush() error {
+	if s.err == nil {
+		s.err = s.flush()
+	}
+	return s.err
+}
+
+// Finish flushes the remaining rows and reports the totals. The phases must
+// not emit into the sink afterwards.
+func (s *DBSink) Finish() error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	s.prog.Log("Inserted %d nodes", s.nodeCount)
+	s.prog.Log("Inserted %d edges", s.edgeCount)
+	s.prog.Log("Inserted %d source files", s.sourceCount)
+	s.prog.Log("Inserted %d function metrics", s.metricsCount)
+	if s.diagnosticCount > 0 {
+		s.prog.Log("Recorded %d diagnostics", s.diagnosticCount)
+	}
+	return nil
+}
+
+// Close flushes any remaining rows and closes the connection. It is safe to
+// call more than once.
+func (s *DBSink) Close() error {
+	if s.conn == nil {
+		return s.err
+	}
+	err := s.Flush()
+	if cerr := s.conn.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("close sqlite: %w", cerr)
+	}
+	s.conn = nil
+	return err
+}
+
+// NodeCount returns the number of nodes stored so far (after deduplication).
+func (s *DBSink) NodeCount() int { return s.nodeCount }
+
+// EdgeCount returns the number of edges stored so far (after deduplication).
+func (s *DBSink) EdgeCount() int { return s.edgeCount }
+
+func (s *DBSink) flush() (err error) {
+	if s.pending() == 0 {
+		return nil
+	}
+	endFn, err := sqlitex.ImmediateTransaction(s.conn)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer endFn(&err)
+
+	if err = s.flushNodes(); err != nil {
+		return err
+	}
+	if err = s.flushEdges(); err != nil {
+		return err
+	}
+	if err = s.flushSources(); err != nil {
+		return err
+	}
+	if err = s.flushMetrics(); err != nil {
+		return err
+	}
+	if err = s.flushDiagnostics(); err != nil {
+		return err
+	}
+	if err = s.flushCoverage(); err != nil {
+		return err
+	}
+	if err = s.flushConfigs(); err != nil {
+		return err
+	}
+	s.prog.Verbose("  flushed batch: %d nodes, %d edges, %d sources, %d metrics so far",
+		s.nodeCount, s.edgeCount, s.sourceCount, s.metricsCount)
+	s.prog.Report("flush", Fields{"nodes": s.nodeCount, "edges": s.edgeCount, "sources": s.sourceCount, "metrics": s.metricsCount,
+		"diagnostics": s.diagnosticCount})
+	return nil
+}
+
+func (s *DBSink) flushNodes() error {
+	stmt, err := s.conn.Prepare(`INSERT OR IGNORE INTO nodes (id, kind, name, file, line, col, end_line, package, parent_function, type_info, properties) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("prepare node insert: %w", err)
+	}
+	for _, n := range s.nodes {
+		stmt.BindText(1, n.ID)
+		stmt.BindText(2, n.Kind)
+		stmt.BindText(3, n.Name)
+		bindTextOrNull(stmt, 4, n.File)
+		bindIntOrNull(stmt, 5, n.Line)
+		bindIntOrNull(stmt, 6, n.Col)
+		bindIntOrNull(stmt, 7, n.EndLine)
+		bindTextOrNull(stmt, 8, n.Package)
+		bindTextOrNull(stmt, 9, n.ParentFunction)
+		bindTextOrNull(stmt, 10, n.TypeInfo)
+		bindTextOrNull(stmt, 11, PropsJSON(n.Properties))
+
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("insert node %s: %w", n.ID, err)
+		}
+		s.nodeCount += s.conn.Changes()
+		_ = stmt.Reset()
+	}
+	clear(s.nodes)
+	s.nodes = s.nodes[:0]
+	return nil
+}
+
+func (s *DBSink) flushEdges() error {
+	stmt, err := s.conn.Prepare(`INSERT INTO edges (source, target, kind, properties) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("prepare edge insert: %w", err)
+	}
+	for _, e := range s.edges {
+		stmt.BindText(1, e.Source)
+		stmt.BindText(2, e.Target)
+		stmt.BindText(3, e.Kind)
+		bindTextOrNull(stmt, 4, PropsJSON(e.Properties))
+
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("insert edge %s→%s: %w", e.Source, e.Target, err)
+		}
+		_ = stmt.Reset()
+	}
+	s.edgeCount += len(s.edges)
+	clear(s.edges)
+	s.edges = s.edges[:0]
+	return nil
+}
+
+func (s *DBSink) flushSources() error {
+	stmt, err := s.conn.Prepare(`INSERT OR IGNORE INTO sources (file, content, package) VALUES (?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("prepare source insert: %w", err)
+	}
+	for _, src := range s.sources {
+		stmt.BindText(1, src.file)
+		stmt.BindText(2, src.content)
+		// Extract package from file path: first directory component
+		bindTextOrNull(stmt, 3, extractPkgFromPath(src.file))
+
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("insert source %s: %w", src.file, err)
+		}
+		s.sourceCount += s.conn.Changes()
+		_ = stmt.Reset()
+	}
+	clear(s.sources)
+	s.sources = s.sources[:0]
+	s.pendingBytes = 0
+	return nil
+}
+
+func (s *DBSink) flushMetrics() error {
+	stmt, err := s.conn.Prepare(`INSERT OR IGNORE INTO metrics (function_id, cyclomatic_complexity, fan_in, fan_out, loc, num_params) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("prepare metrics insert: %w", err)
+	}
+	for _, m := range s.metrics {
+		stmt.BindText(1, m.FunctionID)
+		stmt.BindInt64(2, int64(m.CyclomaticComplexity))
+		stmt.BindInt64(3, int64(m.FanIn))
+		stmt.BindInt64(4, int64(m.FanOut))
+		stmt.BindInt64(5, int64(m.LOC))
+		stmt.BindInt64(6, int64(m.NumParams))
+
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("insert metric %s: %w", m.FunctionID, err)
+		}
+		s.metricsCount += s.conn.Changes()
+		_ = stmt.Reset()
+	}
+	s.metrics = s.metrics[:0]
+	return nil
+}
+
+func (s *DBSink) flushDiagnostics() error {
+	stmt, err := s.conn.Prepare(`INSERT INTO diagnostics (package, phase, kind, file, line, col, symbol, message) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("prepare diagnostic insert: %w", err)
+	}
+	for _, d := range s.diagnostics {
+		bindTextOrNull(stmt, 1, d.Package)
+		stmt.BindText(2, d.Phase)
+		stmt.BindText(3, d.Kind)
+		bindTextOrNull(stmt, 4, d.File)
+		bindIntOrNull(stmt, 5, d.Line)
+		bindIntOrNull(stmt, 6, d.Col)
+		bindTextOrNull(stmt, 7, d.Symbol)
+		bindTextOrNull(stmt, 8, d.Message)
+
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("insert diagnostic %s %s: %w", d.Kind, d.Package, err)
+		}
+		_ = stmt.Reset()
+	}
+	s.diagnosticCount += len(s.diagnostics)
+	s.diagnostics = s.diagnostics[:0]
+	return nil
+}
+
+func (s *DBSink) flushCoverage() error {
+	stmt, err := s.conn.Prepare(`INSERT INTO package_coverage (package, check_name, total, failed) VALUES (?, ?, ?, ?)
+	  ON CONFLICT (package, check_name) DO UPDATE SET total = total + excluded.total, failed = failed + excluded.failed`)
+	if err != nil {
+		return fmt.Errorf("prepare coverage insert: %w", err)
+	}
+	for _, c := range sortedCoverage(s.coverage) {
+		stmt.BindText(1, c.Package)
+		stmt.BindText(2, c.Check)
+		stmt.BindInt64(3, int64(c.Total))
+		stmt.BindInt64(4, int64(c.Failed))
+
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("insert coverage %s %s: %w", c.Package, c.Check, err)
+		}
+		_ = stmt.Reset()
+	}
+	clear(s.coverage)
+	return nil
+}
+
+func (s *DBSink) flushConfigs() error {
+	if len(s.nodeConfigs) > 0 {
+		stmt, err := s.conn.Prepare(`INSERT OR IGNORE INTO node_configs (node_id, config) VALUES (?, ?)`)
+		if err != nil {
+			return fmt.Errorf("prepare node config insert: %w", err)
+		}
+		for _, id := range s.nodeConfigs {
+			stmt.BindText(1, id)
+			stmt.BindText(2, s.build)
+			if _, err := stmt.Step(); err != nil {
+				return fmt.Errorf("insert node config %s: %w", id, err)
+			}
+			_ = stmt.Reset()
+		}
+		s.nodeConfigs = s.nodeConfigs[:0]
+	}
+	if len(s.edgeConfigs) > 0 {
+		stmt, err := s.conn.Prepare(`INSERT OR IGNORE INTO edge_configs (source, target, kind, config) VALUES (?, ?, ?, ?)`)
+		if err != nil {
+			return fmt.Errorf("prepare edge config insert: %w", err)
+		}
+		for _, e := range s.edgeConfigs {
+			stmt.BindText(1, e.Source)
+			stmt.BindText(2, e.Target)
+			stmt.BindText(3, e.Kind)
+			stmt.BindText(4, s.build)
+			if _, err := stmt.Step(); err != nil {
+				return fmt.Errorf("insert edge config %s→%s: %w", e.Source, e.Target, err)
+			}
+			_ = stmt.Reset()
+		}
+		clear(s.edgeConfigs)
+		s.edgeConfigs = s.edgeConfigs[:0]
+	}
+	return nil
+}
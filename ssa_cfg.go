@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"go/token"
 	"go/types"
+	"sort"
+	"sync/atomic"
 
 	"golang.org/x/tools/go/packages"
 	"golang.org/x/tools/go/ssa"
@@ -13,33 +16,109 @@ import (
 type SSAResult struct {
 	Prog     *ssa.Program
 	AllFuncs map[*ssa.Function]bool
+	// Scope, when non-nil, limits per-function edge extraction to functions
+	// whose package path it contains (incremental mode). The call graph is
+	// still built over AllFuncs since VTA is whole-program.
+	Scope map[string]bool
+	// Diagnostics holds the packages SSA construction skipped.
+	Diagnostics []Diagnostic
+
+	// loaded, when non-nil, holds the SSA packages of the loaded package
+	// list. With tests loaded, a package's production copy is built as a
+	// dependency of its importers besides its test variant; Funcs keeps only
+	// the test variant's functions so each function is extracted once.
+	loaded map[*ssa.Package]bool
+	funcs  []*ssa.Function // cached by Funcs
+}
+
+// InScope reports whether edges should be extracted for fn.
+func (r *SSAResult) InScope(fn *ssa.Function) bool {
+	return r.Scope == nil || (fn.Pkg != nil && r.Scope[fn.Pkg.Pkg.Path()])
+}
+
+// Funcs returns the non-synthetic, in-scope functions of the analyzed modules
+// in a stable order (by package path, then name), so the parallel extraction
+// phases shard the same work the same way on every run.
+func (r *SSAResult) Funcs() []*ssa.Function {
+	if r.funcs != nil {
+		return r.funcs
+	}
+	funcs := make([]*ssa.Function, 0, len(r.AllFuncs))
+	for fn := range r.AllFuncs {
+		if fn.Pkg == nil || fn.Synthetic != "" {
+			continue
+		}
+		if !modSet.IsKnownPkg(fn.Pkg.Pkg.Path()) || !r.InScope(fn) {
+			continue
+		}
+		if r.loaded != nil && !r.loaded[fn.Pkg] {
+			continue
+		}
+		funcs = append(funcs, fn)
+	}
+	sort.Slice(funcs, func(i, j int) bool {
+		a, b := funcs[i], funcs[j]
+		if pa, pb := a.Pkg.Pkg.Path(), b.Pkg.Pkg.Path(); pa != pb {
+			return pa < pb
+		}
+		if sa, sb := a.String(), b.String(); sa != sb {
+			return sa < sb
+		}
+		return a.Pos() < b.Pos()
+	})
+	r.funcs = funcs
+	return funcs
 }
 
 // BuildSSA constructs the SSA representation from loaded packages.
 func BuildSSA(pkgs []*packages.Package, prog *Progress) *SSAResult {
-	prog.Log("Building SSA...")
+	prog.Begin("ssa", "Building SSA...")
 
 	ssaProg, ssaPkgs := ssautil.AllPackages(pkgs, ssa.InstantiateGenerics)
 	var ssaFailed int
+	var diags []Diagnostic
 	for i, sp := range ssaPkgs {
 		if sp == nil && i < len(pkgs) {
 			prog.Verbose("SSA build skipped package: %s", pkgs[i].PkgPath)
+			prog.Report("ssa_failure", Fields{"package": pkgs[i].PkgPath})
+			msg := "SSA construction skipped the package: an imported package has errors"
+			if n := len(pkgs[i].Errors); n > 0 {
+				msg = fmt.Sprintf("SSA construction skipped the package: %d load errors", n)
+			}
+			diags = append(diags, Diagnostic{
+				Package: modSet.RelPkg(pkgs[i].PkgPath),
+				Phase:   "ssa",
+				Kind:    diagSSAFailure,
+				Message: msg,
+			})
 			ssaFailed++
 		}
 	}
 	if ssaFailed > 0 {
-		prog.Log("Warning: %d packages failed SSA construction", ssaFailed)
+		prog.Warn("%d packages failed SSA construction", ssaFailed)
 	}
 	ssaProg.Build()
 
-	allFuncs := ssautil.AllFunctions(ssaProg)
+	res := &SSAResult{
+		Prog:        ssaProg,
+		AllFuncs:    ssautil.AllFunctions(ssaProg),
+		Diagnostics: diags,
+	}
+	if !flagSkipTests {
+		res.loaded = make(map[*ssa.Package]bool)
+		for _, sp := range ssaPkgs {
+			if sp != nil {
+				res.loaded[sp] = true
+			}
+		}
+	}
 
 	var count int
-	for fn := range allFuncs {
+	for fn := range res.AllFuncs {
 		if fn.Synthetic != "" {
 			continue
 		}
-		if fn.Pkg == nil {
+		if fn.Pkg == nil || (res.loaded != nil && !res.loaded[fn.Pkg]) {
 			continue
 		}
 		if modSet.IsKnownPkg(fn.Pkg.Pkg.Path()) {
@@ -47,63 +126,66 @@ func BuildSSA(pkgs []*packages.Package, prog *Progress) *SSAResult {
 		}
 	}
 
-	prog.Log("Built SSA for %d functions across %d modules", count, len(modSet.Dirs()))
+	prog.End("ssa", Fields{"functions": count, "failed_packages": ssaFailed},
+		"Built SSA for %d functions across %d modules", count, len(modSet.Dirs()))
 
-	return &SSAResult{
-		Prog:     ssaProg,
-		AllFuncs: allFuncs,
-	}
+	return res
 }
 
 // ExtractCFGAndDFG extracts control-flow and data-flow edges from SSA.
+// withCFG emits basic blocks and cfg edges, withDFG emits dfg and capture
+// edges; the two share one pass over the functions.
 func ExtractCFGAndDFG(
 	ssaResult *SSAResult,
 	fset *token.FileSet,
 	posLookup *PosLookup,
 	funcLookup *FuncLookup,
-	cpg *CPG,
+	cpg Sink,
+	withCFG, withDFG bool,
 	prog *Progress,
 ) {
-	prog.Log("Extracting CFG + DFG...")
+	prog.Begin("cfg", "Extracting CFG + DFG...")
 
-	var cfgEdges, dfgEdges, bbNodes, captureEdges int
-	var ssaPromFuncs, ssaWithBlocks, ssaMatched int
+	var cfgEdges, dfgEdges, bbNodes, captureEdges atomic.Int64
+	var ssaWithBlocks, ssaMatched, ssaMisses atomic.Int64
 
-	for fn := range ssaResult.AllFuncs {
-		if fn.Pkg == nil || fn.Synthetic != "" {
-			continue
-		}
-		if !modSet.IsKnownPkg(fn.Pkg.Pkg.Path()) {
-			continue
-		}
-		ssaPromFuncs++
+	funcs := ssaResult.Funcs()
+	runSharded(len(funcs), cpg, func(k int, cpg *CPG) {
+		fn := funcs[k]
 		if len(fn.Blocks) == 0 {
-			continue
+			return
 		}
-		ssaWithBlocks++
+		ssaWithBlocks.Add(1)
+		pkg := ssaFuncPkg(fn)
 
 		// Find the function's node ID via position
 		funcNodeID := ssaFuncNodeID(fn, fset, funcLookup)
 		if funcNodeID == "" {
-			if ssaWithBlocks-ssaMatched <= 5 {
-				pos := fn.Pos()
-				if pos.IsValid() {
-					p := fset.Position(pos)
-					rel := modSet.RelFile(p.Filename)
-					prog.Verbose("  SSA miss: %s at %s:%d:%d", fn.String(), rel, p.Line, p.Column)
+			d := Diagnostic{Package: pkg, Phase: "ssa", Kind: diagSSAUnmatched, Symbol: fn.String(),
+				Message: "no AST function node at the SSA function's position"}
+			if pos := fn.Pos(); pos.IsValid() {
+				p := fset.Position(pos)
+				d.File, d.Line, d.Col = modSet.RelFile(p.Filename), p.Line, p.Column
+			}
+			cpg.AddDiagnostic(d)
+			cpg.AddCoverage(Coverage{Package: pkg, Check: covSSAMatch, Total: 1, Failed: 1})
+			if ssaMisses.Add(1) <= 5 {
+				if d.File != "" {
+					prog.Verbose("  SSA miss: %s at %s:%d:%d", fn.String(), d.File, d.Line, d.Col)
 				} else {
 					prog.Verbose("  SSA miss (no pos): %s", fn.String())
 				}
 			}
-			continue
+			return
 		}
-		ssaMatched++
+		ssaMatched.Add(1)
+		cpg.AddCoverage(Coverage{Package: pkg, Check: covSSAMatch, Total: 1})
 
 		// Closure capture edges: FuncLit → captured variables from enclosing scope.
 		// Go closures always capture by reference (the closure and the enclosing
 		// scope share the same variable). This is annotated as capture_kind so
 		// downstream analysis can correctly model mutation semantics.
-		if fn.Parent() != nil && len(fn.FreeVars) > 0 {
+		if withDFG && fn.Parent() != nil && len(fn.FreeVars) > 0 {
 			for _, fv := range fn.FreeVars {
 				fvPos := fv.Pos()
 				if !fvPos.IsValid() {
@@ -123,81 +205,28 @@ func ExtractCFGAndDFG(
 							"capture_kind": "by_reference",
 						},
 					})
-					captureEdges++
+					captureEdges.Add(1)
 				}
 			}
 		}
 
-		// Create basic block nodes and CFG edges
-		blockIDs := make([]string, len(fn.Blocks))
-		for i, block := range fn.Blocks {
-			bbID := BlockID(funcNodeID, i)
-			blockIDs[i] = bbID
-
-			// Determine position from first instruction with valid pos
-			line, col, file := blockPos(block, fset)
-
-			cpg.AddNode(Node{
-				ID:             bbID,
-				Kind:           "basic_block",
-				Name:           block.Comment,
-				File:           file,
-				Line:           line,
-				Col:            col,
-				Package:        modSet.RelPkg(fn.Pkg.Pkg.Path()),
-				ParentFunction: funcNodeID,
-				Properties: map[string]any{
-					"index": i,
-				},
-			})
-			bbNodes++
+		if withCFG {
+			emitBlocksAndCFG(fn, funcNodeID, fset, cpg, &bbNodes, &cfgEdges)
 		}
 
-		// CFG entry edge: function → first block
-		cpg.AddEdge(Edge{
-			Source: funcNodeID, Target: blockIDs[0],
-			Kind:       "cfg",
-			Properties: map[string]any{"label": "entry"},
-		})
-		cfgEdges++
-
-		// CFG exit edges: terminal blocks (no successors) → function
-		for i, block := range fn.Blocks {
-			if len(block.Succs) == 0 {
-				cpg.AddEdge(Edge{
-					Source: blockIDs[i], Target: funcNodeID,
-					Kind:       "cfg",
-					Properties: map[string]any{"label": "exit"},
-				})
-				cfgEdges++
-			}
+		// DFG edges: definition → use (intra-procedural)
+		if !withDFG {
+			return
 		}
-
-		// CFG edges between basic blocks
-		for i, block := range fn.Blocks {
-			for j, succ := range block.Succs {
-				props := map[string]any{}
-				// Label branch edges for If terminators
-				if len(block.Instrs) > 0 {
-					if _, ok := block.Instrs[len(block.Instrs)-1].(*ssa.If); ok {
-						if j == 0 {
-							props["label"] = "true"
-						} else {
-							props["label"] = "false"
-						}
-					}
-				}
-				cpg.AddEdge(Edge{
-					Source:     blockIDs[i],
-					Target:     blockIDs[succ.Index],
-					Kind:       "cfg",
-					Properties: props,
-				})
-				cfgEdges++
-			}
+		var lookups, unresolved int
+		unresolvedAt := func(kind, file string, line, col int, val ssa.Value, instr ssa.Instruction) {
+			unresolved++
+			cpg.AddDiagnostic(Diagnostic{Package: pkg, Phase: "dfg", Kind: kind,
+				File: file, Line: line, Col: col, Symbol: val.Name(), Message: instr.String()})
 		}
-
-		// DFG edges: definition → use (intra-procedural)
+		defer func() {
+			cpg.AddCoverage(Coverage{Package: pkg, Check: covDFGLookup, Total: lookups, Failed: unresolved})
+		}()
 		for _, block := range fn.Blocks {
 			for _, instr := range block.Instrs {
 				val, ok := instr.(ssa.Value)
@@ -205,7 +234,7 @@ func ExtractCFGAndDFG(
 					continue
 				}
 				refs := val.Referrers()
-				if refs == nil {
+				if refs == nil || syntheticValue(val) {
 					continue
 				}
 
@@ -213,18 +242,28 @@ func ExtractCFGAndDFG(
 				if defFile == "" {
 					continue
 				}
+				lookups++
 				defNodeID := posLookup.Get(defFile, defLine, defCol)
 				if defNodeID == "" {
+					unresolvedAt(diagUnresolvedDef, defFile, defLine, defCol, val, instr)
 					continue
 				}
 
 				for _, ref := range *refs {
+					if v, ok := ref.(ssa.Value); ok && syntheticValue(v) {
+						continue
+					}
 					useFile, useLine, useCol := instrPos(ref, fset)
 					if useFile == "" {
 						continue
 					}
+					lookups++
 					useNodeID := posLookup.Get(useFile, useLine, useCol)
-					if useNodeID == "" || useNodeID == defNodeID {
+					if useNodeID == "" {
+						unresolvedAt(diagUnresolvedUse, useFile, useLine, useCol, val, ref)
+						continue
+					}
+					if useNodeID == defNodeID {
 						continue
 					}
 
@@ -238,14 +277,90 @@ func ExtractCFGAndDFG(
 						Kind:       "dfg",
 						Properties: props,
 					})
-					dfgEdges++
+					dfgEdges.Add(1)
 				}
 			}
 		}
+	})
+
+	prog.Log("SSA: %d Prometheus funcs, %d with blocks, %d matched to AST", len(funcs), ssaWithBlocks.Load(), ssaMatched.Load())
+	prog.End("cfg", Fields{
+		"ssa_funcs": len(funcs), "ssa_with_blocks": ssaWithBlocks.Load(), "ssa_matched": ssaMatched.Load(), "ssa_misses": ssaMisses.Load(),
+		"basic_blocks": bbNodes.Load(), "cfg_edges": cfgEdges.Load(), "dfg_edges": dfgEdges.Load(), "capture_edges": captureEdges.Load(),
+	}, "Created %d basic_block nodes, %d CFG edges, %d DFG edges, %d capture edges",
+		bbNodes.Load(), cfgEdges.Load(), dfgEdges.Load(), captureEdges.Load())
+}
+
+// emitBlocksAndCFG emits fn's basic_block nodes plus its entry, exit and
+// block-to-block cfg edges.
+func emitBlocksAndCFG(fn *ssa.Function, funcNodeID string, fset *token.FileSet, cpg Sink, bbNodes, cfgEdges *atomic.Int64) {
+	blockIDs := make([]string, len(fn.Blocks))
+	for i, block := range fn.Blocks {
+		bbID := BlockID(funcNodeID, i)
+		blockIDs[i] = bbID
+
+		// Determine position from first instruction with valid pos
+		line, col, file := blockPos(block, fset)
+
+		cpg.AddNode(Node{
+			ID:             bbID,
+			Kind:           "basic_block",
+			Name:           block.Comment,
+			File:           file,
+			Line:           line,
+			Col:            col,
+			Package:        modSet.RelPkg(fn.Pkg.Pkg.Path()),
+			ParentFunction: funcNodeID,
+			Properties: map[string]any{
+				"index": i,
+			},
+		})
+		bbNodes.Add(1)
+	}
+
+	// CFG entry edge: function → first block
+	cpg.AddEdge(Edge{
+		Source: funcNodeID, Target: blockIDs[0],
+		Kind:       "cfg",
+		Properties: map[string]any{"label": "entry"},
+	})
+	cfgEdges.Add(1)
+
+	// CFG exit edges: terminal blocks (no successors) → function
+	for i, block := range fn.Blocks {
+		if len(block.Succs) == 0 {
+			cpg.AddEdge(Edge{
+				Source: blockIDs[i], Target: funcNodeID,
+				Kind:       "cfg",
+				Properties: map[string]any{"label": "exit"},
+			})
+			cfgEdges.Add(1)
+		}
 	}
 
-	prog.Log("SSA: %d Prometheus funcs, %d with blocks, %d matched to AST", ssaPromFuncs, ssaWithBlocks, ssaMatched)
-	prog.Log("Created %d basic_block nodes, %d CFG edges, %d DFG edges, %d capture edges", bbNodes, cfgEdges, dfgEdges, captureEdges)
+	// CFG edges between basic blocks
+	for i, block := range fn.Blocks {
+		for j, succ := range block.Succs {
+			props := map[string]any{}
+			// Label branch edges for If terminators
+			if len(block.Instrs) > 0 {
+				if _, ok := block.Instrs[len(block.Instrs)-1].(*ssa.If); ok {
+					if j == 0 {
+						props["label"] = "true"
+					} else {
+						props["label"] = "false"
+					}
+				}
+			}
+			cpg.AddEdge(Edge{
+				Source:     blockIDs[i],
+				Target:     blockIDs[succ.Index],
+				Kind:       "cfg",
+				Properties: props,
+			})
+			cfgEdges.Add(1)
+		}
+	}
 }
 
 // ExtractChannelFlow finds channel send→receive pairs by tracking MakeChan
@@ -254,22 +369,17 @@ func ExtractChannelFlow(
 	ssaResult *SSAResult,
 	fset *token.FileSet,
 	posLookup *PosLookup,
-	cpg *CPG,
+	cpg Sink,
 	prog *Progress,
 ) {
-	prog.Log("Extracting channel flow edges...")
+	prog.Begin("chan", "Extracting channel flow edges...")
 
-	var chanFlowEdges int
+	var chanFlowEdges atomic.Int64
 
 	// For each MakeChan, follow referrers to find all sends and receives
-	for fn := range ssaResult.AllFuncs {
-		if fn.Pkg == nil || fn.Synthetic != "" {
-			continue
-		}
-		if !modSet.IsKnownPkg(fn.Pkg.Pkg.Path()) {
-			continue
-		}
-
+	funcs := ssaResult.Funcs()
+	runSharded(len(funcs), cpg, func(k int, cpg *CPG) {
+		fn := funcs[k]
 		for _, block := range fn.Blocks {
 			for _, instr := range block.Instrs {
 				mc, ok := instr.(*ssa.MakeChan)
@@ -288,14 +398,14 @@ func ExtractChannelFlow(
 							Source: sendID, Target: recvID,
 							Kind: "chan_flow",
 						})
-						chanFlowEdges++
+						chanFlowEdges.Add(1)
 					}
 				}
 			}
 		}
-	}
+	})
 
-	prog.Log("Created %d channel flow edges", chanFlowEdges)
+	prog.End("chan", Fields{"chan_flow_edges": chanFlowEdges.Load()}, "Created %d channel flow edges", chanFlowEdges.Load())
 }
 
 // chanFollowRefs recursively follows SSA referrers of a channel value to find
@@ -438,20 +548,16 @@ func ExtractPanicRecover(
 	fset *token.FileSet,
 	posLookup *PosLookup,
 	funcLookup *FuncLookup,
-	cpg *CPG,
+	cpg Sink,
 	prog *Progress,
 ) {
-	prog.Log("Extracting panic/recover flow edges...")
+	prog.Begin("panic", "Extracting panic/recover flow edges...")
 
-	var panicRecoverEdges int
+	var panicRecoverEdges atomic.Int64
 
-	for fn := range ssaResult.AllFuncs {
-		if fn.Pkg == nil || fn.Synthetic != "" {
-			continue
-		}
-		if !modSet.IsKnownPkg(fn.Pkg.Pkg.Path()) {
-			continue
-		}
+	funcs := ssaResult.Funcs()
+	runSharded(len(funcs), cpg, func(k int, cpg *CPG) {
+		fn := funcs[k]
 
 		// Find all panic sites in this function
 		var panicIDs []string
@@ -507,12 +613,12 @@ func ExtractPanicRecover(
 					Source: panicID, Target: recoverID,
 					Kind: "panic_recover",
 				})
-				panicRecoverEdges++
+				panicRecoverEdges.Add(1)
 			}
 		}
-	}
+	})
 
-	prog.Log("Created %d panic/recover flow edges", panicRecoverEdges)
+	prog.End("panic", Fields{"panic_recover_edges": panicRecoverEdges.Load()}, "Created %d panic/recover flow edges", panicRecoverEdges.Load())
 }
 
 // deferTarget extracts the SSA function from a Defer instruction.
@@ -616,6 +722,20 @@ func ssaValueName(v ssa.Value) string {
 	return ""
 }
 
+// syntheticValue reports whether SSA made val up without an expression of
+// its own in the source, so no AST node can match it: the array holding the
+// variadic arguments of a call, and the comma-ok receive of a range over a
+// channel.
+func syntheticValue(val ssa.Value) bool {
+	switch v := val.(type) {
+	case *ssa.Alloc:
+		return v.Comment == "varargs"
+	case *ssa.UnOp:
+		return v.Op == token.ARROW && v.CommaOk && v.Block() != nil && v.Block().Comment == "rangechan.loop"
+	}
+	return false
+}
+
 // instrPos returns the relative file, line, col for an SSA instruction.
 // Returns "" for files outside all known modules.
 func instrPos(instr ssa.Instruction, fset *token.FileSet) (file string, line, col int) {
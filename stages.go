@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// flagStageJobs is the number of connections finishDB runs SQL stages on.
+// 0 or 1 runs every stage in order on the writer's connection.
+var flagStageJobs int
+
+// stageBusyTimeout bounds how long a stage on its own connection waits for
+// another stage's write transaction. Single statements on large graphs can
+// hold the write lock for minutes.
+const stageBusyTimeout = time.Hour
+
+// allTables in Inputs or Outputs makes a stage a barrier: it waits for every
+// earlier stage and every later stage waits for it.
+const allTables = "*"
+
+// sqlStage is one named step of finishDB. Inputs and Outputs name the tables
+// and views the stage reads and creates or writes; the scheduler uses them to
+// decide which stages may overlap, and rows are counted on the output tables.
+type sqlStage struct {
+	Name    string
+	Phase   string // "" = core stage, always runs
+	Title   string // progress message
+	Inputs  []string
+	Outputs []string
+	Run     func(conn *sqlite.Conn) error
+
+	// Optional stages log a failure as a warning instead of aborting.
+	Optional bool
+}
+
+// stageRun is the outcome of one stage, stored in pipeline_runs.
+type stageRun struct {
+	Stage  string
+	Phase  string
+	Status string // ok, error, warning, skipped, not_run
+	Start  time.Duration
+	Wall   time.Duration
+	Rows   int64
+	Err    error
+
+	Resumed bool // completed by an earlier run (see ResumeDB)
+}
+
+// pipelineStages returns the derived stages of finishDB in order. The
+// escape, git, co-change, ownership and validation stages only exist when they have work to do.
+func pipelineStages(escapeResults []EscapeResult, git GitResults, phases PhaseSet, validate bool, prog *Progress) []sqlStage {
+	base := []string{"nodes", "edges", "node_properties"}
+	withFindings := append(slices.Clone(base), "metrics", "findings", "queries")
+
+	stages := []sqlStage{
+		{Name: "flow_semantics", Title: "Building flow semantics model",
+			Outputs: []string{"flow_semantics"},
+			Run:     func(conn *sqlite.Conn) error { return createFlowSemantics(conn) }},
+		{Name: "heuristic_dfg", Phase: "dfg", Title: "Inferring DFG for external calls",
+			Inputs: []string{"nodes", "edges", "flow_semantics"}, Outputs: []string{"edges"},
+			Run: func(conn *sqlite.Conn) error { return inferHeuristicDFG(conn, prog) }},
+		{Name: "orphan_cleanup", Title: "Removing orphan edges",
+			Inputs: []string{"nodes", "edges"}, Outputs: []string{"edges"},
+			Run: func(conn *sqlite.Conn) error { return deleteOrphanEdges(conn, prog) }},
+		{Name: "indexes", Title: "Creating indexes",
+			Inputs: []string{allTables}, Outputs: []string{allTables},
+			Run: func(conn *sqlite.Conn) error { return createIndexes(conn) }},
+		{Name: "eog", Phase: "eog", Title: "Computing evaluation order edges",
+			Inputs: []string{"edges"}, Outputs: []string{"edges"},
+			Run: func(conn *sqlite.Conn) error { return computeEOG(conn, prog) }},
+		{Name: "test_links", Phase: "tests", Title: "Linking tests to production code",
+			Inputs: []string{"nodes", "edges"}, Outputs: []string{"edges"},
+			Run: func(conn *sqlite.Conn) error { return linkTests(conn, prog) }},
+		{Name: "fts", Phase: "fts", Title: "Building FTS5 index",
+			Inputs: []string{"sources"}, Outputs: []string{"sources_fts"},
+			Run: func(conn *sqlite.Conn) error { return createFTS(conn) }},
+		{Name: "summary_stats", Title: "Computing summary statistics",
+			Inputs: []string{"nodes", "edges", "metrics", "sources", "diagnostics", "package_coverage"},
+			Outputs: []string{"node_properties", "edge_properties", "stats_overview", "stats_packages", "stats_node_kinds", "stats_edge_kinds",
+				"package_completeness"},
+			Run: func(conn *sqlite.Conn) error { return createSummaryStats(conn) }},
+		{Name: "analysis_views", Title: "Creating analysis views",
+			Inputs: []string{"nodes", "edges", "metrics", "node_properties", "edge_properties"},
+			Outputs: []string{"findings", "queries", "v_call_graph", "v_data_flow", "v_file_deps", "v_function_io",
+				"v_function_summary", "v_package_deps", "v_type_hierarchy"},
+			Run: func(conn *sqlite.Conn) error { return createAnalysisViews(conn) }},
+		{Name: "build_views", Title: "Creating build configuration views",
+			Inputs: []string{"nodes", "build_configs", "edge_configs", "queries"}, Outputs: []string{"v_config_specific_calls", "queries"},
+			Run: func(conn *sqlite.Conn) error { return createBuildViews(conn) }},
+		{Name: "taint_model", Phase: "taint", Title: "Building taint model",
+			Inputs: []string{"nodes", "edges", "node_properties", "findings"}, Outputs: []string{"taint_specs", "node_properties", "findings"},
+			Run: func(conn *sqlite.Conn) error { return createTaintModel(conn) }},
+		{Name: "additional_analysis", Phase: "analysis", Title: "Computing additional analysis",
+			Inputs: withFindings, Outputs: []string{"findings", "queries", "v_api_surface", "v_error_handling", "v_method_sets"},
+			Run: func(conn *sqlite.Conn) error { return createAdditionalAnalysis(conn, prog) }},
+	}
+	if len(escapeResults) > 0 {
+		stages = append(stages, sqlStage{Name: "escape", Phase: "escape", Title: "Applying escape analysis annotations",
+			Inputs: []string{"nodes", "node_properties"}, Outputs: []string{"node_properties"}, Optional: true,
+			Run: func(conn *sqlite.Conn) error { return applyEscapeAnalysis(conn, escapeResults, prog) }})
+	}
+	stages = append(stages, []sqlStage{
+		{Name: "advanced_analysis", Phase: "analysis", Title: "Computing advanced analysis",
+			Inputs: append(slices.Clone(withFindings), "v_package_deps"), Outputs: []string{"findings", "queries", "v_control_flow_profile", "v_package_stability"},
+			Run: func(conn *sqlite.Conn) error { return createAdvancedAnalysis(conn, prog) }},
+		{Name: "cohesion_patterns", Phase: "analysis", Title: "Computing cohesion and patterns",
+			Inputs: append(slices.Clone(withFindings), "v_package_deps"), Outputs: []string{"findings", "queries", "v_concurrency_profile", "v_package_cohesion", "v_package_impact"},
+			Run: func(conn *sqlite.Conn) error { return createCohesionAndPatterns(conn, prog) }},
+		// Without statistics the query planner has no row counts and picks
+		// catastrophically bad plans on 445k+ row tables, so every later
+		// stage waits for ANALYZE.
+		{Name: "analyze", Title: "Running ANALYZE for query planner",
+			Inputs: []string{allTables}, Outputs: []string{allTables},
+			Run: func(conn *sqlite.Conn) error { return sqlitex.ExecuteTransient(conn, "ANALYZE", nil) }},
+		{Name: "dashboard_data", Phase: "dashboard", Title: "Building dashboard data",
+			Inputs: withFindings,
+			Outputs: []string{"dashboard_overview", "dashboard_node_distribution", "dashboard_edge_distribution", "dashboard_complexity_distribution",
+				"dashboard_complexity_vs_loc", "dashboard_findings_summary", "dashboard_package_treemap"},
+			Run: func(conn *sqlite.Conn) error { return createDashboardData(conn, prog) }},
+		{Name: "graph_intelligence", Phase: "dashboard", Title: "Building graph intelligence",
+			Inputs: withFindings, Outputs: []string{"findings", "queries", "dashboard_top_functions", "dashboard_hotspots", "package_coupling", "error_chains"},
+			Run: func(conn *sqlite.Conn) error { return createGraphIntelligence(conn, prog) }},
+		{Name: "file_dep_analysis", Phase: "dashboard", Title: "Building file and dependency analysis",
+			Inputs: append(slices.Clone(withFindings), "package_coupling"), Outputs: []string{"queries", "dashboard_file_heatmap", "dashboard_package_graph", "dashboard_function_detail"},
+			Run: func(conn *sqlite.Conn) error { return createFileAndDepAnalysis(conn, prog) }},
+		{Name: "untested_functions", Phase: "tests", Title: "Creating untested functions view",
+			Inputs: []string{"nodes", "edges", "metrics", "dashboard_hotspots"}, Outputs: []string{"v_untested_functions"},
+			Run: func(conn *sqlite.Conn) error { return createUntestedFunctions(conn) }},
+		{Name: "type_system", Phase: "typesys", Title: "Building type system analysis",
+			Inputs: withFindings, Outputs: []string{"findings", "queries", "type_hierarchy", "type_impl_map", "type_method_set"},
+			Run: func(conn *sqlite.Conn) error { return createTypeSystemAnalysis(conn, prog) }},
+		{Name: "navigation", Phase: "navigation", Title: "Building navigation and patterns",
+			Inputs: append(slices.Clone(base), "queries"), Outputs: []string{"queries", "symbol_index", "file_outline", "xrefs", "go_pattern_summary"},
+			Run: func(conn *sqlite.Conn) error { return createNavigationAndPatterns(conn, prog) }},
+		{Name: "schema_docs", Title: "Building schema documentation",
+			Outputs: []string{"schema_docs"},
+			Run:     func(conn *sqlite.Conn) error { return createSchemaDocs(conn) }},
+		{Name: "phases", Title: "Recording pipeline phases",
+			Inputs: []string{"schema_docs"}, Outputs: []string{"pipeline_phases", "schema_docs"},
+			Run: func(conn *sqlite.Conn) error { return writePhases(conn, phases) }},
+	}...)
+	if len(git.History) > 0 {
+		stages = append(stages, sqlStage{Name: "git", Phase: "git", Title: "Running git history analysis",
+			Inputs:  []string{"nodes", "findings", "schema_docs", "dashboard_file_heatmap"},
+			Outputs: []string{"git_file_history", "v_file_risk", "findings", "schema_docs"},
+			Run:     func(conn *sqlite.Conn) error { return applyGitHistory(conn, git.History, prog) }})
+	}
+	if len(git.Commits) > 0 {
+		stages = append(stages, sqlStage{Name: "co_change", Phase: "git", Title: "Computing co-change coupling",
+			Inputs:  []string{"nodes", "edges", "findings", "queries", "schema_docs"},
+			Outputs: []string{"co_change", "findings", "queries", "schema_docs"},
+			Run:     func(conn *sqlite.Conn) error { return applyCoChange(conn, git.Commits, prog) }})
+	}
+	if len(git.Blame) > 0 {
+		stages = append(stages, sqlStage{Name: "ownership", Phase: "git", Title: "Computing function ownership from git blame",
+			Inputs:  []string{"nodes", "dashboard_hotspots", "queries", "schema_docs"},
+			Outputs: []string{"function_ownership", "dashboard_hotspots", "queries", "schema_docs"},
+			Run:     func(conn *sqlite.Conn) error { return applyOwnership(conn, git, prog) }})
+	}
+	stages = append(stages, []sqlStage{
+		{Name: "taint_flow_states", Phase: "taint", Title: "Computing taint flow states",
+			Inputs: append(slices.Clone(base), "findings", "queries", "schema_docs"), Outputs: []string{"taint_flow_state", "v_taint_summary", "findings", "queries", "schema_docs"},
+			Run: func(conn *sqlite.Conn) error { return createTaintFlowStates(conn, prog) }},
+		{Name: "index_sensitivity", Phase: "taint", Title: "Computing index sensitivity",
+			Inputs: []string{"nodes", "taint_flow_state", "findings", "queries", "schema_docs"}, Outputs: []string{"index_sensitivity", "v_container_taint_summary", "findings", "queries", "schema_docs"},
+			Run: func(conn *sqlite.Conn) error { return createIndexSensitivity(conn, prog) }},
+		{Name: "scip", Phase: "scip", Title: "Building SCIP symbol index",
+			Inputs: []string{"nodes", "queries", "schema_docs"}, Outputs: []string{"scip_symbols", "queries", "schema_docs"},
+			Run: func(conn *sqlite.Conn) error { return createSCIPSymbols(conn, modSet.Dirs(), prog) }},
+		{Name: "communication_patterns", Phase: "comm", Title: "Building communication patterns",
+			Inputs: []string{"nodes", "queries", "schema_docs"},
+			Outputs: []string{"comm_participants", "comm_endpoints", "comm_graph", "comm_channel_patterns", "comm_protocols", "comm_session_steps",
+				"comm_conformance", "comm_causality", "v_comm_topology", "v_comm_endpoint_detail", "v_protocol_coverage", "v_session_duality",
+				"v_causality_summary", "queries", "schema_docs"},
+			Run: func(conn *sqlite.Conn) error {
+				return createCommunicationPatterns(conn, modSet.Primary().ModPath, prog)
+			}},
+		{Name: "session_type_corrections", Phase: "comm", Title: "Applying Honda 2008 corrections (Scalas & Yoshida 2019, Yoshida & Hou 2024)",
+			Inputs: []string{"comm_participants", "comm_endpoints", "comm_protocols", "comm_causality", "queries", "schema_docs"},
+			Outputs: []string{"comm_subtype_check", "comm_dependency_cycles", "comm_association", "v_subtype_detail", "v_dependency_cycles",
+				"v_association_summary", "queries", "schema_docs"},
+			Run: func(conn *sqlite.Conn) error { return createSessionTypeCorrections(conn, prog) }},
+	}...)
+	// Every stage that adds findings has run.
+	stages = append(stages, sqlStage{Name: "finding_ids", Title: "Deriving finding ids from their content",
+		Inputs: []string{"findings"}, Outputs: []string{"findings"},
+		Run: func(conn *sqlite.Conn) error { return stableFindingIDs(conn, prog) }})
+	if validate {
+		stages = append(stages, sqlStage{Name: "validate", Title: "Running validation queries",
+			Inputs: []string{"nodes", "edges"},
+			Run:    func(conn *sqlite.Conn) error { return runValidation(conn, prog) }})
+	}
+	return stages
+}
+
+// runStages runs the stages whose phase is enabled and that have no
+// checkpoint yet, and reports every stage's outcome, including the ones
+// skipped or never reached after an error. Each stage runs in its own
+// transaction together with its checkpoint. With
+// flagStageJobs > 1, stages run on separate connections to path as soon as
+// every earlier stage they conflict with (see stageConflicts) has finished,
+// so the result matches the sequential order.
+func runStages(conn *sqlite.Conn, path string, stages []sqlStage, phases PhaseSet, prog *Progress) ([]stageRun, error) {
+	_, checkpoints, err := loadCheckpoints(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]stageRun, len(stages))
+	var active []int
+	for i, st := range stages {
+		runs[i] = stageRun{Stage: st.Name, Phase: st.Phase, Status: "not_run"}
+		if st.Phase != "" && !phases.Enabled(st.Phase) {
+			runs[i].Status = "skipped"
+			continue
+		}
+		if cp, ok := checkpoints[st.Name]; ok {
+			runs[i].Status = "ok"
+			runs[i].Start = time.Duration(cp.StartMS) * time.Millisecond
+			runs[i].Wall = time.Duration(cp.WallMS) * time.Millisecond
+			runs[i].Rows = cp.Rows
+			runs[i].Resumed = true
+			continue
+		}
+		active = append(active, i)
+	}
+	start := time.Now()
+	prog.Report("sql_stages", Fields{"total": len(stages), "to_run": len(active)})
+
+	if flagStageJobs <= 1 {
+		for _, i := range active {
+			runs[i] = runStage(conn, stages[i], start, prog)
+			if runs[i].Status == "error" {
+				return runs, runs[i].Err
+			}
+		}
+		return runs, nil
+	}
+
+	pool := make(chan *sqlite.Conn, flagStageJobs)
+	for range flagStageJobs {
+		c, err := openDB(path)
+		if err != nil {
+			close(pool)
+			for c := range pool {
+				_ = c.Close()
+			}
+			return runs, fmt.Errorf("stage connection: %w", err)
+		}
+		c.SetBusyTimeout(stageBusyTimeout)
+		pool <- c
+	}
+	defer func() {
+		for range flagStageJobs {
+			_ = (<-pool).Close()
+		}
+	}()
+	prog.Verbose("Running %d SQL stages on %d connections", len(active), flagStageJobs)
+
+	done := make(map[int]chan struct{}, len(active))
+	for _, i := range active {
+		done[i] = make(chan struct{})
+	}
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	for k, i := range active {
+		var waitFor []chan struct{}
+		for _, j := range active[:k] {
+			if stageConflicts(stages[j], stages[i]) {
+				waitFor = append(waitFor, done[j])
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[i])
+			for _, ch := range waitFor {
+				<-ch
+			}
+			mu.Lock()
+			failed := firstErr != nil
+			mu.Unlock()
+			if failed {
+				return
+			}
+			c := <-pool
+			run := runStage(c, stages[i], start, prog)
+			pool <- c
+			mu.Lock()
+			runs[i] = run
+			if run.Status == "error" && firstErr == nil {
+				firstErr = run.Err
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return runs, firstErr
+}
+
+// stageConflicts reports whether later must wait for earlier: one writes a
+// table the other reads or writes.
+func stageConflicts(earlier, later sqlStage) bool {
+	return tablesOverlap(earlier.Outputs, later.Inputs) ||
+		tablesOverlap(earlier.Outputs, later.Outputs) ||
+		tablesOverlap(earlier.Inputs, later.Outputs)
+}
+
+func tablesOverlap(a, b []string) bool {
+	for _, t := range a {
+		if t == allTables && len(b) > 0 {
+			return true
+		}
+		if slices.Contains(b, t) || slices.Contains(b, allTables) {
+			return true
+		}
+	}
+	return false
+}
+
+// runStage runs one stage, timing it and counting the net rows added to its
+// output tables.
+func runStage(conn *sqlite.Conn, st sqlStage, pipelineStart time.Time, prog *Progress) stageRun {
+	prog.Begin("sql:"+st.Name, "%s...", st.Title)
+	run := stageRun{Stage: st.Name, Phase: st.Phase}
+	run.Start = time.Since(pipelineStart)
+	err := runStageTx(conn, st, &run, false)
+	if sqlite.ErrCode(err).ToPrimary() == sqlite.ResultBusy {
+		// The deferred transaction read a snapshot that another stage's
+		// commit made stale, so it could not take the write lock. It rolled
+		// back; run the stage again holding the write lock from the start.
+		prog.Verbose("  stage %s: database busy, retrying with the write lock held", st.Name)
+		run.Start = time.Since(pipelineStart)
+		err = runStageTx(conn, st, &run, true)
+	}
+
+	switch {
+	case err == nil:
+		run.Status = "ok"
+	case st.Optional:
+		run.Status = "warning"
+		run.Err = err
+		prog.Warn("stage %s failed: %v", st.Name, err)
+	default:
+		run.Status = "error"
+		run.Err = fmt.Errorf("stage %s: %w", st.Name, err)
+	}
+	prog.Verbose("  stage %s: %s in %s, %+d rows", st.Name, run.Status, run.Wall.Round(time.Millisecond), run.Rows)
+	prog.End("sql:"+st.Name, Fields{"status": run.Status, "rows": run.Rows}, "")
+	return run
+}
+
+// runStageTx runs st and records its checkpoint in one transaction, which
+// takes the write lock up front when immediate is set.
+func runStageTx(conn *sqlite.Conn, st sqlStage, run *stageRun, immediate bool) (err error) {
+	var endFn func(*error)
+	if immediate {
+		if endFn, err = sqlitex.ImmediateTransaction(conn); err != nil {
+			return err
+		}
+	} else {
+		endFn = sqlitex.Transaction(conn)
+	}
+	defer endFn(&err)
+
+	t := time.Now()
+	before := countTables(conn, st.Outputs)
+	if err = st.Run(conn); err != nil {
+		run.Wall = time.Since(t)
+		return err
+	}
+	run.Rows = countTables(conn, st.Outputs) - before
+	run.Wall = time.Since(t)
+	return markStageDone(conn, *run)
+}
+
+// countTables sums the row counts of the named tables that exist. Views and
+// missing tables count as zero.
+func countTables(conn *sqlite.Conn, names []string) int64 {
+	var total int64
+	for _, name := range names {
+		if name == allTables {
+			continue
+		}
+		var isTable bool
+		_ = sqlitex.ExecuteTransient(conn, `SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?`,
+			&sqlitex.ExecOptions{
+				Args:       []any{name},
+				ResultFunc: func(stmt *sqlite.Stmt) error { isTable = true; return nil },
+			})
+		if !isTable {
+			continue
+		}
+		_ = sqlitex.ExecuteTransient(conn, fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, name),
+			&sqlitex.ExecOptions{
+				ResultFunc: func(stmt *sqlite.Stmt) error { total += stmt.ColumnInt64(0); return nil },
+			})
+	}
+	return total
+}
+
+// writeStageRuns replaces pipeline_runs with the outcome of every stage.
+func writeStageRuns(conn *sqlite.Conn, stages []sqlStage, runs []stageRun) error {
+	script := `
+DROP TABLE IF EXISTS pipeline_runs;
+CREATE TABLE pipeline_runs (
+    seq INTEGER PRIMARY KEY,  -- registry order
+    stage TEXT NOT NULL,
+    phase TEXT,               -- NULL for core stages
+    status TEXT NOT NULL,     -- ok, warning, error, skipped, not_run
+    start_ms INTEGER,         -- offset from the start of the SQL stages
+    wall_ms INTEGER,
+    rows INTEGER,             -- net rows added to the output tables
+    error TEXT,
+    inputs TEXT NOT NULL,     -- JSON array of tables read
+    outputs TEXT NOT NULL,    -- JSON array of tables created or written
+    resumed INTEGER NOT NULL  -- 1 if an earlier run completed the stage (-resume)
+);`
+	if err := sqlitex.ExecuteScript(conn, script, nil); err != nil {
+		return fmt.Errorf("pipeline_runs: %w", err)
+	}
+
+	stmt, err := conn.Prepare(`INSERT INTO pipeline_runs (seq, stage, phase, status, start_ms, wall_ms, rows, error, inputs, outputs, resumed)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("pipeline_runs: %w", err)
+	}
+	defer func() { _ = stmt.Finalize() }()
+	for i, run := range runs {
+		inputs, _ := json.Marshal(append([]string{}, stages[i].Inputs...))
+		outputs, _ := json.Marshal(append([]string{}, stages[i].Outputs...))
+		stmt.BindInt64(1, int64(i+1))
+		stmt.BindText(2, run.Stage)
+		bindTextOrNull(stmt, 3, run.Phase)
+		stmt.BindText(4, run.Status)
+		if run.Status == "skipped" || run.Status == "not_run" {
+			stmt.BindNull(5)
+			stmt.BindNull(6)
+			stmt.BindNull(7)
+		} else {
+			stmt.BindInt64(5, run.Start.Milliseconds())
+			stmt.BindInt64(6, run.Wall.Milliseconds())
+			stmt.BindInt64(7, run.Rows)
+		}
+		if run.Err != nil {
+			stmt.BindText(8, run.Err.Error())
+		} else {
+			stmt.BindNull(8)
+		}
+		stmt.BindText(9, string(inputs))
+		stmt.BindText(10, string(outputs))
+		stmt.BindBool(11, run.Resumed)
+		if _, err := stmt.Step(); err != nil {
+			return fmt.Errorf("pipeline_runs %s: %w", run.Stage, err)
+		}
+		_ = stmt.Reset()
+	}
+	return nil
+}
+
+// reportSize logs the size of the finished database file.
+func reportSize(path string, prog *Progress) {
+	if info, _ := os.Stat(path); info != nil {
+		prog.Log("Wrote %s (%d MB)", path, info.Size()/(1024*1024))
+	}
+}
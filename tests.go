@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// testKind classifies a top-level function declared in a _test.go file the
+// way go test does: "test", "benchmark", "fuzz" or "example", or "" for a
+// helper. A Test, Benchmark or Fuzz prefix must not be followed by a
+// lower-case letter (TestFoo and Test_foo count, Testify does not).
+func testKind(name string) string {
+	for _, p := range []struct{ prefix, kind string }{
+		{"Test", "test"},
+		{"Benchmark", "benchmark"},
+		{"Fuzz", "fuzz"},
+	} {
+		rest, ok := strings.CutPrefix(name, p.prefix)
+		if !ok {
+			continue
+		}
+		if r, _ := utf8.DecodeRuneInString(rest); rest == "" || !unicode.IsLower(r) {
+			return p.kind
+		}
+	}
+	if strings.HasPrefix(name, "Example") {
+		return "example"
+	}
+	return ""
+}
+
+// linkTests adds a tests edge from every test function (test_kind set) to
+// each production function it reaches over call edges, with the length of the
+// shortest call path as depth. The search walks through test helpers but
+// links only functions outside _test.go files. It runs breadth-first, one
+// depth level per statement, so the first depth a pair is reached at is the
+// one kept.
+func linkTests(conn *sqlite.Conn, prog *Progress) error {
+	script := `
+CREATE TEMP TABLE test_reach (
+    test TEXT NOT NULL,
+    fn TEXT NOT NULL,
+    depth INTEGER NOT NULL,
+    PRIMARY KEY (test, fn)
+);
+INSERT OR IGNORE INTO temp.test_reach (test, fn, depth)
+  SELECT t.id, e.target, 1
+  FROM nodes t
+  JOIN edges e ON e.source = t.id AND e.kind = 'call'
+  WHERE t.kind = 'function' AND json_extract(t.properties, '$.test_kind') IS NOT NULL;
+CREATE INDEX temp.idx_test_reach_depth ON test_reach(depth);`
+	if err := sqlitex.ExecuteScript(conn, script, nil); err != nil {
+		return fmt.Errorf("test links: %w", err)
+	}
+	for depth := 1; ; depth++ {
+		if err := sqlitex.Execute(conn,
+			`INSERT OR IGNORE INTO temp.test_reach (test, fn, depth)
+			 SELECT r.test, e.target, r.depth + 1
+			 FROM temp.test_reach r
+			 JOIN edges e ON e.source = r.fn AND e.kind = 'call'
+			 WHERE r.depth = ?`,
+			&sqlitex.ExecOptions{Args: []any{depth}}); err != nil {
+			return fmt.Errorf("test links depth %d: %w", depth+1, err)
+		}
+		if conn.Changes() == 0 {
+			break
+		}
+	}
+
+	if err := sqlitex.ExecuteTransient(conn,
+		`INSERT OR IGNORE INTO edges (source, target, kind, properties)
+		 SELECT r.test, r.fn, 'tests', json_object('depth', r.depth)
+		 FROM temp.test_reach r
+		 JOIN nodes n ON n.id = r.fn
+		 WHERE n.kind = 'function' AND n.id NOT LIKE 'ext::%'
+		   AND n.file IS NOT NULL AND n.file NOT LIKE '%\_test.go' ESCAPE '\'
+		 ORDER BY r.test, r.depth, r.fn`, nil); err != nil {
+		return fmt.Errorf("test links: %w", err)
+	}
+	links := conn.Changes()
+
+	var tests int
+	if err := sqlitex.ExecuteTransient(conn,
+		`SELECT COUNT(*) FROM nodes WHERE kind = 'function' AND json_extract(properties, '$.test_kind') IS NOT NULL`,
+		&sqlitex.ExecOptions{ResultFunc: func(stmt *sqlite.Stmt) error {
+			tests = stmt.ColumnInt(0)
+			return nil
+		}}); err != nil {
+		return fmt.Errorf("test links: %w", err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, `DROP TABLE temp.test_reach`, nil); err != nil {
+		return fmt.Errorf("test links: %w", err)
+	}
+	if tests > 0 {
+		prog.Log("Linked %d test functions to production code (%d tests edges)", tests, links)
+	}
+	return nil
+}
+
+// createUntestedFunctions creates v_untested_functions: production functions
+// no test reaches, ranked by hotspot score and complexity. Without -skip-tests=false
+// no test functions are loaded and every function is listed.
+func createUntestedFunctions(conn *sqlite.Conn) error {
+	ddl := `
+CREATE VIEW v_untested_functions AS
+  SELECT n.id AS function_id,
+         n.name,
+         n.package,
+         n.file,
+         n.line,
+         m.cyclomatic_complexity AS complexity,
+         m.loc,
+         m.fan_in,
+         m.fan_out,
+         COALESCE(h.hotspot_score, 0) AS hotspot_score
+  FROM nodes n
+  JOIN metrics m ON m.function_id = n.id
+  LEFT JOIN dashboard_hotspots h ON h.function_id = n.id
+  WHERE n.kind = 'function'
+    AND n.file NOT LIKE '%\_test.go' ESCAPE '\'
+    AND NOT EXISTS (SELECT 1 FROM edges e WHERE e.target = n.id AND e.kind = 'tests')
+  ORDER BY hotspot_score DESC, complexity DESC, n.id;
+`
+	return sqlitex.ExecuteScript(conn, ddl, nil)
+}
@@ -12,10 +12,10 @@ func ExtractTypeRelationships(
 	pkgs []*packages.Package,
 	fset *token.FileSet,
 	posLookup *PosLookup,
-	cpg *CPG,
+	cpg Sink,
 	prog *Progress,
 ) {
-	prog.Log("Extracting type relationships...")
+	prog.Begin("types", "Extracting type relationships...")
 
 	// Collect all named types and interfaces from known module packages
 	type namedInfo struct {
@@ -165,7 +165,8 @@ func ExtractTypeRelationships(
 		}
 	}
 
-	prog.Log("Created %d implements, %d embeds, %d alias_of, %d satisfies_method edges", implementsCount, embedsCount, aliasCount, satisfiesCount)
+	prog.End("types", Fields{"implements_edges": implementsCount, "embeds_edges": embedsCount, "alias_of_edges": aliasCount, "satisfies_method_edges": satisfiesCount},
+		"Created %d implements, %d embeds, %d alias_of, %d satisfies_method edges", implementsCount, embedsCount, aliasCount, satisfiesCount)
 }
 
 // emitSatisfiesMethod connects each method on concreteType to the interface method
@@ -175,7 +176,7 @@ func emitSatisfiesMethod(
 	ifaceType *types.Interface,
 	fset *token.FileSet,
 	posLookup *PosLookup,
-	cpg *CPG,
+	cpg Sink,
 	count *int,
 ) {
 	// Build method set for both T and *T.
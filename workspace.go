@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/packages"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+// Workspace is how go list sees the modules: the GOWORK value it runs with
+// and whether the build is vendored.
+type Workspace struct {
+	GoWork string // go.work path, or "off" for a vendored single-module build
+	Source string // the repository's own go.work, if one was found
+	Vendor bool   // GOFLAGS has -mod=vendor
+	temp   bool   // GoWork is a temporary file (see Remove)
+}
+
+// PrepareWorkspace decides how the modules in ms are loaded. Without
+// -mod=vendor it writes a temporary go.work (see CreateTempGoWork) that also
+// carries the use and replace directives of a go.work the repository
+// already has. A vendored build cannot add modules to a workspace, so it
+// uses the repository's go.work as is (its vendor directory comes from go
+// work vendor) or, for a single module, no workspace at all.
+func PrepareWorkspace(ms *ModuleSet, prog *Progress) (*Workspace, error) {
+	ws := &Workspace{Vendor: vendorBuild()}
+	source, err := findGoWork(ms.PrimaryDir())
+	if err != nil {
+		return nil, err
+	}
+	ws.Source = source
+
+	if ws.Vendor {
+		switch {
+		case source != "":
+			wf, err := readGoWork(source)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range ms.Workspace() {
+				if !slices.ContainsFunc(wf.Use, func(u *modfile.Use) bool { return useDir(source, u.Path) == m.Dir }) {
+					return nil, fmt.Errorf("-mod=vendor: module %s (%s) is not used by %s", m.ModPath, m.Dir, source)
+				}
+			}
+			ws.GoWork = source
+		case len(ms.Workspace()) == 1:
+			ws.GoWork = "off"
+		default:
+			return nil, fmt.Errorf("-mod=vendor with %d modules needs a go.work with a vendor directory (go work vendor)", len(ms.Workspace()))
+		}
+		prog.Log("Vendored build (-mod=vendor), workspace: %s", ws.GoWork)
+		return ws, nil
+	}
+
+	if ws.GoWork, err = CreateTempGoWork(ms, source); err != nil {
+		return nil, err
+	}
+	ws.temp = true
+	if source != "" {
+		prog.Log("Extending existing workspace %s", source)
+	}
+	prog.Verbose("Created workspace: %s", ws.GoWork)
+	return ws, nil
+}
+
+// Remove deletes the temporary go.work and its go.work.sum, if any.
+func (ws *Workspace) Remove() {
+	if ws.temp {
+		os.Remove(ws.GoWork)
+		os.Remove(ws.GoWork + ".sum")
+	}
+}
+
+// findGoWork returns the go.work the go command would use from dir: GOWORK
+// if set ("" for off), else the first go.work in dir or its parents.
+func findGoWork(dir string) (string, error) {
+	switch gowork := os.Getenv("GOWORK"); gowork {
+	case "off":
+		return "", nil
+	case "":
+	default:
+		if !filepath.IsAbs(gowork) {
+			return "", fmt.Errorf("GOWORK=%s: must be an absolute path", gowork)
+		}
+		return gowork, nil
+	}
+	for {
+		file := filepath.Join(dir, "go.work")
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			return file, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+func readGoWork(file string) (*modfile.WorkFile, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", file, err)
+	}
+	wf, err := modfile.ParseWork(file, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+// useDir resolves a use or replace directory of the go.work file against
+// the file's directory.
+func useDir(gowork, dir string) string {
+	if filepath.IsAbs(dir) {
+		return filepath.Clean(dir)
+	}
+	return filepath.Join(filepath.Dir(gowork), filepath.FromSlash(dir))
+}
+
+// vendorBuild reports whether GOFLAGS (from the environment or go env)
+// selects -mod=vendor.
+func vendorBuild() bool {
+	flags, err := goEnv("GOFLAGS")
+	if err != nil {
+		return false
+	}
+	vendor := false
+	for _, f := range strings.Fields(flags) {
+		if v, ok := strings.CutPrefix(strings.TrimLeft(f, "-"), "mod="); ok {
+			vendor = v == "vendor"
+		}
+	}
+	return vendor
+}
+
+// ResolvedModule is one module of the build list go list resolved, as
+// recorded in the modules table.
+type ResolvedModule struct {
+	Path      string
+	Version   string // "" for workspace modules
+	Replace   *module.Version
+	Main      bool
+	Indirect  bool
+	GoVersion string
+	Requires  []Requirement // from the module's go.mod
+}
+
+// Requirement is one require directive of a module's go.mod.
+type Requirement struct {
+	Path, Version string
+	Indirect      bool
+}
+
+// resolvedModules returns the modules providing the packages reachable from
+// roots, with their go.mod requirements, sorted by path.
+func resolvedModules(roots []*packages.Package) []ResolvedModule {
+	byPath := make(map[string]*packages.Module)
+	packages.Visit(roots, nil, func(pkg *packages.Package) {
+		if pkg.Module != nil && byPath[pkg.Module.Path] == nil {
+			byPath[pkg.Module.Path] = pkg.Module
+		}
+	})
+	mods := make([]ResolvedModule, 0, len(byPath))
+	for _, m := range byPath {
+		r := ResolvedModule{
+			Path:      m.Path,
+			Version:   m.Version,
+			Main:      m.Main,
+			Indirect:  m.Indirect,
+			GoVersion: m.GoVersion,
+			Requires:  moduleRequires(m.GoMod),
+		}
+		if m.Replace != nil {
+			r.Replace = &module.Version{Path: m.Replace.Path, Version: m.Replace.Version}
+			if r.Replace.Version == "" && filepath.IsAbs(r.Replace.Path) {
+				// Directory replacement from the temporary go.work: keep it
+				// relative to the modules under analysis when it is one of them
+				if rel := modSet.RelFile(r.Replace.Path); rel != "" {
+					r.Replace.Path = path.Clean(filepath.ToSlash(rel))
+				}
+			}
+			if m.Replace.GoMod != "" {
+				r.Requires = moduleRequires(m.Replace.GoMod)
+			}
+		}
+		mods = append(mods, r)
+	}
+	sort.Slice(mods, func(i, j int) bool { return mods[i].Path < mods[j].Path })
+	return mods
+}
+
+// moduleRequires reads the require directives of a go.mod file; a file that
+// is missing (vendored builds have none for dependencies) yields none.
+func moduleRequires(gomod string) []Requirement {
+	if gomod == "" {
+		return nil
+	}
+	data, err := os.ReadFile(gomod)
+	if err != nil {
+		return nil
+	}
+	f, err := modfile.ParseLax(gomod, data, nil)
+	if err != nil {
+		return nil
+	}
+	reqs := make([]Requirement, len(f.Require))
+	for i, r := range f.Require {
+		reqs[i] = Requirement{Path: r.Mod.Path, Version: r.Mod.Version, Indirect: r.Indirect}
+	}
+	return reqs
+}
+
+// createModuleTables creates the modules and module_requires base tables.
+func createModuleTables(conn *sqlite.Conn) error {
+	ddl := `
+CREATE TABLE IF NOT EXISTS modules (
+    path TEXT PRIMARY KEY,
+    version TEXT,          -- selected version, NULL for workspace modules
+    replace_path TEXT,     -- replacement module, or directory relative to the analyzed modules
+    replace_version TEXT,  -- NULL for a directory replacement
+    main INTEGER NOT NULL, -- 1 for workspace modules
+    indirect INTEGER NOT NULL,
+    go_version TEXT,
+    prefix TEXT            -- package prefix when analyzed ('' for the primary), NULL for ext:: stubs only
+);
+
+CREATE TABLE IF NOT EXISTS module_requires (
+    module TEXT NOT NULL,
+    requires TEXT NOT NULL,
+    version TEXT NOT NULL,
+    indirect INTEGER NOT NULL,
+    PRIMARY KEY (module, requires)
+);
+`
+	if err := sqlitex.ExecuteScript(conn, ddl, nil); err != nil {
+		return fmt.Errorf("module tables: %w", err)
+	}
+	return nil
+}
+
+// writeModules records mods in the modules and module_requires tables,
+// replacing earlier rows for the same modules.
+func writeModules(conn *sqlite.Conn, mods []ResolvedModule) (err error) {
+	endFn, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer endFn(&err)
+
+	prefixes := make(map[string]string)
+	for _, m := range modSet.Dirs() {
+		prefixes[m.ModPath] = m.Prefix
+	}
+	modStmt, err := conn.Prepare(`INSERT OR REPLACE INTO modules
+	  (path, version, replace_path, replace_version, main, indirect, go_version, prefix) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("prepare module insert: %w", err)
+	}
+	delStmt, err := conn.Prepare(`DELETE FROM module_requires WHERE module = ?`)
+	if err != nil {
+		return fmt.Errorf("prepare module requires delete: %w", err)
+	}
+	reqStmt, err := conn.Prepare(`INSERT OR REPLACE INTO module_requires (module, requires, version, indirect) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("prepare module requires insert: %w", err)
+	}
+	for _, m := range mods {
+		modStmt.BindText(1, m.Path)
+		bindTextOrNull(modStmt, 2, m.Version)
+		if m.Replace != nil {
+			modStmt.BindText(3, m.Replace.Path)
+			bindTextOrNull(modStmt, 4, m.Replace.Version)
+		} else {
+			modStmt.BindNull(3)
+			modStmt.BindNull(4)
+		}
+		modStmt.BindBool(5, m.Main)
+		modStmt.BindBool(6, m.Indirect)
+		bindTextOrNull(modStmt, 7, m.GoVersion)
+		if prefix, ok := prefixes[m.Path]; ok {
+			modStmt.BindText(8, prefix)
+		} else {
+			modStmt.BindNull(8)
+		}
+		if _, err := modStmt.Step(); err != nil {
+			return fmt.Errorf("insert module %s: %w", m.Path, err)
+		}
+		_ = modStmt.Reset()
+
+		delStmt.BindText(1, m.Path)
+		if _, err := delStmt.Step(); err != nil {
+			return fmt.Errorf("delete module requires %s: %w", m.Path, err)
+		}
+		_ = delStmt.Reset()
+		for _, r := range m.Requires {
+			reqStmt.BindText(1, m.Path)
+			reqStmt.BindText(2, r.Path)
+			reqStmt.BindText(3, r.Version)
+			reqStmt.BindBool(4, r.Indirect)
+			if _, err := reqStmt.Step(); err != nil {
+				return fmt.Errorf("insert module require %s→%s: %w", m.Path, r.Path, err)
+			}
+			_ = reqStmt.Reset()
+		}
+	}
+	return nil
+}